@@ -0,0 +1,230 @@
+// memstore-replay re-sends RESP traffic recorded by the proxy's -capture-file
+// option against another instance, optionally comparing the replies with the
+// recorded ones.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/proxy"
+)
+
+// maxReportedMismatches limits how many reply differences are printed
+const maxReportedMismatches = 20
+
+type options struct {
+	addr          string
+	password      string
+	useTLS        bool
+	tlsSkipVerify bool
+	compare       bool
+	pace          bool
+	timeout       time.Duration
+}
+
+type results struct {
+	requests   atomic.Uint64
+	skipped    atomic.Uint64
+	mismatches atomic.Uint64
+	failed     atomic.Uint64 // Connections that could not be replayed to the end
+	reportMu   sync.Mutex
+}
+
+func main() {
+	file := flag.String("file", "", "Capture file written by the proxy's -capture-file option")
+	connID := flag.Uint64("conn", 0, "Replay only this connection ID (0 replays all)")
+	var opts options
+	flag.StringVar(&opts.addr, "addr", "127.0.0.1:6379", "Target address (host:port), e.g. another proxy or a new instance")
+	flag.StringVar(&opts.password, "password", os.Getenv("REPLAY_PASSWORD"), "Password or access token sent with AUTH on each connection (recorded AUTH commands are skipped)")
+	flag.BoolVar(&opts.useTLS, "tls", false, "Connect to the target with TLS")
+	flag.BoolVar(&opts.tlsSkipVerify, "tls-skip-verify", false, "Skip TLS certificate verification")
+	flag.BoolVar(&opts.compare, "compare", false, "Compare replies with the recorded replies and report differences")
+	flag.BoolVar(&opts.pace, "pace", false, "Preserve the recorded delay between requests")
+	flag.DurationVar(&opts.timeout, "timeout", 5*time.Second, "Timeout for each request")
+	flag.Parse()
+
+	if *file == "" {
+		fmt.Println("Usage: memstore-replay -file <capture-file> -addr <host:port> [-compare]")
+		fmt.Println("\nExample:")
+		fmt.Println("  memstore-replay -file capture.jsonl -addr 127.0.0.1:6380 -compare")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		os.Exit(1)
+	}
+	conns, order, err := capture.ReadAll(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("❌ Error reading %s: %v\n", *file, err)
+		os.Exit(1)
+	}
+	if *connID != 0 {
+		if _, ok := conns[*connID]; !ok {
+			fmt.Printf("❌ Connection %d not found in capture\n", *connID)
+			os.Exit(1)
+		}
+		order = []uint64{*connID}
+	}
+
+	fmt.Printf("Replaying %d connection(s) from %s against %s\n", len(order), *file, opts.addr)
+
+	var res results
+	var wg sync.WaitGroup
+	for _, id := range order {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			if err := replayConnection(id, conns[id], opts, &res); err != nil {
+				res.failed.Add(1)
+				fmt.Printf("❌ conn %d: %v\n", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	fmt.Printf("\nRequests sent: %d, skipped: %d, failed connections: %d", res.requests.Load(), res.skipped.Load(), res.failed.Load())
+	if opts.compare {
+		fmt.Printf(", reply mismatches: %d", res.mismatches.Load())
+	}
+	fmt.Println()
+
+	if res.failed.Load() > 0 || res.mismatches.Load() > 0 {
+		os.Exit(1)
+	}
+}
+
+// dial connects and authenticates to the target
+func dial(opts options) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: opts.timeout}
+	if opts.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.addr, &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opts.tlsSkipVerify,
+		})
+	} else {
+		conn, err = dialer.Dial("tcp", opts.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	if opts.password != "" {
+		auth := proxy.RESPValue{Type: proxy.Array, Array: []proxy.RESPValue{
+			{Type: proxy.BulkString, Str: "AUTH"},
+			{Type: proxy.BulkString, Str: opts.password},
+		}}
+		reply, err := roundTrip(conn, proxy.NewRESPReader(conn), auth.Serialize(), opts.timeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH failed: %w", err)
+		}
+		if reply.Type == proxy.Error {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH failed: %s", reply.Str)
+		}
+	}
+	return conn, nil
+}
+
+// roundTrip sends one request and reads its reply
+func roundTrip(conn net.Conn, reader *proxy.RESPReader, data []byte, timeout time.Duration) (*proxy.RESPValue, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	reply, err := reader.ReadValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+	return reply, nil
+}
+
+// replayConnection re-sends one connection's requests in order. Replies are
+// paired with recorded replies in order, which assumes one reply per request
+// (pub/sub and MONITOR streams are not comparable).
+func replayConnection(id uint64, records []capture.Record, opts options, res *results) error {
+	conn, err := dial(opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := proxy.NewRESPReader(conn)
+
+	var requests, responses []capture.Record
+	for _, rec := range records {
+		if rec.Direction == capture.DirectionRequest {
+			requests = append(requests, rec)
+		} else {
+			responses = append(responses, rec)
+		}
+	}
+
+	for i, req := range requests {
+		if opts.pace && i > 0 {
+			time.Sleep(req.Time.Sub(requests[i-1].Time))
+		}
+
+		value, err := proxy.NewRESPReader(bytes.NewReader(req.Data)).ReadValue()
+		if err != nil {
+			return fmt.Errorf("request %d: invalid recorded frame: %w", i+1, err)
+		}
+		name := value.CommandName()
+		// Recorded credentials are masked; the target is authenticated with -password instead
+		if name == "AUTH" {
+			res.skipped.Add(1)
+			continue
+		}
+
+		reply, err := roundTrip(conn, reader, req.Data, opts.timeout)
+		if err != nil {
+			return fmt.Errorf("request %d (%s): %w", i+1, name, err)
+		}
+		res.requests.Add(1)
+
+		if opts.compare && i < len(responses) {
+			if got := reply.Serialize(); !bytes.Equal(got, responses[i].Data) {
+				res.reportMismatch(id, i+1, name, responses[i].Data, got)
+			}
+		}
+	}
+	return nil
+}
+
+// reportMismatch counts a reply difference and prints the first few
+func (r *results) reportMismatch(id uint64, n int, name string, want, got []byte) {
+	count := r.mismatches.Add(1)
+	if count > maxReportedMismatches {
+		return
+	}
+	r.reportMu.Lock()
+	defer r.reportMu.Unlock()
+	fmt.Printf("⚠️  conn %d request %d (%s): reply differs\n   recorded: %s\n   replayed: %s\n",
+		id, n, name, quote(want), quote(got))
+	if count == maxReportedMismatches {
+		fmt.Println("   (further mismatches are counted but not printed)")
+	}
+}
+
+// quote shortens a RESP frame for display
+func quote(data []byte) string {
+	s := fmt.Sprintf("%q", data)
+	if len(s) > 120 {
+		s = s[:117] + "..."
+	}
+	return strings.TrimSpace(s)
+}
@@ -13,8 +13,9 @@
 
 func main() {
 	instanceName := flag.String("instance", "", "Instance name to discover")
-	instanceType := flag.String("type", "valkey", "Instance type: 'valkey' or 'redis'")
+	instanceType := flag.String("type", "valkey", "Instance type: 'valkey', 'redis', 'redis-cluster' or 'auto'")
 	verbose := flag.Bool("verbose", false, "Verbose output")
+	recordDir := flag.String("record", "", "Write sanitized API responses to this directory (for test fixtures)")
 	flag.Parse()
 
 	if *instanceName == "" {
@@ -27,6 +28,7 @@ func main() {
 
 	ctx := context.Background()
 	discoverer := discovery.NewGCPDiscoverer(30) // 30 second timeout
+	discoverer.SetRecordDir(*recordDir)
 
 	fmt.Printf("Discovering %s instance: %s\n\n", *instanceType, *instanceName)
 
@@ -38,8 +40,12 @@ func main() {
 		info, err = discoverer.DiscoverRedisInstance(ctx, *instanceName)
 	case "valkey":
 		info, err = discoverer.DiscoverInstance(ctx, *instanceName)
+	case "redis-cluster":
+		info, err = discoverer.DiscoverRedisCluster(ctx, *instanceName)
+	case "auto":
+		info, err = discoverer.DiscoverAuto(ctx, *instanceName)
 	default:
-		fmt.Printf("❌ Unknown instance type: %s (must be 'valkey' or 'redis')\n", *instanceType)
+		fmt.Printf("❌ Unknown instance type: %s (must be 'valkey', 'redis', 'redis-cluster' or 'auto')\n", *instanceType)
 		os.Exit(1)
 	}
 	if err != nil {
@@ -54,13 +60,14 @@ func main() {
 	fmt.Println(strings.Repeat("=", 60))
 
 	fmt.Printf("\n📋 Configuration:\n")
+	fmt.Printf("   Instance Type:           %s\n", info.InstanceType)
 	fmt.Printf("   Transit Encryption Mode: %s\n", info.TransitEncryptionMode)
 	fmt.Printf("   Authorization Mode:      %s\n", info.AuthorizationMode)
 	fmt.Printf("   TLS Required:            %v\n", info.RequiresTLS)
 
 	fmt.Printf("\n🌐 Endpoints (%d):\n", len(info.Endpoints))
 	for i, ep := range info.Endpoints {
-		fmt.Printf("   %d. %s:%d (%s)\n", i+1, ep.Host, ep.Port, ep.Type)
+		fmt.Printf("   %d. %s (%s)\n", i+1, ep.Address(), ep.Type)
 	}
 
 	if info.RequiresTLS && info.CACertificate != "" {
@@ -2,52 +2,398 @@
 
 import (
 	"context"
+	"crypto/tls"
+	"expvar"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/auth"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/bench"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/handover"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/metadata"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/monitoring"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/proxy"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/statsd"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// A failed discovery is retried with this backoff, keeping the health server
+// up so /status shows the error, rather than exiting
+const (
+	discoveryMinBackoff = time.Second
+	discoveryMaxBackoff = time.Minute
+)
+
+// Build info, set at build time with -ldflags "-X main.Version=..."
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+
 	// Parse configuration from flags and environment variables
 	cfg := config.NewConfig()
 
-	var instanceType string
+	var instanceType, clusterMode, clientAuth string
 	flag.StringVar(&cfg.InstanceName, "instance", os.Getenv("INSTANCE_NAME"), "Instance name (format: projects/PROJECT_ID/locations/LOCATION/instances/INSTANCE_ID)")
-	flag.StringVar(&instanceType, "type", getEnvOrDefault("INSTANCE_TYPE", "valkey"), "Instance type: 'valkey' or 'redis'")
+	flag.StringVar(&instanceType, "type", getEnvOrDefault("INSTANCE_TYPE", "valkey"), "Instance type: 'valkey', 'redis', 'redis-cluster' or 'auto'")
 	flag.StringVar(&cfg.LocalAddr, "local-addr", getEnvOrDefault("LOCAL_ADDR", "127.0.0.1"), "Local address to bind to")
 	flag.IntVar(&cfg.StartPort, "start-port", getEnvOrDefaultInt("START_PORT", 6379), "Starting port number for the first endpoint")
 	flag.IntVar(&cfg.HealthPort, "health-port", getEnvOrDefaultInt("HEALTH_PORT", 8080), "Health check HTTP server port")
 	flag.IntVar(&cfg.APITimeout, "api-timeout", getEnvOrDefaultInt("API_TIMEOUT", 30), "Timeout for GCP API calls in seconds")
 	flag.BoolVar(&cfg.TLSSkipVerify, "tls-skip-verify", getEnvOrDefaultBool("TLS_SKIP_VERIFY", true), "Skip TLS certificate verification (needed for GCP Memorystore self-signed certs)")
+	flag.StringVar(&cfg.CACertFile, "ca-cert-file", os.Getenv("CA_CERT_FILE"), "PEM file of CA certificates to verify the instance certificate against instead of the discovered CA; enables verification unless -tls-skip-verify is set explicitly")
+	flag.StringVar(&cfg.CACertDir, "ca-cert-dir", os.Getenv("CA_CERT_DIR"), "Directory of PEM files of CA certificates to verify the instance certificate against instead of the discovered CA; enables verification unless -tls-skip-verify is set explicitly")
+	flag.StringVar(&cfg.TLSServerName, "tls-server-name", os.Getenv("TLS_SERVER_NAME"), "Server name sent in SNI and verified against the instance certificate, e.g. the DNS name it was issued for when dialing PSC IP addresses (empty uses the endpoint address)")
+	flag.IntVar(&cfg.CARefresh, "ca-refresh", getEnvOrDefaultInt("CA_REFRESH", 3600), "Seconds between re-reads of the server CA certificates (from the API, or -ca-cert-file/-ca-cert-dir); new upstream connections verify against rotated ones without a restart (0 disables; only with verification)")
+	flag.StringVar(&cfg.TLSClientCert, "tls-client-cert", os.Getenv("TLS_CLIENT_CERT"), "PEM file of the client certificate (chain) presented to upstreams requiring mutual TLS; needs -tls-client-key")
+	flag.StringVar(&cfg.TLSClientKey, "tls-client-key", os.Getenv("TLS_CLIENT_KEY"), "PEM file of the private key of -tls-client-cert")
+	flag.StringVar(&cfg.TLSClientSecret, "tls-client-secret", os.Getenv("TLS_CLIENT_SECRET"), "Secret Manager secret holding the PEM client certificate (chain) and private key presented to upstreams requiring mutual TLS, as projects/PROJECT/secrets/NAME[/versions/VERSION]")
+	flag.IntVar(&cfg.TLSSessionCache, "tls-session-cache", getEnvOrDefaultInt("TLS_SESSION_CACHE", 64), "TLS sessions cached per endpoint so new upstream connections resume them with an abbreviated handshake (0 disables)")
+	flag.BoolVar(&cfg.InspectCommands, "inspect-commands", getEnvOrDefaultBool("INSPECT_COMMANDS", false), "Parse client requests and export per-command counters")
+	flag.BoolVar(&cfg.AuditLog, "audit-log", getEnvOrDefaultBool("AUDIT_LOG", false), "Log every command with the client address (and pid/uid for Unix socket clients) that issued it")
+	flag.IntVar(&cfg.ShedThreshold, "shed-threshold", getEnvOrDefaultInt("SHED_THRESHOLD", 0), "Upstream BUSY/LOADING/OOM errors within -shed-window that trigger rejecting new connections (0 disables)")
+	flag.IntVar(&cfg.ShedWindow, "shed-window", getEnvOrDefaultInt("SHED_WINDOW", 10), "Window for counting upstream overload errors in seconds")
+	flag.IntVar(&cfg.ShedCooldown, "shed-cooldown", getEnvOrDefaultInt("SHED_COOLDOWN", 30), "How long to reject new connections once shedding is triggered in seconds")
+	flag.IntVar(&cfg.BreakerThreshold, "breaker-threshold", getEnvOrDefaultInt("BREAKER_THRESHOLD", 0), "Consecutive upstream dial/AUTH failures that open the circuit, failing new client connections immediately (0 disables)")
+	flag.IntVar(&cfg.BreakerCooldown, "breaker-cooldown", getEnvOrDefaultInt("BREAKER_COOLDOWN", 10), "Seconds the circuit stays open before a single trial connection is let through")
+	flag.BoolVar(&cfg.MaintenanceResponder, "maintenance-responder", getEnvOrDefaultBool("MAINTENANCE_RESPONDER", false), "While an upstream can't be reached (dial failure or open circuit), keep clients connected and answer PING and a minimal INFO locally and -PROXYERR backend unavailable to anything else, instead of closing them; they are disconnected once the upstream is back")
+	flag.IntVar(&cfg.ReadinessPingInterval, "readiness-ping-interval", getEnvOrDefaultInt("READINESS_PING_INTERVAL", 0), "Seconds between authenticated PINGs to every upstream; /readyz fails while any upstream is unreachable (0 disables)")
+	flag.IntVar(&cfg.UpstreamProbeInterval, "upstream-probe-interval", getEnvOrDefaultInt("UPSTREAM_PROBE_INTERVAL", 0), "Seconds between measurements of TCP+TLS+AUTH handshake time and PING RTT to every upstream, reported per proxy on /status (0 disables)")
+	flag.IntVar(&cfg.DialTimeout, "dial-timeout", getEnvOrDefaultInt("DIAL_TIMEOUT", 5), "Seconds to wait for the TCP connection to an upstream endpoint (raise for slow PSC handshakes)")
+	flag.IntVar(&cfg.TLSHandshakeTimeout, "tls-handshake-timeout", getEnvOrDefaultInt("TLS_HANDSHAKE_TIMEOUT", 5), "Seconds to wait for the TLS handshake with an upstream endpoint once the TCP connection is up")
+	flag.IntVar(&cfg.DialRetryWindow, "dial-retry-window", getEnvOrDefaultInt("DIAL_RETRY_WINDOW", 0), "Seconds a new client connection keeps retrying a failed upstream dial with jittered exponential backoff before it is closed (0 disables retries)")
+	flag.IntVar(&cfg.KeepAlivePeriod, "keepalive-period", getEnvOrDefaultInt("KEEPALIVE_PERIOD", 30), "Seconds between TCP keepalive probes on client and upstream connections; lower it to stay under NAT idle timeouts (0 disables)")
+	flag.IntVar(&cfg.TCPUserTimeout, "tcp-user-timeout", getEnvOrDefaultInt("TCP_USER_TIMEOUT", 0), "Seconds sent data may stay unacknowledged before a client or upstream connection is dropped (TCP_USER_TIMEOUT, Linux only); detects dead peers behind packet loss quickly (0 keeps the OS default)")
+	flag.IntVar(&cfg.HappyEyeballsDelay, "happy-eyeballs-delay", getEnvOrDefaultInt("HAPPY_EYEBALLS_DELAY", 250), "Milliseconds to wait for the first address family before also dialing the other when an upstream host resolves to both IPv4 and IPv6 addresses (RFC 8305 Happy Eyeballs; negative disables)")
+	flag.BoolVar(&cfg.TransparentReconnect, "transparent-reconnect", getEnvOrDefaultBool("TRANSPARENT_RECONNECT", false), "When an upstream connection drops while its client is idle (maintenance, failover), re-dial, re-TLS and re-AUTH on the client's next request instead of closing the client connection")
+	flag.IntVar(&cfg.PoolSize, "pool-size", getEnvOrDefaultInt("POOL_SIZE", 0), "Dialed, TLS-negotiated and authenticated upstream connections kept ready per endpoint for new clients (0 disables)")
+	flag.IntVar(&cfg.PoolMaxIdle, "pool-max-idle", getEnvOrDefaultInt("POOL_MAX_IDLE", 300), "Seconds a pooled upstream connection may wait before it is replaced (keep below the IAM token lifetime)")
+	flag.IntVar(&cfg.Prewarm, "prewarm", getEnvOrDefaultInt("PREWARM", 0), "Upstream connections dialed and authenticated per endpoint before /readyz succeeds, handed to the first clients (0 disables)")
+	flag.IntVar(&cfg.UpstreamPingInterval, "upstream-ping-interval", getEnvOrDefaultInt("UPSTREAM_PING_INTERVAL", 0), "Seconds between PINGs on idle pooled (-pool-size) and shared (-mux-connections) upstream connections, so NATs, firewalls and the server's idle timeout don't drop them (0 disables)")
+	flag.IntVar(&cfg.MuxConnections, "mux-connections", getEnvOrDefaultInt("MUX_CONNECTIONS", 0), "Multiplex all clients of an endpoint over this many shared upstream connections; stateful commands (SELECT, WATCH, SUBSCRIBE, blocking pops, CLIENT, ...) are rejected (0 disables)")
+	flag.BoolVar(&cfg.ReadWriteSplit, "read-write-split", getEnvOrDefaultBool("READ_WRITE_SPLIT", false), "Route read-only commands received on the primary listener to the read-replica endpoint(s) and everything else to the primary, so applications only need one address (not for cluster instances)")
+	flag.BoolVar(&cfg.RetryReads, "retry-reads", getEnvOrDefaultBool("RETRY_READS", false), "With -read-write-split, send a read again to the primary once when the replica's connection is lost or it replies LOADING, instead of returning the error to the client")
+	flag.IntVar(&cfg.ReplicaMaxLag, "replica-max-lag", getEnvOrDefaultInt("REPLICA_MAX_LAG", 0), "Bytes of replication stream a replica may trail its master before reads stop going to it (with -read-write-split, and new connections of cluster replica listeners) until it catches up (0 disables)")
+	flag.IntVar(&cfg.ReplicaLagInterval, "replica-lag-interval", getEnvOrDefaultInt("REPLICA_LAG_INTERVAL", 5), "Seconds between replication lag measurements for -replica-max-lag")
+	flag.StringVar(&clusterMode, "cluster", getEnvOrDefault("CLUSTER_MODE", "auto"), "Give every cluster node a listener: 'auto' probes CLUSTER INFO on the first endpoint at startup, 'on' requires a cluster and 'off' only proxies the endpoints")
+	flag.BoolVar(&cfg.ClusterReplicaReads, "cluster-replica-reads", getEnvOrDefaultBool("CLUSTER_REPLICA_READS", true), "Send READONLY after AUTH on upstream connections to cluster replica nodes, so clients of replica listeners can read without being redirected to the master with MOVED")
+	flag.BoolVar(&cfg.ClusterRouting, "cluster-routing", getEnvOrDefaultBool("CLUSTER_ROUTING", false), "On cluster instances, route every request received on the first endpoint's listener to the node serving its key and follow MOVED/ASK redirects in the proxy, so clients without cluster support can use the whole cluster through one port")
+	flag.IntVar(&cfg.FailoverInterval, "failover-interval", getEnvOrDefaultInt("FAILOVER_INTERVAL", 10), "Seconds between CLUSTER NODES polls on cluster instances; promoted replicas switch their listener to master (no READONLY, new role label) and nodes that joined get listeners (0 disables)")
+	flag.IntVar(&cfg.ClusterPortStart, "cluster-port-start", getEnvOrDefaultInt("CLUSTER_PORT_START", 0), "First local port of the listeners of discovered cluster nodes, so they get a dedicated range apart from the endpoint ports (0 continues after the endpoint ports)")
+	flag.StringVar(&cfg.PortStateFile, "port-state-file", os.Getenv("PORT_STATE_FILE"), "File the local port of each cluster node is saved to, so nodes keep their ports across restarts (without it, ports follow node address order)")
+	flag.BoolVar(&cfg.ClientName, "client-name", getEnvOrDefaultBool("CLIENT_NAME", false), "Name every upstream connection with CLIENT SETNAME after the proxy pod and the client address (pod/ip:port), so CLIENT LIST on the server shows which workload owns it")
+	flag.StringVar(&cfg.PodName, "pod-name", getEnvOrDefault("POD_NAME", defaultPodName()), "Proxy instance name used by -client-name (defaults to the POD_NAME environment variable, set it with the Kubernetes downward API, or the hostname)")
+	flag.IntVar(&cfg.DefaultDB, "default-db", getEnvOrDefaultInt("DEFAULT_DB", 0), "Logical database to SELECT on every new upstream connection before it is handed to a client, for applications that expect a non-zero database but can't be changed (not for cluster instances)")
+	flag.IntVar(&cfg.BufferSize, "buffer-size", getEnvOrDefaultInt("BUFFER_SIZE", 32*1024), "Size in bytes of the pooled buffers used to relay traffic (larger suits big values, smaller saves memory with many connections)")
+	flag.BoolVar(&cfg.ZeroCopy, "zero-copy", getEnvOrDefaultBool("ZERO_COPY", true), "Relay plaintext (non-TLS) connections that need no inspection with splice(2) on Linux, keeping the data in the kernel")
+	flag.IntVar(&cfg.MaxConnections, "max-connections", getEnvOrDefaultInt("MAX_CONNECTIONS", 0), "Maximum simultaneous client connections across all listeners; further clients get 'max number of clients reached' (0 means unlimited)")
+	flag.IntVar(&cfg.MaxConnectionsPerProxy, "max-connections-per-proxy", getEnvOrDefaultInt("MAX_CONNECTIONS_PER_PROXY", 0), "Maximum simultaneous client connections per listener (0 means unlimited)")
+	listenerLimits := flag.String("max-connections-per-listener", os.Getenv("MAX_CONNECTIONS_PER_LISTENER"), "Per-listener overrides of -max-connections-per-proxy as comma-separated local-port=limit or endpoint-type=limit pairs, e.g. '6379=500,read-replica=100' (0 means unlimited)")
+	deniedCommands := flag.String("deny-commands", os.Getenv("DENY_COMMANDS"), "Comma-separated commands the proxy rejects with an error instead of forwarding, as a command name or command and subcommand, e.g. 'FLUSHALL,FLUSHDB,KEYS,CONFIG SET'; scripts and functions (EVAL, FCALL) can still run denied commands")
+	flag.StringVar(&cfg.AuthUser, "auth-user", os.Getenv("AUTH_USER"), "ACL user to authenticate upstream connections as, sending 'AUTH user credential' (empty uses the default user)")
+	flag.StringVar(&cfg.ImpersonateServiceAccount, "impersonate-service-account", os.Getenv("IMPERSONATE_SERVICE_ACCOUNT"), "Service account to impersonate through the IAM Credentials API for IAM auth tokens and Memorystore API calls; the proxy's own identity needs roles/iam.serviceAccountTokenCreator on it (empty uses the application default credentials directly)")
+	flag.StringVar(&cfg.TokenCommand, "token-command", os.Getenv("TOKEN_COMMAND"), "Shell command printing the token upstream connections authenticate with, optionally followed by its TTL in seconds on a second line; run again before the token expires (replaces GCP IAM tokens)")
+	flag.StringVar(&cfg.AuthSecret, "auth-secret", os.Getenv("AUTH_SECRET"), "Secret Manager secret holding the upstream password, as projects/PROJECT/secrets/NAME (latest version) or with /versions/VERSION; takes precedence over the discovered auth string")
+	flag.StringVar(&cfg.AuthPasswordFile, "auth-password-file", os.Getenv("AUTH_PASSWORD_FILE"), "File holding the upstream password, e.g. a mounted Kubernetes secret; the auth string isn't fetched from the Redis API then")
+	flag.IntVar(&cfg.AuthStringRefresh, "auth-string-refresh", getEnvOrDefaultInt("AUTH_STRING_REFRESH", 300), "Seconds between re-fetches of the discovered Redis auth string; after a rotation, new and pooled upstream connections authenticate with the new one (0 disables)")
+	flag.IntVar(&cfg.AuthSecretRefresh, "auth-secret-refresh", getEnvOrDefaultInt("AUTH_SECRET_REFRESH", 300), "Seconds between re-reads of -auth-secret; new and pooled upstream connections authenticate with a changed password (0 disables)")
+	flag.StringVar(&clientAuth, "client-auth", getEnvOrDefault("CLIENT_AUTH", "forward"), "What to do with AUTH commands of clients: 'forward' sends them upstream as is, 'ignore' answers +OK without forwarding, 'replace' sends the proxy's IAM token or instance password instead")
+	tlsPins := flag.String("tls-pin-sha256", os.Getenv("TLS_PIN_SHA256"), "Comma-separated base64 SHA-256 hashes of public keys (SPKI), one of which the instance certificate must have; works with -tls-skip-verify, as an alternative to CA verification")
+	cacheKeys := flag.String("cache-keys", os.Getenv("CACHE_KEYS"), "Comma-separated key patterns (* and ? wildcards) whose GET/MGET replies are cached in the proxy and invalidated by the server through RESP3 client-side caching, e.g. 'user:*,config:*' (empty disables)")
+	flag.IntVar(&cfg.CacheMaxMemory, "cache-max-memory", getEnvOrDefaultInt("CACHE_MAX_MEMORY", 64*1024*1024), "Bytes of keys and values the read cache holds per endpoint before evicting the least recently used")
+	flag.IntVar(&cfg.MaxBulkSize, "max-bulk-size", getEnvOrDefaultInt("MAX_BULK_SIZE", 512*1024*1024), "Largest RESP bulk string accepted, in bytes; connections announcing more are closed (only applies where RESP is parsed)")
+	flag.IntVar(&cfg.MaxArrayLength, "max-array-length", getEnvOrDefaultInt("MAX_ARRAY_LENGTH", 1<<31-1), "Largest RESP array element count accepted; connections announcing more are closed (only applies where RESP is parsed)")
+	flag.StringVar(&cfg.RecordDiscoveryDir, "record-discovery", os.Getenv("RECORD_DISCOVERY"), "Write sanitized discovery API responses to this directory (for test fixtures)")
+	flag.StringVar(&cfg.StatsdAddr, "statsd-addr", os.Getenv("STATSD_ADDR"), "StatsD/DogStatsD address (host:port) to push metrics to (disabled if empty)")
+	flag.IntVar(&cfg.StatsdInterval, "statsd-interval", getEnvOrDefaultInt("STATSD_INTERVAL", 10), "StatsD flush interval in seconds")
+	flag.BoolVar(&cfg.StatsdTags, "statsd-tags", getEnvOrDefaultBool("STATSD_TAGS", true), "Send labels as DogStatsD tags (disable for plain StatsD)")
+	flag.BoolVar(&cfg.CloudMonitoring, "cloud-monitoring", getEnvOrDefaultBool("CLOUD_MONITORING", false), "Write proxy metrics to Cloud Monitoring custom metrics in the instance's project")
+	flag.IntVar(&cfg.CloudMonitoringInterval, "cloud-monitoring-interval", getEnvOrDefaultInt("CLOUD_MONITORING_INTERVAL", 60), "Cloud Monitoring export interval in seconds (minimum 10)")
+	flag.BoolVar(&cfg.DumpProtocol, "dump-protocol", getEnvOrDefaultBool("DUMP_PROTOCOL", false), "Hex/ASCII dump RESP frames of sampled connections to stderr, with credentials masked (debugging only)")
+	flag.Float64Var(&cfg.DumpProtocolSample, "dump-protocol-sample", getEnvOrDefaultFloat("DUMP_PROTOCOL_SAMPLE", 1), "Fraction of connections dumped by -dump-protocol (0-1)")
+	flag.IntVar(&cfg.DumpProtocolMaxValue, "dump-protocol-max-value", getEnvOrDefaultInt("DUMP_PROTOCOL_MAX_VALUE", 64), "Truncate bulk strings longer than this many bytes in protocol dumps")
+	flag.StringVar(&cfg.CaptureFile, "capture-file", os.Getenv("CAPTURE_FILE"), "Record the decrypted RESP traffic of sampled connections to this file for memstore-replay (disabled if empty)")
+	flag.Float64Var(&cfg.CaptureSample, "capture-sample", getEnvOrDefaultFloat("CAPTURE_SAMPLE", 1), "Fraction of connections recorded by -capture-file (0-1)")
+	flag.IntVar(&cfg.ChaosLatency, "chaos-latency", getEnvOrDefaultInt("CHAOS_LATENCY", 0), "Testing only: milliseconds added before each request is forwarded")
+	flag.IntVar(&cfg.ChaosStall, "chaos-stall", getEnvOrDefaultInt("CHAOS_STALL", 1000), "Testing only: milliseconds a reply picked by -chaos-stall-rate pauses midway")
+	flag.Float64Var(&cfg.ChaosStallRate, "chaos-stall-rate", getEnvOrDefaultFloat("CHAOS_STALL_RATE", 0), "Testing only: fraction of replies that pause midway, as if a packet was lost (0-1)")
+	flag.Float64Var(&cfg.ChaosDisconnectRate, "chaos-disconnect-rate", getEnvOrDefaultFloat("CHAOS_DISCONNECT_RATE", 0), "Testing only: fraction of requests that drop the client connection instead of being forwarded (0-1)")
+	flag.Float64Var(&cfg.ChaosMovedRate, "chaos-moved-rate", getEnvOrDefaultFloat("CHAOS_MOVED_RATE", 0), "Testing only: fraction of keyed requests answered with a MOVED redirect to the same proxy instead of being executed (0-1)")
+	flag.BoolVar(&cfg.EnableTracing, "enable-tracing", getEnvOrDefaultBool("ENABLE_TRACING", false), "Export OpenTelemetry traces via OTLP/HTTP (configured by standard OTEL_EXPORTER_OTLP_* env vars)")
+	flag.StringVar(&cfg.LogFormat, "log-format", getEnvOrDefault("LOG_FORMAT", "text"), "Log output format: 'text', 'json' or 'gcp' (Cloud Logging structured JSON)")
+	flag.StringVar(&cfg.LogOutput, "log-output", getEnvOrDefault("LOG_OUTPUT", "stdout"), "Log destination: 'stdout' or 'syslog' (local syslog/journald socket)")
+	flag.BoolVar(&cfg.QuitQuitQuit, "quitquitquit", getEnvOrDefaultBool("QUITQUITQUIT", false), "Enable POST /quitquitquit on the health port to trigger a graceful shutdown (for sidecars of Kubernetes Jobs)")
+	flag.BoolVar(&cfg.DrainEndpoint, "drain-endpoint", getEnvOrDefaultBool("DRAIN_ENDPOINT", false), "Enable POST /drain on the health port: fail readiness, stop accepting connections and exit once they finish or -drain-timeout expires")
+	flag.BoolVar(&cfg.LogLevelPut, "loglevel-endpoint", getEnvOrDefaultBool("LOGLEVEL_ENDPOINT", false), "Enable PUT /loglevel on the health port to change the log level without a restart; GET is always served")
+	flag.IntVar(&cfg.DrainTimeout, "drain-timeout", getEnvOrDefaultInt("DRAIN_TIMEOUT", 30), "Seconds to wait for established connections to finish on shutdown or /drain")
 	flag.BoolVar(&cfg.Verbose, "verbose", getEnvOrDefaultBool("VERBOSE", false), "Enable verbose logging")
+	showVersion := flag.Bool("version", false, "Print version information and exit")
 	flag.Parse()
 
+	build := buildInfo()
+	if *showVersion {
+		fmt.Printf("cloud-memstore-proxy %s (commit %s, built %s, %s)\n", build.Version, build.GitCommit, build.BuildTime, build.GoVersion)
+		return
+	}
+
 	// Set instance type
 	cfg.InstanceType = config.InstanceType(strings.ToLower(instanceType))
+	cfg.Cluster = config.ClusterMode(strings.ToLower(clusterMode))
+	cfg.ClientAuth = config.ClientAuthMode(strings.ToLower(clientAuth))
 
 	// Validate configuration
 	if cfg.InstanceName == "" {
 		logger.Fatal("Instance name is required. Set via -instance flag or VALKEY_INSTANCE_NAME env variable")
 	}
 
-	logger.Init(cfg.Verbose)
-	logger.Info(fmt.Sprintf("Starting Cloud Memstore Proxy for %s...", cfg.InstanceType))
+	// Accept IPv6 local addresses in brackets, as in "[::1]"
+	cfg.LocalAddr = strings.TrimSuffix(strings.TrimPrefix(cfg.LocalAddr, "["), "]")
+
+	limits, err := config.ParseConnectionLimits(*listenerLimits)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Invalid -max-connections-per-listener: %v", err))
+	}
+	cfg.ListenerConnectionLimits = limits
+
+	denied, err := config.ParseDeniedCommands(*deniedCommands)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Invalid -deny-commands: %v", err))
+	}
+	cfg.DeniedCommands = denied
+	cfg.CacheKeys = config.ParseCacheKeys(*cacheKeys)
+	pins, err := config.ParseTLSPins(*tlsPins)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Invalid -tls-pin-sha256: %v", err))
+	}
+	cfg.TLSPins = pins
+
+	if cfg.DialTimeout <= 0 {
+		logger.Fatal("-dial-timeout must be positive")
+	}
+	if cfg.TLSHandshakeTimeout <= 0 {
+		logger.Fatal("-tls-handshake-timeout must be positive")
+	}
+
+	if cfg.MaxBulkSize <= 0 || cfg.MaxArrayLength <= 0 {
+		logger.Fatal("-max-bulk-size and -max-array-length must be positive")
+	}
+
+	if cfg.PoolSize > 0 && cfg.MuxConnections > 0 {
+		logger.Fatal("-pool-size is not supported with -mux-connections")
+	}
+
+	if cfg.ChaosEnabled() && cfg.MuxConnections > 0 {
+		logger.Fatal("Chaos injection is not supported with -mux-connections")
+	}
+
+	if cfg.ReadWriteSplit && (cfg.MuxConnections > 0 || cfg.TransparentReconnect || cfg.ChaosEnabled()) {
+		logger.Fatal("-read-write-split is not supported with -mux-connections, -transparent-reconnect or chaos injection")
+	}
+
+	if cfg.RetryReads && !cfg.ReadWriteSplit {
+		logger.Fatal("-retry-reads requires -read-write-split")
+	}
+
+	if len(cfg.CacheKeys) > 0 && (cfg.MuxConnections > 0 || cfg.ReadWriteSplit) {
+		logger.Fatal("-cache-keys is not supported with -mux-connections or -read-write-split")
+	}
+	if len(cfg.CacheKeys) > 0 && cfg.CacheMaxMemory <= 0 {
+		logger.Fatal("-cache-max-memory must be positive")
+	}
+
+	if cfg.ClusterRouting && (cfg.MuxConnections > 0 || cfg.ReadWriteSplit || cfg.TransparentReconnect || cfg.ChaosEnabled() || len(cfg.CacheKeys) > 0) {
+		logger.Fatal("-cluster-routing is not supported with -mux-connections, -read-write-split, -transparent-reconnect, -cache-keys or chaos injection")
+	}
+
+	cfg.AuthPassword = os.Getenv("AUTH_PASSWORD")
+	passwordSources := 0
+	for _, source := range []string{cfg.AuthSecret, cfg.AuthPasswordFile, cfg.AuthPassword} {
+		if source != "" {
+			passwordSources++
+		}
+	}
+	if passwordSources > 1 {
+		logger.Fatal("-auth-secret, -auth-password-file and AUTH_PASSWORD are mutually exclusive")
+	}
+	if cfg.AuthPasswordFile != "" {
+		data, err := os.ReadFile(cfg.AuthPasswordFile)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to read -auth-password-file: %v", err))
+		}
+		// Files written by editors or echo usually end with a newline that isn't part of the password
+		cfg.AuthPassword = strings.TrimRight(string(data), "\r\n")
+		if cfg.AuthPassword == "" {
+			logger.Fatal(fmt.Sprintf("-auth-password-file %s is empty", cfg.AuthPasswordFile))
+		}
+	}
+	if cfg.CACertFile != "" || cfg.CACertDir != "" {
+		// A CA supplied out-of-band is meant to be verified against, unlike
+		// the self-signed discovered one the default skips verification for
+		skipVerifySet := os.Getenv("TLS_SKIP_VERIFY") != ""
+		flag.Visit(func(f *flag.Flag) {
+			skipVerifySet = skipVerifySet || f.Name == "tls-skip-verify"
+		})
+		if !skipVerifySet {
+			cfg.TLSSkipVerify = false
+		}
+	}
+	if (cfg.TLSClientCert == "") != (cfg.TLSClientKey == "") {
+		logger.Fatal("-tls-client-cert and -tls-client-key must be set together")
+	}
+	if cfg.TLSClientCert != "" && cfg.TLSClientSecret != "" {
+		logger.Fatal("-tls-client-cert and -tls-client-secret are mutually exclusive")
+	}
+	if cfg.CARefresh < 0 {
+		logger.Fatal("-ca-refresh must not be negative")
+	}
+	if cfg.AuthSecretRefresh < 0 {
+		logger.Fatal("-auth-secret-refresh must not be negative")
+	}
+	if cfg.AuthStringRefresh < 0 {
+		logger.Fatal("-auth-string-refresh must not be negative")
+	}
+	if cfg.DefaultDB < 0 {
+		logger.Fatal("-default-db must not be negative")
+	}
+	switch cfg.Cluster {
+	case config.ClusterModeAuto, config.ClusterModeOn, config.ClusterModeOff:
+	default:
+		logger.Fatal(fmt.Sprintf("Unknown -cluster mode: %s (must be 'auto', 'on' or 'off')", cfg.Cluster))
+	}
+	switch cfg.ClientAuth {
+	case config.ClientAuthForward, config.ClientAuthIgnore, config.ClientAuthReplace:
+	default:
+		logger.Fatal(fmt.Sprintf("Unknown -client-auth mode: %s (must be 'forward', 'ignore' or 'replace')", cfg.ClientAuth))
+	}
+	if cfg.ClusterPortStart < 0 || cfg.ClusterPortStart > 65535 {
+		logger.Fatal("-cluster-port-start must be a port number, or 0 to continue after the endpoint ports")
+	}
+
+	if cfg.BufferSize < proxy.MinBufferSize {
+		logger.Fatal(fmt.Sprintf("-buffer-size must be at least %d bytes", proxy.MinBufferSize))
+	}
+
+	if err := logger.Init(cfg.Verbose, cfg.LogFormat, cfg.LogOutput); err != nil {
+		logger.Fatal(err.Error())
+	}
+	logger.SetLabels(map[string]string{"instance": cfg.InstanceName})
+	logger.Info(fmt.Sprintf("Starting Cloud Memstore Proxy %s (commit %s) for %s...", build.Version, build.GitCommit, cfg.InstanceType))
+	if cfg.TCPUserTimeout > 0 && !proxy.TCPUserTimeoutSupported {
+		logger.Info("-tcp-user-timeout is only supported on Linux and is ignored")
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Initialize tracing before anything that creates spans
+	if cfg.EnableTracing {
+		shutdownTracing, err := tracing.Init(ctx)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to initialize tracing: %v", err))
+		}
+		defer func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			if err := shutdownTracing(shutdownCtx); err != nil {
+				logger.Error(fmt.Sprintf("Failed to flush traces: %v", err))
+			}
+		}()
+		logger.Info("OpenTelemetry tracing enabled")
+	}
+
+	if cfg.ChaosEnabled() {
+		logger.Error(fmt.Sprintf("CHAOS INJECTION ENABLED, do not use in production: latency %dms, stalls %.1f%% (%dms), disconnects %.1f%%, MOVED %.1f%%",
+			cfg.ChaosLatency, cfg.ChaosStallRate*100, cfg.ChaosStall, cfg.ChaosDisconnectRate*100, cfg.ChaosMovedRate*100))
+	}
+
+	if cfg.ClientAuth != config.ClientAuthForward {
+		logger.Info(fmt.Sprintf("Intercepting client AUTH commands (-client-auth %s)", cfg.ClientAuth))
+	}
+	if len(cfg.DeniedCommands) > 0 {
+		logger.Info(fmt.Sprintf("Rejecting denied commands: %s", strings.Join(cfg.DeniedCommands, ", ")))
+	}
+
+	if len(cfg.CacheKeys) > 0 {
+		logger.Info(fmt.Sprintf("Read cache enabled for keys %s (%d bytes per endpoint)", strings.Join(cfg.CacheKeys, ", "), cfg.CacheMaxMemory))
+	}
+
+	if cfg.DumpProtocol {
+		logger.Info(fmt.Sprintf("Protocol dumps enabled for %.0f%% of connections (stderr, values truncated to %d bytes)",
+			cfg.DumpProtocolSample*100, cfg.DumpProtocolMaxValue))
+	}
+
+	// Metrics registry shared by the health server and proxies
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	// Push metrics to StatsD/DogStatsD for environments without a Prometheus scraper
+	if cfg.StatsdAddr != "" {
+		emitter, err := statsd.New(cfg.StatsdAddr, metricsRegistry, time.Duration(cfg.StatsdInterval)*time.Second, cfg.StatsdTags)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to initialize StatsD emitter: %v", err))
+		}
+		go emitter.Run(ctx)
+		logger.Info(fmt.Sprintf("Pushing metrics to StatsD at %s every %ds", cfg.StatsdAddr, cfg.StatsdInterval))
+	}
+
+	// Sockets handed over by a previous process during a hitless restart
+	inherited, err := handover.Inherited()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	if len(inherited) > 0 {
+		logger.Info(fmt.Sprintf("Took over %d listening sockets from the previous process", len(inherited)))
+	}
+
 	// Start health check server
 	healthServer := health.NewServer(cfg.HealthPort)
+	if ln, ok := inherited[healthListener]; ok {
+		healthServer.SetListener(ln)
+		delete(inherited, healthListener)
+	}
+	healthServer.SetBuildInfo(build)
+	healthServer.SetMetricsGatherer(metricsRegistry)
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	requestShutdown := func() { quitOnce.Do(func() { close(quit) }) }
+	if cfg.QuitQuitQuit {
+		healthServer.SetQuitFunc(requestShutdown)
+	}
+	if cfg.DrainEndpoint {
+		healthServer.SetDrainFunc(requestShutdown)
+	}
+	if cfg.LogLevelPut {
+		healthServer.EnableLogLevelPut()
+	}
 	if err := healthServer.Start(); err != nil {
 		logger.Fatal(fmt.Sprintf("Failed to start health server: %v", err))
 	}
@@ -64,31 +410,88 @@ func main() {
 	}
 
 	logger.Info(fmt.Sprintf("Instance: %s", resolvedInstanceName))
+
+	// Export metrics straight to Cloud Monitoring so no scraper is needed
+	if cfg.CloudMonitoring {
+		project, err := monitoring.ProjectFromInstance(resolvedInstanceName)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to initialize Cloud Monitoring exporter: %v", err))
+		}
+		interval := time.Duration(max(cfg.CloudMonitoringInterval, 10)) * time.Second
+		exporter, err := monitoring.NewExporter(ctx, project, metricsRegistry, interval)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to initialize Cloud Monitoring exporter: %v", err))
+		}
+		go exporter.Run(ctx)
+		logger.Info(fmt.Sprintf("Exporting metrics to Cloud Monitoring project %s every %s", project, interval))
+	}
 	logger.Info(fmt.Sprintf("Local address: %s", cfg.LocalAddr))
 
 	// Discover instance endpoints and configuration based on type
 	logger.Info(fmt.Sprintf("Discovering %s instance configuration...", cfg.InstanceType))
 	logger.Info(fmt.Sprintf("API timeout: %ds", cfg.APITimeout))
 	discoverer := discovery.NewGCPDiscoverer(cfg.APITimeout)
+	discoverer.SetRecordDir(cfg.RecordDiscoveryDir)
+	if cfg.ImpersonateServiceAccount != "" {
+		ts, err := auth.TokenSource(ctx, cfg.ImpersonateServiceAccount)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to set up impersonation of %s: %v", cfg.ImpersonateServiceAccount, err))
+		}
+		discoverer.SetTokenSource(ts)
+		logger.Info(fmt.Sprintf("Impersonating service account %s", cfg.ImpersonateServiceAccount))
+	}
+	if cfg.AuthSecret != "" || cfg.AuthPassword != "" {
+		// The password is supplied otherwise, so don't require redis.instances.getAuthString
+		discoverer.SkipAuthString()
+	}
 
 	var instanceInfo *discovery.InstanceInfo
 
-	switch cfg.InstanceType {
-	case config.InstanceTypeRedis:
-		instanceInfo, err = discoverer.DiscoverRedisInstance(ctx, resolvedInstanceName)
-	case config.InstanceTypeValkey:
-		instanceInfo, err = discoverer.DiscoverInstance(ctx, resolvedInstanceName)
-	default:
-		logger.Fatal(fmt.Sprintf("Unknown instance type: %s (must be 'valkey' or 'redis')", cfg.InstanceType))
+	for backoff := discoveryMinBackoff; ; backoff = min(backoff*2, discoveryMaxBackoff) {
+		discoveryCtx, discoverySpan := tracing.Start(ctx, "discovery",
+			attribute.String("memorystore.instance", resolvedInstanceName),
+			attribute.String("memorystore.type", string(cfg.InstanceType)))
+
+		switch cfg.InstanceType {
+		case config.InstanceTypeRedis:
+			instanceInfo, err = discoverer.DiscoverRedisInstance(discoveryCtx, resolvedInstanceName)
+		case config.InstanceTypeValkey:
+			instanceInfo, err = discoverer.DiscoverInstance(discoveryCtx, resolvedInstanceName)
+		case config.InstanceTypeRedisCluster:
+			instanceInfo, err = discoverer.DiscoverRedisCluster(discoveryCtx, resolvedInstanceName)
+		case config.InstanceTypeAuto:
+			instanceInfo, err = discoverer.DiscoverAuto(discoveryCtx, resolvedInstanceName)
+		default:
+			logger.Fatal(fmt.Sprintf("Unknown instance type: %s (must be 'valkey', 'redis', 'redis-cluster' or 'auto')", cfg.InstanceType))
+		}
+
+		tracing.End(discoverySpan, err)
+		if err == nil {
+			break
+		}
+
+		healthServer.RecordDiscovery(resolvedInstanceName, 0, err)
+		logger.Error(fmt.Sprintf("Failed to discover instance, retrying in %s: %v", backoff, err))
+		select {
+		case <-quit:
+			logger.Info("Shutdown requested before the instance was discovered")
+			return
+		case <-time.After(backoff):
+		}
 	}
 
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("Failed to discover instance: %v", err))
+	if cfg.InstanceType == config.InstanceTypeAuto {
+		cfg.InstanceType = config.InstanceType(instanceInfo.InstanceType)
+		logger.Info(fmt.Sprintf("Detected instance type: %s", cfg.InstanceType))
+	}
+	if cfg.DefaultDB != 0 && cfg.InstanceType == config.InstanceTypeRedisCluster {
+		logger.Fatal("-default-db is not supported on cluster instances, which only have DB 0")
 	}
 
 	if len(instanceInfo.Endpoints) == 0 {
 		logger.Fatal("No endpoints found for the instance")
 	}
+	healthServer.RecordDiscovery(resolvedInstanceName, len(instanceInfo.Endpoints), nil)
 
 	logger.Info("Instance configuration:")
 	logger.Info(fmt.Sprintf("  Transit Encryption: %s", instanceInfo.TransitEncryptionMode))
@@ -97,71 +500,381 @@ func main() {
 	logger.Info(fmt.Sprintf("  Endpoints: %d", len(instanceInfo.Endpoints)))
 
 	for i, ep := range instanceInfo.Endpoints {
-		logger.Info(fmt.Sprintf("    %d. %s:%d (%s)", i+1, ep.Host, ep.Port, ep.Type))
+		logger.Info(fmt.Sprintf("    %d. %s (%s)", i+1, ep.Address(), ep.Type))
 	}
 
 	// Start proxy servers for each endpoint
 	proxyManager := proxy.NewManager(cfg)
+	proxyManager.SetMetricsRegistry(metricsRegistry)
+	proxyManager.SetInheritedListeners(inherited)
+	if cfg.CaptureFile != "" {
+		captureWriter, err := capture.Create(cfg.CaptureFile)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		defer captureWriter.Close()
+		proxyManager.SetCaptureWriter(captureWriter)
+		logger.Info(fmt.Sprintf("Capturing traffic of %.0f%% of connections to %s", cfg.CaptureSample*100, cfg.CaptureFile))
+	}
+	healthServer.SetProxyStatsProvider(proxyManager)
+	healthServer.SetConnectionsProvider(proxyManager)
+	healthServer.SetTopologyProvider(proxyManager)
+
+	// Lightweight runtime state on /debug/vars
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("active_proxies", expvar.Func(func() any { return proxyManager.ProxyCount() }))
 
 	// Set authorization mode from discovery
 	proxyManager.SetAuthorizationMode(instanceInfo.AuthorizationMode)
 
+	if len(cfg.TLSPins) > 0 && !instanceInfo.RequiresTLS {
+		logger.Fatal("-tls-pin-sha256 is set but the instance doesn't use transit encryption")
+	}
+	if cfg.TLSClientCert != "" || cfg.TLSClientSecret != "" {
+		if !instanceInfo.RequiresTLS {
+			logger.Fatal("A TLS client certificate is configured but the instance doesn't use transit encryption")
+		}
+		cert, err := loadClientCertificate(ctx, cfg)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to load the TLS client certificate: %v", err))
+		}
+		proxyManager.SetClientCertificate(cert)
+	}
+
 	// Configure TLS if required
 	if instanceInfo.RequiresTLS {
 		logger.Info("Configuring TLS...")
-		if err := proxyManager.SetTLSConfig(instanceInfo.CACertificate, cfg.TLSSkipVerify); err != nil {
+		caCert := instanceInfo.CACertificate
+		if cfg.CACertFile != "" || cfg.CACertDir != "" {
+			if caCert, err = proxy.ReadCACertificates(cfg.CACertFile, cfg.CACertDir); err != nil {
+				logger.Fatal(fmt.Sprintf("Failed to read CA certificates: %v", err))
+			}
+			logger.Info(fmt.Sprintf("Using CA certificates from %s instead of the discovered CA (verification: %v)",
+				strings.Trim(cfg.CACertFile+" "+cfg.CACertDir, " "), !cfg.TLSSkipVerify))
+		}
+		if err := proxyManager.SetTLSConfig(caCert, cfg.TLSSkipVerify); err != nil {
 			logger.Fatal(fmt.Sprintf("Failed to configure TLS: %v", err))
 		}
+		if cfg.CARefresh > 0 && !cfg.TLSSkipVerify {
+			readCA := func(ctx context.Context) (string, error) {
+				if cfg.CACertFile != "" || cfg.CACertDir != "" {
+					return proxy.ReadCACertificates(cfg.CACertFile, cfg.CACertDir)
+				}
+				return discoverer.CACertificates(ctx, string(cfg.InstanceType), resolvedInstanceName)
+			}
+			go proxyManager.WatchCACertificates(ctx, time.Duration(cfg.CARefresh)*time.Second, readCA)
+			logger.Info(fmt.Sprintf("Checking the server CA certificates for rotation every %ds", cfg.CARefresh))
+		}
 		logger.Info("TLS configuration complete")
 	}
 
 	// Configure password auth for Redis instances
 	if instanceInfo.AuthPassword != "" {
 		proxyManager.SetAuthPassword(instanceInfo.AuthPassword)
+		if cfg.AuthStringRefresh > 0 {
+			go proxyManager.WatchPassword(ctx, time.Duration(cfg.AuthStringRefresh)*time.Second, func(ctx context.Context) (string, error) {
+				return discoverer.RedisAuthString(ctx, resolvedInstanceName)
+			})
+			logger.Info(fmt.Sprintf("Checking the auth string for rotation every %ds", cfg.AuthStringRefresh))
+		}
+	}
+	if cfg.AuthPassword != "" {
+		proxyManager.SetAuthPassword(cfg.AuthPassword)
+	}
+	if cfg.AuthSecret != "" {
+		ts, err := auth.TokenSource(ctx, cfg.ImpersonateServiceAccount)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to read -auth-secret: %v", err))
+		}
+		secret, err := auth.NewSecretReader(ts, cfg.AuthSecret)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Invalid -auth-secret: %v", err))
+		}
+		password, err := secret.Read(ctx)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Failed to read -auth-secret: %v", err))
+		}
+		// The secret takes precedence over the discovered auth string
+		proxyManager.SetAuthPassword(password)
+		if cfg.AuthSecretRefresh > 0 {
+			go proxyManager.WatchPassword(ctx, time.Duration(cfg.AuthSecretRefresh)*time.Second, secret.Read)
+			logger.Info(fmt.Sprintf("Reading the upstream password from %s every %ds", cfg.AuthSecret, cfg.AuthSecretRefresh))
+		}
 	}
 
 	for i, endpoint := range instanceInfo.Endpoints {
 		localPort := cfg.StartPort + i
 		if err := proxyManager.AddProxy(ctx, endpoint, localPort); err != nil {
-			logger.Fatal(fmt.Sprintf("Failed to start proxy for %s:%d: %v", endpoint.Host, endpoint.Port, err))
+			logger.Fatal(fmt.Sprintf("Failed to start proxy for %s: %v", endpoint.Address(), err))
 		}
 		tlsStatus := "plaintext"
 		if instanceInfo.RequiresTLS {
 			tlsStatus = "TLS"
 		}
-		logger.Info(fmt.Sprintf("Proxy listening on %s:%d -> %s:%d (%s, %s)", cfg.LocalAddr, localPort, endpoint.Host, endpoint.Port, endpoint.Type, tlsStatus))
+		logger.Info(fmt.Sprintf("Proxy listening on %s -> %s (%s, %s)", cfg.ListenAddr(localPort), endpoint.Address(), endpoint.Type, tlsStatus))
 	}
+	if cfg.ReadWriteSplit && !slices.ContainsFunc(instanceInfo.Endpoints, func(ep discovery.Endpoint) bool { return ep.Type == "read-replica" }) {
+		logger.Error("-read-write-split is set but the instance has no read-replica endpoint; all requests go to the primary")
+	}
+	healthServer.SetInstanceInfo(instanceSummary(resolvedInstanceName, instanceInfo, cfg))
 
-	// Discover and proxy cluster nodes if this is a cluster with IAM auth
+	// Discover and proxy cluster nodes if this is a cluster
 	totalProxies := len(instanceInfo.Endpoints)
-	if instanceInfo.AuthorizationMode == "IAM_AUTH" && len(instanceInfo.Endpoints) > 0 {
+	isCluster := cfg.Cluster == config.ClusterModeOn
+	if cfg.Cluster == config.ClusterModeAuto && len(instanceInfo.Endpoints) > 0 {
 		logger.Info("Checking for cluster mode...")
+		isCluster, err = proxyManager.ProbeClusterMode(ctx, instanceInfo.Endpoints[0])
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to detect cluster mode, proxying the endpoints only (set -cluster=on to discover nodes anyway): %v", err))
+		}
+	}
+	if isCluster && len(instanceInfo.Endpoints) > 0 {
 		nextPort := cfg.StartPort + len(instanceInfo.Endpoints)
+		if cfg.ClusterPortStart > 0 {
+			nextPort = cfg.ClusterPortStart
+		}
 		clusterNodeCount, err := proxyManager.DiscoverAndAddClusterNodes(ctx, instanceInfo.Endpoints[0], nextPort)
 		if err != nil {
-			logger.Debug(fmt.Sprintf("Not a cluster or discovery failed: %v", err))
+			logger.Fatal(fmt.Sprintf("Failed to discover cluster nodes: %v", err))
 		} else if clusterNodeCount > 0 {
 			logger.Info(fmt.Sprintf("Cluster mode detected: created proxies for %d additional nodes", clusterNodeCount))
+			if cfg.DefaultDB != 0 {
+				logger.Fatal("-default-db is not supported on cluster instances, which only have DB 0")
+			}
+			if cfg.ClusterRouting {
+				if err := proxyManager.EnableClusterRouting(ctx, instanceInfo.Endpoints[0]); err != nil {
+					logger.Fatal(fmt.Sprintf("Failed to enable cluster routing: %v", err))
+				}
+				logger.Info(fmt.Sprintf("Routing requests on %s to the cluster node of each key", cfg.ListenAddr(cfg.StartPort)))
+			}
+			if cfg.FailoverInterval > 0 {
+				go proxyManager.RunClusterFailoverChecks(ctx, instanceInfo.Endpoints[0], time.Duration(cfg.FailoverInterval)*time.Second, func(endpointCount int, err error) {
+					healthServer.RecordDiscovery(resolvedInstanceName, endpointCount, err)
+				})
+			}
 			totalProxies += clusterNodeCount
 		} else {
-			logger.Info("Single-node instance (not a cluster)")
+			logger.Info("Single-node cluster, no additional nodes to proxy")
+		}
+	} else {
+		logger.Info("Single-node instance (not a cluster)")
+	}
+	if cfg.ClusterRouting && !proxyManager.Topology().ClusterMode {
+		logger.Error("-cluster-routing is set but the instance is not a cluster; requests go to the endpoints as they are")
+	}
+
+	// Periodic upstream checks report handshake/PING latency on /status and, with
+	// -readiness-ping-interval, gate readiness on the upstreams actually answering
+	if interval := upstreamCheckInterval(cfg); interval > 0 {
+		if cfg.ReadinessPingInterval > 0 {
+			healthServer.SetUpstreamHealthProvider(proxyManager)
+			logger.Info(fmt.Sprintf("Readiness requires upstream PING every %s", interval))
+		}
+		go proxyManager.RunUpstreamChecks(ctx, interval)
+	}
+
+	// Reads stay away from replicas that fall behind their master
+	if cfg.ReplicaMaxLag > 0 && cfg.ReplicaLagInterval > 0 {
+		go proxyManager.RunReplicaLagChecks(ctx, time.Duration(cfg.ReplicaLagInterval)*time.Second, int64(cfg.ReplicaMaxLag))
+	}
+
+	// Open upstream connections before traffic arrives so the first clients skip the handshake
+	if cfg.Prewarm > 0 {
+		start := time.Now()
+		if err := proxyManager.Prewarm(ctx, cfg.Prewarm); err != nil {
+			logger.Error(fmt.Sprintf("Prewarming upstream connections failed: %v", err))
+		} else {
+			logger.Info(fmt.Sprintf("Prewarmed %d upstream connections per endpoint in %s", cfg.Prewarm, time.Since(start).Round(time.Millisecond)))
 		}
 	}
 
 	// Mark health server as ready
+	proxyManager.CloseUnusedListeners()
 	healthServer.SetReady(totalProxies)
-	logger.Info(fmt.Sprintf("All proxies ready. Health endpoints: http://localhost:%d/livez, /readyz, /status", cfg.HealthPort))
+	logger.Info(fmt.Sprintf("All proxies ready. Health endpoints: http://localhost:%d/livez, /readyz, /status, /metrics, /debug/vars", cfg.HealthPort))
+
+	// The previous process stops accepting once we serve traffic
+	if err := handover.Ready(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to notify the previous process: %v", err))
+	}
 
-	// Wait for termination signal
+	// Wait for termination signal, POST /quitquitquit, POST /drain or a hitless restart
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	upgradeChan := make(chan os.Signal, 1)
+	handover.Notify(upgradeChan)
+	handedOver := false
+wait:
+	for {
+		select {
+		case <-sigChan:
+			break wait
+		case <-quit:
+			break wait
+		case <-upgradeChan:
+			if handedOver = upgrade(ctx, healthServer, proxyManager); handedOver {
+				break wait
+			}
+		}
+	}
 
-	logger.Info("Shutting down...")
-	proxyManager.Shutdown()
+	if handedOver {
+		// The new process answers health checks and accepts new clients from now on
+		healthServer.Stop()
+		logger.Info(fmt.Sprintf("Draining connections for up to %ds before exiting...", cfg.DrainTimeout))
+	} else {
+		// Fail readiness first, then let established connections finish
+		logger.Info(fmt.Sprintf("Shutting down, draining connections for up to %ds...", cfg.DrainTimeout))
+		healthServer.SetDraining()
+	}
+	proxyManager.Shutdown(time.Duration(cfg.DrainTimeout) * time.Second)
 	logger.Info("Shutdown complete")
 }
 
+// healthListener names the health server socket among the handed over listeners
+const healthListener = "health"
+
+// upgradeTimeout bounds how long the new process may take to become ready
+const upgradeTimeout = 5 * time.Minute
+
+// upgrade starts a new copy of the binary on the listening sockets and reports
+// whether it took over; if it fails, this process keeps serving
+func upgrade(ctx context.Context, healthServer *health.Server, proxyManager *proxy.Manager) bool {
+	listeners := proxyManager.Listeners()
+	listeners[healthListener] = healthServer.Listener()
+
+	logger.Info(fmt.Sprintf("Hitless restart: starting a new process on %d listening sockets", len(listeners)))
+	ctx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+	defer cancel()
+	process, err := handover.Upgrade(ctx, listeners)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Hitless restart failed, keeping this process: %v", err))
+		return false
+	}
+	logger.Info(fmt.Sprintf("Hitless restart: process %d is ready and took over the listening sockets", process.Pid))
+	return true
+}
+
+// buildInfo returns the version information embedded at build time, falling
+// back to the VCS revision recorded by the Go toolchain for plain go builds
+func buildInfo() health.BuildInfo {
+	info := health.BuildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && (info.GitCommit == "" || info.GitCommit == "unknown"):
+				info.GitCommit = setting.Value
+			case setting.Key == "vcs.time" && (info.BuildTime == "" || info.BuildTime == "unknown"):
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// upstreamCheckInterval returns how often upstreams are checked: the shorter of
+// the readiness and latency probe intervals that are enabled, or 0
+func upstreamCheckInterval(cfg *config.Config) time.Duration {
+	seconds := 0
+	for _, s := range []int{cfg.ReadinessPingInterval, cfg.UpstreamProbeInterval} {
+		if s > 0 && (seconds == 0 || s < seconds) {
+			seconds = s
+		}
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runHealthcheck implements the healthcheck subcommand: it queries the health
+// server of a proxy running in the same container and returns the exit code
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	port := fs.Int("health-port", getEnvOrDefaultInt("HEALTH_PORT", 8080), "Health check HTTP server port of the running proxy")
+	path := fs.String("path", "/readyz", "Endpoint to query, e.g. /livez or /readyz")
+	timeout := fs.Duration("timeout", 3*time.Second, "Request timeout")
+	quiet := fs.Bool("quiet", false, "Do not print the failure reason")
+	fs.Parse(args)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", *port, *path)
+	if err := health.Check(context.Background(), url, *timeout); err != nil {
+		if !*quiet {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// runBench implements the bench subcommand: it drives GET/SET load through a
+// proxy port, or directly against an instance for comparison, and prints
+// throughput and latency percentiles
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var opts bench.Options
+	fs.StringVar(&opts.Addr, "addr", "127.0.0.1:6379", "Address to benchmark: a local proxy port, or an instance endpoint to compare against")
+	fs.IntVar(&opts.Clients, "clients", 50, "Concurrent connections")
+	fs.IntVar(&opts.Requests, "requests", 100000, "Requests per test, across all connections")
+	fs.IntVar(&opts.Pipeline, "pipeline", 1, "Requests sent per round trip on each connection")
+	fs.IntVar(&opts.DataSize, "data-size", 64, "SET value size in bytes")
+	fs.IntVar(&opts.Keyspace, "keyspace", 10000, "Number of distinct bench:<n> keys to pick from at random")
+	fs.StringVar(&opts.Password, "password", os.Getenv("BENCH_PASSWORD"), "Password or access token sent with AUTH on each connection (not needed through the proxy)")
+	fs.BoolVar(&opts.TLS, "tls", false, "Connect with TLS (for direct connections to an instance with transit encryption)")
+	fs.BoolVar(&opts.TLSSkipVerify, "tls-skip-verify", false, "Skip TLS certificate verification")
+	fs.DurationVar(&opts.Timeout, "timeout", 5*time.Second, "Timeout for connecting and for each round trip")
+	tests := fs.String("tests", strings.Join(bench.Tests, ","), "Comma-separated tests to run in order: "+strings.Join(bench.Tests, ", "))
+	fs.Parse(args)
+
+	fmt.Printf("Benchmarking %s: %d connections, %d requests per test, pipeline %d, %d-byte values\n",
+		opts.Addr, opts.Clients, opts.Requests, opts.Pipeline, opts.DataSize)
+	for test := range strings.SplitSeq(*tests, ",") {
+		result, err := bench.Run(context.Background(), strings.ToLower(strings.TrimSpace(test)), opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		result.Report(os.Stdout)
+	}
+	return 0
+}
+
+// defaultPodName returns the hostname, which is the pod name in Kubernetes
+func defaultPodName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "memstore-proxy"
+	}
+	return hostname
+}
+
+// loadClientCertificate loads the TLS client certificate from -tls-client-cert
+// and -tls-client-key, or from -tls-client-secret
+func loadClientCertificate(ctx context.Context, cfg *config.Config) (tls.Certificate, error) {
+	if cfg.TLSClientSecret == "" {
+		return tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+	}
+	ts, err := auth.TokenSource(ctx, cfg.ImpersonateServiceAccount)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	secret, err := auth.NewSecretReader(ts, cfg.TLSClientSecret)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	data, err := secret.Read(ctx)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// Both halves are looked up in the one payload by their PEM block types
+	return tls.X509KeyPair([]byte(data), []byte(data))
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -189,6 +902,40 @@ func getEnvOrDefaultInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvOrDefaultFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var floatValue float64
+	if _, err := fmt.Sscanf(value, "%g", &floatValue); err == nil {
+		return floatValue
+	}
+	return defaultValue
+}
+
+// instanceSummary converts discovery results into the credential-free form served on /instance
+func instanceSummary(name string, info *discovery.InstanceInfo, cfg *config.Config) *health.InstanceInfo {
+	summary := &health.InstanceInfo{
+		Name:                  name,
+		Type:                  info.InstanceType,
+		TransitEncryptionMode: info.TransitEncryptionMode,
+		AuthorizationMode:     info.AuthorizationMode,
+		RequiresTLS:           info.RequiresTLS,
+		CAFingerprints:        info.CAFingerprints(),
+		DiscoveredAt:          time.Now(),
+	}
+	for i, ep := range info.Endpoints {
+		summary.Endpoints = append(summary.Endpoints, health.InstanceEndpoint{
+			Host:      ep.Host,
+			Port:      ep.Port,
+			Type:      ep.Type,
+			LocalAddr: cfg.ListenAddr(cfg.StartPort + i),
+		})
+	}
+	return summary
+}
+
 // resolveInstanceName converts a short instance name to full resource path if needed
 func resolveInstanceName(ctx context.Context, instanceName string) (string, error) {
 	// If already in full format, return as-is
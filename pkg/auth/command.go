@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenCommandTimeout bounds how long a token command may run
+const tokenCommandTimeout = 30 * time.Second
+
+// tokenCommandWaitDelay bounds how long the output of a token command that
+// exited (or was killed) is still read, as a process it left running in the
+// background may hold it open
+const tokenCommandWaitDelay = time.Second
+
+// commandTokenSource gets tokens by running a user-supplied shell command,
+// e.g. a custom credential broker. The command prints the token on the first
+// line of its output, optionally followed by its TTL in seconds on the second;
+// a token without a TTL never expires.
+type commandTokenSource struct {
+	command string
+}
+
+// CommandTokenSource returns a token source running command with sh -c and
+// reusing each token until the refresh margin before it expires
+func CommandTokenSource(command string) oauth2.TokenSource {
+	return reuseTokenSource(&commandTokenSource{command: command})
+}
+
+// Token implements oauth2.TokenSource
+func (s *commandTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = tokenCommandWaitDelay
+	start := time.Now()
+	// ErrWaitDelay means the command succeeded and its output was cut off
+	// after the delay
+	if err := cmd.Run(); err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("token command failed: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("token command failed: %w", err)
+	}
+	return parseCommandToken(stdout.String(), start)
+}
+
+// parseCommandToken parses the output of a token command run at start
+func parseCommandToken(output string, start time.Time) (*oauth2.Token, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	token := &oauth2.Token{AccessToken: strings.TrimSpace(lines[0])}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token command printed no token")
+	}
+	if len(lines) > 1 {
+		ttl, err := strconv.Atoi(strings.TrimSpace(lines[1]))
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("token command printed an invalid TTL %q: must be a positive number of seconds", strings.TrimSpace(lines[1]))
+		}
+		// Counted from when the command started, as it may have taken a while
+		token.Expiry = start.Add(time.Duration(ttl) * time.Second)
+	}
+	return token, nil
+}
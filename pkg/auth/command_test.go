@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTokenSource(t *testing.T) {
+	start := time.Now()
+	token, err := CommandTokenSource(`printf 'secret-token\n120\n'`).Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "secret-token" {
+		t.Errorf("Expected secret-token, got %q", token.AccessToken)
+	}
+	if ttl := token.Expiry.Sub(start); ttl < 119*time.Second || ttl > 121*time.Second {
+		t.Errorf("Expected the token to expire in 120s, got %s", ttl)
+	}
+
+	_, err = CommandTokenSource(`echo denied >&2; exit 3`).Token()
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("Expected the command's error output in the error, got %v", err)
+	}
+}
+
+func TestCommandTokenWithBackgroundProcess(t *testing.T) {
+	// The background sleep keeps the command's stdout open after it exited
+	start := time.Now()
+	token, err := CommandTokenSource(`echo bg-token; sleep 20 &`).Token()
+	if err != nil {
+		t.Fatalf("Token failed: %v", err)
+	}
+	if token.AccessToken != "bg-token" {
+		t.Errorf("Expected bg-token, got %q", token.AccessToken)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected Token not to wait for the background process, took %s", elapsed)
+	}
+}
+
+func TestCommandTokenRenewedBeforeRefreshMargin(t *testing.T) {
+	// $$ differs between runs, so a reused token is told apart from a new one
+	for _, tt := range []struct {
+		ttl   time.Duration
+		reuse bool
+	}{
+		{time.Hour, true},
+		{tokenRefreshMargin - time.Minute, false},
+	} {
+		source := CommandTokenSource(fmt.Sprintf(`echo "token-$$"; echo %d`, int(tt.ttl.Seconds())))
+		first, err := source.Token()
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		second, err := source.Token()
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		if reused := first.AccessToken == second.AccessToken; reused != tt.reuse {
+			t.Errorf("Expected a token living %s to be reused=%v, got %q then %q", tt.ttl, tt.reuse, first.AccessToken, second.AccessToken)
+		}
+	}
+}
+
+func TestParseCommandToken(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name   string
+		output string
+		token  string
+		ttl    time.Duration
+		fails  bool
+	}{
+		{"token only", "abc\n", "abc", 0, false},
+		{"token and ttl", "abc\n3600\n", "abc", time.Hour, false},
+		{"surrounding whitespace", "\n  abc  \r\n 60 \n", "abc", time.Minute, false},
+		{"empty", "\n", "", 0, true},
+		{"invalid ttl", "abc\nsoon\n", "", 0, true},
+		{"negative ttl", "abc\n-5\n", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := parseCommandToken(tt.output, start)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got token %q", token.AccessToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if token.AccessToken != tt.token {
+				t.Errorf("Expected token %q, got %q", tt.token, token.AccessToken)
+			}
+			if tt.ttl == 0 && !token.Expiry.IsZero() {
+				t.Errorf("Expected no expiry, got %s", token.Expiry)
+			}
+			if tt.ttl != 0 && !token.Expiry.Equal(start.Add(tt.ttl)) {
+				t.Errorf("Expected expiry after %s, got %s", tt.ttl, token.Expiry.Sub(start))
+			}
+		})
+	}
+}
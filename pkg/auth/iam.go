@@ -2,35 +2,193 @@
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+)
+
+var (
+	// tokenFetches counts GetToken calls; tokenRefreshes counts how often a new token was issued
+	tokenFetches   = expvar.NewInt("token_fetches")
+	tokenRefreshes = expvar.NewInt("token_refreshes")
+)
+
+// Token refresh timing
+const (
+	tokenRefreshMargin = 5 * time.Minute  // The refresher starts renewing a token this long before it expires
+	tokenExpiryDelta   = 10 * time.Second // A cached token this close to expiry is no longer handed out, as in oauth2
+	tokenRetryMin      = time.Second      // First wait after a failed refresh, doubled up to tokenRetryMax
+	tokenRetryMax      = 30 * time.Second
 )
 
 // IAMTokenProvider provides GCP IAM tokens for authentication
+// It also implements prometheus.Collector for token fetch and refresh metrics.
 type IAMTokenProvider struct {
 	tokenSource oauth2.TokenSource
+	lastToken   string    // Used to detect when the underlying source refreshed the token
+	expiry      time.Time // Expiry of the current token
+	mu          sync.Mutex
+
+	// While the background refresher runs, GetToken hands out lastToken
+	// instead of asking the source, which blocks while it obtains a new token
+	refreshing   atomic.Bool
+	startRefresh sync.Once
+
+	fetches        atomic.Uint64
+	fetchErrors    atomic.Uint64
+	refreshes      atomic.Uint64
+	refreshErrors  atomic.Uint64 // Failed background refreshes
+	refreshLatency prometheus.Histogram
 }
 
-// NewIAMTokenProvider creates a new IAM token provider
-func NewIAMTokenProvider(ctx context.Context) (*IAMTokenProvider, error) {
-	// Get default credentials with cloud-platform scope
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+// NewIAMTokenProvider creates a new IAM token provider for the application
+// default credentials, or for serviceAccount impersonated by them if it isn't empty
+func NewIAMTokenProvider(ctx context.Context, serviceAccount string) (*IAMTokenProvider, error) {
+	ts, err := TokenSource(ctx, serviceAccount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get default credentials: %w", err)
+		return nil, err
 	}
+	return NewIAMTokenProviderFromSource(ts), nil
+}
 
+// NewIAMTokenProviderFromSource creates an IAM token provider that gets its
+// tokens from ts
+func NewIAMTokenProviderFromSource(ts oauth2.TokenSource) *IAMTokenProvider {
 	return &IAMTokenProvider{
-		tokenSource: creds.TokenSource,
-	}, nil
+		tokenSource:    ts,
+		refreshLatency: newRefreshLatencyHistogram(),
+	}
 }
 
-// GetToken returns a fresh IAM token
+// GetToken returns a fresh IAM token. With the background refresher running
+// it is the cached token, unless that one is about to expire.
 func (p *IAMTokenProvider) GetToken(ctx context.Context) (string, error) {
+	token, _, err := p.GetTokenWithExpiry(ctx)
+	return token, err
+}
+
+// GetTokenWithExpiry is GetToken that also returns when the token expires,
+// or the zero time if the source didn't say
+func (p *IAMTokenProvider) GetTokenWithExpiry(ctx context.Context) (string, time.Time, error) {
+	tokenFetches.Add(1)
+	if p.refreshing.Load() {
+		if token, expiry, ok := p.cached(time.Now()); ok {
+			p.fetches.Add(1)
+			return token, expiry, nil
+		}
+	}
+	token, err := p.fetch()
+	if err != nil {
+		p.fetchErrors.Add(1)
+		return "", time.Time{}, err
+	}
+	p.fetches.Add(1)
+	return token.AccessToken, token.Expiry, nil
+}
+
+// Expiry returns when the current token expires, or the zero time if unknown
+func (p *IAMTokenProvider) Expiry() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiry
+}
+
+// cached returns the last token and its expiry if it is still valid at now
+func (p *IAMTokenProvider) cached(now time.Time) (string, time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastToken == "" || (!p.expiry.IsZero() && p.expiry.Sub(now) <= tokenExpiryDelta) {
+		return "", time.Time{}, false
+	}
+	return p.lastToken, p.expiry, true
+}
+
+// fetch asks the token source for a token and records it if it is new
+func (p *IAMTokenProvider) fetch() (*oauth2.Token, error) {
+	start := time.Now()
 	token, err := p.tokenSource.Token()
 	if err != nil {
-		return "", fmt.Errorf("failed to get token: %w", err)
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	p.mu.Lock()
+	if token.AccessToken != p.lastToken {
+		// The source only blocks when it had to obtain a new token, so this
+		// call's duration is the refresh latency
+		p.refreshLatency.Observe(time.Since(start).Seconds())
+		p.lastToken = token.AccessToken
+		p.expiry = token.Expiry
+		p.refreshes.Add(1)
+		tokenRefreshes.Add(1)
+		logger.AddSecret(token.AccessToken)
+	}
+	p.mu.Unlock()
+	return token, nil
+}
+
+// Start runs a background refresher that keeps a valid token cached until
+// ctx is cancelled, so a slow metadata server or STS doesn't stall the
+// connections that need a token. Only the first call starts it.
+func (p *IAMTokenProvider) Start(ctx context.Context) {
+	p.startRefresh.Do(func() {
+		p.refreshing.Store(true)
+		go p.refresh(ctx)
+	})
+}
+
+// refresh fetches a token right away and then again shortly before each one
+// expires, retrying failures with backoff
+func (p *IAMTokenProvider) refresh(ctx context.Context) {
+	defer p.refreshing.Store(false)
+
+	retry := tokenRetryMin
+	for {
+		wait := retry
+		token, err := p.fetch()
+		if err != nil {
+			p.refreshErrors.Add(1)
+			logger.Error(fmt.Sprintf("Failed to refresh the IAM token, retrying in %s: %v", retry, err))
+			retry = min(retry*2, tokenRetryMax)
+		} else {
+			retry = tokenRetryMin
+			wait = nextRefresh(token.Expiry, time.Now())
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// reuseTokenSource returns a token source reusing the tokens of src until
+// tokenRefreshMargin before they expire. With oauth2's default of 10 seconds
+// the refresher would get the current token back until it is almost expired.
+// Tokens living less than the margin are obtained anew on every call.
+func reuseTokenSource(src oauth2.TokenSource) oauth2.TokenSource {
+	return oauth2.ReuseTokenSourceWithExpiry(nil, src, tokenRefreshMargin)
+}
+
+// nextRefresh returns how long to wait before refreshing a token expiring at
+// expiry. Within tokenRefreshMargin of expiry the source is asked more and
+// more often: sources that cache tokens keep returning the current one until
+// shortly before it expires.
+func nextRefresh(expiry, now time.Time) time.Duration {
+	if expiry.IsZero() {
+		return tokenRefreshMargin
+	}
+	left := expiry.Sub(now)
+	if left > 2*tokenRefreshMargin {
+		return left - tokenRefreshMargin
 	}
-	return token.AccessToken, nil
+	return max(left/4, tokenRetryMin)
 }
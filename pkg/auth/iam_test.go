@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// countingTokenSource returns token and counts the calls
+type countingTokenSource struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+	calls int
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	return s.token, nil
+}
+
+func (s *countingTokenSource) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestBackgroundRefresherCachesToken(t *testing.T) {
+	source := &countingTokenSource{token: &oauth2.Token{AccessToken: "cached", Expiry: time.Now().Add(time.Hour)}}
+	p := NewIAMTokenProviderFromSource(source)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, ok := p.cached(time.Now()); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for range 10 {
+		token, err := p.GetToken(context.Background())
+		if err != nil || token != "cached" {
+			t.Fatalf("Expected the cached token, got %q, %v", token, err)
+		}
+	}
+	if calls := source.callCount(); calls != 1 {
+		t.Errorf("Expected only the refresher to ask the source, got %d calls", calls)
+	}
+
+	// A token about to expire isn't handed out; it is fetched inline instead
+	p.mu.Lock()
+	p.expiry = time.Now().Add(time.Second)
+	p.mu.Unlock()
+	if _, err := p.GetToken(context.Background()); err != nil {
+		t.Fatalf("GetToken failed: %v", err)
+	}
+	if calls := source.callCount(); calls != 2 {
+		t.Errorf("Expected an expiring token to be fetched again, got %d calls", calls)
+	}
+}
+
+func TestNextRefresh(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		left time.Duration
+		want time.Duration
+	}{
+		{time.Hour, time.Hour - tokenRefreshMargin},
+		{8 * time.Minute, 2 * time.Minute},
+		{2 * time.Second, tokenRetryMin},
+		{-time.Minute, tokenRetryMin},
+	}
+	for _, tt := range tests {
+		if got := nextRefresh(now.Add(tt.left), now); got != tt.want {
+			t.Errorf("Token expiring in %s: expected a refresh in %s, got %s", tt.left, tt.want, got)
+		}
+	}
+	if got := nextRefresh(time.Time{}, now); got != tokenRefreshMargin {
+		t.Errorf("Expected a token without expiry to be refreshed in %s, got %s", tokenRefreshMargin, got)
+	}
+}
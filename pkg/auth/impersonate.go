@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// iamCredentialsURL is the IAM Credentials API endpoint issuing access
+	// tokens of other service accounts
+	iamCredentialsURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/"
+
+	impersonatedTokenLifetime = time.Hour
+)
+
+// TokenSource returns a token source with cloud-platform scope for the
+// application default credentials or, if serviceAccount isn't empty, for
+// that service account impersonated by them
+func TokenSource(ctx context.Context, serviceAccount string) (oauth2.TokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default credentials: %w", err)
+	}
+	if serviceAccount == "" {
+		return reuseTokenSource(creds.TokenSource), nil
+	}
+	return newImpersonatedTokenSource(creds.TokenSource, serviceAccount, iamCredentialsURL), nil
+}
+
+// impersonatedTokenSource gets tokens of a service account from the IAM
+// Credentials API, authorized by the identity of base. The caller needs
+// roles/iam.serviceAccountTokenCreator on the service account.
+type impersonatedTokenSource struct {
+	client         *http.Client
+	serviceAccount string
+	url            string
+}
+
+// newImpersonatedTokenSource returns a token source impersonating
+// serviceAccount that reuses each token until the refresh margin before it expires
+func newImpersonatedTokenSource(base oauth2.TokenSource, serviceAccount, endpoint string) oauth2.TokenSource {
+	return reuseTokenSource(&impersonatedTokenSource{
+		client:         oauth2.NewClient(context.Background(), base),
+		serviceAccount: serviceAccount,
+		url:            endpoint + url.PathEscape(serviceAccount) + ":generateAccessToken",
+	})
+}
+
+// Token implements oauth2.TokenSource
+func (s *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	body, err := json.Marshal(map[string]any{
+		"scope":    []string{cloudPlatformScope},
+		"lifetime": fmt.Sprintf("%ds", int(impersonatedTokenLifetime.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", s.serviceAccount, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %w", s.serviceAccount, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to impersonate %s: status %d: %s", s.serviceAccount, resp.StatusCode, bytes.TrimSpace(data))
+	}
+
+	var token struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to decode impersonated token: %w", err)
+	}
+	return &oauth2.Token{AccessToken: token.AccessToken, TokenType: "Bearer", Expiry: token.ExpireTime}, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestImpersonatedTokenSource(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != http.MethodPost || r.URL.Path != "/proxy@project.iam.gserviceaccount.com:generateAccessToken" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer caller" {
+			t.Errorf("Expected the caller's token, got %q", got)
+		}
+		var body struct {
+			Scope    []string `json:"scope"`
+			Lifetime string   `json:"lifetime"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Scope) != 1 || body.Scope[0] != cloudPlatformScope {
+			t.Errorf("Unexpected request body %+v: %v", body, err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"accessToken": "impersonated", "expireTime": expiry.Format(time.RFC3339)})
+	}))
+	defer server.Close()
+
+	base := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "caller"})
+	ts := newImpersonatedTokenSource(base, "proxy@project.iam.gserviceaccount.com", server.URL+"/")
+	for range 3 {
+		token, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		if token.AccessToken != "impersonated" || !token.Expiry.Equal(expiry) {
+			t.Errorf("Unexpected token %q expiring %s", token.AccessToken, token.Expiry)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected the token to be reused, got %d API calls", calls)
+	}
+}
+
+func TestImpersonatedTokenSourceError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"status": "PERMISSION_DENIED"}}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	base := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "caller"})
+	if _, err := newImpersonatedTokenSource(base, "proxy@project.iam.gserviceaccount.com", server.URL+"/").Token(); err == nil {
+		t.Fatal("Expected a denied impersonation to fail")
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tokenFetchesDesc = prometheus.NewDesc(
+		"memstore_proxy_token_fetches_total",
+		"Total IAM token requests, by result.",
+		[]string{"result"}, nil,
+	)
+	tokenRefreshesDesc = prometheus.NewDesc(
+		"memstore_proxy_token_refreshes_total",
+		"Total times a new IAM access token was issued.",
+		nil, nil,
+	)
+	tokenRefreshErrorsDesc = prometheus.NewDesc(
+		"memstore_proxy_token_refresh_errors_total",
+		"Total failed background IAM token refreshes.",
+		nil, nil,
+	)
+	tokenExpiryDesc = prometheus.NewDesc(
+		"memstore_proxy_token_expiry_seconds",
+		"Seconds until the current IAM access token expires.",
+		nil, nil,
+	)
+)
+
+// refreshLatencyBuckets span 10ms to ~10s for metadata server and STS round trips
+var refreshLatencyBuckets = prometheus.ExponentialBuckets(0.01, 2, 11)
+
+// newRefreshLatencyHistogram creates the histogram of token fetches that issued a new token
+func newRefreshLatencyHistogram() prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "memstore_proxy_token_refresh_duration_seconds",
+		Help:    "Time taken to obtain a new IAM access token.",
+		Buckets: refreshLatencyBuckets,
+	})
+}
+
+// Describe implements prometheus.Collector
+func (p *IAMTokenProvider) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokenFetchesDesc
+	ch <- tokenRefreshesDesc
+	ch <- tokenRefreshErrorsDesc
+	ch <- tokenExpiryDesc
+	p.refreshLatency.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (p *IAMTokenProvider) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(tokenFetchesDesc, prometheus.CounterValue,
+		float64(p.fetches.Load()), "success")
+	ch <- prometheus.MustNewConstMetric(tokenFetchesDesc, prometheus.CounterValue,
+		float64(p.fetchErrors.Load()), "error")
+	ch <- prometheus.MustNewConstMetric(tokenRefreshesDesc, prometheus.CounterValue,
+		float64(p.refreshes.Load()))
+	ch <- prometheus.MustNewConstMetric(tokenRefreshErrorsDesc, prometheus.CounterValue,
+		float64(p.refreshErrors.Load()))
+
+	p.mu.Lock()
+	expiry := p.expiry
+	p.mu.Unlock()
+	if !expiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(tokenExpiryDesc, prometheus.GaugeValue,
+			time.Until(expiry).Seconds())
+	}
+
+	p.refreshLatency.Collect(ch)
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource returns the queued tokens in order, then errors
+type fakeTokenSource struct {
+	tokens []*oauth2.Token
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	if len(f.tokens) == 0 {
+		return nil, errors.New("metadata server unavailable")
+	}
+	token := f.tokens[0]
+	if len(f.tokens) > 1 {
+		f.tokens = f.tokens[1:]
+	}
+	return token, nil
+}
+
+func TestTokenMetrics(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+	source := &fakeTokenSource{tokens: []*oauth2.Token{
+		{AccessToken: "token-one", Expiry: expiry},
+		{AccessToken: "token-one", Expiry: expiry},
+		{AccessToken: "token-two", Expiry: expiry},
+	}}
+	p := NewIAMTokenProviderFromSource(source)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.GetToken(context.Background()); err != nil {
+			t.Fatalf("GetToken failed: %v", err)
+		}
+	}
+	source.tokens = nil
+	if _, err := p.GetToken(context.Background()); err == nil {
+		t.Fatal("Expected error from empty token source")
+	}
+
+	expected := `
+# HELP memstore_proxy_token_fetches_total Total IAM token requests, by result.
+# TYPE memstore_proxy_token_fetches_total counter
+memstore_proxy_token_fetches_total{result="error"} 1
+memstore_proxy_token_fetches_total{result="success"} 3
+# HELP memstore_proxy_token_refreshes_total Total times a new IAM access token was issued.
+# TYPE memstore_proxy_token_refreshes_total counter
+memstore_proxy_token_refreshes_total 2
+`
+	if err := testutil.CollectAndCompare(p, strings.NewReader(expected),
+		"memstore_proxy_token_fetches_total", "memstore_proxy_token_refreshes_total"); err != nil {
+		t.Error(err)
+	}
+
+	// fetches (2) + refreshes + refresh errors + expiry + refresh latency histogram
+	if count := testutil.CollectAndCount(p); count != 6 {
+		t.Errorf("Expected 6 metrics, got %d", count)
+	}
+}
+
+func TestTokenExpiryOmittedBeforeFirstToken(t *testing.T) {
+	p := NewIAMTokenProviderFromSource(&fakeTokenSource{})
+	if count := testutil.CollectAndCount(p, "memstore_proxy_token_expiry_seconds"); count != 0 {
+		t.Errorf("Expected no expiry metric before a token is fetched, got %d", count)
+	}
+}
+
+func TestTokenExpvars(t *testing.T) {
+	fetches, refreshes := tokenFetches.Value(), tokenRefreshes.Value()
+	expiry := time.Now().Add(time.Hour)
+	p := NewIAMTokenProviderFromSource(&fakeTokenSource{tokens: []*oauth2.Token{
+		{AccessToken: "expvar-one", Expiry: expiry},
+		{AccessToken: "expvar-one", Expiry: expiry},
+		{AccessToken: "expvar-two", Expiry: expiry},
+	}})
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.GetToken(context.Background()); err != nil {
+			t.Fatalf("GetToken failed: %v", err)
+		}
+	}
+	if got := tokenFetches.Value() - fetches; got != 3 {
+		t.Errorf("Expected token_fetches to grow by 3, got %d", got)
+	}
+	if got := tokenRefreshes.Value() - refreshes; got != 2 {
+		t.Errorf("Expected token_refreshes to grow by 2, got %d", got)
+	}
+}
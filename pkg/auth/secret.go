@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// secretManagerURL is the Secret Manager API endpoint
+const secretManagerURL = "https://secretmanager.googleapis.com/v1/"
+
+// SecretReader reads a Secret Manager secret, e.g. an instance password
+// mirrored into it by policy
+type SecretReader struct {
+	client  *http.Client
+	version string // projects/.../secrets/.../versions/...
+	url     string
+}
+
+// NewSecretReader returns a reader of secret, given as
+// projects/PROJECT/secrets/NAME, which reads its latest version, or with
+// /versions/VERSION appended, authorized by tokens of ts
+func NewSecretReader(ts oauth2.TokenSource, secret string) (*SecretReader, error) {
+	parts := strings.Split(secret, "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "projects" && parts[2] == "secrets":
+		secret += "/versions/latest"
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "secrets" && parts[4] == "versions":
+	default:
+		return nil, fmt.Errorf("invalid secret name %q: must be projects/PROJECT/secrets/NAME[/versions/VERSION]", secret)
+	}
+	return &SecretReader{client: oauth2.NewClient(context.Background(), ts), version: secret, url: secretManagerURL}, nil
+}
+
+// Read returns the payload of the secret version
+func (r *SecretReader) Read(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+r.version+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to access %s: %w", r.version, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to access %s: %w", r.version, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to access %s: status %d: %s", r.version, resp.StatusCode, bytes.TrimSpace(data))
+	}
+
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", r.version, err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", r.version, err)
+	}
+	// Secrets created from files often end with a newline that isn't part of the password
+	return strings.TrimRight(string(payload), "\r\n"), nil
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSecretReader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/p/secrets/redis-auth/versions/latest:access" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer caller" {
+			t.Errorf("Expected the caller's token, got %q", got)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"name":    "projects/p/secrets/redis-auth/versions/3",
+			"payload": map[string]string{"data": base64.StdEncoding.EncodeToString([]byte("hunter2\n"))},
+		})
+	}))
+	defer server.Close()
+
+	r, err := NewSecretReader(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "caller"}), "projects/p/secrets/redis-auth")
+	if err != nil {
+		t.Fatalf("NewSecretReader failed: %v", err)
+	}
+	r.url = server.URL + "/"
+	password, err := r.Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if password != "hunter2" {
+		t.Errorf("Expected hunter2 without the trailing newline, got %q", password)
+	}
+}
+
+func TestSecretReaderName(t *testing.T) {
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "caller"})
+	for name, want := range map[string]string{
+		"projects/p/secrets/s":            "projects/p/secrets/s/versions/latest",
+		"projects/p/secrets/s/versions/2": "projects/p/secrets/s/versions/2",
+		"s":                               "",
+		"projects/p/secrets":              "",
+		"projects/p/instances/s":          "",
+	} {
+		r, err := NewSecretReader(ts, name)
+		if want == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected", name)
+			}
+			continue
+		}
+		if err != nil || r.version != want {
+			t.Errorf("%q: expected %q, got %+v, %v", name, want, r, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package bench drives GET/SET load through a proxy port (or directly against
+// an instance) and measures throughput and request latency, so the proxy's
+// overhead can be checked without installing redis-benchmark.
+package bench
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/proxy"
+)
+
+// Tests lists the supported load types
+var Tests = []string{"set", "get"}
+
+// keyPrefix keeps benchmark keys apart from application data
+const keyPrefix = "bench:"
+
+// Options configures a benchmark run
+type Options struct {
+	Addr          string
+	Clients       int // Concurrent connections
+	Requests      int // Requests per test, across all clients
+	Pipeline      int // Requests sent per round trip
+	DataSize      int // SET value size in bytes
+	Keyspace      int // Keys are picked at random from this many
+	Password      string
+	TLS           bool
+	TLSSkipVerify bool
+	Timeout       time.Duration // Per round trip
+}
+
+// Result holds the measurements of one test
+type Result struct {
+	Test      string
+	Requests  int
+	Errors    int // Error replies
+	Duration  time.Duration
+	latencies []time.Duration // Sorted
+}
+
+// Throughput returns the completed requests per second
+func (r *Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Duration.Seconds()
+}
+
+// Percentile returns the request latency below which p percent of requests completed
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies)-1) * p / 100)
+	return r.latencies[i]
+}
+
+// Report writes a human readable summary
+func (r *Result) Report(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d requests in %s, %.0f requests/s, %d errors\n",
+		strings.ToUpper(r.Test), r.Requests, r.Duration.Round(time.Millisecond), r.Throughput(), r.Errors)
+	fmt.Fprintf(w, "  latency p50 %s  p95 %s  p99 %s  max %s\n",
+		formatLatency(r.Percentile(50)), formatLatency(r.Percentile(95)),
+		formatLatency(r.Percentile(99)), formatLatency(r.Percentile(100)))
+}
+
+// formatLatency rounds a latency to a readable precision
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(10 * time.Microsecond).String()
+}
+
+// Run runs one test with opts and returns its measurements. It fails if a
+// connection can't be established or breaks; error replies are only counted.
+func Run(ctx context.Context, test string, opts Options) (*Result, error) {
+	if !slices.Contains(Tests, test) {
+		return nil, fmt.Errorf("unknown test %q (supported: %s)", test, strings.Join(Tests, ", "))
+	}
+	if opts.Clients <= 0 || opts.Requests <= 0 || opts.Pipeline <= 0 || opts.Keyspace <= 0 || opts.DataSize < 0 {
+		return nil, errors.New("clients, requests, pipeline and keyspace must be positive")
+	}
+
+	conns := make([]net.Conn, min(opts.Clients, opts.Requests))
+	for i := range conns {
+		conn, err := dial(ctx, opts)
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns[i] = conn
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var remaining atomic.Int64
+	remaining.Store(int64(opts.Requests))
+	value := strings.Repeat("x", opts.DataSize)
+
+	clients := make([]client, len(conns))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			c := &clients[i]
+			c.conn, c.reader = conn, proxy.NewRESPReader(conn)
+			if errs[i] = c.run(ctx, test, value, &remaining, opts); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := &Result{Test: test, Duration: time.Since(start)}
+	for _, c := range clients {
+		result.Requests += len(c.latencies)
+		result.Errors += c.errors
+		result.latencies = append(result.latencies, c.latencies...)
+	}
+	slices.Sort(result.latencies)
+	return result, errors.Join(errs...)
+}
+
+// client is one benchmark connection
+type client struct {
+	conn      net.Conn
+	reader    *proxy.RESPReader
+	latencies []time.Duration
+	errors    int
+}
+
+// run sends pipelined requests until the shared request budget is used up
+func (c *client) run(ctx context.Context, test, value string, remaining *atomic.Int64, opts Options) error {
+	var batch []byte
+	for ctx.Err() == nil {
+		n := int(min(remaining.Add(-int64(opts.Pipeline))+int64(opts.Pipeline), int64(opts.Pipeline)))
+		if n <= 0 {
+			return nil
+		}
+
+		batch = batch[:0]
+		for range n {
+			key := keyPrefix + strconv.Itoa(rand.IntN(opts.Keyspace))
+			if test == "set" {
+				batch = appendCommand(batch, "SET", key, value)
+			} else {
+				batch = appendCommand(batch, "GET", key)
+			}
+		}
+
+		c.conn.SetDeadline(time.Now().Add(opts.Timeout))
+		sent := time.Now()
+		if _, err := c.conn.Write(batch); err != nil {
+			return fmt.Errorf("failed to send requests: %w", err)
+		}
+		for range n {
+			reply, err := c.reader.ReadValue()
+			if err != nil {
+				return fmt.Errorf("failed to read reply: %w", err)
+			}
+			c.latencies = append(c.latencies, time.Since(sent))
+			if reply.Type == proxy.Error {
+				c.errors++
+			}
+		}
+	}
+	return nil
+}
+
+// appendCommand appends a RESP array of bulk strings
+func appendCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// dial connects and authenticates one benchmark connection
+func dial(ctx context.Context, opts Options) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", opts.Addr, err)
+	}
+	if opts.TLS {
+		host, _, _ := net.SplitHostPort(opts.Addr)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         host,
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opts.TLSSkipVerify,
+		})
+		hsCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		err := tlsConn.HandshakeContext(hsCtx)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", opts.Addr, err)
+		}
+		conn = tlsConn
+	}
+
+	if opts.Password != "" {
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+		reply, err := roundTrip(conn, appendCommand(nil, "AUTH", opts.Password))
+		conn.SetDeadline(time.Time{})
+		if err == nil && reply.Type == proxy.Error {
+			err = errors.New(reply.Str)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("AUTH failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// roundTrip sends one request and reads its reply
+func roundTrip(conn net.Conn, request []byte) (*proxy.RESPValue, error) {
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	return proxy.NewRESPReader(conn).ReadValue()
+}
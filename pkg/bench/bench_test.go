@@ -0,0 +1,117 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/proxy"
+)
+
+// fakeServer answers SET with +OK, GET with the last value set and AUTH with
+// +OK for "secret"; it counts the requests it served
+func fakeServer(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var served atomic.Int64
+	var mu sync.Mutex
+	data := make(map[string]string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := proxy.NewRESPReader(conn)
+				for {
+					request, err := reader.ReadValue()
+					if err != nil {
+						return
+					}
+					var reply proxy.RESPValue
+					switch request.CommandName() {
+					case "AUTH":
+						reply = proxy.RESPValue{Type: proxy.SimpleString, Str: "OK"}
+						if request.Array[1].Str != "secret" {
+							reply = proxy.RESPValue{Type: proxy.Error, Str: "WRONGPASS invalid password"}
+						}
+					case "SET":
+						mu.Lock()
+						data[request.Array[1].Str] = request.Array[2].Str
+						mu.Unlock()
+						reply = proxy.RESPValue{Type: proxy.SimpleString, Str: "OK"}
+						served.Add(1)
+					case "GET":
+						mu.Lock()
+						value, ok := data[request.Array[1].Str]
+						mu.Unlock()
+						reply = proxy.RESPValue{Type: proxy.BulkString, Str: value, Null: !ok}
+						served.Add(1)
+					default:
+						reply = proxy.RESPValue{Type: proxy.Error, Str: "ERR unknown command"}
+					}
+					conn.Write(reply.Serialize())
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &served
+}
+
+func TestRun(t *testing.T) {
+	addr, served := fakeServer(t)
+	opts := Options{Addr: addr, Clients: 4, Requests: 1001, Pipeline: 8, DataSize: 16, Keyspace: 50, Password: "secret", Timeout: 5 * time.Second}
+
+	for _, test := range Tests {
+		result, err := Run(context.Background(), test, opts)
+		if err != nil {
+			t.Fatalf("%s failed: %v", test, err)
+		}
+		if result.Requests != opts.Requests || result.Errors != 0 {
+			t.Errorf("%s: expected %d requests without errors, got %d and %d errors", test, opts.Requests, result.Requests, result.Errors)
+		}
+		if result.Throughput() <= 0 || result.Percentile(50) <= 0 || result.Percentile(50) > result.Percentile(100) {
+			t.Errorf("%s: unexpected measurements %+v", test, result)
+		}
+
+		var out bytes.Buffer
+		result.Report(&out)
+		if !strings.HasPrefix(out.String(), strings.ToUpper(test)+": 1001 requests") || !strings.Contains(out.String(), "p99") {
+			t.Errorf("Unexpected report %q", out.String())
+		}
+	}
+	if n := served.Load(); n != 2*int64(opts.Requests) {
+		t.Errorf("Expected the server to see %d requests, got %d", 2*opts.Requests, n)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	addr, _ := fakeServer(t)
+	opts := Options{Addr: addr, Clients: 1, Requests: 1, Pipeline: 1, Keyspace: 1, Timeout: time.Second}
+
+	if _, err := Run(context.Background(), "incr", opts); err == nil {
+		t.Error("Expected an unknown test to be rejected")
+	}
+
+	opts.Password = "wrong"
+	if _, err := Run(context.Background(), "get", opts); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected an AUTH failure, got %v", err)
+	}
+
+	opts.Pipeline = 0
+	if _, err := Run(context.Background(), "get", opts); err == nil {
+		t.Error("Expected a zero pipeline to be rejected")
+	}
+}
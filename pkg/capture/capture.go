@@ -0,0 +1,126 @@
+// Package capture reads and writes recordings of proxied RESP traffic.
+//
+// A capture file holds one JSON object per line, each describing a single
+// RESP frame seen on a client connection after TLS termination. Frames of
+// concurrent connections are interleaved and told apart by ConnID.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame directions, as seen from the client
+const (
+	DirectionRequest  = "request"
+	DirectionResponse = "response"
+)
+
+// Record is one RESP frame captured on a proxied connection
+type Record struct {
+	ConnID    uint64    `json:"conn_id"`
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Data      []byte    `json:"data"` // RESP-encoded frame, base64 in the file
+}
+
+// Writer appends records to a capture file. It is safe for concurrent use.
+type Writer struct {
+	mu     sync.Mutex
+	closer io.Closer
+	enc    *json.Encoder
+}
+
+// Create opens (or appends to) a capture file. The file is only readable by
+// the owner since it holds application data.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	w := NewWriter(f)
+	w.closer = f
+	return w, nil
+}
+
+// NewWriter writes records to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// Write appends a single record
+func (w *Writer) Write(rec Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(rec)
+}
+
+// Close closes the underlying file, if the writer opened one
+func (w *Writer) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Reader reads records from a capture file
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// maxRecordSize bounds a single line; frames up to the server's 512MB bulk
+// limit would not fit, but captures of such values are not useful to replay
+const maxRecordSize = 64 * 1024 * 1024
+
+// NewReader reads records from r
+func NewReader(r io.Reader) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	return &Reader{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF at the end of the capture
+func (r *Reader) Next() (Record, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if len(r.scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(r.scanner.Bytes(), &rec); err != nil {
+			return Record{}, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Record{}, fmt.Errorf("line %d: %w", r.line+1, err)
+	}
+	return Record{}, io.EOF
+}
+
+// ReadAll groups the records of a capture by connection, in capture order.
+// The returned IDs list connections in the order they first appear.
+func ReadAll(r io.Reader) (map[uint64][]Record, []uint64, error) {
+	reader := NewReader(r)
+	conns := make(map[uint64][]Record)
+	var order []uint64
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return conns, order, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := conns[rec.ConnID]; !ok {
+			order = append(order, rec.ConnID)
+		}
+		conns[rec.ConnID] = append(conns[rec.ConnID], rec)
+	}
+}
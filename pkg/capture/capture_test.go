@@ -0,0 +1,60 @@
+package capture
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteAndReadAll(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{ConnID: 2, Time: now, Direction: DirectionRequest, Data: []byte("*1\r\n$4\r\nPING\r\n")},
+		{ConnID: 1, Time: now, Direction: DirectionRequest, Data: []byte("*1\r\n$4\r\nPING\r\n")},
+		{ConnID: 2, Time: now, Direction: DirectionResponse, Data: []byte("+PONG\r\n")},
+	}
+	for _, rec := range records {
+		if err := w.Write(rec); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	conns, order, err := ReadAll(&buf)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("Expected connections in first-seen order [2 1], got %v", order)
+	}
+	if len(conns[2]) != 2 || string(conns[2][1].Data) != "+PONG\r\n" {
+		t.Errorf("Unexpected records for connection 2: %+v", conns[2])
+	}
+}
+
+func TestReadAllInvalidLine(t *testing.T) {
+	if _, _, err := ReadAll(bytes.NewBufferString("{\"conn_id\":1}\nnot json\n")); err == nil {
+		t.Error("Expected error for malformed line")
+	}
+}
+
+func TestCreatePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	w, err := Create(path)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer w.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected mode 0600, got %o", perm)
+	}
+}
@@ -1,34 +1,329 @@
 package config
 
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
 // InstanceType represents the type of Memorystore instance
 type InstanceType string
 
 const (
-	InstanceTypeValkey InstanceType = "valkey"
-	InstanceTypeRedis  InstanceType = "redis"
+	InstanceTypeValkey       InstanceType = "valkey"
+	InstanceTypeRedis        InstanceType = "redis"
+	InstanceTypeRedisCluster InstanceType = "redis-cluster"
+	InstanceTypeAuto         InstanceType = "auto" // Detect the product via the Memorystore APIs
+)
+
+// ClusterMode selects whether the nodes of a cluster instance get listeners
+type ClusterMode string
+
+const (
+	ClusterModeAuto ClusterMode = "auto" // Probe CLUSTER INFO on the first endpoint at startup
+	ClusterModeOn   ClusterMode = "on"
+	ClusterModeOff  ClusterMode = "off"
+)
+
+// ClientAuthMode selects what the proxy does with the AUTH commands of clients
+type ClientAuthMode string
+
+const (
+	ClientAuthForward ClientAuthMode = "forward" // Sent to the upstream as is
+	ClientAuthIgnore  ClientAuthMode = "ignore"  // Answered with +OK by the proxy
+	ClientAuthReplace ClientAuthMode = "replace" // Sent with the proxy's IAM token or instance password instead
 )
 
 // Config holds the configuration for the proxy
 type Config struct {
-	InstanceName  string
-	InstanceType  InstanceType
-	LocalAddr     string
-	StartPort     int
-	HealthPort    int
-	APITimeout    int // Timeout for GCP API calls in seconds
-	Verbose       bool
-	TLSSkipVerify bool
+	InstanceName    string
+	InstanceType    InstanceType
+	LocalAddr       string
+	StartPort       int
+	HealthPort      int
+	QuitQuitQuit    bool // Enable POST /quitquitquit on the health port
+	DrainEndpoint   bool // Enable POST /drain on the health port
+	LogLevelPut     bool // Enable PUT /loglevel on the health port
+	DrainTimeout    int  // Seconds to wait for connections to finish on shutdown
+	APITimeout      int  // Timeout for GCP API calls in seconds
+	Verbose         bool
+	TLSSkipVerify   bool
+	TLSSessionCache int // TLS sessions cached per endpoint so reconnects resume them (0 disables)
+
+	// CACertFile and CACertDir supply the CA certificates the instance
+	// certificate is verified against, instead of the discovered one
+	CACertFile string
+	CACertDir  string
+	CARefresh  int // Seconds between re-reads of the server CA certificates, to follow their rotation (0 disables)
+
+	// TLSServerName is the name the instance certificate is verified for and
+	// sent in SNI; empty uses the endpoint address
+	TLSServerName string
+
+	// TLSPins are SHA-256 hashes of the public keys (SubjectPublicKeyInfo) the
+	// instance certificate must have one of; empty disables pinning
+	TLSPins [][32]byte
+
+	// TLSClientCert and TLSClientKey are PEM files of the client certificate
+	// presented to upstreams requiring mutual TLS; TLSClientSecret is a Secret
+	// Manager secret holding both instead
+	TLSClientCert   string
+	TLSClientKey    string
+	TLSClientSecret string
+
+	InspectCommands bool // Parse client requests and count commands by type
+	AuditLog        bool // Log every command with the client that issued it
+	ShedThreshold   int  // BUSY/LOADING/OOM errors within ShedWindow that trigger connection shedding (0 disables)
+	ShedWindow      int  // Window for counting overload errors in seconds
+	ShedCooldown    int  // How long to shed new connections once triggered in seconds
+
+	BreakerThreshold int // Consecutive upstream dial/AUTH failures that open the circuit (0 disables)
+	BreakerCooldown  int // Seconds the circuit stays open before a trial connection
+
+	MaintenanceResponder bool // Answer PING/INFO locally and -PROXYERR otherwise while the upstream can't be reached
+
+	ReadinessPingInterval int // Seconds between upstream PING checks gating /readyz (0 disables)
+	UpstreamProbeInterval int // Seconds between upstream latency measurements for /status (0 disables)
+
+	DialTimeout          int  // Seconds to wait for the TCP connection to an endpoint
+	TLSHandshakeTimeout  int  // Seconds to wait for the TLS handshake once connected
+	DialRetryWindow      int  // Seconds a client connection keeps retrying a failed upstream dial (0 disables retries)
+	KeepAlivePeriod      int  // Seconds between TCP keepalive probes on client and upstream connections (0 disables)
+	TCPUserTimeout       int  // Seconds sent data may stay unacknowledged before a connection is dropped (0 keeps the OS default)
+	HappyEyeballsDelay   int  // Milliseconds before also dialing the other address family of a dual-stack endpoint (negative disables)
+	TransparentReconnect bool // Re-dial and re-authenticate an upstream connection lost while its client is idle
+
+	PoolSize    int // Pre-authenticated upstream connections kept ready per endpoint (0 disables)
+	PoolMaxIdle int // Seconds a pooled connection may wait before it is replaced
+	Prewarm     int // Upstream connections opened per endpoint before the proxy reports ready
+
+	UpstreamPingInterval int // Seconds between PINGs on idle pooled and shared upstream connections (0 disables)
+
+	MuxConnections int  // Upstream connections shared by all clients of an endpoint (0 disables multiplexing)
+	ReadWriteSplit bool // Send reads received by the primary listener to the read-replica endpoints
+	RetryReads     bool // Retry reads the replica failed to answer on the primary, with ReadWriteSplit
+	BufferSize     int  // Size in bytes of the pooled relay buffers
+	ZeroCopy       bool // Relay plaintext TCP connections with splice(2) on Linux
+	MaxBulkSize    int  // Largest RESP bulk string accepted from clients or servers, in bytes
+	MaxArrayLength int  // Largest RESP array element count accepted
+
+	Cluster             ClusterMode // Whether to discover cluster nodes and give them listeners
+	ClusterReplicaReads bool        // Send READONLY on upstream connections to cluster replica nodes so they serve reads
+	PortStateFile       string      // If set, the local port of each cluster node is kept here across restarts
+	ClusterPortStart    int         // First local port of cluster node listeners; 0 continues after the endpoint ports
+	ClusterRouting      bool        // Route each request of the first endpoint's clients to the cluster node serving its key
+	FailoverInterval    int         // Seconds between cluster topology polls following failovers and new nodes (0 disables)
+	ReplicaMaxLag       int         // Replication offset bytes a replica may trail its master before reads stop going to it (0 disables)
+	ReplicaLagInterval  int         // Seconds between replication lag measurements
+
+	ClientName bool   // Name upstream connections after PodName and the client with CLIENT SETNAME
+	PodName    string // Proxy instance name used in upstream connection names
+
+	DefaultDB int // Logical database SELECTed on every new upstream connection (0 keeps the server default)
+
+	MaxConnections         int // Simultaneous client connections across all proxies (0 means unlimited)
+	MaxConnectionsPerProxy int // Simultaneous client connections per proxy listener (0 means unlimited)
+
+	// ListenerConnectionLimits overrides MaxConnectionsPerProxy for some
+	// listeners, keyed by local port ("6380") or endpoint type ("read-replica")
+	ListenerConnectionLimits map[string]int
+
+	// DeniedCommands are rejected by the proxy instead of forwarded: command
+	// names ("FLUSHALL") or command and subcommand ("CONFIG SET"), in upper case
+	DeniedCommands []string
+
+	ClientAuth ClientAuthMode // What happens to the AUTH commands of clients, as the proxy authenticates upstream connections itself
+	AuthUser   string         // ACL user upstream connections authenticate as (AUTH user credential); empty uses the default user
+
+	// ImpersonateServiceAccount is the service account whose tokens are used
+	// for IAM auth and the Memorystore APIs, obtained through the IAM
+	// Credentials API; empty uses the application default credentials directly
+	ImpersonateServiceAccount string
+
+	// TokenCommand is a shell command printing the AUTH token, and optionally
+	// its TTL in seconds on a second line, used instead of GCP IAM tokens
+	TokenCommand string
+
+	AuthSecret        string // Secret Manager secret (version) holding the upstream password; empty uses the discovered auth string
+	AuthSecretRefresh int    // Seconds between re-reads of AuthSecret (0 disables)
+	AuthStringRefresh int    // Seconds between re-fetches of the discovered Redis auth string (0 disables)
+
+	// AuthPasswordFile and AuthPassword (only from the environment, to keep it
+	// out of process listings) supply the upstream password directly, instead
+	// of discovery fetching the auth string
+	AuthPasswordFile string
+	AuthPassword     string
+
+	// CacheKeys are key patterns ("user:*", with * and ? wildcards) whose
+	// GET/MGET replies are cached by the proxy; empty disables the read cache
+	CacheKeys      []string
+	CacheMaxMemory int // Bytes of keys and values cached per endpoint
+
+	RecordDiscoveryDir string // If set, sanitized discovery API responses are written here
+	EnableTracing      bool   // Export OpenTelemetry traces via OTLP (configured by OTEL_* env vars)
+	StatsdAddr         string // StatsD/DogStatsD host:port; empty disables the emitter
+	StatsdInterval     int    // StatsD flush interval in seconds
+	StatsdTags         bool   // Send labels as DogStatsD tags
+	LogFormat          string // "text", "json" or "gcp"
+	LogOutput          string // "stdout" or "syslog"
+
+	CloudMonitoring         bool // Export metrics to Cloud Monitoring custom metrics
+	CloudMonitoringInterval int  // Cloud Monitoring export interval in seconds
+
+	DumpProtocol         bool    // Hex/ASCII dump RESP frames of sampled connections to stderr
+	DumpProtocolSample   float64 // Fraction of connections dumped (0-1)
+	DumpProtocolMaxValue int     // Bulk strings longer than this are truncated in dumps
+
+	CaptureFile   string  // If set, RESP traffic of sampled connections is recorded here for replay
+	CaptureSample float64 // Fraction of connections captured (0-1)
+
+	// Chaos injection, for testing client retry logic; never enable in production
+	ChaosLatency        int     // Milliseconds added before each request is forwarded
+	ChaosStall          int     // Milliseconds a stalled reply pauses midway
+	ChaosStallRate      float64 // Fraction of replies that stall (0-1)
+	ChaosDisconnectRate float64 // Fraction of requests that drop the client connection instead (0-1)
+	ChaosMovedRate      float64 // Fraction of keyed requests answered with MOVED instead (0-1)
 }
 
 // NewConfig creates a new configuration with default values
 func NewConfig() *Config {
 	return &Config{
-		InstanceType:  InstanceTypeValkey, // Default to Valkey
-		LocalAddr:     "127.0.0.1",
-		StartPort:     6379,
-		HealthPort:    8080,
-		APITimeout:    30, // 30 seconds default for API calls
-		Verbose:       false,
-		TLSSkipVerify: true, // Default to true for GCP Memorystore self-signed certs
+		InstanceType:        InstanceTypeValkey, // Default to Valkey
+		LocalAddr:           "127.0.0.1",
+		StartPort:           6379,
+		HealthPort:          8080,
+		DrainTimeout:        30,
+		APITimeout:          30, // 30 seconds default for API calls
+		Verbose:             false,
+		TLSSkipVerify:       true, // Default to true for GCP Memorystore self-signed certs
+		TLSSessionCache:     64,
+		CARefresh:           3600,
+		ShedWindow:          10,
+		ShedCooldown:        30,
+		BreakerCooldown:     10,
+		DialTimeout:         5,
+		TLSHandshakeTimeout: 5,
+		KeepAlivePeriod:     30,
+		HappyEyeballsDelay:  250,
+		PoolMaxIdle:         300,
+		BufferSize:          32 * 1024,
+		ZeroCopy:            true,
+		MaxBulkSize:         512 * 1024 * 1024,
+		MaxArrayLength:      1<<31 - 1,
+		CacheMaxMemory:      64 * 1024 * 1024,
+		LogFormat:           "text",
+		LogOutput:           "stdout",
+		StatsdInterval:      10,
+		StatsdTags:          true,
+
+		CloudMonitoringInterval: 60,
+		DumpProtocolSample:      1,
+		DumpProtocolMaxValue:    64,
+		CaptureSample:           1,
+		Cluster:                 ClusterModeAuto,
+		ClientAuth:              ClientAuthForward,
+		AuthSecretRefresh:       300,
+		AuthStringRefresh:       300,
+		ClusterReplicaReads:     true,
+		FailoverInterval:        10,
+		ReplicaLagInterval:      5,
+		ChaosStall:              1000,
+	}
+}
+
+// ChaosEnabled reports whether any chaos injection is configured
+func (c *Config) ChaosEnabled() bool {
+	return c.ChaosLatency > 0 || (c.ChaosStallRate > 0 && c.ChaosStall > 0) ||
+		c.ChaosDisconnectRate > 0 || c.ChaosMovedRate > 0
+}
+
+// ListenAddr returns the local address of the listener on port, with an
+// IPv6 LocalAddr in brackets
+func (c *Config) ListenAddr(port int) string {
+	return net.JoinHostPort(c.LocalAddr, strconv.Itoa(port))
+}
+
+// ConnectionLimit returns the client connection limit for the listener on
+// port serving an endpoint of the given type. A port entry takes precedence
+// over an endpoint type entry, which takes precedence over MaxConnectionsPerProxy.
+func (c *Config) ConnectionLimit(port int, endpointType string) int {
+	if limit, ok := c.ListenerConnectionLimits[strconv.Itoa(port)]; ok {
+		return limit
+	}
+	if limit, ok := c.ListenerConnectionLimits[endpointType]; ok {
+		return limit
+	}
+	return c.MaxConnectionsPerProxy
+}
+
+// ParseConnectionLimits parses a comma-separated list of key=limit pairs,
+// e.g. "6379=500,read-replica=100"
+func ParseConnectionLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid connection limit %q (expected port=limit or endpoint-type=limit)", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid connection limit %q: limit must be a non-negative integer", entry)
+		}
+		limits[key] = limit
+	}
+	return limits, nil
+}
+
+// ParseCacheKeys parses a comma-separated list of key patterns, e.g. "user:*,config:*"
+func ParseCacheKeys(s string) []string {
+	var patterns []string
+	for _, entry := range strings.Split(s, ",") {
+		if pattern := strings.TrimSpace(entry); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// ParseTLSPins parses a comma-separated list of base64 SHA-256 hashes of
+// certificate public keys, as printed by
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParseTLSPins(s string) ([][32]byte, error) {
+	var pins [][32]byte
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("invalid pin %q (expected a base64 SHA-256 hash)", entry)
+		}
+		pins = append(pins, [32]byte(hash))
+	}
+	return pins, nil
+}
+
+// ParseDeniedCommands parses a comma-separated list of commands, each a
+// command name or a command and subcommand, e.g. "FLUSHALL,CONFIG SET"
+func ParseDeniedCommands(s string) ([]string, error) {
+	var commands []string
+	for _, entry := range strings.Split(s, ",") {
+		words := strings.Fields(entry)
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) > 2 {
+			return nil, fmt.Errorf("invalid denied command %q (expected a command or a command and subcommand)", strings.TrimSpace(entry))
+		}
+		commands = append(commands, strings.ToUpper(strings.Join(words, " ")))
 	}
+	return commands, nil
 }
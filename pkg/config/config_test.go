@@ -1,6 +1,10 @@
 package config
 
-import "testing"
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
 
 func TestNewConfig(t *testing.T) {
 	cfg := NewConfig()
@@ -21,6 +25,10 @@ func TestNewConfig(t *testing.T) {
 	if cfg.Verbose != false {
 		t.Error("Expected Verbose to be false")
 	}
+
+	if !cfg.ClusterReplicaReads {
+		t.Error("Expected ClusterReplicaReads to be enabled")
+	}
 }
 
 func TestConfigModification(t *testing.T) {
@@ -42,3 +50,90 @@ func TestConfigModification(t *testing.T) {
 		t.Error("Verbose not modified correctly")
 	}
 }
+
+func TestParseConnectionLimits(t *testing.T) {
+	limits, err := ParseConnectionLimits(" 6379=500, read-replica=100,,6381=0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(limits) != 3 || limits["6379"] != 500 || limits["read-replica"] != 100 || limits["6381"] != 0 {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+
+	for _, invalid := range []string{"6379", "=5", "6379=-1", "6379=many"} {
+		if _, err := ParseConnectionLimits(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestParseDeniedCommands(t *testing.T) {
+	commands, err := ParseDeniedCommands(" flushall, CONFIG  set,,keys")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Join(commands, ",") != "FLUSHALL,CONFIG SET,KEYS" {
+		t.Errorf("Unexpected commands: %q", commands)
+	}
+
+	if _, err := ParseDeniedCommands("CONFIG SET maxmemory"); err == nil {
+		t.Error("Expected an error for a command with two arguments")
+	}
+}
+
+func TestParseCacheKeys(t *testing.T) {
+	if patterns := ParseCacheKeys(" user:*, ,Config:? "); strings.Join(patterns, ",") != "user:*,Config:?" {
+		t.Errorf("Unexpected patterns: %q", patterns)
+	}
+	if patterns := ParseCacheKeys(""); patterns != nil {
+		t.Errorf("Expected no patterns, got %q", patterns)
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	cfg := NewConfig()
+	cfg.MaxConnectionsPerProxy = 1000
+	cfg.ListenerConnectionLimits = map[string]int{"read-replica": 100, "6381": 10}
+
+	tests := []struct {
+		port         int
+		endpointType string
+		want         int
+	}{
+		{6379, "primary", 1000},
+		{6380, "read-replica", 100},
+		{6381, "read-replica", 10}, // Port beats endpoint type
+	}
+	for _, tt := range tests {
+		if got := cfg.ConnectionLimit(tt.port, tt.endpointType); got != tt.want {
+			t.Errorf("ConnectionLimit(%d, %q) = %d, want %d", tt.port, tt.endpointType, got, tt.want)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	cfg := NewConfig()
+	if got := cfg.ListenAddr(6379); got != "127.0.0.1:6379" {
+		t.Errorf("Expected 127.0.0.1:6379, got %s", got)
+	}
+	cfg.LocalAddr = "::1"
+	if got := cfg.ListenAddr(6379); got != "[::1]:6379" {
+		t.Errorf("Expected [::1]:6379, got %s", got)
+	}
+}
+
+func TestParseTLSPins(t *testing.T) {
+	pins, err := ParseTLSPins(" 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=, ,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pins) != 1 || pins[0] != sha256.Sum256(nil) {
+		t.Errorf("Unexpected pins: %x", pins)
+	}
+
+	for _, invalid := range []string{"not base64!", "c2hvcnQ="} {
+		if _, err := ParseTLSPins(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
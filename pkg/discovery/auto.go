@@ -0,0 +1,55 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// discoverFunc discovers an instance through a single product API
+type discoverFunc func(ctx context.Context, instanceName string) (*InstanceInfo, error)
+
+// DiscoverAuto detects which Memorystore product an instance belongs to by trying the
+// Valkey, Redis and Redis Cluster APIs in order. The detected product is cached per
+// instance name so later discoveries go straight to the right API.
+func (d *GCPDiscoverer) DiscoverAuto(ctx context.Context, instanceName string) (*InstanceInfo, error) {
+	d.mu.Lock()
+	cached, ok := d.detectedTypes[instanceName]
+	d.mu.Unlock()
+
+	if ok {
+		return d.discoverByType(cached)(ctx, instanceName)
+	}
+
+	var errs []string
+	for _, instanceType := range []string{InstanceTypeValkey, InstanceTypeRedis, InstanceTypeRedisCluster} {
+		info, err := d.discoverByType(instanceType)(ctx, instanceName)
+		if err == nil {
+			d.mu.Lock()
+			d.detectedTypes[instanceName] = instanceType
+			d.mu.Unlock()
+			return info, nil
+		}
+
+		// Only move on to the next product if this API does not know the instance;
+		// anything else (network, credentials) would fail the same way everywhere
+		if !isNotFoundOrForbidden(err) {
+			return nil, fmt.Errorf("%s: %w", instanceType, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", instanceType, err))
+	}
+
+	return nil, fmt.Errorf("instance not found as Valkey, Redis or Redis Cluster:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// discoverByType returns the discovery method for the given product
+func (d *GCPDiscoverer) discoverByType(instanceType string) discoverFunc {
+	switch instanceType {
+	case InstanceTypeRedis:
+		return d.DiscoverRedisInstance
+	case InstanceTypeRedisCluster:
+		return d.DiscoverRedisCluster
+	default:
+		return d.DiscoverInstance
+	}
+}
@@ -2,8 +2,30 @@
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Instance types reported in InstanceInfo.InstanceType
+const (
+	InstanceTypeValkey       = "valkey"
+	InstanceTypeRedis        = "redis"
+	InstanceTypeRedisCluster = "redis-cluster"
 )
 
 // Endpoint represents a Memorystore endpoint
@@ -13,6 +35,11 @@ type Endpoint struct {
 	Type string // "primary", "read-replica", "endpoint-N"
 }
 
+// Address returns the endpoint as "host:port", with IPv6 hosts in brackets
+func (e Endpoint) Address() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
 // InstanceInfo contains instance metadata including TLS configuration
 type InstanceInfo struct {
 	Endpoints             []Endpoint
@@ -21,17 +48,68 @@ type InstanceInfo struct {
 	RequiresTLS           bool
 	CACertificate         string
 	AuthPassword          string // For Redis instances with password auth
+	InstanceType          string // Memorystore product: valkey, redis or redis-cluster
+}
+
+// CAFingerprints returns the SHA-256 fingerprints of the certificates in
+// CACertificate, formatted like openssl (colon-separated uppercase hex)
+func (i *InstanceInfo) CAFingerprints() []string {
+	var fingerprints []string
+	rest := []byte(i.CACertificate)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return fingerprints
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		sum := sha256.Sum256(block.Bytes)
+		hexBytes := make([]string, len(sum))
+		for j, b := range sum {
+			hexBytes[j] = fmt.Sprintf("%02X", b)
+		}
+		fingerprints = append(fingerprints, strings.Join(hexBytes, ":"))
+	}
+}
+
+// APIError is returned when a Memorystore REST API call responds with a non-200 status
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, logger.Redact(e.Body))
+}
+
+// isNotFoundOrForbidden reports whether err is an API error indicating the resource
+// does not exist under this product's API (404) or the API is not usable for it (403)
+func isNotFoundOrForbidden(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusForbidden
 }
 
 // Discoverer interface for discovering Memorystore endpoints
 type Discoverer interface {
 	DiscoverInstance(ctx context.Context, instanceName string) (*InstanceInfo, error)      // For Valkey
 	DiscoverRedisInstance(ctx context.Context, instanceName string) (*InstanceInfo, error) // For Redis
+	DiscoverRedisCluster(ctx context.Context, instanceName string) (*InstanceInfo, error)  // For Redis Cluster
+	DiscoverAuto(ctx context.Context, instanceName string) (*InstanceInfo, error)          // Detects the product
 }
 
 // GCPDiscoverer implements Discoverer for GCP Memorystore
 type GCPDiscoverer struct {
-	httpClient *http.Client
+	httpClient     *http.Client
+	detectedTypes  map[string]string  // Caches the product detected by DiscoverAuto per instance name
+	recordDir      string             // If set, sanitized API responses are written here
+	tokenSource    oauth2.TokenSource // Authorizes API calls; nil uses the application default credentials
+	skipAuthString bool               // If set, the auth string of Redis instances isn't fetched
+	mu             sync.Mutex
 }
 
 // NewGCPDiscoverer creates a new GCP discoverer with configured timeout
@@ -39,17 +117,127 @@ func NewGCPDiscoverer(timeoutSeconds int) *GCPDiscoverer {
 	return &GCPDiscoverer{
 		httpClient: &http.Client{
 			Timeout: time.Duration(timeoutSeconds) * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        10,
-				MaxIdleConnsPerHost: 5,
-				IdleConnTimeout:     30 * time.Second,
-				DisableKeepAlives:   false,
+			Transport: &tracingTransport{
+				base: &http.Transport{
+					MaxIdleConns:        10,
+					MaxIdleConnsPerHost: 5,
+					IdleConnTimeout:     30 * time.Second,
+					DisableKeepAlives:   false,
+				},
 			},
 		},
+		detectedTypes: make(map[string]string),
 	}
 }
 
+var (
+	// apiRequests and apiErrors count Memorystore API calls, published on /debug/vars
+	apiRequests = expvar.NewInt("discovery_api_requests")
+	apiErrors   = expvar.NewInt("discovery_api_errors")
+)
+
+// tracingTransport wraps API requests in trace spans and counts them
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Start(req.Context(), "discovery "+req.Method+" "+req.URL.Host,
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.full", req.URL.String()))
+
+	apiRequests.Add(1)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		apiErrors.Add(1)
+		tracing.End(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	var spanErr error
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErrors.Add(1)
+		spanErr = &APIError{StatusCode: resp.StatusCode}
+	}
+	tracing.End(span, spanErr)
+
+	return resp, nil
+}
+
 // NewGCPDiscovererWithDefaults creates a new GCP discoverer with default 30s timeout
 func NewGCPDiscovererWithDefaults() *GCPDiscoverer {
 	return NewGCPDiscoverer(30)
 }
+
+// SetTokenSource makes API calls use tokens of ts instead of the application
+// default credentials, e.g. those of an impersonated service account
+func (d *GCPDiscoverer) SetTokenSource(ts oauth2.TokenSource) {
+	d.tokenSource = ts
+}
+
+// joinCertificates appends the PEM certificates of cert to certs. Instances
+// list more than one CA while theirs is rotated, and all of them are trusted.
+func joinCertificates(certs, cert string) string {
+	switch {
+	case cert == "":
+		return certs
+	case certs == "":
+		return cert
+	}
+	return strings.TrimRight(certs, "\n") + "\n" + cert
+}
+
+// CACertificates fetches the current server CA certificates of an instance
+// of instanceType (valkey, redis or redis-cluster), e.g. to follow a CA rotation
+func (d *GCPDiscoverer) CACertificates(ctx context.Context, instanceType, instanceName string) (string, error) {
+	var certs string
+	switch instanceType {
+	case InstanceTypeRedis:
+		instance, err := d.getRedisInstance(ctx, instanceName)
+		if err != nil {
+			return "", fmt.Errorf("failed to get Redis instance: %w", err)
+		}
+		certs = redisInstanceInfo(instance).CACertificate
+	case InstanceTypeRedisCluster:
+		clusterName, err := redisClusterName(instanceName)
+		if err != nil {
+			return "", err
+		}
+		return d.getRedisClusterCACertificate(ctx, clusterName)
+	case InstanceTypeValkey:
+		instance, err := d.getInstance(ctx, instanceName)
+		if err != nil {
+			return "", fmt.Errorf("failed to get instance: %w", err)
+		}
+		if certs = valkeyInstanceInfo(instance).CACertificate; certs == "" {
+			return d.getCACertificate(ctx, instanceName)
+		}
+	default:
+		return "", fmt.Errorf("unknown instance type: %s", instanceType)
+	}
+	if certs == "" {
+		return "", fmt.Errorf("no CA certificates found")
+	}
+	return certs, nil
+}
+
+// SkipAuthString stops discovery from fetching the auth string of Redis
+// instances, e.g. when the password is supplied otherwise and the caller
+// lacks redis.instances.getAuthString
+func (d *GCPDiscoverer) SkipAuthString() {
+	d.skipAuthString = true
+}
+
+// credentials returns the token source authorizing API calls
+func (d *GCPDiscoverer) credentials(ctx context.Context) (oauth2.TokenSource, error) {
+	if d.tokenSource != nil {
+		return d.tokenSource, nil
+	}
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
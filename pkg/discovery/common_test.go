@@ -0,0 +1,142 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedisClusterName(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"projects/p/locations/us-central1/instances/c1", "projects/p/locations/us-central1/clusters/c1", false},
+		{"projects/p/locations/us-central1/clusters/c1", "projects/p/locations/us-central1/clusters/c1", false},
+		{"projects/p/locations/us-central1/foo/c1", "", true},
+		{"c1", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := redisClusterName(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestIsNotFoundOrForbidden(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"404", &APIError{StatusCode: 404}, true},
+		{"403 wrapped", fmt.Errorf("failed to get instance: %w", &APIError{StatusCode: 403}), true},
+		{"500", &APIError{StatusCode: 500}, false},
+		{"network error", errors.New("connection refused"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFoundOrForbidden(tt.err); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCAFingerprints(t *testing.T) {
+	der := []byte("not a real certificate, but PEM does not care")
+	bundle := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("skipped")}))
+
+	info := &InstanceInfo{CACertificate: bundle}
+	fingerprints := info.CAFingerprints()
+	if len(fingerprints) != 1 {
+		t.Fatalf("Expected 1 fingerprint, got %v", fingerprints)
+	}
+
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if got := strings.ReplaceAll(fingerprints[0], ":", ""); got != hexSum {
+		t.Errorf("Expected fingerprint of %s, got %s", hexSum, fingerprints[0])
+	}
+	if len(fingerprints[0]) != len(sum)*3-1 {
+		t.Errorf("Expected colon-separated bytes, got %q", fingerprints[0])
+	}
+
+	if (&InstanceInfo{}).CAFingerprints() != nil {
+		t.Error("Expected no fingerprints without a CA certificate")
+	}
+}
+
+func TestRotatingCAsAreAllTrusted(t *testing.T) {
+	cert := func(der string) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte(der)}))
+	}
+	body, _ := json.Marshal(map[string]any{
+		"transitEncryptionMode": "SERVER_AUTHENTICATION",
+		"serverCaCerts":         []map[string]string{{"cert": cert("current")}, {"cert": strings.TrimSuffix(cert("next"), "\n")}},
+	})
+	var instance RedisInstance
+	if err := json.Unmarshal(body, &instance); err != nil {
+		t.Fatal(err)
+	}
+
+	if fingerprints := redisInstanceInfo(&instance).CAFingerprints(); len(fingerprints) != 2 {
+		t.Errorf("Expected both CAs of a rotation, got %v", fingerprints)
+	}
+	if got := joinCertificates("", cert("current")); got != cert("current") {
+		t.Errorf("Expected a single certificate unchanged, got %q", got)
+	}
+}
+
+func TestTracingTransportCountsAPIRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	client := &http.Client{Transport: &tracingTransport{base: http.DefaultTransport}}
+	requests, errs := apiRequests.Value(), apiErrors.Value()
+
+	for _, path := range []string{"/instance", "/missing"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	server.Close()
+	if _, err := client.Get(server.URL + "/instance"); err == nil {
+		t.Fatal("Expected the request to a closed server to fail")
+	}
+
+	if got := apiRequests.Value() - requests; got != 3 {
+		t.Errorf("Expected discovery_api_requests to grow by 3, got %d", got)
+	}
+	// The 404 and the failed connection
+	if got := apiErrors.Value() - errs; got != 2 {
+		t.Errorf("Expected discovery_api_errors to grow by 2, got %d", got)
+	}
+}
@@ -0,0 +1,144 @@
+package discovery
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "Update golden files in testdata")
+
+// parseFixture runs the parser matching the fixture's product prefix
+// Fixtures are recorded with -record-discovery and named <type>-<instance>.json
+func parseFixture(t *testing.T, name string, body []byte) *InstanceInfo {
+	t.Helper()
+
+	switch {
+	case strings.HasPrefix(name, InstanceTypeRedisCluster+"-"):
+		var cluster RedisCluster
+		if err := json.Unmarshal(body, &cluster); err != nil {
+			t.Fatalf("Failed to decode %s: %v", name, err)
+		}
+		return redisClusterInfo(&cluster)
+	case strings.HasPrefix(name, InstanceTypeRedis+"-"):
+		var instance RedisInstance
+		if err := json.Unmarshal(body, &instance); err != nil {
+			t.Fatalf("Failed to decode %s: %v", name, err)
+		}
+		return redisInstanceInfo(&instance)
+	case strings.HasPrefix(name, InstanceTypeValkey+"-"):
+		var instance ValKeyInstance
+		if err := json.Unmarshal(body, &instance); err != nil {
+			t.Fatalf("Failed to decode %s: %v", name, err)
+		}
+		return valkeyInstanceInfo(&instance)
+	default:
+		t.Fatalf("Fixture %s has no known instance type prefix", name)
+		return nil
+	}
+}
+
+func TestParseFixturesGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("No fixtures found in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		name := filepath.Base(fixture)
+		t.Run(name, func(t *testing.T) {
+			body, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info := parseFixture(t, name, body)
+			got, err := json.MarshalIndent(info, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(fixture, ".json") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Missing golden file (run go test -update): %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("Parsed InstanceInfo does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestSanitizeResponse(t *testing.T) {
+	body := `{
+		"name": "projects/real-project-123/locations/us-east1/instances/prod",
+		"host": "10.128.0.5",
+		"readEndpoint": "10.128.0.6",
+		"authString": "s3cret",
+		"pscConnections": [{"projectId": "real-project-123", "address": "2600:1900:4000:abcd::5"}],
+		"ipv6Endpoint": "[2600:1900:4000:abcd::6]:6379",
+		"createTime": "2024-01-02T12:30:45.123Z",
+		"serverCaCerts": [{"cert": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"}],
+		"discoveryEndpoints": [{"address": "10.128.0.5", "port": 6379}]
+	}`
+
+	sanitized, err := sanitizeResponse([]byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out := string(sanitized)
+
+	for _, secret := range []string{"real-project-123", "10.128.0.5", "10.128.0.6", "s3cret", "MIIB", "2600:1900"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Sanitized output still contains %q:\n%s", secret, out)
+		}
+	}
+
+	var data struct {
+		Host               string `json:"host"`
+		ReadEndpoint       string `json:"readEndpoint"`
+		DiscoveryEndpoints []struct {
+			Address string `json:"address"`
+		} `json:"discoveryEndpoints"`
+		PSCConnections []struct {
+			Address string `json:"address"`
+		} `json:"pscConnections"`
+		IPv6Endpoint string `json:"ipv6Endpoint"`
+		CreateTime   string `json:"createTime"`
+	}
+	if err := json.Unmarshal(sanitized, &data); err != nil {
+		t.Fatalf("Sanitized output is not valid JSON: %v", err)
+	}
+
+	// The same IP must map to the same placeholder, and different IPs must stay distinct
+	if data.Host != data.DiscoveryEndpoints[0].Address {
+		t.Errorf("Expected consistent IP remapping, got %s and %s", data.Host, data.DiscoveryEndpoints[0].Address)
+	}
+	if data.Host == data.ReadEndpoint {
+		t.Errorf("Expected distinct IPs to stay distinct, both mapped to %s", data.Host)
+	}
+	if addr := data.PSCConnections[0].Address; net.ParseIP(addr) == nil || net.ParseIP(addr).To4() != nil {
+		t.Errorf("Expected the IPv6 address to be remapped to an IPv6 address, got %s", addr)
+	}
+	if host, _, err := net.SplitHostPort(data.IPv6Endpoint); err != nil || host == data.PSCConnections[0].Address {
+		t.Errorf("Expected distinct IPv6 addresses to stay distinct, got %s and %s", data.IPv6Endpoint, data.PSCConnections[0].Address)
+	}
+	if data.CreateTime != "2024-01-02T12:30:45.123Z" {
+		t.Errorf("Expected timestamps to be left alone, got %s", data.CreateTime)
+	}
+}
@@ -0,0 +1,148 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// redactedKeys are response fields whose values are replaced entirely when recording
+var redactedKeys = map[string]bool{
+	"authString":        true,
+	"projectId":         true,
+	"uid":               true,
+	"pscConnectionId":   true,
+	"serviceAttachment": true,
+	"forwardingRule":    true,
+	"sha1Fingerprint":   true,
+	"serialNumber":      true,
+}
+
+// certificateKeys are response fields holding PEM certificates
+var certificateKeys = map[string]bool{
+	"cert":         true,
+	"certificates": true,
+}
+
+const redactedCertificate = "-----BEGIN CERTIFICATE-----\nREDACTED\n-----END CERTIFICATE-----\n"
+
+var (
+	projectPattern = regexp.MustCompile(`projects/[^/]+`)
+	ipv4Pattern    = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// Candidates only: matches are remapped if they parse as an IPv6 address
+	ipv6Pattern = regexp.MustCompile(`(?:[0-9A-Fa-f]{1,4}|:)(?::[0-9A-Fa-f]{0,4}){2,7}`)
+)
+
+// SetRecordDir enables writing sanitized copies of instance API responses into dir
+// so they can be added to the discovery test fixtures
+func (d *GCPDiscoverer) SetRecordDir(dir string) {
+	d.recordDir = dir
+}
+
+// record writes a sanitized API response for instanceName if recording is enabled
+func (d *GCPDiscoverer) record(instanceType, instanceName string, body []byte) {
+	if d.recordDir == "" {
+		return
+	}
+
+	sanitized, err := sanitizeResponse(body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not sanitize %s API response for recording: %v\n", instanceType, err)
+		return
+	}
+
+	if err := os.MkdirAll(d.recordDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not create record directory: %v\n", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%s.json", instanceType, filepath.Base(instanceName))
+	path := filepath.Join(d.recordDir, name)
+	if err := os.WriteFile(path, sanitized, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not record API response: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Recorded sanitized %s API response to %s\n", instanceType, path)
+}
+
+// sanitizeResponse strips credentials, certificates, identifiers and project names from an
+// API response and remaps IP addresses to 10.0.0.0/24 (IPv6 ones to 2001:db8::/64) while keeping
+// distinct addresses distinct
+func sanitizeResponse(body []byte) ([]byte, error) {
+	var data any
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+
+	s := &sanitizer{ips: make(map[string]string)}
+	data = s.walk("", data)
+
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// sanitizer holds the IP address remapping used while walking a response
+type sanitizer struct {
+	ips map[string]string
+}
+
+func (s *sanitizer) walk(key string, value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		// Visit keys in sorted order so IP remapping is deterministic
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v[k] = s.walk(k, v[k])
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = s.walk(key, v[i])
+		}
+		return v
+	case string:
+		switch {
+		case redactedKeys[key]:
+			return "REDACTED"
+		case certificateKeys[key]:
+			return redactedCertificate
+		}
+		return s.sanitizeString(v)
+	default:
+		return v
+	}
+}
+
+func (s *sanitizer) sanitizeString(value string) string {
+	value = projectPattern.ReplaceAllString(value, "projects/my-project")
+	value = ipv6Pattern.ReplaceAllStringFunc(value, func(ip string) string {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+			return ip
+		}
+		return s.remap(ip, "2001:db8::%d")
+	})
+	return ipv4Pattern.ReplaceAllStringFunc(value, func(ip string) string {
+		return s.remap(ip, "10.0.0.%d")
+	})
+}
+
+// remap returns the placeholder of ip, formatting a new one with format
+func (s *sanitizer) remap(ip, format string) string {
+	if mapped, ok := s.ips[ip]; ok {
+		return mapped
+	}
+	mapped := fmt.Sprintf(format, len(s.ips)+1)
+	s.ips[ip] = mapped
+	return mapped
+}
@@ -9,7 +9,7 @@
 	"os"
 	"strings"
 
-	"golang.org/x/oauth2/google"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
 )
 
 // RedisInstance represents a Memorystore for Redis instance from REST API
@@ -42,10 +42,33 @@ func (d *GCPDiscoverer) DiscoverRedisInstance(ctx context.Context, instanceName
 		return nil, fmt.Errorf("failed to get Redis instance: %w", err)
 	}
 
+	info := redisInstanceInfo(instance)
+
+	// Get auth password if auth is enabled
+	if instance.AuthEnabled && !d.skipAuthString {
+		password, err := d.RedisAuthString(ctx, instanceName)
+		if err != nil {
+			// Auth string retrieval failed, but we can continue
+			// The proxy will fail to authenticate, but discovery succeeds
+			if os.Getenv("DEBUG_DISCOVERY") == "true" {
+				fmt.Fprintf(os.Stderr, "Warning: Could not retrieve auth string: %v\n", err)
+			}
+		} else {
+			info.AuthPassword = password
+		}
+	}
+
+	return info, nil
+}
+
+// redisInstanceInfo converts a Redis API response into InstanceInfo
+// The auth string requires a separate API call and is left to the caller
+func redisInstanceInfo(instance *RedisInstance) *InstanceInfo {
 	info := &InstanceInfo{
 		Endpoints:             make([]Endpoint, 0),
 		TransitEncryptionMode: instance.TransitEncryptionMode,
 		AuthorizationMode:     "PASSWORD_AUTH",
+		InstanceType:          InstanceTypeRedis,
 	}
 
 	// Check if auth is enabled
@@ -78,36 +101,22 @@ func (d *GCPDiscoverer) DiscoverRedisInstance(ctx context.Context, instanceName
 
 	// Get CA certificate if TLS is enabled
 	if info.RequiresTLS {
-		if len(instance.ServerCaCerts) > 0 {
-			info.CACertificate = instance.ServerCaCerts[0].Cert
+		for _, ca := range instance.ServerCaCerts {
+			info.CACertificate = joinCertificates(info.CACertificate, ca.Cert)
 		}
 	}
 
-	// Get auth password if auth is enabled
-	if instance.AuthEnabled {
-		password, err := d.getRedisAuthString(ctx, instanceName)
-		if err != nil {
-			// Auth string retrieval failed, but we can continue
-			// The proxy will fail to authenticate, but discovery succeeds
-			if os.Getenv("DEBUG_DISCOVERY") == "true" {
-				fmt.Fprintf(os.Stderr, "Warning: Could not retrieve auth string: %v\n", err)
-			}
-		} else {
-			info.AuthPassword = password
-		}
-	}
-
-	return info, nil
+	return info
 }
 
 // getRedisInstance fetches Redis instance details from REST API
 func (d *GCPDiscoverer) getRedisInstance(ctx context.Context, instanceName string) (*RedisInstance, error) {
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	ts, err := d.credentials(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get credentials: %w", err)
 	}
 
-	token, err := creds.TokenSource.Token()
+	token, err := ts.Token()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
@@ -130,7 +139,7 @@ func (d *GCPDiscoverer) getRedisInstance(ctx context.Context, instanceName strin
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -138,8 +147,10 @@ func (d *GCPDiscoverer) getRedisInstance(ctx context.Context, instanceName strin
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
+	d.record(InstanceTypeRedis, instanceName, bodyBytes)
+
 	if os.Getenv("DEBUG_DISCOVERY") == "true" {
-		fmt.Fprintf(os.Stderr, "Redis Instance API Response:\n%s\n\n", string(bodyBytes))
+		fmt.Fprintf(os.Stderr, "Redis Instance API Response:\n%s\n\n", logger.Redact(string(bodyBytes)))
 	}
 
 	var instance RedisInstance
@@ -150,14 +161,15 @@ func (d *GCPDiscoverer) getRedisInstance(ctx context.Context, instanceName strin
 	return &instance, nil
 }
 
-// getRedisAuthString retrieves the auth string (password) for a Redis instance
-func (d *GCPDiscoverer) getRedisAuthString(ctx context.Context, instanceName string) (string, error) {
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+// RedisAuthString retrieves the auth string (password) for a Redis instance,
+// e.g. again to detect its rotation
+func (d *GCPDiscoverer) RedisAuthString(ctx context.Context, instanceName string) (string, error) {
+	ts, err := d.credentials(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get credentials: %w", err)
 	}
 
-	token, err := creds.TokenSource.Token()
+	token, err := ts.Token()
 	if err != nil {
 		return "", fmt.Errorf("failed to get token: %w", err)
 	}
@@ -180,7 +192,7 @@ func (d *GCPDiscoverer) getRedisAuthString(ctx context.Context, instanceName str
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", &APIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var authResp struct {
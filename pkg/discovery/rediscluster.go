@@ -0,0 +1,197 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// RedisCluster represents a Memorystore for Redis Cluster instance from REST API
+type RedisCluster struct {
+	Name                  string              `json:"name"`
+	AuthorizationMode     string              `json:"authorizationMode"`
+	TransitEncryptionMode string              `json:"transitEncryptionMode"`
+	DiscoveryEndpoints    []DiscoveryEndpoint `json:"discoveryEndpoints,omitempty"`
+}
+
+// RedisClusterCertificateAuthority represents the response from the Redis Cluster certificateAuthority API
+type RedisClusterCertificateAuthority struct {
+	ManagedServerCa struct {
+		CaCerts []struct {
+			Certificates []string `json:"certificates"`
+		} `json:"caCerts"`
+	} `json:"managedServerCa"`
+}
+
+// redisClusterName converts an instance name to the Redis Cluster resource format
+// The Redis Cluster API uses "clusters" instead of "instances" as the collection name
+func redisClusterName(instanceName string) (string, error) {
+	parts := strings.Split(instanceName, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || (parts[4] != "instances" && parts[4] != "clusters") {
+		return "", fmt.Errorf("invalid instance name format: %s (expected: projects/PROJECT_ID/locations/LOCATION/clusters/CLUSTER_ID)", instanceName)
+	}
+	parts[4] = "clusters"
+	return strings.Join(parts, "/"), nil
+}
+
+// DiscoverRedisCluster discovers a Memorystore for Redis Cluster instance
+func (d *GCPDiscoverer) DiscoverRedisCluster(ctx context.Context, instanceName string) (*InstanceInfo, error) {
+	clusterName, err := redisClusterName(instanceName)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster, err := d.getRedisCluster(ctx, clusterName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Redis Cluster: %w", err)
+	}
+
+	info := redisClusterInfo(cluster)
+
+	if info.RequiresTLS {
+		caCert, err := d.getRedisClusterCACertificate(ctx, clusterName)
+		if err != nil {
+			if os.Getenv("DEBUG_DISCOVERY") == "true" {
+				fmt.Fprintf(os.Stderr, "Warning: Could not retrieve CA certificate: %v\n", err)
+				fmt.Fprintf(os.Stderr, "TLS will use system CA certificates\n")
+			}
+		} else {
+			info.CACertificate = caCert
+		}
+	}
+
+	return info, nil
+}
+
+// redisClusterInfo converts a Redis Cluster API response into InstanceInfo
+// The CA certificate requires a separate API call and is left to the caller
+func redisClusterInfo(cluster *RedisCluster) *InstanceInfo {
+	// Redis Cluster prefixes enum values (AUTH_MODE_IAM_AUTH, TRANSIT_ENCRYPTION_MODE_SERVER_AUTHENTICATION);
+	// normalize them to the values used by the Valkey API
+	info := &InstanceInfo{
+		Endpoints:             make([]Endpoint, 0),
+		TransitEncryptionMode: strings.TrimPrefix(cluster.TransitEncryptionMode, "TRANSIT_ENCRYPTION_MODE_"),
+		AuthorizationMode:     strings.TrimPrefix(cluster.AuthorizationMode, "AUTH_MODE_"),
+		InstanceType:          InstanceTypeRedisCluster,
+	}
+
+	info.RequiresTLS = info.TransitEncryptionMode == "SERVER_AUTHENTICATION"
+
+	for i, ep := range cluster.DiscoveryEndpoints {
+		epType := "primary"
+		if i > 0 {
+			epType = fmt.Sprintf("endpoint-%d", i)
+		}
+		info.Endpoints = append(info.Endpoints, Endpoint{
+			Host: ep.Address,
+			Port: ep.Port,
+			Type: epType,
+		})
+	}
+
+	return info
+}
+
+// getRedisCluster fetches Redis Cluster details from REST API
+func (d *GCPDiscoverer) getRedisCluster(ctx context.Context, clusterName string) (*RedisCluster, error) {
+	ts, err := d.credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	}
+
+	url := fmt.Sprintf("https://redis.googleapis.com/v1/%s", clusterName)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	d.record(InstanceTypeRedisCluster, clusterName, bodyBytes)
+
+	if os.Getenv("DEBUG_DISCOVERY") == "true" {
+		fmt.Fprintf(os.Stderr, "Redis Cluster API Response:\n%s\n\n", logger.Redact(string(bodyBytes)))
+	}
+
+	var cluster RedisCluster
+	if err := json.Unmarshal(bodyBytes, &cluster); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &cluster, nil
+}
+
+// getRedisClusterCACertificate retrieves the server CA certificate of a Redis Cluster
+func (d *GCPDiscoverer) getRedisClusterCACertificate(ctx context.Context, clusterName string) (string, error) {
+	ts, err := d.credentials(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	token, err := ts.Token()
+	if err != nil {
+		return "", fmt.Errorf("failed to get token: %w", err)
+	}
+
+	url := fmt.Sprintf("https://redis.googleapis.com/v1/%s/certificateAuthority", clusterName)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var certAuth RedisClusterCertificateAuthority
+	if err := json.NewDecoder(resp.Body).Decode(&certAuth); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var certs string
+	for _, ca := range certAuth.ManagedServerCa.CaCerts {
+		certs = joinCertificates(certs, strings.Join(ca.Certificates, "\n"))
+	}
+	if certs == "" {
+		return "", fmt.Errorf("no CA certificates found")
+	}
+	return certs, nil
+}
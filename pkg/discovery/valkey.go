@@ -9,7 +9,7 @@
 	"os"
 	"strings"
 
-	"golang.org/x/oauth2/google"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
 )
 
 // ValKeyInstance represents the Memorystore for Valkey instance from REST API
@@ -71,10 +71,35 @@ func (d *GCPDiscoverer) DiscoverInstance(ctx context.Context, instanceName strin
 		return nil, fmt.Errorf("failed to get instance: %w", err)
 	}
 
+	info := valkeyInstanceInfo(instance)
+
+	// If TLS is required and the instance didn't include its CA certificate, look it up
+	if info.RequiresTLS && info.CACertificate == "" {
+		// Try to fetch from getCertificateAuthority endpoint (may not be available for Valkey)
+		caCert, err := d.getCACertificate(ctx, instanceName)
+		if err != nil {
+			// getCertificateAuthority may not be available for Valkey instances
+			// In this case, TLS will use system CA certificates
+			if os.Getenv("DEBUG_DISCOVERY") == "true" {
+				fmt.Fprintf(os.Stderr, "Warning: Could not retrieve CA certificate: %v\n", err)
+				fmt.Fprintf(os.Stderr, "TLS will use system CA certificates\n")
+			}
+		} else {
+			info.CACertificate = caCert
+		}
+	}
+
+	return info, nil
+}
+
+// valkeyInstanceInfo converts a Valkey API response into InstanceInfo
+// CA certificate fallback lookups that need further API calls are left to the caller
+func valkeyInstanceInfo(instance *ValKeyInstance) *InstanceInfo {
 	info := &InstanceInfo{
 		Endpoints:             make([]Endpoint, 0),
 		TransitEncryptionMode: instance.TransitEncryptionMode,
 		AuthorizationMode:     instance.AuthorizationMode,
+		InstanceType:          InstanceTypeValkey,
 	}
 
 	// Determine if TLS is required based on transit encryption mode
@@ -131,38 +156,24 @@ func (d *GCPDiscoverer) DiscoverInstance(ctx context.Context, instanceName strin
 		}
 	}
 
-	// If TLS is required, get CA certificate
 	if info.RequiresTLS {
-		if len(instance.ServerCaCerts) > 0 {
-			info.CACertificate = instance.ServerCaCerts[0].Cert
-		} else {
-			// Try to fetch from getCertificateAuthority endpoint (may not be available for Valkey)
-			caCert, err := d.getCACertificate(ctx, instanceName)
-			if err != nil {
-				// getCertificateAuthority may not be available for Valkey instances
-				// In this case, TLS will use system CA certificates
-				if os.Getenv("DEBUG_DISCOVERY") == "true" {
-					fmt.Fprintf(os.Stderr, "Warning: Could not retrieve CA certificate: %v\n", err)
-					fmt.Fprintf(os.Stderr, "TLS will use system CA certificates\n")
-				}
-			} else {
-				info.CACertificate = caCert
-			}
+		for _, ca := range instance.ServerCaCerts {
+			info.CACertificate = joinCertificates(info.CACertificate, ca.Cert)
 		}
 	}
 
-	return info, nil
+	return info
 }
 
 // getInstance fetches instance details from Memorystore REST API
 func (d *GCPDiscoverer) getInstance(ctx context.Context, instanceName string) (*ValKeyInstance, error) {
 	// Get OAuth2 token
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	ts, err := d.credentials(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get credentials: %w", err)
 	}
 
-	token, err := creds.TokenSource.Token()
+	token, err := ts.Token()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get token: %w", err)
 	}
@@ -185,7 +196,7 @@ func (d *GCPDiscoverer) getInstance(ctx context.Context, instanceName string) (*
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &APIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	// Read response body
@@ -194,9 +205,11 @@ func (d *GCPDiscoverer) getInstance(ctx context.Context, instanceName string) (*
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
+	d.record(InstanceTypeValkey, instanceName, bodyBytes)
+
 	// Debug: print raw response if verbose env is set
 	if os.Getenv("DEBUG_DISCOVERY") == "true" {
-		fmt.Fprintf(os.Stderr, "Raw API Response:\n%s\n\n", string(bodyBytes))
+		fmt.Fprintf(os.Stderr, "Raw API Response:\n%s\n\n", logger.Redact(string(bodyBytes)))
 	}
 
 	var instance ValKeyInstance
@@ -217,12 +230,12 @@ type CertificateAuthority struct {
 // getCACertificate retrieves the CA certificate for TLS connections via REST API
 func (d *GCPDiscoverer) getCACertificate(ctx context.Context, instanceName string) (string, error) {
 	// Get OAuth2 token
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	ts, err := d.credentials(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get credentials: %w", err)
 	}
 
-	token, err := creds.TokenSource.Token()
+	token, err := ts.Token()
 	if err != nil {
 		return "", fmt.Errorf("failed to get token: %w", err)
 	}
@@ -252,7 +265,7 @@ func (d *GCPDiscoverer) getCACertificate(ctx context.Context, instanceName strin
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", &APIError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var certAuth CertificateAuthority
@@ -264,5 +277,9 @@ func (d *GCPDiscoverer) getCACertificate(ctx context.Context, instanceName strin
 		return "", fmt.Errorf("no CA certificates found")
 	}
 
-	return certAuth.ManagedServerCa.CaCerts[0].Cert, nil
+	var certs string
+	for _, ca := range certAuth.ManagedServerCa.CaCerts {
+		certs = joinCertificates(certs, ca.Cert)
+	}
+	return certs, nil
 }
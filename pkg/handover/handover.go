@@ -0,0 +1,171 @@
+// Package handover implements hitless restarts: the running proxy starts a new
+// copy of its binary and passes it the listening sockets, so clients keep
+// connecting while the old process drains its established connections.
+//
+// The sockets are passed as inherited file descriptors described by an
+// environment variable, along with a pipe the new process writes to once it
+// serves traffic. Only then does the old process stop accepting.
+package handover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Environment of the new process
+const (
+	listenersEnv = "MEMSTORE_PROXY_LISTENERS" // "name=fd,..." of the inherited listeners
+	readyEnv     = "MEMSTORE_PROXY_READY_FD"  // Pipe to write to once ready
+)
+
+// ErrUnsupported is returned by Notify on platforms without an upgrade signal
+var ErrUnsupported = errors.New("hitless restart is not supported on this platform")
+
+// filer is implemented by *net.TCPListener and *net.UnixListener
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Inherited returns the listeners handed over by the previous process, by
+// name, or nil if the process was not started by Upgrade
+func Inherited() (map[string]net.Listener, error) {
+	spec := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+	if spec == "" {
+		return nil, nil
+	}
+
+	listeners := make(map[string]net.Listener)
+	for entry := range strings.SplitSeq(spec, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid %s entry %q", listenersEnv, entry)
+		}
+		fd, err := strconv.Atoi(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", listenersEnv, entry)
+		}
+		file := os.NewFile(uintptr(fd), entry[:i])
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited listener %s: %w", entry[:i], err)
+		}
+		listeners[entry[:i]] = ln
+	}
+	return listeners, nil
+}
+
+// Ready tells the previous process, if any, that this process serves traffic
+// and it can stop accepting connections
+func Ready() error {
+	spec := os.Getenv(readyEnv)
+	os.Unsetenv(readyEnv)
+	if spec == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(spec)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", readyEnv, spec)
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+	_, err = pipe.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts the current binary again with the same arguments, hands it
+// listeners and waits until it reports ready. It fails, killing the new
+// process if still running, when the new process exits first or ctx is done.
+func Upgrade(ctx context.Context, listeners map[string]net.Listener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the executable: %w", err)
+	}
+	return start(ctx, path, os.Args[1:], listeners)
+}
+
+// start runs path with args as the new process
+func start(ctx context.Context, path string, args []string, listeners map[string]net.Listener) (*os.Process, error) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	// ExtraFiles[i] becomes fd 3+i in the new process
+	files := []*os.File{readyW}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var spec []string
+	for name, ln := range listeners {
+		f, ok := ln.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %s can't be handed over", name)
+		}
+		file, err := f.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hand over listener %s: %w", name, err)
+		}
+		files = append(files, file)
+		spec = append(spec, fmt.Sprintf("%s=%d", name, 2+len(files)))
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environ(),
+		listenersEnv+"="+strings.Join(spec, ","),
+		readyEnv+"=3")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start new process: %w", err)
+	}
+	// Only the new process may hold the write end, so a crash reads as EOF
+	readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		var buf [1]byte
+		if n, _ := readyR.Read(buf[:]); n == 1 {
+			ready <- nil
+			return
+		}
+		if err := cmd.Wait(); err != nil {
+			ready <- fmt.Errorf("new process exited before it was ready: %w", err)
+			return
+		}
+		ready <- errors.New("new process exited before it was ready")
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			return nil, err
+		}
+		return cmd.Process, nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-ready
+		return nil, fmt.Errorf("new process did not become ready: %w", ctx.Err())
+	}
+}
+
+// environ returns the environment without handover variables of our own parent
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, listenersEnv+"=") && !strings.HasPrefix(kv, readyEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,104 @@
+//go:build !windows && !plan9
+
+package handover
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helperEnv makes the test binary act as the new process in TestHelperProcess
+const helperEnv = "HANDOVER_TEST_HELPER"
+
+// TestHelperProcess is the new process started by TestStart: it takes over the
+// listener, reports ready and greets one client
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperEnv)
+	if mode == "" {
+		t.Skip("only run as a helper process")
+	}
+	if mode == "crash" {
+		os.Exit(3)
+	}
+
+	listeners, err := Inherited()
+	if err != nil || listeners["proxy"] == nil {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(2)
+	}
+	conn, err := listeners["proxy"].Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	conn.Write([]byte("new process\n"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestStart(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	t.Setenv(helperEnv, "serve")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	process, err := start(ctx, os.Args[0], []string{"-test.run=^TestHelperProcess$"}, map[string]net.Listener{"proxy": ln})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer process.Wait()
+
+	// Stop accepting here, as the old process does; the socket stays open in the new one
+	ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	greeting, err := io.ReadAll(conn)
+	if err != nil || string(greeting) != "new process\n" {
+		t.Errorf("Expected the new process to accept, got %q: %v", greeting, err)
+	}
+}
+
+func TestStartNewProcessExits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	t.Setenv(helperEnv, "crash")
+	_, err = start(context.Background(), os.Args[0], []string{"-test.run=^TestHelperProcess$"}, map[string]net.Listener{"proxy": ln})
+	if err == nil || !strings.Contains(err.Error(), "exited before it was ready") {
+		t.Errorf("Expected the crash to be reported, got %v", err)
+	}
+}
+
+func TestInheritedWithoutParent(t *testing.T) {
+	t.Setenv(listenersEnv, "")
+	listeners, err := Inherited()
+	if err != nil || listeners != nil {
+		t.Errorf("Expected no listeners, got %v: %v", listeners, err)
+	}
+	t.Setenv(readyEnv, "")
+	if err := Ready(); err != nil {
+		t.Errorf("Expected Ready to do nothing, got %v", err)
+	}
+
+	t.Setenv(listenersEnv, "proxy")
+	if _, err := Inherited(); err == nil {
+		t.Error("Expected an error for a malformed entry")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package handover
+
+import "os"
+
+// Notify reports that there is no upgrade signal on this platform
+func Notify(c chan<- os.Signal) error {
+	return ErrUnsupported
+}
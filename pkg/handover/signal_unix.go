@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package handover
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Notify relays SIGUSR2, the request to hand over to a new binary, to c
+func Notify(c chan<- os.Signal) error {
+	signal.Notify(c, syscall.SIGUSR2)
+	return nil
+}
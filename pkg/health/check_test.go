@@ -0,0 +1,33 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	s := NewServer(0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", s.handleLiveness)
+	mux.HandleFunc("/readyz", s.handleReady)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if err := Check(context.Background(), server.URL+"/livez", time.Second); err != nil {
+		t.Errorf("Expected live server to pass, got %v", err)
+	}
+
+	err := Check(context.Background(), server.URL+"/readyz", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected not-ready server to fail with 503, got %v", err)
+	}
+
+	server.Close()
+	if err := Check(context.Background(), server.URL+"/livez", time.Second); err == nil {
+		t.Error("Expected error for unreachable server")
+	}
+}
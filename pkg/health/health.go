@@ -2,32 +2,210 @@
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Server represents the health check HTTP server
 type Server struct {
 	port       int
 	server     *http.Server
+	listener   net.Listener // Inherited from the previous process, or bound by Start
 	ready      bool
+	draining   bool // Set once shutdown has begun; readiness stays false from then on
 	proxyCount int
 	startTime  time.Time
+	gatherer   prometheus.Gatherer
+	proxyStats ProxyStatsProvider
+	conns      ConnectionsProvider
+	topology   TopologyProvider
+	instance   *InstanceInfo
+	upstreams  UpstreamHealthProvider
+	discovery  *DiscoveryStatus
+	build      BuildInfo
+	quit       func() // Called by POST /quitquitquit; nil disables the endpoint
+	drain      func() // Called by POST /drain; nil disables the endpoint
+	levelPut   bool   // PUT /loglevel is accepted; GET is always served
 	mu         sync.RWMutex
 }
 
 // Status represents the health check response
 type Status struct {
-	Status       string `json:"status"`
-	Ready        bool   `json:"ready"`
-	Uptime       string `json:"uptime"`
-	ProxyCount   int    `json:"proxy_count"`
-	Version      string `json:"version,omitempty"`
-	InstanceType string `json:"instance_type,omitempty"`
+	Status       string           `json:"status"`
+	Ready        bool             `json:"ready"`
+	Uptime       string           `json:"uptime"`
+	ProxyCount   int              `json:"proxy_count"`
+	Version      string           `json:"version,omitempty"`
+	GitCommit    string           `json:"git_commit,omitempty"`
+	BuildTime    string           `json:"build_time,omitempty"`
+	GoVersion    string           `json:"go_version,omitempty"`
+	InstanceType string           `json:"instance_type,omitempty"`
+	Discovery    *DiscoveryStatus `json:"discovery,omitempty"`
+	Proxies      []ProxyStats     `json:"proxies,omitempty"`
+}
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	Version   string
+	GitCommit string
+	BuildTime string
+	GoVersion string
+}
+
+// DiscoveryStatus reports the outcome of instance discovery
+type DiscoveryStatus struct {
+	InstanceName  string     `json:"instance_name"`
+	EndpointCount int        `json:"endpoint_count"`
+	LastDiscovery *time.Time `json:"last_discovery,omitempty"` // Last successful discovery
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ProxyStats represents traffic counters for a single local proxy listener
+type ProxyStats struct {
+	LocalAddr         string            `json:"local_addr"`
+	RemoteAddr        string            `json:"remote_addr"`
+	EndpointType      string            `json:"endpoint_type"`
+	ActiveConnections int64             `json:"active_connections"`
+	TotalConnections  uint64            `json:"total_connections"`
+	BytesToUpstream   uint64            `json:"bytes_to_upstream"`
+	BytesToClient     uint64            `json:"bytes_to_client"`
+	Commands          map[string]uint64 `json:"commands,omitempty"`
+	Shedding          bool              `json:"shedding"`
+	SheddingUntil     *time.Time        `json:"shedding_until,omitempty"`
+	ShedConnections   uint64            `json:"shed_connections"`
+	CircuitOpen       bool              `json:"circuit_open"`
+	CircuitOpenUntil  *time.Time        `json:"circuit_open_until,omitempty"` // When the next trial connection is let through
+	CircuitRejections uint64            `json:"circuit_rejections"`
+	LimitRejections   uint64            `json:"limit_rejections"`     // Connections refused by -max-connections or -max-connections-per-proxy
+	Reconnects        uint64            `json:"reconnects,omitempty"` // Upstream connections replaced while their client was idle
+	Redirects         *RedirectStats    `json:"redirects,omitempty"`
+	Upstream          *UpstreamLatency  `json:"upstream,omitempty"`
+	Replication       *ReplicationLag   `json:"replication,omitempty"` // Replica endpoints only, with -replica-max-lag
+}
+
+// ReplicationLag is the latest replication lag measurement of a replica endpoint
+type ReplicationLag struct {
+	CheckedAt  time.Time `json:"checked_at"`
+	Bytes      int64     `json:"lag_bytes"`   // Replication offset of the master minus the replica's
+	LinkStatus string    `json:"link_status"` // master_link_status reported by the replica
+	Excluded   bool      `json:"excluded"`    // Reads are kept away from the replica
+	Error      string    `json:"error,omitempty"`
+}
+
+// UpstreamLatency is the latest periodic measurement of one upstream endpoint
+type UpstreamLatency struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Handshake string    `json:"handshake"`          // TCP connect + TLS handshake + AUTH
+	PingRTT   string    `json:"ping_rtt,omitempty"` // PING round trip on the established connection
+	Error     string    `json:"error,omitempty"`
+}
+
+// RedirectStats counts cluster MOVED/ASK redirects seen by a proxy
+type RedirectStats struct {
+	Moved       uint64 `json:"moved"`
+	Ask         uint64 `json:"ask"`
+	Rewritten   uint64 `json:"rewritten"`
+	UnknownNode uint64 `json:"unknown_node"` // Redirects to nodes without a local proxy
+}
+
+// InstanceInfo describes the discovered Memorystore instance. It never
+// carries credentials so it can be served to other sidecars as-is.
+type InstanceInfo struct {
+	Name                  string             `json:"name"`
+	Type                  string             `json:"type"`
+	TransitEncryptionMode string             `json:"transit_encryption_mode"`
+	AuthorizationMode     string             `json:"authorization_mode"`
+	RequiresTLS           bool               `json:"requires_tls"`
+	Endpoints             []InstanceEndpoint `json:"endpoints"`
+	CAFingerprints        []string           `json:"ca_fingerprints_sha256,omitempty"`
+	DiscoveredAt          time.Time          `json:"discovered_at"`
+}
+
+// InstanceEndpoint is a discovered endpoint and the local address proxying it
+type InstanceEndpoint struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Type      string `json:"type"`
+	LocalAddr string `json:"local_addr,omitempty"`
+}
+
+// ConnectionInfo describes a single proxied client connection
+type ConnectionInfo struct {
+	ID              uint64    `json:"id"`
+	ClientAddr      string    `json:"client_addr"`
+	LocalAddr       string    `json:"local_addr"`
+	RemoteAddr      string    `json:"remote_addr"`
+	EndpointType    string    `json:"endpoint_type"`
+	StartedAt       time.Time `json:"started_at"`
+	Age             string    `json:"age"`
+	BytesToUpstream uint64    `json:"bytes_to_upstream"`
+	BytesToClient   uint64    `json:"bytes_to_client"`
+	TLS             bool      `json:"tls"`
+	TLSVersion      string    `json:"tls_version,omitempty"`
+	Protocol        int       `json:"protocol,omitempty"` // Negotiated RESP version; 0 when the connection isn't parsed
+}
+
+// ConnectionsProvider supplies the active connections for the /connections endpoint
+type ConnectionsProvider interface {
+	Connections() []ConnectionInfo
+}
+
+// Topology describes how remote endpoints are mapped to local proxy ports
+type Topology struct {
+	ClusterMode bool           `json:"cluster_mode"`
+	Nodes       []TopologyNode `json:"nodes"`
+}
+
+// TopologyNode is a single remote endpoint or cluster node
+type TopologyNode struct {
+	ID           string `json:"id,omitempty"`
+	Role         string `json:"role,omitempty"`
+	Flags        string `json:"flags,omitempty"`
+	RemoteAddr   string `json:"remote_addr"`
+	LocalAddr    string `json:"local_addr,omitempty"` // Empty if the node has no local proxy
+	EndpointType string `json:"endpoint_type,omitempty"`
+}
+
+// TopologyProvider supplies the remote->local mapping for the /topology endpoint
+type TopologyProvider interface {
+	Topology() Topology
+}
+
+// UpstreamHealth is the result of the last readiness PING to one upstream endpoint
+type UpstreamHealth struct {
+	LocalAddr  string     `json:"local_addr"`
+	RemoteAddr string     `json:"remote_addr"`
+	Healthy    bool       `json:"healthy"`
+	LastCheck  *time.Time `json:"last_check,omitempty"`
+	Latency    string     `json:"latency,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// UpstreamHealthProvider supplies upstream reachability for /readyz
+type UpstreamHealthProvider interface {
+	UpstreamHealth() []UpstreamHealth
+}
+
+// readyResponse is the body of /readyz
+type readyResponse struct {
+	Status    string           `json:"status"`
+	Upstreams []UpstreamHealth `json:"upstreams,omitempty"`
+}
+
+// ProxyStatsProvider supplies per-proxy counters for the /status endpoint
+type ProxyStatsProvider interface {
+	ProxyStats() []ProxyStats
 }
 
 // NewServer creates a new health check server
@@ -39,6 +217,103 @@ func NewServer(port int) *Server {
 	}
 }
 
+// SetMetricsGatherer sets the Prometheus gatherer served on /metrics
+// Must be called before Start
+func (s *Server) SetMetricsGatherer(gatherer prometheus.Gatherer) {
+	s.gatherer = gatherer
+}
+
+// SetBuildInfo sets the version information reported on /status
+func (s *Server) SetBuildInfo(info BuildInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.build = info
+}
+
+// SetQuitFunc enables POST /quitquitquit, which calls quit to request a
+// graceful shutdown. Must be called before Start.
+func (s *Server) SetQuitFunc(quit func()) {
+	s.quit = quit
+}
+
+// EnableLogLevelPut enables PUT /loglevel, which changes the log level.
+// Must be called before Start.
+func (s *Server) EnableLogLevelPut() {
+	s.levelPut = true
+}
+
+// SetDrainFunc enables POST /drain, which marks the server as draining and
+// calls drain to start a graceful shutdown. Must be called before Start.
+func (s *Server) SetDrainFunc(drain func()) {
+	s.drain = drain
+}
+
+// SetDraining makes readiness fail permanently so traffic moves elsewhere
+// while existing connections finish
+func (s *Server) SetDraining() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+}
+
+// SetProxyStatsProvider sets the source of per-proxy counters reported on /status
+func (s *Server) SetProxyStatsProvider(provider ProxyStatsProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxyStats = provider
+}
+
+// SetConnectionsProvider sets the source of active connections reported on /connections
+func (s *Server) SetConnectionsProvider(provider ConnectionsProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns = provider
+}
+
+// SetTopologyProvider sets the source of the remote->local mapping reported on /topology
+func (s *Server) SetTopologyProvider(provider TopologyProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.topology = provider
+}
+
+// SetInstanceInfo publishes discovery results on /instance
+func (s *Server) SetInstanceInfo(info *InstanceInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instance = info
+}
+
+// RecordDiscovery records the result of a discovery attempt for /status
+// A failed attempt keeps the endpoint count and time of the last success
+func (s *Server) RecordDiscovery(instanceName string, endpointCount int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := DiscoveryStatus{InstanceName: instanceName}
+	if s.discovery != nil {
+		d = *s.discovery
+		d.InstanceName = instanceName
+	}
+	now := time.Now()
+	if err != nil {
+		d.LastError = err.Error()
+		d.LastErrorAt = &now
+	} else {
+		d.EndpointCount = endpointCount
+		d.LastDiscovery = &now
+	}
+	s.discovery = &d
+}
+
+// SetUpstreamHealthProvider makes /readyz also require every upstream endpoint
+// to have passed its last PING check
+func (s *Server) SetUpstreamHealthProvider(provider UpstreamHealthProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upstreams = provider
+}
+
 // Start starts the health check HTTP server
 func (s *Server) Start() error {
 	mux := http.NewServeMux()
@@ -54,6 +329,34 @@ func (s *Server) Start() error {
 	// Status endpoint - detailed status information
 	mux.HandleFunc("/status", s.handleStatus)
 
+	// Connections endpoint - every active proxied connection
+	mux.HandleFunc("/connections", s.handleConnections)
+
+	// Instance endpoint - discovery results for other sidecars
+	mux.HandleFunc("/instance", s.handleInstance)
+
+	// Topology endpoint - remote endpoints/cluster nodes and their local ports
+	mux.HandleFunc("/topology", s.handleTopology)
+
+	// Log level - GET to read, PUT (only if enabled) to change verbosity without a restart
+	mux.HandleFunc("/loglevel", s.handleLogLevel)
+
+	// Graceful shutdown for sidecars of Jobs, like cloud-sql-proxy and Envoy
+	if s.quit != nil {
+		mux.HandleFunc("/quitquitquit", s.handleQuit)
+	}
+	if s.drain != nil {
+		mux.HandleFunc("/drain", s.handleDrain)
+	}
+
+	// Runtime counters published via expvar
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	// Metrics endpoint - Prometheus exposition format
+	if s.gatherer != nil {
+		mux.Handle("/metrics", promhttp.HandlerFor(s.gatherer, promhttp.HandlerOpts{}))
+	}
+
 	s.server = &http.Server{
 		Addr:              fmt.Sprintf(":%d", s.port),
 		Handler:           mux,
@@ -62,9 +365,17 @@ func (s *Server) Start() error {
 		ReadHeaderTimeout: 2 * time.Second,
 	}
 
+	if s.listener == nil {
+		ln, err := net.Listen("tcp", s.server.Addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.server.Addr, err)
+		}
+		s.listener = ln
+	}
+
 	go func() {
 		logger.Info(fmt.Sprintf("Health check server listening on :%d", s.port))
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
 			logger.Error(fmt.Sprintf("Health server error: %v", err))
 		}
 	}()
@@ -72,6 +383,17 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// SetListener makes Start serve on ln, a socket handed over by the previous
+// process, instead of binding the port
+func (s *Server) SetListener(ln net.Listener) {
+	s.listener = ln
+}
+
+// Listener returns the socket the server accepts on, for handing over to a new process
+func (s *Server) Listener() net.Listener {
+	return s.listener
+}
+
 // Stop stops the health check server
 func (s *Server) Stop() error {
 	if s.server != nil {
@@ -98,31 +420,86 @@ func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
 }
 
 // handleReady handles /ready and /readyz endpoints
+// With an upstream health provider, every upstream must also be reachable
 func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
-	ready := s.ready
+	ready := s.ready && !s.draining
+	draining := s.draining
+	upstreams := s.upstreams
 	s.mu.RUnlock()
 
+	var resp readyResponse
+	if ready && upstreams != nil {
+		resp.Upstreams = upstreams.UpstreamHealth()
+		for _, u := range resp.Upstreams {
+			if !u.Healthy {
+				ready = false
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	if ready {
+		resp.Status = "ready"
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "ready",
-		})
+	} else if draining {
+		resp.Status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
 	} else {
+		resp.Status = "not ready"
 		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status": "not ready",
-		})
 	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleQuit handles POST /quitquitquit
+func (s *Server) handleQuit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info(fmt.Sprintf("Shutdown requested via /quitquitquit from %s", r.RemoteAddr))
+	s.quit()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "shutting down",
+	})
+}
+
+// handleDrain handles POST /drain
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info(fmt.Sprintf("Drain requested via /drain from %s", r.RemoteAddr))
+	s.SetDraining()
+	s.drain()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "draining",
+	})
 }
 
 // handleStatus handles /status endpoint
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
-	ready := s.ready
+	ready := s.ready && !s.draining
+	draining := s.draining
 	proxyCount := s.proxyCount
+	proxyStats := s.proxyStats
+	instance := s.instance
+	discovery := s.discovery
+	build := s.build
 	s.mu.RUnlock()
 
 	uptime := time.Since(s.startTime).Round(time.Second)
@@ -132,9 +509,125 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		Ready:      ready,
 		Uptime:     uptime.String(),
 		ProxyCount: proxyCount,
+		Version:    build.Version,
+		GitCommit:  build.GitCommit,
+		BuildTime:  build.BuildTime,
+		GoVersion:  build.GoVersion,
+		Discovery:  discovery,
+	}
+
+	if draining {
+		status.Status = "draining"
+	}
+
+	if instance != nil {
+		status.InstanceType = instance.Type
+	}
+
+	if proxyStats != nil {
+		status.Proxies = proxyStats.ProxyStats()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(status)
 }
+
+// handleInstance handles the /instance endpoint
+// Returns 503 until discovery has completed
+func (s *Server) handleInstance(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	instance := s.instance
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if instance == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "discovery pending"})
+		return
+	}
+	json.NewEncoder(w).Encode(instance)
+}
+
+// connectionsResponse is the body returned by /connections
+type connectionsResponse struct {
+	Count       int              `json:"count"`
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// handleConnections handles the /connections endpoint
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	provider := s.conns
+	s.mu.RUnlock()
+
+	resp := connectionsResponse{Connections: []ConnectionInfo{}}
+	if provider != nil {
+		if conns := provider.Connections(); conns != nil {
+			resp.Connections = conns
+		}
+	}
+	resp.Count = len(resp.Connections)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleTopology handles the /topology endpoint
+func (s *Server) handleTopology(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	provider := s.topology
+	s.mu.RUnlock()
+
+	topology := Topology{Nodes: []TopologyNode{}}
+	if provider != nil {
+		topology = provider.Topology()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topology)
+}
+
+// logLevelResponse is the body returned by /loglevel
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// handleLogLevel handles /loglevel. PUT, if enabled, accepts either a plain
+// level name ("debug") or a JSON body ({"level":"debug"})
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	allow := "GET"
+	if s.levelPut {
+		allow = "GET, PUT"
+	}
+	switch {
+	case r.Method == http.MethodGet:
+	case r.Method == http.MethodPut && s.levelPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(string(body))
+		if strings.HasPrefix(name, "{") {
+			var req logLevelResponse
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+				return
+			}
+			name = req.Level
+		}
+		if err := logger.SetLevel(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info(fmt.Sprintf("Log level changed to %s", logger.Level()))
+	default:
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevelResponse{Level: logger.Level()})
+}
@@ -0,0 +1,306 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+type fakeProxyStats []ProxyStats
+
+func (f fakeProxyStats) ProxyStats() []ProxyStats {
+	return f
+}
+
+func TestHandleStatusIncludesProxyStats(t *testing.T) {
+	s := NewServer(0)
+	s.SetReady(1)
+	s.SetBuildInfo(BuildInfo{Version: "v1.2.3", GitCommit: "abc1234", BuildTime: "2024-01-01_00:00:00"})
+	s.SetProxyStatsProvider(fakeProxyStats{
+		{LocalAddr: "127.0.0.1:6379", RemoteAddr: "10.0.0.1:6379", ActiveConnections: 3, TotalConnections: 10},
+	})
+
+	rec := httptest.NewRecorder()
+	s.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+
+	if status.Version != "v1.2.3" || status.GitCommit != "abc1234" || status.BuildTime != "2024-01-01_00:00:00" {
+		t.Errorf("Unexpected build info: %s %s %s", status.Version, status.GitCommit, status.BuildTime)
+	}
+
+	if !status.Ready || status.ProxyCount != 1 {
+		t.Errorf("Expected ready with 1 proxy, got ready=%v count=%d", status.Ready, status.ProxyCount)
+	}
+
+	if len(status.Proxies) != 1 {
+		t.Fatalf("Expected 1 proxy entry, got %d", len(status.Proxies))
+	}
+
+	if status.Proxies[0].LocalAddr != "127.0.0.1:6379" || status.Proxies[0].ActiveConnections != 3 {
+		t.Errorf("Unexpected proxy stats: %+v", status.Proxies[0])
+	}
+}
+
+func TestHandleStatusIncludesDiscovery(t *testing.T) {
+	s := NewServer(0)
+	name := "projects/p/locations/l/instances/cache"
+	s.RecordDiscovery(name, 2, nil)
+	s.RecordDiscovery(name, 0, errors.New("permission denied"))
+
+	rec := httptest.NewRecorder()
+	s.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	d := status.Discovery
+	if d == nil || d.InstanceName != name {
+		t.Fatalf("Expected discovery status for %s, got %+v", name, d)
+	}
+	if d.EndpointCount != 2 || d.LastDiscovery == nil {
+		t.Errorf("Expected last success with 2 endpoints to be kept, got %+v", d)
+	}
+	if d.LastError != "permission denied" || d.LastErrorAt == nil {
+		t.Errorf("Expected last error to be reported, got %+v", d)
+	}
+}
+
+func TestHandleQuit(t *testing.T) {
+	s := NewServer(0)
+	quit := make(chan struct{})
+	s.SetQuitFunc(func() { close(quit) })
+
+	rec := httptest.NewRecorder()
+	s.handleQuit(rec, httptest.NewRequest(http.MethodGet, "/quitquitquit", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for GET, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleQuit(rec, httptest.NewRequest(http.MethodPost, "/quitquitquit", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rec.Code)
+	}
+	select {
+	case <-quit:
+	default:
+		t.Error("Expected quit func to be called")
+	}
+}
+
+func TestHandleDrain(t *testing.T) {
+	s := NewServer(0)
+	s.SetReady(1)
+	drained := false
+	s.SetDrainFunc(func() { drained = true })
+
+	rec := httptest.NewRecorder()
+	s.handleDrain(rec, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if rec.Code != http.StatusAccepted || !drained {
+		t.Fatalf("Expected status 202 and drain func called, got %d (called=%v)", rec.Code, drained)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var resp readyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusServiceUnavailable || resp.Status != "draining" {
+		t.Errorf("Expected 503 draining while draining, got %d %q", rec.Code, resp.Status)
+	}
+}
+
+func TestHandleReadyNotReady(t *testing.T) {
+	s := NewServer(0)
+
+	rec := httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", rec.Code)
+	}
+}
+
+type fakeUpstreams []UpstreamHealth
+
+func (f fakeUpstreams) UpstreamHealth() []UpstreamHealth {
+	return f
+}
+
+func TestHandleReadyRequiresHealthyUpstreams(t *testing.T) {
+	s := NewServer(0)
+	s.SetReady(2)
+	upstreams := fakeUpstreams{
+		{LocalAddr: "127.0.0.1:6379", RemoteAddr: "10.0.0.1:6379", Healthy: true},
+		{LocalAddr: "127.0.0.1:6380", RemoteAddr: "10.0.0.2:6379", Error: "connection refused"},
+	}
+	s.SetUpstreamHealthProvider(upstreams)
+
+	rec := httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 with an unreachable upstream, got %d", rec.Code)
+	}
+	var resp readyResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Status != "not ready" || len(resp.Upstreams) != 2 || resp.Upstreams[1].Error != "connection refused" {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+
+	upstreams[1] = UpstreamHealth{LocalAddr: "127.0.0.1:6380", RemoteAddr: "10.0.0.2:6379", Healthy: true}
+	rec = httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with healthy upstreams, got %d", rec.Code)
+	}
+}
+
+func TestHandleLogLevel(t *testing.T) {
+	s := NewServer(0)
+	t.Cleanup(func() { logger.SetLevel("info") })
+
+	// Changes are refused unless enabled
+	rec := httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader("debug")))
+	if rec.Code != http.StatusMethodNotAllowed || logger.Level() != "info" {
+		t.Errorf("Expected status 405 and level info while disabled, got %d level=%s", rec.Code, logger.Level())
+	}
+	rec = httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodGet, "/loglevel", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected GET to be served while disabled, got %d", rec.Code)
+	}
+
+	s.EnableLogLevelPut()
+	rec = httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader(`{"level":"debug"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if logger.Level() != "debug" {
+		t.Errorf("Expected level debug, got %s", logger.Level())
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader("warn\n")))
+	if rec.Code != http.StatusOK || logger.Level() != "warn" {
+		t.Errorf("Expected plain-text PUT to set warn, got %d level=%s", rec.Code, logger.Level())
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodPut, "/loglevel", strings.NewReader("loud")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown level, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleLogLevel(rec, httptest.NewRequest(http.MethodPost, "/loglevel", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", rec.Code)
+	}
+}
+
+type fakeConnections []ConnectionInfo
+
+func (f fakeConnections) Connections() []ConnectionInfo {
+	return f
+}
+
+func TestHandleConnections(t *testing.T) {
+	s := NewServer(0)
+
+	rec := httptest.NewRecorder()
+	s.handleConnections(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	if !strings.Contains(rec.Body.String(), `"connections":[]`) {
+		t.Errorf("Expected empty list without a provider, got %s", rec.Body.String())
+	}
+
+	s.SetConnectionsProvider(fakeConnections{
+		{ID: 1, ClientAddr: "127.0.0.1:50000", LocalAddr: "127.0.0.1:6379", TLS: true, TLSVersion: "TLS 1.3"},
+	})
+	rec = httptest.NewRecorder()
+	s.handleConnections(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+
+	var resp connectionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Count != 1 || resp.Connections[0].ClientAddr != "127.0.0.1:50000" || !resp.Connections[0].TLS {
+		t.Errorf("Unexpected response: %+v", resp)
+	}
+}
+
+func TestHandleInstance(t *testing.T) {
+	s := NewServer(0)
+
+	rec := httptest.NewRecorder()
+	s.handleInstance(rec, httptest.NewRequest(http.MethodGet, "/instance", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 before discovery, got %d", rec.Code)
+	}
+
+	s.SetInstanceInfo(&InstanceInfo{
+		Name:              "projects/p/locations/l/instances/i",
+		Type:              "valkey",
+		AuthorizationMode: "IAM_AUTH",
+		Endpoints:         []InstanceEndpoint{{Host: "10.0.0.1", Port: 6379, Type: "primary", LocalAddr: "127.0.0.1:6379"}},
+	})
+
+	rec = httptest.NewRecorder()
+	s.handleInstance(rec, httptest.NewRequest(http.MethodGet, "/instance", nil))
+	var info InstanceInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("Failed to decode instance: %v", err)
+	}
+	if rec.Code != http.StatusOK || info.Type != "valkey" || len(info.Endpoints) != 1 || info.Endpoints[0].LocalAddr != "127.0.0.1:6379" {
+		t.Errorf("Unexpected instance response %d: %+v", rec.Code, info)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if !strings.Contains(rec.Body.String(), `"instance_type":"valkey"`) {
+		t.Errorf("Expected instance type in /status, got %s", rec.Body.String())
+	}
+}
+
+func TestDebugVarsServed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer(0)
+	s.SetListener(ln)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer s.Stop()
+	expvar.NewInt("health_test_counter").Add(3)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/debug/vars")
+	if err != nil {
+		t.Fatalf("GET /debug/vars failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("Expected JSON: %v", err)
+	}
+	if got := string(vars["health_test_counter"]); got != "3" {
+		t.Errorf("Expected the published counter to be 3, got %q", got)
+	}
+}
@@ -1,65 +1,328 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Supported output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatGCP  = "gcp" // JSON understood by Cloud Logging (severity, timestamp, labels)
+)
+
+// gcpLabelsKey is the special field Cloud Logging turns into entry labels
+const gcpLabelsKey = "logging.googleapis.com/labels"
+
+// Supported outputs
+const (
+	OutputStdout = "stdout" // Info/debug to stdout, errors to stderr
+	OutputSyslog = "syslog" // Local syslog/journald socket with matching priorities
 )
 
 var (
-	infoLog  *log.Logger
-	errorLog *log.Logger
-	debugLog *log.Logger
-	verbose  bool
+	level  = new(slog.LevelVar)
+	base   = newLogger(stdSinks(os.Stdout, os.Stderr), FormatText, false)
+	format = FormatText
 )
 
-func Init(v bool) {
-	verbose = v
-	infoLog = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime)
-	errorLog = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime)
-	debugLog = log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
+// Init configures the package logger in text, JSON or Cloud Logging format,
+// writing either to stdout/stderr or to syslog
+func Init(verbose bool, f, output string) error {
+	var s sinks
+	switch output {
+	case OutputStdout, "":
+		s = stdSinks(os.Stdout, os.Stderr)
+	case OutputSyslog:
+		var err error
+		if s, err = syslogSinks("cloud-memstore-proxy"); err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown log output %q (expected %q or %q)", output, OutputStdout, OutputSyslog)
+	}
+
+	l, err := build(s, f, verbose)
+	if err != nil {
+		return err
+	}
+	base = l
+	if f != "" {
+		format = f
+	}
+	return nil
 }
 
-func Info(msg string) {
-	if infoLog == nil {
-		Init(false)
+// SetLabels attaches labels to every entry in Cloud Logging format
+// It is a no-op for the other formats, where labels would only add noise
+func SetLabels(labels map[string]string) {
+	if format != FormatGCP || len(labels) == 0 {
+		return
 	}
-	infoLog.Println(msg)
+	base = base.With(slog.Any(gcpLabelsKey, labels))
 }
 
-func Error(msg string) {
-	if errorLog == nil {
-		Init(false)
+// Level returns the current minimum log level ("debug", "info", "warn" or "error")
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+// SetLevel changes the minimum log level at runtime
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+		return fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", name)
 	}
-	errorLog.Println(msg)
+	level.Set(l)
+	return nil
 }
 
-func Debug(msg string) {
-	if !verbose {
-		return
+// sinks are the writers records are sent to, by severity
+type sinks struct {
+	debug, info, warn, err io.Writer
+	stampsTime             bool // The destination records its own timestamps
+}
+
+// stdSinks sends errors to stderr and everything else to stdout
+func stdSinks(stdout, stderr io.Writer) sinks {
+	return sinks{debug: stdout, info: stdout, warn: stdout, err: stderr}
+}
+
+// build validates the format and creates a logger writing to the given sinks
+func build(s sinks, format string, verbose bool) (*slog.Logger, error) {
+	switch format {
+	case FormatText, FormatJSON, FormatGCP:
+	case "":
+		format = FormatText
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected %q, %q or %q)", format, FormatText, FormatJSON, FormatGCP)
 	}
-	if debugLog == nil {
-		Init(false)
+	return newLogger(s, format, verbose), nil
+}
+
+// newLogger creates the underlying slog logger; source locations are only
+// included in verbose mode, matching the old debug output
+func newLogger(s sinks, format string, verbose bool) *slog.Logger {
+	if verbose {
+		level.Set(slog.LevelDebug)
+	} else {
+		level.Set(slog.LevelInfo)
 	}
-	debugLog.Println(msg)
+
+	opts := &slog.HandlerOptions{Level: level, AddSource: verbose}
+	switch {
+	case format == FormatGCP:
+		opts.ReplaceAttr = gcpReplaceAttr
+	case s.stampsTime:
+		opts.ReplaceAttr = dropTime
+	}
+	newHandler := func(w io.Writer) slog.Handler {
+		if format == FormatText {
+			return slog.NewTextHandler(w, opts)
+		}
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	return slog.New(&levelHandler{
+		debug: newHandler(s.debug),
+		info:  newHandler(s.info),
+		warn:  newHandler(s.warn),
+		err:   newHandler(s.err),
+	})
+}
+
+// dropTime removes the record timestamp for destinations that add their own
+func dropTime(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return a
+}
+
+// gcpReplaceAttr renames the built-in slog fields to the ones Cloud Logging
+// recognises in a structured jsonPayload
+func gcpReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		return slog.String("severity", gcpSeverity(a.Value.Any().(slog.Level)))
+	case slog.TimeKey:
+		return slog.String("timestamp", a.Value.Time().UTC().Format(time.RFC3339Nano))
+	case slog.MessageKey:
+		a.Key = "message"
+	case slog.SourceKey:
+		a.Key = "logging.googleapis.com/sourceLocation"
+	}
+	return a
+}
+
+// gcpSeverity maps slog levels to Cloud Logging severities
+func gcpSeverity(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "ERROR"
+	case l >= slog.LevelWarn:
+		return "WARNING"
+	case l >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// levelHandler routes each record to the handler for its severity
+type levelHandler struct {
+	debug, info, warn, err slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.info.Enabled(ctx, l)
 }
 
-func Fatal(msg string) {
-	if errorLog == nil {
-		Init(false)
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.err.Handle(ctx, r)
+	case r.Level >= slog.LevelWarn:
+		return h.warn.Handle(ctx, r)
+	case r.Level >= slog.LevelInfo:
+		return h.info.Handle(ctx, r)
+	default:
+		return h.debug.Handle(ctx, r)
 	}
-	errorLog.Println(msg)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{
+		debug: h.debug.WithAttrs(attrs),
+		info:  h.info.WithAttrs(attrs),
+		warn:  h.warn.WithAttrs(attrs),
+		err:   h.err.WithAttrs(attrs),
+	}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{
+		debug: h.debug.WithGroup(name),
+		info:  h.info.WithGroup(name),
+		warn:  h.warn.WithGroup(name),
+		err:   h.err.WithGroup(name),
+	}
+}
+
+// Logger is a logger carrying a fixed set of structured fields
+// (e.g. proxy port, remote endpoint, client address)
+type Logger struct {
+	attrs []any
+}
+
+// With returns a Logger that adds the given key/value pairs to every record
+func With(args ...any) Logger {
+	return Logger{attrs: redactArgs(args)}
+}
+
+// With returns a Logger with additional key/value pairs
+func (l Logger) With(args ...any) Logger {
+	attrs := make([]any, 0, len(l.attrs)+len(args))
+	attrs = append(attrs, l.attrs...)
+	return Logger{attrs: append(attrs, redactArgs(args)...)}
+}
+
+// Debug logs a debug message with optional key/value pairs
+func (l Logger) Debug(msg string, args ...any) {
+	write(slog.LevelDebug, msg, l.attrs, args)
+}
+
+// Info logs an informational message with optional key/value pairs
+func (l Logger) Info(msg string, args ...any) {
+	write(slog.LevelInfo, msg, l.attrs, args)
+}
+
+// Error logs an error message with optional key/value pairs
+func (l Logger) Error(msg string, args ...any) {
+	write(slog.LevelError, msg, l.attrs, args)
+}
+
+// write emits a record, attributing it to the caller of the public logging function
+func write(lvl slog.Level, msg string, attrs, args []any) {
+	ctx := context.Background()
+	if !base.Enabled(ctx, lvl) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, write and the public wrapper
+	r := slog.NewRecord(time.Now(), lvl, Redact(msg), pcs[0])
+	r.Add(attrs...)
+	r.Add(redactArgs(args)...)
+	_ = base.Handler().Handle(ctx, r)
+}
+
+// redactArgs masks credentials in string and error field values
+func redactArgs(args []any) []any {
+	var out []any
+	for i, arg := range args {
+		var v any
+		switch a := arg.(type) {
+		case string:
+			v = Redact(a)
+		case error:
+			v = Redact(a.Error())
+		case slog.Attr:
+			if a.Value.Kind() == slog.KindString {
+				v = slog.String(a.Key, Redact(a.Value.String()))
+			}
+		}
+		if v == nil {
+			continue
+		}
+		if out == nil {
+			out = append([]any(nil), args...)
+		}
+		out[i] = v
+	}
+	if out == nil {
+		return args
+	}
+	return out
+}
+
+func Info(msg string, args ...any) {
+	write(slog.LevelInfo, msg, nil, args)
+}
+
+func Error(msg string, args ...any) {
+	write(slog.LevelError, msg, nil, args)
+}
+
+func Debug(msg string, args ...any) {
+	write(slog.LevelDebug, msg, nil, args)
+}
+
+func Fatal(msg string, args ...any) {
+	write(slog.LevelError, msg, nil, args)
 	os.Exit(1)
 }
 
 func Debugf(format string, args ...interface{}) {
-	Debug(fmt.Sprintf(format, args...))
+	if !base.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	write(slog.LevelDebug, fmt.Sprintf(format, args...), nil, nil)
 }
 
 func Infof(format string, args ...interface{}) {
-	Info(fmt.Sprintf(format, args...))
+	write(slog.LevelInfo, fmt.Sprintf(format, args...), nil, nil)
 }
 
 func Errorf(format string, args ...interface{}) {
-	Error(fmt.Sprintf(format, args...))
+	write(slog.LevelError, fmt.Sprintf(format, args...), nil, nil)
 }
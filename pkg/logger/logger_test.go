@@ -0,0 +1,156 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// capture swaps the package logger for one writing to buffers
+func capture(t *testing.T, format string, verbose bool) (stdout, stderr *bytes.Buffer) {
+	t.Helper()
+	stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+	l, err := build(stdSinks(stdout, stderr), format, verbose)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	prev := base
+	base = l
+	t.Cleanup(func() { base = prev })
+	return stdout, stderr
+}
+
+func TestJSONFieldsAndRouting(t *testing.T) {
+	stdout, stderr := capture(t, FormatJSON, false)
+
+	log := With("conn_id", uint64(42), "local_addr", "127.0.0.1:6379")
+	log.Info("New connection", "client_addr", "127.0.0.1:50000")
+	log.Error("Upstream authentication failed")
+
+	var rec map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &rec); err != nil {
+		t.Fatalf("stdout is not a JSON record: %v (%q)", err, stdout.String())
+	}
+	if rec["msg"] != "New connection" || rec["level"] != "INFO" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+	if rec["conn_id"] != float64(42) || rec["local_addr"] != "127.0.0.1:6379" || rec["client_addr"] != "127.0.0.1:50000" {
+		t.Errorf("Missing structured fields: %v", rec)
+	}
+
+	if !strings.Contains(stderr.String(), `"level":"ERROR"`) || !strings.Contains(stderr.String(), `"conn_id":42`) {
+		t.Errorf("Expected error record on stderr, got %q", stderr.String())
+	}
+}
+
+func TestDebugRequiresVerbose(t *testing.T) {
+	stdout, _ := capture(t, FormatText, false)
+	Debug("hidden")
+	Debugf("hidden %d", 1)
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no debug output, got %q", stdout.String())
+	}
+
+	stdout, _ = capture(t, FormatText, true)
+	Debug("shown")
+	out := stdout.String()
+	if !strings.Contains(out, "level=DEBUG") || !strings.Contains(out, "msg=shown") {
+		t.Errorf("Expected debug record, got %q", out)
+	}
+	if !strings.Contains(out, "logger_test.go") {
+		t.Errorf("Expected source to point at the caller, got %q", out)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := build(stdSinks(&bytes.Buffer{}, &bytes.Buffer{}), "xml", false); err == nil {
+		t.Error("Expected error for unknown log format")
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	stdout, _ := capture(t, FormatText, false)
+	t.Cleanup(func() { SetLevel("info") })
+
+	if err := SetLevel("DEBUG"); err != nil {
+		t.Fatalf("SetLevel failed: %v", err)
+	}
+	if Level() != "debug" {
+		t.Errorf("Expected level debug, got %s", Level())
+	}
+	Debug("now visible")
+	if !strings.Contains(stdout.String(), "now visible") {
+		t.Errorf("Expected debug output after raising level, got %q", stdout.String())
+	}
+
+	if err := SetLevel("loud"); err == nil {
+		t.Error("Expected error for unknown level")
+	}
+	if Level() != "debug" {
+		t.Errorf("Invalid level should not change the current level, got %s", Level())
+	}
+}
+
+func TestGCPFormat(t *testing.T) {
+	stdout, stderr := capture(t, FormatGCP, false)
+	prevFormat := format
+	format = FormatGCP
+	t.Cleanup(func() { format = prevFormat })
+
+	SetLabels(map[string]string{"instance": "my-instance"})
+	Info("Proxy started", "local_addr", "127.0.0.1:6379")
+	Error("Upstream connection failed")
+
+	var rec map[string]any
+	if err := json.Unmarshal(stdout.Bytes(), &rec); err != nil {
+		t.Fatalf("stdout is not a JSON record: %v (%q)", err, stdout.String())
+	}
+	if rec["severity"] != "INFO" || rec["message"] != "Proxy started" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+	if _, ok := rec["timestamp"].(string); !ok {
+		t.Errorf("Expected timestamp field, got %v", rec)
+	}
+	labels, _ := rec[gcpLabelsKey].(map[string]any)
+	if labels["instance"] != "my-instance" {
+		t.Errorf("Expected labels, got %v", rec[gcpLabelsKey])
+	}
+	if !strings.Contains(stderr.String(), `"severity":"ERROR"`) {
+		t.Errorf("Expected ERROR severity on stderr, got %q", stderr.String())
+	}
+}
+
+func TestSinksBySeverity(t *testing.T) {
+	var debug, info, warn, errs bytes.Buffer
+	l, err := build(sinks{debug: &debug, info: &info, warn: &warn, err: &errs, stampsTime: true}, FormatText, true)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	prev := base
+	base = l
+	t.Cleanup(func() { base = prev; SetLevel("info") })
+
+	Debug("d")
+	Info("i")
+	With("conn_id", 1).Error("e")
+	base.Warn("w")
+
+	for name, tc := range map[string]struct {
+		buf  *bytes.Buffer
+		want string
+	}{
+		"debug": {&debug, "msg=d"},
+		"info":  {&info, "msg=i"},
+		"warn":  {&warn, "msg=w"},
+		"error": {&errs, "msg=e conn_id=1"},
+	} {
+		out := tc.buf.String()
+		if !strings.Contains(out, tc.want) || strings.Count(out, "\n") != 1 {
+			t.Errorf("%s sink: expected one record containing %q, got %q", name, tc.want, out)
+		}
+		if strings.Contains(out, "time=") {
+			t.Errorf("%s sink: timestamp should be omitted when the sink stamps its own, got %q", name, out)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package logger
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credential values in log output
+const redacted = "[REDACTED]"
+
+// maxSecrets bounds the registry so rotating tokens do not grow it forever.
+// Pinned secrets are bounded separately, so tokens never evict them.
+const maxSecrets = 16
+
+// minSecretLength avoids replacing short strings that would mangle unrelated output
+const minSecretLength = 4
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+	pinned    []string // Added by PinSecret
+
+	// redactPatterns match credentials by shape, independent of the registry
+	redactPatterns = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		// Authorization: Bearer <token>
+		{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+		// Google OAuth2 access tokens
+		{regexp.MustCompile(`ya29\.[A-Za-z0-9._-]+`), redacted},
+		// JSON or key=value credential fields, e.g. "authString": "..." or password=...
+		{regexp.MustCompile(`(?i)("?(?:authString|access_token|password|token)"?\s*[:=]\s*"?)[^"\s,}]+`), "${1}" + redacted},
+		// RESP AUTH [username] password
+		{regexp.MustCompile(`(?i)(AUTH(?:\r\n\$\d+\r\n[^\r\n]*)?\r\n\$\d+\r\n)[^\r\n]*`), "${1}" + redacted},
+	}
+)
+
+// AddSecret registers a short-lived credential (token) that must never appear
+// in log output. Only the most recent secrets are kept.
+func AddSecret(secret string) {
+	register(&secrets, secret)
+}
+
+// PinSecret registers a long-lived credential (password) that must never
+// appear in log output. Pinned secrets are kept however many tokens are added
+// with AddSecret; only the most recent ones are kept across rotations.
+func PinSecret(secret string) {
+	register(&pinned, secret)
+}
+
+func register(list *[]string, secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range *list {
+		if s == secret {
+			return
+		}
+	}
+	*list = append(*list, secret)
+	if len(*list) > maxSecrets {
+		*list = (*list)[len(*list)-maxSecrets:]
+	}
+}
+
+// MaskSecrets replaces registered secrets in s, but not other
+// credential-shaped text; for output that is not a log message
+func MaskSecrets(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range pinned {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// Redact masks registered secrets and anything shaped like a credential
+func Redact(s string) string {
+	s = MaskSecrets(s)
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
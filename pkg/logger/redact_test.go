@@ -0,0 +1,85 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		secret string // Must not survive redaction
+	}{
+		{"bearer header", "Authorization: Bearer abc.def-123", "abc.def-123"},
+		{"access token", "token ya29.a0AfH6SMBx-yz_1 expired", "ya29.a0AfH6SMBx-yz_1"},
+		{"json authString", `{"authString": "s3cr3t-pass", "port": 6379}`, "s3cr3t-pass"},
+		{"key value", "password=hunter22 user=default", "hunter22"},
+		{"resp auth", "*2\r\n$4\r\nAUTH\r\n$8\r\nhunter22\r\n", "hunter22"},
+		{"resp auth with user", "*3\r\n$4\r\nAUTH\r\n$7\r\ndefault\r\n$8\r\nhunter22\r\n", "hunter22"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Redact(tt.input)
+			if strings.Contains(got, tt.secret) {
+				t.Errorf("Redact(%q) = %q still contains %q", tt.input, got, tt.secret)
+			}
+			if !strings.Contains(got, redacted) {
+				t.Errorf("Redact(%q) = %q, expected %s marker", tt.input, got, redacted)
+			}
+		})
+	}
+
+	if got := Redact("Upstream authentication failed: -WRONGPASS"); got != "Upstream authentication failed: -WRONGPASS" {
+		t.Errorf("Unexpected change to credential-free message: %q", got)
+	}
+}
+
+func TestAddSecret(t *testing.T) {
+	t.Cleanup(func() { secrets = nil })
+
+	AddSecret("abc") // Too short to register
+	AddSecret("opaque-password")
+	if got := Redact("server said opaque-password abc"); got != "server said [REDACTED] abc" {
+		t.Errorf("Unexpected redaction: %q", got)
+	}
+
+	for i := 0; i < maxSecrets+5; i++ {
+		AddSecret(strings.Repeat("x", i+minSecretLength))
+	}
+	if len(secrets) != maxSecrets {
+		t.Errorf("Expected registry capped at %d, got %d", maxSecrets, len(secrets))
+	}
+}
+
+func TestPinnedSecretSurvivesTokenRotation(t *testing.T) {
+	t.Cleanup(func() { secrets, pinned = nil, nil })
+
+	PinSecret("instance-password")
+	for i := 0; i < maxSecrets+5; i++ {
+		AddSecret(strings.Repeat("t", i+minSecretLength))
+	}
+	if got := MaskSecrets("WRONGPASS instance-password"); got != "WRONGPASS [REDACTED]" {
+		t.Errorf("Expected the pinned password to stay masked, got %q", got)
+	}
+	if got := MaskSecrets("password=hunter22"); got != "password=hunter22" {
+		t.Errorf("Expected MaskSecrets to leave unregistered values alone, got %q", got)
+	}
+}
+
+func TestLogOutputIsRedacted(t *testing.T) {
+	stdout, stderr := capture(t, FormatText, true)
+	t.Cleanup(func() { SetLevel("info") })
+
+	Debug("request headers: Authorization: Bearer tok-123")
+	Errorf("authentication failed: %s", `{"authString":"pw-456"}`)
+	With("header", "Bearer tok-789").Info("sent")
+
+	out := stdout.String() + stderr.String()
+	for _, secret := range []string{"tok-123", "pw-456", "tok-789"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Log output leaked %q: %s", secret, out)
+		}
+	}
+}
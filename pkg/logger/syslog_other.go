@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package logger
+
+import "errors"
+
+// syslogSinks is unavailable on platforms without log/syslog
+func syslogSinks(tag string) (sinks, error) {
+	return sinks{}, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"log/syslog"
+)
+
+// syslogSinks connects to the local syslog daemon (journald also listens on
+// /dev/log) and maps each severity to the matching syslog priority
+func syslogSinks(tag string) (sinks, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return sinks{}, err
+	}
+	return sinks{
+		debug:      priorityWriter(w.Debug),
+		info:       priorityWriter(w.Info),
+		warn:       priorityWriter(w.Warning),
+		err:        priorityWriter(w.Err),
+		stampsTime: true,
+	}, nil
+}
+
+// priorityWriter adapts a syslog.Writer method to io.Writer
+type priorityWriter func(string) error
+
+func (f priorityWriter) Write(p []byte) (int, error) {
+	if err := f(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,286 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/metadata"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	apiEndpoint = "https://monitoring.googleapis.com/v3"
+
+	// metricPrefix selects the proxy's own metrics from the registry
+	metricPrefix = "memstore_proxy_"
+
+	// metricTypePrefix is where the proxy's custom metrics live in Cloud Monitoring
+	metricTypePrefix = "custom.googleapis.com/memstore_proxy/"
+
+	// maxSeriesPerRequest is the timeSeries.create limit
+	maxSeriesPerRequest = 200
+)
+
+// Exporter periodically writes proxy metrics to Cloud Monitoring as custom
+// metrics, authenticated with Application Default Credentials
+type Exporter struct {
+	client    *http.Client
+	endpoint  string
+	project   string
+	gatherer  prometheus.Gatherer
+	interval  time.Duration
+	resource  monitoredResource
+	startTime time.Time // Start of the cumulative interval for counters and histograms
+}
+
+// NewExporter creates an exporter writing to the given project. Points are
+// attached to a generic_node resource identifying this proxy host.
+func NewExporter(ctx context.Context, project string, gatherer prometheus.Gatherer, interval time.Duration) (*Exporter, error) {
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/monitoring.write")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	return &Exporter{
+		client:    oauth2.NewClient(ctx, creds.TokenSource),
+		endpoint:  apiEndpoint,
+		project:   project,
+		gatherer:  gatherer,
+		interval:  interval,
+		resource:  detectResource(ctx, project),
+		startTime: time.Now(),
+	}, nil
+}
+
+// detectResource builds the generic_node resource, using the GCE zone as the
+// location when the metadata server is reachable
+func detectResource(ctx context.Context, project string) monitoredResource {
+	location := "global"
+	if zone, err := metadata.NewGCPMetadata().GetZone(ctx); err == nil {
+		location = zone
+	}
+
+	nodeID, err := os.Hostname()
+	if err != nil {
+		nodeID = "unknown"
+	}
+
+	return monitoredResource{
+		Type: "generic_node",
+		Labels: map[string]string{
+			"project_id": project,
+			"location":   location,
+			"namespace":  "cloud-memstore-proxy",
+			"node_id":    nodeID,
+		},
+	}
+}
+
+// Run exports metrics every interval until ctx is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.export(ctx); err != nil {
+				logger.Error(fmt.Sprintf("Cloud Monitoring export failed: %v", err))
+			}
+		}
+	}
+}
+
+// export gathers the current metrics and writes them in batches
+func (e *Exporter) export(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	series := e.timeSeries(families, time.Now())
+	for start := 0; start < len(series); start += maxSeriesPerRequest {
+		end := min(start+maxSeriesPerRequest, len(series))
+		if err := e.write(ctx, series[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends one timeSeries.create request
+func (e *Exporter) write(ctx context.Context, series []timeSeries) error {
+	body, err := json.Marshal(createRequest{TimeSeries: series})
+	if err != nil {
+		return fmt.Errorf("failed to encode time series: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/projects/%s/timeSeries", e.endpoint, e.project)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write time series: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("timeSeries.create returned status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// timeSeries converts metric families into Cloud Monitoring time series:
+// gauges as GAUGE doubles, counters as CUMULATIVE doubles and histograms as
+// CUMULATIVE distributions
+func (e *Exporter) timeSeries(families []*dto.MetricFamily, now time.Time) []timeSeries {
+	end := now.UTC().Format(time.RFC3339Nano)
+	start := e.startTime.UTC().Format(time.RFC3339Nano)
+
+	var out []timeSeries
+	for _, mf := range families {
+		name := mf.GetName()
+		if !strings.HasPrefix(name, metricPrefix) {
+			continue
+		}
+		metricType := metricTypePrefix + strings.TrimPrefix(name, metricPrefix)
+
+		for _, m := range mf.GetMetric() {
+			ts := timeSeries{
+				Metric:   metricDescriptor{Type: metricType, Labels: labels(m)},
+				Resource: e.resource,
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				v := m.GetGauge().GetValue()
+				ts.MetricKind, ts.ValueType = "GAUGE", "DOUBLE"
+				ts.Points = []point{{Interval: interval{EndTime: end}, Value: typedValue{DoubleValue: &v}}}
+			case dto.MetricType_COUNTER:
+				v := m.GetCounter().GetValue()
+				ts.MetricKind, ts.ValueType = "CUMULATIVE", "DOUBLE"
+				ts.Points = []point{{Interval: interval{StartTime: start, EndTime: end}, Value: typedValue{DoubleValue: &v}}}
+			case dto.MetricType_HISTOGRAM:
+				ts.MetricKind, ts.ValueType = "CUMULATIVE", "DISTRIBUTION"
+				ts.Points = []point{{Interval: interval{StartTime: start, EndTime: end}, Value: typedValue{DistributionValue: toDistribution(m.GetHistogram())}}}
+			default:
+				continue
+			}
+			out = append(out, ts)
+		}
+	}
+	return out
+}
+
+// toDistribution converts cumulative Prometheus buckets into per-bucket counts
+// with an explicit-bounds layout (underflow bucket first, overflow bucket last)
+func toDistribution(h *dto.Histogram) *distribution {
+	d := &distribution{Count: strconv.FormatUint(h.GetSampleCount(), 10)}
+	if h.GetSampleCount() > 0 {
+		d.Mean = h.GetSampleSum() / float64(h.GetSampleCount())
+	}
+
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		d.BucketOptions.ExplicitBuckets.Bounds = append(d.BucketOptions.ExplicitBuckets.Bounds, b.GetUpperBound())
+		d.BucketCounts = append(d.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+		prev = b.GetCumulativeCount()
+	}
+	d.BucketCounts = append(d.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+	return d
+}
+
+// labels converts Prometheus labels into metric labels
+func labels(m *dto.Metric) map[string]string {
+	if len(m.GetLabel()) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		out[lp.GetName()] = lp.GetValue()
+	}
+	return out
+}
+
+// ProjectFromInstance extracts the project ID from a full instance name
+// (projects/PROJECT/locations/LOCATION/instances/NAME)
+func ProjectFromInstance(instanceName string) (string, error) {
+	parts := strings.Split(instanceName, "/")
+	if len(parts) < 2 || parts[0] != "projects" || parts[1] == "" {
+		return "", fmt.Errorf("cannot determine project from instance name %q", instanceName)
+	}
+	return parts[1], nil
+}
+
+// Cloud Monitoring v3 REST types (only the fields the exporter writes)
+
+type createRequest struct {
+	TimeSeries []timeSeries `json:"timeSeries"`
+}
+
+type timeSeries struct {
+	Metric     metricDescriptor  `json:"metric"`
+	Resource   monitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []point           `json:"points"`
+}
+
+type metricDescriptor struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type point struct {
+	Interval interval   `json:"interval"`
+	Value    typedValue `json:"value"`
+}
+
+type interval struct {
+	StartTime string `json:"startTime,omitempty"`
+	EndTime   string `json:"endTime"`
+}
+
+type typedValue struct {
+	DoubleValue       *float64      `json:"doubleValue,omitempty"`
+	DistributionValue *distribution `json:"distributionValue,omitempty"`
+}
+
+type distribution struct {
+	Count         string        `json:"count"` // int64 values are JSON strings in the REST API
+	Mean          float64       `json:"mean"`
+	BucketOptions bucketOptions `json:"bucketOptions"`
+	BucketCounts  []string      `json:"bucketCounts"`
+}
+
+type bucketOptions struct {
+	ExplicitBuckets explicitBuckets `json:"explicitBuckets"`
+}
+
+type explicitBuckets struct {
+	Bounds []float64 `json:"bounds"`
+}
@@ -0,0 +1,113 @@
+package monitoring
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestExporter(reg prometheus.Gatherer, endpoint string) *Exporter {
+	return &Exporter{
+		client:    http.DefaultClient,
+		endpoint:  endpoint,
+		project:   "my-project",
+		gatherer:  reg,
+		resource:  monitoredResource{Type: "generic_node", Labels: map[string]string{"project_id": "my-project"}},
+		startTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "memstore_proxy_connections_total"}, []string{"local_addr"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "memstore_proxy_active_connections"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "memstore_proxy_request_duration_seconds",
+		Buckets: []float64{0.001, 0.01},
+	})
+	reg.MustRegister(counter, gauge, histogram, prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_goroutines"}))
+
+	counter.WithLabelValues("127.0.0.1:6379").Add(3)
+	gauge.Set(2)
+	histogram.Observe(0.0005)
+	histogram.Observe(0.005)
+	histogram.Observe(0.005)
+	histogram.Observe(1)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	e := newTestExporter(reg, "")
+	series := e.timeSeries(families, time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC))
+	if len(series) != 3 {
+		t.Fatalf("Expected 3 series (go_ metrics skipped), got %d", len(series))
+	}
+
+	byType := make(map[string]timeSeries)
+	for _, ts := range series {
+		byType[ts.Metric.Type] = ts
+	}
+
+	c := byType["custom.googleapis.com/memstore_proxy/connections_total"]
+	if c.MetricKind != "CUMULATIVE" || *c.Points[0].Value.DoubleValue != 3 || c.Metric.Labels["local_addr"] != "127.0.0.1:6379" {
+		t.Errorf("Unexpected counter series: %+v", c)
+	}
+	if c.Points[0].Interval.StartTime != "2024-01-01T00:00:00Z" {
+		t.Errorf("Expected cumulative start time, got %q", c.Points[0].Interval.StartTime)
+	}
+
+	g := byType["custom.googleapis.com/memstore_proxy/active_connections"]
+	if g.MetricKind != "GAUGE" || *g.Points[0].Value.DoubleValue != 2 || g.Points[0].Interval.StartTime != "" {
+		t.Errorf("Unexpected gauge series: %+v", g)
+	}
+
+	h := byType["custom.googleapis.com/memstore_proxy/request_duration_seconds"]
+	d := h.Points[0].Value.DistributionValue
+	if h.ValueType != "DISTRIBUTION" || d == nil {
+		t.Fatalf("Unexpected histogram series: %+v", h)
+	}
+	if d.Count != "4" || strings.Join(d.BucketCounts, ",") != "1,2,1" {
+		t.Errorf("Expected count 4 with buckets 1,2,1, got %s with %v", d.Count, d.BucketCounts)
+	}
+}
+
+func TestExportPostsTimeSeries(t *testing.T) {
+	var got createRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/projects/my-project/timeSeries" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "memstore_proxy_active_connections"})
+	reg.MustRegister(gauge)
+
+	if err := newTestExporter(reg, server.URL).export(context.Background()); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if len(got.TimeSeries) != 1 || got.TimeSeries[0].Resource.Type != "generic_node" {
+		t.Errorf("Unexpected request body: %+v", got)
+	}
+}
+
+func TestProjectFromInstance(t *testing.T) {
+	project, err := ProjectFromInstance("projects/my-project/locations/us-central1/instances/cache")
+	if err != nil || project != "my-project" {
+		t.Errorf("Expected my-project, got %q (%v)", project, err)
+	}
+	if _, err := ProjectFromInstance("cache"); err == nil {
+		t.Error("Expected error for short instance name")
+	}
+}
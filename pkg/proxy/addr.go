@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// addrMap maps remote "ip:port" to local "ip:port" for cluster redirects. It
+// is replaced as a whole when nodes are added after startup, so proxies read
+// it without locking.
+type addrMap struct {
+	m atomic.Pointer[map[string]string]
+}
+
+// newAddrMap returns an addrMap holding m
+func newAddrMap(m map[string]string) *addrMap {
+	a := &addrMap{}
+	a.m.Store(&m)
+	return a
+}
+
+// load returns the current map, which must not be modified
+func (a *addrMap) load() map[string]string {
+	if a == nil {
+		return nil
+	}
+	if m := a.m.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// set maps remote to local. Writers are serialized by the Manager's lock.
+func (a *addrMap) set(remote, local string) {
+	m := maps.Clone(a.load())
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[remote] = local
+	a.m.Store(&m)
+}
+
+// delete removes the mapping of remote
+func (a *addrMap) delete(remote string) {
+	m := maps.Clone(a.load())
+	delete(m, remote)
+	a.m.Store(&m)
+}
+
+// splitAddr splits a "host:port" address. Besides the bracketed form produced
+// by net.JoinHostPort it accepts bare IPv6 hosts ("2001:db8::1:6379"), which
+// is how Redis and Valkey write node addresses in CLUSTER NODES and MOVED/ASK
+// errors: the port is always after the last colon.
+func splitAddr(addr string) (host string, port int, ok bool) {
+	idx := strings.LastIndex(addr, ":")
+	if idx == -1 {
+		return "", 0, false
+	}
+	port, err := strconv.Atoi(addr[idx+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	host = addr[:idx]
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return host, port, true
+}
+
+// normalizeAddr returns addr in net.JoinHostPort form, so a node has the same
+// key however its address was written; invalid addresses are returned as is
+func normalizeAddr(addr string) string {
+	host, port, ok := splitAddr(addr)
+	if !ok {
+		return addr
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// redisAddr returns addr in the unbracketed form Redis uses in redirects,
+// which clients parse by splitting at the last colon
+func redisAddr(addr string) string {
+	host, port, ok := splitAddr(addr)
+	if !ok {
+		return addr
+	}
+	return host + ":" + strconv.Itoa(port)
+}
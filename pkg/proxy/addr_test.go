@@ -0,0 +1,58 @@
+package proxy
+
+import "testing"
+
+func TestSplitAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+		ok   bool
+	}{
+		{"10.128.0.5:6379", "10.128.0.5", 6379, true},
+		{"[2001:db8::5]:6379", "2001:db8::5", 6379, true},
+		{"2001:db8::5:6379", "2001:db8::5", 6379, true}, // As written by CLUSTER NODES and MOVED
+		{":0", "", 0, true},                             // Node without an address
+		{"redis.internal:6380", "redis.internal", 6380, true},
+		{"10.128.0.5", "", 0, false},
+		{"10.128.0.5:port", "", 0, false},
+	}
+	for _, tt := range tests {
+		host, port, ok := splitAddr(tt.addr)
+		if host != tt.host || port != tt.port || ok != tt.ok {
+			t.Errorf("splitAddr(%q) = %q, %d, %v; expected %q, %d, %v", tt.addr, host, port, ok, tt.host, tt.port, tt.ok)
+		}
+	}
+
+	if got := normalizeAddr("2001:db8::5:6379"); got != "[2001:db8::5]:6379" {
+		t.Errorf("Expected a bracketed address, got %q", got)
+	}
+	if got := redisAddr("[::1]:6380"); got != "::1:6380" {
+		t.Errorf("Expected an unbracketed address, got %q", got)
+	}
+}
+
+func TestClusterIPv6Addresses(t *testing.T) {
+	nodes, err := parseClusterNodes(
+		"07c37dfeb235213a872192d90877d0cd55635b91 2001:db8::4:6379@16379 master - 0 1426238317239 4 connected 0-8191\n" +
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 2001:db8::5:6379@16379,node-5 slave 07c37dfeb235213a872192d90877d0cd55635b91 0 1426238317239 4 connected\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d", len(nodes))
+	}
+	if nodes[1].Address != "[2001:db8::5]:6379" || nodes[1].Port != 6379 || extractHost(nodes[1].Address) != "2001:db8::5" {
+		t.Errorf("Unexpected node %+v", nodes[1])
+	}
+
+	// MOVED targets are matched whichever way the address is written
+	nodeMap := map[string]string{nodes[1].Address: "[::1]:6381"}
+	value := &RESPValue{Type: Error, Str: "MOVED 3999 2001:db8::5:6379"}
+	if !value.RewriteRedirectError(nodeMap) {
+		t.Fatal("Expected the IPv6 redirect to be rewritten")
+	}
+	if value.Str != "MOVED 3999 ::1:6381" {
+		t.Errorf("Unexpected rewritten error %q", value.Str)
+	}
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net"
+)
+
+// auditAttrs identifies the local client in audit records: its address and,
+// for Unix socket and loopback TCP clients, the peer process credentials
+func auditAttrs(conn net.Conn) []any {
+	attrs := []any{"audit", true}
+	if pid, uid, ok := peerCredentials(conn); ok {
+		if pid != 0 {
+			attrs = append(attrs, "client_pid", pid)
+		}
+		attrs = append(attrs, "client_uid", uid)
+	}
+	return attrs
+}
+
+// auditCommand records which client issued a command. Only the command name
+// and argument count are logged; keys and values may hold sensitive data.
+func (s *session) auditCommand(value *RESPValue, name string) {
+	if s.audit == nil {
+		return
+	}
+	args := 0
+	if value.Type == Array && len(value.Array) > 0 {
+		args = len(value.Array) - 1
+	}
+	s.audit.Info("Command", "command", name, "args", args)
+}
@@ -0,0 +1,130 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// peerCredentials returns the pid and uid of the process on the other end of
+// a Unix-domain socket via SO_PEERCRED, or of a loopback TCP connection via
+// /proc/net/tcp{,6}. The pid is 0 when the owning process isn't visible to us.
+func peerCredentials(conn net.Conn) (pid, uid int, ok bool) {
+	switch c := conn.(type) {
+	case *net.UnixConn:
+		return unixPeerCredentials(c)
+	case *net.TCPConn:
+		return tcpPeerCredentials(c)
+	}
+	return 0, 0, false
+}
+
+func unixPeerCredentials(conn *net.UnixConn) (pid, uid int, ok bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return 0, 0, false
+	}
+	return int(cred.Pid), int(cred.Uid), true
+}
+
+// tcpPeerCredentials looks up the client's end of a loopback connection in
+// the kernel socket table for its uid and inode, then the process holding
+// that inode
+func tcpPeerCredentials(conn *net.TCPConn) (pid, uid int, ok bool) {
+	peer, okPeer := conn.RemoteAddr().(*net.TCPAddr)
+	local, okLocal := conn.LocalAddr().(*net.TCPAddr)
+	if !okPeer || !okLocal || !peer.IP.IsLoopback() {
+		return 0, 0, false
+	}
+
+	// The client's socket has the addresses swapped
+	var inode string
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		v6 := strings.HasSuffix(table, "6")
+		uid, inode, ok = findSocket(table, procNetAddr(peer, v6), procNetAddr(local, v6))
+		if ok {
+			break
+		}
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	return socketOwner(inode), uid, true
+}
+
+// procNetAddr formats addr like /proc/net/tcp{,6} does: the address as
+// native-endian 32-bit words in hex, then the port
+func procNetAddr(addr *net.TCPAddr, v6 bool) string {
+	ip := addr.IP.To4()
+	if v6 || ip == nil {
+		ip = addr.IP.To16()
+	}
+	var b strings.Builder
+	for i := 0; i+4 <= len(ip); i += 4 {
+		fmt.Fprintf(&b, "%08X", binary.NativeEndian.Uint32(ip[i:i+4]))
+	}
+	fmt.Fprintf(&b, ":%04X", addr.Port)
+	return b.String()
+}
+
+// findSocket returns the uid and inode of the socket from local to remote
+// in the /proc/net table
+func findSocket(table, local, remote string) (uid int, inode string, ok bool) {
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != local || fields[2] != remote {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return 0, "", false
+		}
+		return uid, fields[9], true
+	}
+	return 0, "", false
+}
+
+// socketOwner returns the pid of a process with a descriptor for the socket
+// inode, or 0 if none is visible (other users' processes need privileges)
+func socketOwner(inode string) int {
+	target := "socket:[" + inode + "]"
+	procs, _ := filepath.Glob("/proc/[0-9]*/fd")
+	for _, dir := range procs {
+		fds, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(dir, fd.Name())); err == nil && link == target {
+				pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(dir)))
+				return pid
+			}
+		}
+	}
+	return 0
+}
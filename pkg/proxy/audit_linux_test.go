@@ -0,0 +1,83 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredentialsUnixSocket(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "proxy.sock"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer server.Close()
+
+	pid, uid, ok := peerCredentials(server)
+	if !ok {
+		t.Fatal("Expected peer credentials for Unix socket")
+	}
+	if pid != os.Getpid() || uid != os.Getuid() {
+		t.Errorf("Expected pid=%d uid=%d, got pid=%d uid=%d", os.Getpid(), os.Getuid(), pid, uid)
+	}
+}
+
+func TestPeerCredentialsLoopbackTCP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(addr, func(t *testing.T) {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				t.Skipf("No loopback for %s: %v", addr, err)
+			}
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer client.Close()
+
+			server, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Failed to accept: %v", err)
+			}
+			defer server.Close()
+
+			pid, uid, ok := peerCredentials(server)
+			if !ok {
+				t.Fatal("Expected peer credentials for loopback TCP connection")
+			}
+			if pid != os.Getpid() || uid != os.Getuid() {
+				t.Errorf("Expected pid=%d uid=%d, got pid=%d uid=%d", os.Getpid(), os.Getuid(), pid, uid)
+			}
+		})
+	}
+}
+
+func TestPeerCredentialsPipe(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if _, _, ok := peerCredentials(a); ok {
+		t.Error("Expected no peer credentials for non-Unix connection")
+	}
+	if attrs := auditAttrs(a); len(attrs) != 2 {
+		t.Errorf("Expected only the audit marker, got %v", attrs)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// peerCredentials is only supported on Linux (SO_PEERCRED, /proc/net/tcp)
+func peerCredentials(conn net.Conn) (pid, uid int, ok bool) {
+	return 0, 0, false
+}
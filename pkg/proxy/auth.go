@@ -1,16 +1,105 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
 )
 
+// errAuthRejected is wrapped by AUTH errors where the server replied with an
+// error, as opposed to network or token failures
+var errAuthRejected = errors.New("authentication failed")
+
+// recordAuthFailure counts a failed upstream AUTH exchange
+func (p *Proxy) recordAuthFailure(err error) {
+	p.stats.authFailures.Add(1)
+	if errors.Is(err, errAuthRejected) {
+		p.stats.authRejections.Add(1)
+	}
+}
+
+// credential is the instance password shared by the proxies of a manager.
+// It changes when the password is rotated; connections dialed afterwards
+// authenticate with the new one.
+type credential struct {
+	value atomic.Pointer[string]
+}
+
+// newCredential returns a credential holding password
+func newCredential(password string) *credential {
+	c := &credential{}
+	c.set(password)
+	return c
+}
+
+// get returns the current password, or "" if none is set
+func (c *credential) get() string {
+	if c == nil {
+		return ""
+	}
+	return *c.value.Load()
+}
+
+// set replaces the password
+func (c *credential) set(password string) {
+	c.value.Store(&password)
+}
+
+// WatchPassword reads the upstream password with read every interval until
+// ctx is cancelled. Upstream connections dialed after it changed
+// authenticate with the new password, and pooled and shared ones are sent
+// AUTH with it.
+func (m *Manager) WatchPassword(ctx context.Context, interval time.Duration, read func(ctx context.Context) (string, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		password, err := read(ctx)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to re-read the upstream password: %v", err))
+			continue
+		}
+		if password == "" || password == m.authPassword.get() {
+			continue
+		}
+		logger.PinSecret(password)
+		m.authPassword.set(password)
+		logger.Info("Upstream password changed, re-authenticating pooled upstream connections")
+
+		m.mu.Lock()
+		proxies := slices.Clone(m.proxies)
+		m.mu.Unlock()
+		for _, p := range proxies {
+			p.reauthPooled(password)
+		}
+	}
+}
+
+// authUser returns the ACL user upstream connections authenticate as, or
+// "" for the default user
+func authUser(cfg *config.Config) string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.AuthUser
+}
+
 // authenticatePassword performs password-based authentication for Redis instances
 func (p *Proxy) authenticatePassword(conn net.Conn, password string) error {
-	// Send AUTH command using RESP protocol
-	// Format: *2\r\n$4\r\nAUTH\r\n$<length>\r\n<password>\r\n
-	authCmd := fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(password), password)
+	// Send AUTH command using RESP protocol, as the ACL user if one is configured
+	authCmd := buildAuthCommand(authUser(p.config), password)
 
 	// Set write deadline
 	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
@@ -35,5 +124,6 @@ func (p *Proxy) authenticatePassword(conn net.Conn, password string) error {
 		return nil
 	}
 
-	return fmt.Errorf("authentication failed: %s", respStr)
+	// The reply is echoed into logs, so strip anything resembling a credential
+	return fmt.Errorf("%w: %s", errAuthRejected, logger.Redact(strings.TrimSpace(respStr)))
 }
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestWatchPassword(t *testing.T) {
+	m := NewManager(&config.Config{})
+	m.SetAuthPassword("old")
+	p := &Proxy{authPassword: m.authPassword}
+
+	var reads atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.WatchPassword(ctx, 10*time.Millisecond, func(context.Context) (string, error) {
+		if reads.Add(1) == 1 {
+			// A failed read keeps the current password
+			return "", errors.New("unavailable")
+		}
+		return "new", nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.authPassword.get() != "new" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := p.authPassword.get(); got != "new" {
+		t.Fatalf("Expected proxies to see the new password, got %q", got)
+	}
+	if reads.Load() < 2 {
+		t.Errorf("Expected the password to change after the failed read, got %d reads", reads.Load())
+	}
+}
+
+func TestWatchPasswordReauthenticatesPooledConnections(t *testing.T) {
+	addr, auths := authUpstream(t)
+	m := NewManager(&config.Config{})
+	m.SetAuthPassword("old")
+
+	p := newMuxProxy(addr, 1)
+	p.authPassword = m.authPassword
+	p.mux.share = p.newSharedConn
+	defer p.mux.close()
+	mc, err := p.mux.acquire(t.Context())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	p.pool = newUpstreamPool(1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+	defer p.pool.close()
+	if err := p.pool.fill(); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+	m.proxies = append(m.proxies, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.WatchPassword(ctx, 10*time.Millisecond, func(context.Context) (string, error) {
+		return "new", nil
+	})
+
+	// Both the shared and the idle pooled connection are sent AUTH
+	expectAuth(t, auths, "new")
+	expectAuth(t, auths, "new")
+	deadline := time.Now().Add(5 * time.Second)
+	for p.stats.reauths.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := p.stats.reauths.Load(); n != 2 {
+		t.Errorf("Expected 2 re-authentications, got %d", n)
+	}
+	if mc.failed() {
+		t.Error("Shared connection failed after re-authentication")
+	}
+	if n := p.pool.idleCount(); n != 1 {
+		t.Errorf("Expected the pooled connection to be kept, %d idle", n)
+	}
+}
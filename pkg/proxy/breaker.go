@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// breakerResponse is sent to clients whose connection is rejected while the circuit is open
+const breakerResponse = "-ERR upstream unavailable: connections to the instance keep failing, retry later\r\n"
+
+// circuitBreaker tracks consecutive upstream dial and AUTH failures. Once
+// threshold is reached the circuit opens and new client connections fail
+// immediately instead of each waiting for the dial timeout. After cooldown a
+// single trial connection is let through (half-open): success closes the
+// circuit, failure opens it for another cooldown. A trial that reports
+// neither within cooldown (e.g. its client went away) is given up, and the
+// next connection becomes the trial.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // Consecutive failures
+	openUntil time.Time // Zero while closed
+	trialEnd  time.Time // When the half-open trial in progress is given up; zero without one
+
+	rejected atomic.Uint64
+}
+
+// newCircuitBreaker creates a breaker, or returns nil if threshold is not positive (disabled)
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a new connection may try the upstream at the given
+// time; rejected connections are counted
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.openUntil.IsZero():
+		return true
+	case now.Before(b.openUntil) || now.Before(b.trialEnd):
+		b.rejected.Add(1)
+		return false
+	default:
+		b.trialEnd = now.Add(b.cooldown)
+		return true
+	}
+}
+
+// success records a working upstream connection and closes the circuit.
+// Returns true if the circuit was open.
+func (b *circuitBreaker) success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := !b.openUntil.IsZero()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.trialEnd = time.Time{}
+	return wasOpen
+}
+
+// failure records a failed dial or AUTH at the given time. Returns true if
+// this failure opened the circuit (or reopened it after a failed trial).
+func (b *circuitBreaker) failure(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	opening := b.openUntil.IsZero() || !b.trialEnd.IsZero()
+	if opening {
+		b.openUntil = now.Add(b.cooldown)
+		b.trialEnd = time.Time{}
+	}
+	return opening
+}
+
+// openedUntil returns when the circuit lets the next trial connection through,
+// or zero time if it is closed
+func (b *circuitBreaker) openedUntil() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openUntil
+}
+
+// upstreamFailed records a failed upstream dial or AUTH with the circuit breaker
+func (p *Proxy) upstreamFailed() {
+	if p.breaker.failure(time.Now()) {
+		logger.Error(fmt.Sprintf("Circuit opened for %s after %d consecutive upstream failures; rejecting new connections for %s",
+			p.remoteAddr, p.breaker.threshold, p.breaker.cooldown))
+	}
+}
+
+// upstreamSucceeded records a working upstream connection with the circuit breaker
+func (p *Proxy) upstreamSucceeded() {
+	p.maintenance.up(time.Now())
+	if p.breaker.success() {
+		logger.Info(fmt.Sprintf("Circuit closed for %s: upstream connection succeeded", p.remoteAddr))
+	}
+}
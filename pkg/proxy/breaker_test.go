@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, 10*time.Second)
+	now := time.Now()
+
+	b.failure(now)
+	if b.failure(now) || !b.allow(now) {
+		t.Fatal("Expected the circuit to stay closed below the threshold")
+	}
+	if !b.failure(now) {
+		t.Fatal("Expected the threshold to open the circuit")
+	}
+	if b.allow(now.Add(5 * time.Second)) {
+		t.Error("Expected connections to be rejected while open")
+	}
+
+	// After the cooldown exactly one trial connection goes through
+	later := now.Add(11 * time.Second)
+	if !b.allow(later) {
+		t.Fatal("Expected a trial connection after the cooldown")
+	}
+	if b.allow(later) {
+		t.Error("Expected only one trial connection at a time")
+	}
+	if !b.failure(later) {
+		t.Fatal("Expected a failed trial to reopen the circuit")
+	}
+	if b.allow(later.Add(5 * time.Second)) {
+		t.Error("Expected the reopened circuit to reject connections")
+	}
+
+	if !b.allow(later.Add(11*time.Second)) || !b.success() {
+		t.Fatal("Expected a successful trial to close the circuit")
+	}
+	if !b.allow(later.Add(11*time.Second)) || b.failure(later) {
+		t.Error("Expected a closed circuit to count failures from zero")
+	}
+	if got := b.rejected.Load(); got != 3 {
+		t.Errorf("Expected 3 rejected connections, got %d", got)
+	}
+}
+
+func TestCircuitBreakerGivesUpSilentTrial(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Second)
+	now := time.Now()
+	b.failure(now)
+
+	// The trial connection never reports success or failure
+	later := now.Add(11 * time.Second)
+	if !b.allow(later) {
+		t.Fatal("Expected a trial connection after the cooldown")
+	}
+	if b.allow(later.Add(5 * time.Second)) {
+		t.Error("Expected connections to be rejected while the trial is in progress")
+	}
+	if !b.allow(later.Add(11 * time.Second)) {
+		t.Fatal("Expected another trial once the silent one was given up")
+	}
+	if !b.success() {
+		t.Error("Expected the new trial to close the circuit")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Second)
+	if b != nil {
+		t.Fatal("Expected nil breaker when threshold is 0")
+	}
+	if b.failure(time.Now()) || !b.allow(time.Now()) {
+		t.Error("Expected a disabled breaker never to open")
+	}
+}
+
+func TestCircuitOpenRejectsClients(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := &Proxy{
+		config:     config.NewConfig(),
+		remoteAddr: addr,
+		breaker:    newCircuitBreaker(1, time.Minute),
+	}
+	connect := func() string {
+		client, proxyClient := net.Pipe()
+		defer client.Close()
+		p.connections.Add(1)
+		go p.handleConnection(proxyClient, nextConnID())
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := io.ReadAll(client)
+		return string(reply)
+	}
+
+	// The first client pays for the failed dial and opens the circuit
+	if reply := connect(); reply != "" {
+		t.Errorf("Expected the connection to be closed without a reply, got %q", reply)
+	}
+	if reply := connect(); reply != breakerResponse {
+		t.Errorf("Expected %q, got %q", breakerResponse, reply)
+	}
+	if stats := p.Stats(); !stats.CircuitOpen || stats.CircuitRejections != 1 || p.stats.dialErrors.Load() != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
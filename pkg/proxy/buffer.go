@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Relay buffer sizes
+const (
+	defaultBufferSize = 32 * 1024 // Same as io.Copy's own buffer
+	MinBufferSize     = 512
+)
+
+// bufferPool hands out fixed-size buffers for relaying so that connections
+// reuse memory instead of allocating their own: copy buffers for the raw byte
+// relay and bufio readers and writers for the RESP parsing relay.
+type bufferPool struct {
+	size    int
+	bufs    sync.Pool // *[]byte
+	readers sync.Pool // *bufio.Reader
+	writers sync.Pool // *bufio.Writer
+}
+
+// newBufferPool creates a pool of size-byte buffers
+func newBufferPool(size int) *bufferPool {
+	b := &bufferPool{size: size}
+	b.bufs.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	b.readers.New = func() any {
+		return bufio.NewReaderSize(nil, size)
+	}
+	b.writers.New = func() any {
+		return bufio.NewWriterSize(nil, size)
+	}
+	return b
+}
+
+// defaultBuffers is used by proxies created without a configured pool
+var defaultBuffers = newBufferPool(defaultBufferSize)
+
+// copy copies src to dst through a pooled buffer
+func (b *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := b.bufs.Get().(*[]byte)
+	defer b.bufs.Put(buf)
+	// Hide io.WriterTo: *net.TCPConn implements it with its own buffer, bypassing ours
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
+}
+
+// respReader returns a RESP reader for r backed by a pooled bufio.Reader;
+// call releaseReader once the connection is done with it
+func (b *bufferPool) respReader(r io.Reader) *RESPReader {
+	reader := b.readers.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return &RESPReader{reader: reader, limits: DefaultRESPLimits}
+}
+
+// releaseReader returns the reader's buffer to the pool
+func (b *bufferPool) releaseReader(r *RESPReader) {
+	r.reader.Reset(nil)
+	b.readers.Put(r.reader)
+}
+
+// writer returns a pooled bufio.Writer writing to w; call releaseWriter once
+// the connection is done with it
+func (b *bufferPool) writer(w io.Writer) *bufio.Writer {
+	bw := b.writers.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+// releaseWriter returns a writer to the pool, discarding unflushed data
+func (b *bufferPool) releaseWriter(w *bufio.Writer) {
+	w.Reset(nil)
+	b.writers.Put(w)
+}
+
+// respReader returns a pooled RESP reader for conn with the configured size
+// limits; release it with p.buffers().releaseReader
+func (p *Proxy) respReader(conn io.Reader) *RESPReader {
+	r := p.buffers().respReader(conn)
+	if p.config != nil {
+		r.SetLimits(RESPLimits{MaxBulkSize: p.config.MaxBulkSize, MaxArrayLength: p.config.MaxArrayLength})
+	}
+	return r
+}
+
+// buffers returns the buffer pool of this proxy
+func (p *Proxy) buffers() *bufferPool {
+	if p.bufferPool != nil {
+		return p.bufferPool
+	}
+	return defaultBuffers
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBufferPoolCopy(t *testing.T) {
+	b := newBufferPool(MinBufferSize)
+	data := strings.Repeat("0123456789", 1000)
+
+	var dst bytes.Buffer
+	n, err := b.copy(&dst, strings.NewReader(data))
+	if err != nil || n != int64(len(data)) || dst.String() != data {
+		t.Fatalf("Expected %d bytes copied unchanged, got %d (%v)", len(data), n, err)
+	}
+}
+
+func TestBufferPoolRESPReader(t *testing.T) {
+	b := newBufferPool(MinBufferSize)
+
+	// Values larger than the buffer still parse
+	large := strings.Repeat("x", 4*MinBufferSize)
+	value := RESPValue{Type: BulkString, Str: large}
+	r := b.respReader(bytes.NewReader(value.Serialize()))
+	if r.reader.Size() != MinBufferSize {
+		t.Errorf("Expected a %d byte reader, got %d", MinBufferSize, r.reader.Size())
+	}
+	got, err := r.ReadValue()
+	if err != nil || got.Str != large {
+		t.Fatalf("Failed to read value through pooled reader: %v", err)
+	}
+	b.releaseReader(r)
+
+	// A reused reader starts clean on its new connection
+	r = b.respReader(strings.NewReader("+OK\r\n"))
+	if got, err := r.ReadValue(); err != nil || got.Str != "OK" {
+		t.Errorf("Expected OK from reused reader, got %+v (%v)", got, err)
+	}
+	b.releaseReader(r)
+}
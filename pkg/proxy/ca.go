@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// ReadCACertificates returns the PEM CA certificates in file and in the
+// files of dir, supplied out-of-band for instances whose CA discovery can't
+// return. Files in dir without certificates (and hidden ones, like the
+// ..data links of Kubernetes volumes) are skipped.
+func ReadCACertificates(file, dir string) (string, error) {
+	var certs strings.Builder
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read CA certificate file: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return "", fmt.Errorf("no PEM certificates in %s", file)
+		}
+		certs.Write(data)
+		certs.WriteString("\n")
+	}
+
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", fmt.Errorf("failed to read CA certificate directory: %w", err)
+		}
+		found := false
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			// Follows symlinks, as in hashed OpenSSL certificate directories
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read CA certificate file: %w", err)
+			}
+			if !x509.NewCertPool().AppendCertsFromPEM(data) {
+				continue
+			}
+			certs.Write(data)
+			certs.WriteString("\n")
+			found = true
+		}
+		if !found {
+			return "", fmt.Errorf("no PEM certificates in %s", dir)
+		}
+	}
+	return certs.String(), nil
+}
+
+// UpdateCACertificates makes new upstream connections verify against the
+// PEM CA certificates caCert, e.g. after the instance CA rotated.
+// Established connections are unaffected.
+func (m *Manager) UpdateCACertificates(caCert string) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caCert)) {
+		return fmt.Errorf("failed to parse CA certificate")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tlsConfig != nil {
+		// Used for cluster nodes added later
+		tlsConfig := m.tlsConfig.Clone()
+		tlsConfig.RootCAs = pool
+		m.tlsConfig = tlsConfig
+	}
+	m.rootCAs.Store(pool)
+	m.caCert = caCert
+	return nil
+}
+
+// WatchCACertificates reads the server CA certificates with read every
+// interval until ctx is cancelled, and swaps them in when they changed
+func (m *Manager) WatchCACertificates(ctx context.Context, interval time.Duration, read func(ctx context.Context) (string, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		caCert, err := read(ctx)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to re-read the server CA certificates: %v", err))
+			continue
+		}
+		m.mu.Lock()
+		unchanged := caCert == m.caCert
+		m.mu.Unlock()
+		if caCert == "" || unchanged {
+			continue
+		}
+		if err := m.UpdateCACertificates(caCert); err != nil {
+			logger.Error(fmt.Sprintf("Ignoring changed server CA certificates: %v", err))
+			continue
+		}
+		// The instance may swap its server certificate around the same time
+		m.reconfiguringAll(time.Now().Add(reconfigureWindow))
+		fingerprints := (&discovery.InstanceInfo{CACertificate: caCert}).CAFingerprints()
+		logger.Info(fmt.Sprintf("Server CA certificates changed, new upstream connections verify against %s", strings.Join(fingerprints, ", ")))
+	}
+}
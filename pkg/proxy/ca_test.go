@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+// serverCA returns the certificate of a TLS test server in PEM
+func serverCA(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+}
+
+// otherCA returns a self-signed CA certificate in PEM that signed nothing
+func otherCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestReadCACertificates(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	ca := serverCA(server)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ca.pem"), []byte(ca), 0o644)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".hidden.pem"), []byte(ca), 0o644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o755)
+	os.Symlink("ca.pem", filepath.Join(dir, "5ed36f99.0"))
+
+	got, err := ReadCACertificates("", dir)
+	if err != nil {
+		t.Fatalf("ReadCACertificates failed: %v", err)
+	}
+	if n := strings.Count(got, "BEGIN CERTIFICATE"); n != 2 {
+		t.Errorf("Expected the certificate and its hash link, got %d certificates", n)
+	}
+
+	file := filepath.Join(dir, "ca.pem")
+	if got, err := ReadCACertificates(file, ""); err != nil || strings.Count(got, "BEGIN CERTIFICATE") != 1 {
+		t.Errorf("Expected the certificate of the file, got %q: %v", got, err)
+	}
+	if _, err := ReadCACertificates(filepath.Join(dir, "README"), ""); err == nil {
+		t.Error("Expected a file without certificates to fail")
+	}
+	if _, err := ReadCACertificates("", t.TempDir()); err == nil {
+		t.Error("Expected a directory without certificates to fail")
+	}
+}
+
+func TestDialUpstreamVerifiesSuppliedCA(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	for _, tt := range []struct {
+		name string
+		ca   string
+		ok   bool
+	}{
+		{"server's CA", serverCA(server), true},
+		{"another CA", otherCA(t), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(&config.Config{})
+			if err := m.SetTLSConfig(tt.ca, false); err != nil {
+				t.Fatalf("SetTLSConfig failed: %v", err)
+			}
+			p := &Proxy{
+				remoteAddr: server.Listener.Addr().String(),
+				endpoint:   discovery.Endpoint{Host: host, Port: port},
+				tlsConfig:  m.tlsConfig,
+			}
+			conn, err := p.dialUpstream(context.Background(), newSession(1, false))
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("Expected success=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestWatchCACertificatesSwapsRootCAs(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// The server's certificate is signed by the CA rotated to
+	m := NewManager(&config.Config{TLSSessionCache: 8})
+	if err := m.SetTLSConfig(otherCA(t), false); err != nil {
+		t.Fatalf("SetTLSConfig failed: %v", err)
+	}
+	p := &Proxy{
+		remoteAddr: server.Listener.Addr().String(),
+		endpoint:   discovery.Endpoint{Host: host, Port: port},
+		tlsConfig:  endpointTLSConfig(m.tlsConfig, m.config),
+		rootCAs:    m.rootCAs,
+	}
+	if conn, err := p.dialUpstream(context.Background(), newSession(1, false)); err == nil {
+		conn.Close()
+		t.Fatal("Expected the server certificate to fail verification before the rotation")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.WatchCACertificates(ctx, 10*time.Millisecond, func(context.Context) (string, error) {
+		return serverCA(server), nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := p.dialUpstream(context.Background(), newSession(2, false))
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected new connections to verify against the rotated CA: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialUpstreamVerifiesServerName(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// The test certificate is issued for example.com besides the loopback addresses
+	for _, tt := range []struct {
+		serverName string
+		ok         bool
+	}{
+		{"example.com", true},
+		{"other.example", false},
+	} {
+		t.Run(tt.serverName, func(t *testing.T) {
+			m := NewManager(&config.Config{TLSServerName: tt.serverName})
+			if err := m.SetTLSConfig(serverCA(server), false); err != nil {
+				t.Fatalf("SetTLSConfig failed: %v", err)
+			}
+			p := &Proxy{
+				remoteAddr: server.Listener.Addr().String(),
+				endpoint:   discovery.Endpoint{Host: host, Port: port},
+				tlsConfig:  m.tlsConfig,
+			}
+			conn, err := p.dialUpstream(context.Background(), newSession(1, false))
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("Expected success=%v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
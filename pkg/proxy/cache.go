@@ -0,0 +1,513 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// cacheEntryOverhead approximates the memory used by a cache entry besides
+// its key and value
+const cacheEntryOverhead = 64
+
+// Invalidation connection settings: reconnect backoff, and how often it is
+// PINGed so a dead connection (and stale cache) is noticed
+const (
+	cacheMinBackoff   = time.Second
+	cacheMaxBackoff   = 30 * time.Second
+	cachePingInterval = 15 * time.Second
+)
+
+// readCache keeps GET/MGET replies for keys matching the configured
+// patterns. A dedicated RESP3 connection enables client-side caching in
+// broadcasting mode (CLIENT TRACKING ON BCAST) for the patterns' prefixes, so
+// the server pushes the name of every modified key. Nothing is cached or
+// served while that connection is down.
+type readCache struct {
+	patterns []string
+	prefixes []string // Tracked key prefixes; empty tracks every key
+	maxBytes int
+
+	mu       sync.Mutex
+	tracking bool // Invalidations are being received
+	entries  map[cacheKey]*list.Element
+	lru      *list.List   // *cacheEntry, most recently used first
+	dbs      map[int]bool // DBs with cached keys, as invalidations don't name the DB
+	bytes    int
+	fills    map[string]int  // Keys with a fill in flight
+	stale    map[string]bool // Keys invalidated while a fill was in flight
+	flushes  uint64          // Times everything was dropped
+
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	invalidations atomic.Uint64
+	evictions     atomic.Uint64
+}
+
+type cacheKey struct {
+	db  int
+	key string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value string
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.key.key) + len(e.value) + cacheEntryOverhead
+}
+
+// cacheFill is a cache miss forwarded to the server, whose reply is cached
+type cacheFill struct {
+	db      int
+	keys    []string
+	mget    bool
+	flushes uint64
+}
+
+// cacheSession is the connection state deciding whether a client's reads
+// can be cached
+type cacheSession struct {
+	db     atomic.Int64 // Selected DB, or -1 while unknown (a SELECT awaits its reply)
+	multi  bool         // Inside MULTI, where reads are only queued
+	queued []string     // Cached keys named by commands queued in MULTI, dropped on EXEC
+}
+
+// newReadCache creates a cache, or returns nil if no key patterns are set
+func newReadCache(cfg *config.Config) *readCache {
+	if cfg == nil || len(cfg.CacheKeys) == 0 {
+		return nil
+	}
+	return &readCache{
+		patterns: cfg.CacheKeys,
+		prefixes: trackingPrefixes(cfg.CacheKeys),
+		maxBytes: cfg.CacheMaxMemory,
+		entries:  make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+		dbs:      make(map[int]bool),
+		fills:    make(map[string]int),
+		stale:    make(map[string]bool),
+	}
+}
+
+// trackingPrefixes returns the key prefixes to track for patterns: the part
+// before the first wildcard. Redis rejects overlapping prefixes, so a prefix
+// covered by a shorter one is left out.
+func trackingPrefixes(patterns []string) []string {
+	var prefixes []string
+	for _, pattern := range patterns {
+		prefix := pattern
+		if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+			prefix = pattern[:i]
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	var kept []string
+	for i, prefix := range prefixes {
+		covered := false
+		for j, other := range prefixes {
+			if j != i && strings.HasPrefix(prefix, other) && (len(other) < len(prefix) || j < i) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			if prefix == "" {
+				return nil
+			}
+			kept = append(kept, prefix)
+		}
+	}
+	return kept
+}
+
+// globMatch reports whether key matches pattern, where * matches any run of
+// characters and ? any single character
+func globMatch(pattern, key string) bool {
+	p, k := 0, 0
+	star, next := -1, 0
+	for k < len(key) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == key[k]):
+			p++
+			k++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, k
+			p++
+		case star >= 0:
+			next++
+			p, k = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// cacheable reports whether key matches one of the patterns
+func (c *readCache) cacheable(key string) bool {
+	for _, pattern := range c.patterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// request handles a client request: a cached read gets its reply, a read that
+// missed gets a fill to cache the server's reply, and commands changing which
+// reads are cacheable update the session. Any other command naming a cacheable
+// key drops it, so the client reads its own writes without waiting for the
+// server's invalidation.
+func (c *readCache) request(value *RESPValue, name string, sess *session) (reply *RESPValue, fill func(*RESPValue)) {
+	state := sess.cache
+	if state == nil {
+		return nil, nil
+	}
+	switch name {
+	case "SELECT":
+		if state.multi || len(value.Array) != 2 {
+			// Takes effect on EXEC, if at all
+			state.db.Store(-1)
+			return nil, nil
+		}
+		prev := state.db.Swap(-1)
+		db, err := strconv.Atoi(value.Array[1].Str)
+		return nil, func(reply *RESPValue) {
+			if err == nil && reply != nil && reply.Type == SimpleString && reply.Str == "OK" {
+				state.db.Store(int64(db))
+			} else {
+				state.db.Store(prev)
+			}
+		}
+	case "MULTI":
+		state.multi = true
+	case "EXEC":
+		state.multi = false
+		if keys := state.queued; len(keys) > 0 {
+			state.queued = nil
+			return nil, func(*RESPValue) { c.drop(keys) }
+		}
+	case "DISCARD":
+		state.multi = false
+		state.queued = nil
+	case "RESET":
+		state.multi = false
+		state.queued = nil
+		state.db.Store(0)
+	case "GET", "MGET":
+		db := int(state.db.Load())
+		if state.multi || db < 0 || len(value.Array) < 2 || (name == "GET" && len(value.Array) != 2) {
+			return nil, nil
+		}
+		keys := make([]string, len(value.Array)-1)
+		for i, arg := range value.Array[1:] {
+			if !c.cacheable(arg.Str) {
+				return nil, nil
+			}
+			keys[i] = arg.Str
+		}
+		if values, ok := c.lookup(db, keys); ok {
+			c.hits.Add(1)
+			if name == "GET" {
+				return &RESPValue{Type: BulkString, Str: values[0]}, nil
+			}
+			reply := &RESPValue{Type: Array, Array: make([]RESPValue, len(values))}
+			for i, v := range values {
+				reply.Array[i] = RESPValue{Type: BulkString, Str: v}
+			}
+			return reply, nil
+		}
+		c.misses.Add(1)
+		if f := c.startFill(db, keys, name == "MGET"); f != nil {
+			return nil, func(reply *RESPValue) { c.finish(f, reply) }
+		}
+	default:
+		// Arguments that aren't keys but look like one only cost a miss
+		var keys []string
+		for _, arg := range value.Array[1:] {
+			if c.cacheable(arg.Str) {
+				keys = append(keys, arg.Str)
+			}
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		if state.multi {
+			state.queued = append(state.queued, keys...)
+			return nil, nil
+		}
+		// Dropped again once the write is done, for reads forwarded meanwhile
+		c.drop(keys)
+		return nil, func(*RESPValue) { c.drop(keys) }
+	}
+	return nil, nil
+}
+
+// lookup returns the cached values of all keys, or false if any is missing
+func (c *readCache) lookup(db int, keys []string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tracking {
+		return nil, false
+	}
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		elem, ok := c.entries[cacheKey{db: db, key: key}]
+		if !ok {
+			return nil, false
+		}
+		c.lru.MoveToFront(elem)
+		values[i] = elem.Value.(*cacheEntry).value
+	}
+	return values, true
+}
+
+// startFill registers a read forwarded to the server, or returns nil if its
+// reply can't be cached as invalidations aren't being received
+func (c *readCache) startFill(db int, keys []string, mget bool) *cacheFill {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tracking {
+		return nil
+	}
+	for _, key := range keys {
+		c.fills[key]++
+	}
+	return &cacheFill{db: db, keys: keys, mget: mget, flushes: c.flushes}
+}
+
+// finish caches the server's reply to a fill, unless a key was invalidated
+// since the read was sent (the reply may predate the change). Missing keys
+// and errors aren't cached; reply is nil if the connection closed first.
+func (c *readCache) finish(f *cacheFill, reply *RESPValue) {
+	var values []RESPValue
+	switch {
+	case reply == nil:
+	case !f.mget:
+		values = []RESPValue{*reply}
+	case reply.Type == Array && len(reply.Array) == len(f.keys):
+		values = reply.Array
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, key := range f.keys {
+		if f.flushes != c.flushes {
+			return
+		}
+		stale := c.stale[key]
+		if c.fills[key]--; c.fills[key] <= 0 {
+			delete(c.fills, key)
+			delete(c.stale, key)
+		}
+		if stale || i >= len(values) || values[i].Type != BulkString || values[i].Null {
+			continue
+		}
+		c.store(&cacheEntry{key: cacheKey{db: f.db, key: key}, value: values[i].Str})
+	}
+}
+
+// store adds or replaces an entry, evicting the least recently used ones to
+// stay within the memory budget. Must be called with mu held.
+func (c *readCache) store(entry *cacheEntry) {
+	if entry.size() > c.maxBytes {
+		return
+	}
+	c.remove(entry.key)
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.dbs[entry.key.db] = true
+	c.bytes += entry.size()
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// remove drops an entry if present. Must be called with mu held.
+func (c *readCache) remove(key cacheKey) {
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.bytes -= elem.Value.(*cacheEntry).size()
+	}
+}
+
+// invalidate drops keys the server reported modified, in every DB
+func (c *readCache) invalidate(keys []string) {
+	c.drop(keys)
+	c.invalidations.Add(uint64(len(keys)))
+}
+
+// drop removes keys in every DB and keeps fills in flight for them from being
+// cached, as their replies may predate a change
+func (c *readCache) drop(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		for db := range c.dbs {
+			c.remove(cacheKey{db: db, key: key})
+		}
+		if c.fills[key] > 0 {
+			c.stale[key] = true
+		}
+	}
+}
+
+// flush drops everything, e.g. after FLUSHALL or when invalidations stop
+func (c *readCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *readCache) flushLocked() {
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.dbs = make(map[int]bool)
+	c.bytes = 0
+	// Fills in flight are told apart by the flush count
+	c.fills = make(map[string]int)
+	c.stale = make(map[string]bool)
+	c.flushes++
+}
+
+// setTracking records whether invalidations are being received. Entries
+// can't be trusted once they stop, so they are dropped.
+func (c *readCache) setTracking(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !on {
+		c.flushLocked()
+	}
+	c.tracking = on
+}
+
+// size returns the memory used by cached entries
+func (c *readCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// trackInvalidations keeps the invalidation connection of the read cache open
+// until the proxy shuts down
+func (p *Proxy) trackInvalidations() {
+	backoff := cacheMinBackoff
+	for {
+		established, err := p.receiveInvalidations()
+		p.cache.setTracking(false)
+		select {
+		case <-p.shutdown:
+			return
+		default:
+		}
+		if established {
+			backoff = cacheMinBackoff
+		}
+		logger.Error(fmt.Sprintf("Read cache for %s disabled: %v (retrying in %s)", p.remoteAddr, err, backoff))
+		select {
+		case <-p.shutdown:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, cacheMaxBackoff)
+	}
+}
+
+// receiveInvalidations opens a connection with client-side caching enabled
+// and applies the invalidation messages the server pushes on it until it fails
+func (p *Proxy) receiveInvalidations() (established bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+	conn, err := p.dialAuthenticated(ctx)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-p.shutdown:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	reader := NewRESPReader(conn)
+	reader.SetRESP3(true)
+	tracking := []string{"CLIENT", "TRACKING", "ON", "BCAST"}
+	for _, prefix := range p.cache.prefixes {
+		tracking = append(tracking, "PREFIX", prefix)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, args := range [][]string{{"HELLO", "3"}, tracking} {
+		request := RESPValue{Type: Array}
+		for _, arg := range args {
+			request.Array = append(request.Array, RESPValue{Type: BulkString, Str: arg})
+		}
+		if _, err := conn.Write(request.Serialize()); err != nil {
+			return false, fmt.Errorf("failed to send %s: %w", args[0], err)
+		}
+		reply, err := reader.ReadValue()
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s reply: %w", args[0], err)
+		}
+		if reply.Type == Error {
+			return false, fmt.Errorf("%s %s failed: %s", args[0], args[1], reply.Str)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.cache.setTracking(true)
+	logger.Info(fmt.Sprintf("Caching reads of %s for keys %s", p.remoteAddr, strings.Join(p.cache.patterns, ", ")))
+
+	go func() {
+		ticker := time.NewTicker(cachePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := conn.Write(pingCommand); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * cachePingInterval))
+		value, err := reader.ReadValue()
+		if err != nil {
+			return true, fmt.Errorf("invalidation connection lost: %w", err)
+		}
+		// Replies to PINGs are dropped; invalidate carries the modified keys, or null after a flush
+		if value.Type != Push || len(value.Array) != 2 || !strings.EqualFold(value.Array[0].Str, "invalidate") {
+			continue
+		}
+		if keys := value.Array[1]; keys.Type == Array && !keys.Null {
+			names := make([]string, len(keys.Array))
+			for i, key := range keys.Array {
+				names[i] = key.Str
+			}
+			p.cache.invalidate(names)
+		} else {
+			p.cache.flush()
+		}
+	}
+}
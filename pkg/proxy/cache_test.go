@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "users", false},
+		{"*:profile", "user:1:profile", true},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"exact", "exact", true},
+		{"*", "", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTrackingPrefixes(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		want     string
+	}{
+		{[]string{"user:*", "config:*"}, "user:,config:"},
+		{[]string{"user:*", "user:1*", "user:*"}, "user:"},
+		{[]string{"session:?:data", "flags"}, "session:,flags"},
+		{[]string{"user:*", "*"}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(trackingPrefixes(tt.patterns), ","); got != tt.want {
+			t.Errorf("trackingPrefixes(%v) = %q, expected %q", tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestReadCacheFillAndInvalidate(t *testing.T) {
+	c := newReadCache(&config.Config{CacheKeys: []string{"k*"}, CacheMaxMemory: 3 * (cacheEntryOverhead + 4)})
+	value := func(s string) *RESPValue { return &RESPValue{Type: BulkString, Str: s} }
+
+	if c.startFill(0, []string{"k1"}, false) != nil {
+		t.Fatal("Expected nothing to be cached before invalidations are received")
+	}
+	c.setTracking(true)
+
+	c.finish(c.startFill(0, []string{"k1"}, false), value("v1"))
+	if got, ok := c.lookup(0, []string{"k1"}); !ok || got[0] != "v1" {
+		t.Fatalf("Expected k1 to be cached, got %v %v", got, ok)
+	}
+	if _, ok := c.lookup(1, []string{"k1"}); ok {
+		t.Error("Expected keys to be cached per DB")
+	}
+
+	// A reply read before an invalidation may predate the change
+	f := c.startFill(0, []string{"k2"}, false)
+	c.invalidate([]string{"k2"})
+	c.finish(f, value("old"))
+	if _, ok := c.lookup(0, []string{"k2"}); ok {
+		t.Error("Expected a fill raced by an invalidation not to be cached")
+	}
+
+	c.finish(c.startFill(0, []string{"k2", "k3", "k4"}, true), &RESPValue{Type: Array, Array: []RESPValue{
+		*value("v2"), {Type: BulkString, Null: true}, *value("v4"),
+	}})
+	if _, ok := c.lookup(0, []string{"k3"}); ok {
+		t.Error("Expected missing keys not to be cached")
+	}
+	if _, ok := c.lookup(0, []string{"k1", "k2", "k4"}); !ok {
+		t.Error("Expected MGET values to be cached")
+	}
+
+	c.invalidate([]string{"k1"})
+	if _, ok := c.lookup(0, []string{"k1"}); ok {
+		t.Error("Expected k1 to be invalidated")
+	}
+
+	// k2 is the least recently used once two more keys fill the budget
+	c.finish(c.startFill(0, []string{"k5"}, false), value("v5"))
+	c.finish(c.startFill(0, []string{"k6"}, false), value("v6"))
+	if _, ok := c.lookup(0, []string{"k2"}); ok || c.evictions.Load() != 1 {
+		t.Errorf("Expected k2 to be evicted, %d evictions", c.evictions.Load())
+	}
+
+	c.setTracking(false)
+	if c.size() != 0 {
+		t.Errorf("Expected the cache to be emptied when invalidations stop, %d bytes left", c.size())
+	}
+}
+
+func TestCachedReadsSkipUpstream(t *testing.T) {
+	addr, received := taggedUpstream(t, "up")
+	cfg := &config.Config{CacheKeys: []string{"user:*"}, CacheMaxMemory: 1 << 20}
+	p := &Proxy{config: cfg, cache: newReadCache(cfg)}
+	p.cache.setTracking(true)
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.cache = &cacheSession{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		defer upstream.Close()
+		p.handleClusterConnection(proxyClient, upstream, sess)
+	}()
+
+	// One at a time, so each read is cached before the next is sent
+	var got []string
+	for _, request := range []*RESPValue{
+		testRequest("GET", "user:1"),
+		testRequest("GET", "user:1"),
+		testRequest("GET", "other"),
+		testRequest("MULTI"),
+		testRequest("GET", "user:1"),
+		testRequest("EXEC"),
+		testRequest("MGET", "user:1"),
+	} {
+		got = append(got, roundTripAll(t, clientSide, request)...)
+	}
+	want := []string{
+		bulk("up GET user:1"),
+		bulk("up GET user:1"),
+		bulk("up GET other"),
+		bulk("up MULTI"),
+		bulk("up GET user:1"),
+		bulk("up EXEC"),
+		"*1\r\n" + bulk("up GET user:1"),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	p.cache.invalidate([]string{"user:1"})
+	roundTripAll(t, clientSide, testRequest("GET", "user:1"))
+
+	want = []string{"GET user:1", "PING", "GET other", "MULTI", "GET user:1", "EXEC", "PING", "GET user:1"}
+	if got := strings.Join(received(), ","); got != strings.Join(want, ",") {
+		t.Errorf("Expected the upstream to get %v, got %q", want, got)
+	}
+	if p.cache.hits.Load() != 2 || p.cache.misses.Load() != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %d and %d", p.cache.hits.Load(), p.cache.misses.Load())
+	}
+}
+
+func TestCacheWritesDropKeys(t *testing.T) {
+	addr, received := taggedUpstream(t, "up")
+	cfg := &config.Config{CacheKeys: []string{"user:*"}, CacheMaxMemory: 1 << 20}
+	p := &Proxy{config: cfg, cache: newReadCache(cfg)}
+	p.cache.setTracking(true)
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.cache = &cacheSession{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		defer upstream.Close()
+		p.handleClusterConnection(proxyClient, upstream, sess)
+	}()
+
+	// No invalidation arrives from the server: the writes alone drop the keys
+	for _, request := range []*RESPValue{
+		testRequest("GET", "user:1"),
+		testRequest("SET", "user:1", "v"),
+		testRequest("GET", "user:1"),
+		testRequest("MSET", "user:2", "a", "user:1", "b"),
+		testRequest("GET", "user:1"),
+		testRequest("MULTI"),
+		testRequest("INCR", "user:1"),
+		testRequest("GET", "user:1"),
+		testRequest("EXEC"),
+		testRequest("GET", "user:1"),
+		testRequest("GET", "user:1"),
+	} {
+		roundTripAll(t, clientSide, request)
+	}
+
+	want := []string{
+		"GET user:1", "SET user:1 v", "GET user:1", "MSET user:2 a user:1 b", "GET user:1",
+		"MULTI", "INCR user:1", "GET user:1", "EXEC", "GET user:1", "PING",
+	}
+	if got := strings.Join(received(), ","); got != strings.Join(want, ",") {
+		t.Errorf("Expected the upstream to get %v, got %q", want, got)
+	}
+}
+
+func TestReceiveInvalidations(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	invalidate := make(chan struct{})
+	trackingArgs := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := NewRESPReader(conn)
+		if _, err := reader.ReadValue(); err != nil {
+			return
+		}
+		conn.Write([]byte("%1\r\n+proto\r\n:3\r\n"))
+		tracking, err := reader.ReadValue()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range tracking.Array {
+			args = append(args, arg.Str)
+		}
+		trackingArgs <- strings.Join(args, " ")
+		conn.Write([]byte("+OK\r\n"))
+		<-invalidate
+		conn.Write([]byte(">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n"))
+		reader.ReadValue()
+	}()
+
+	cfg := config.NewConfig()
+	cfg.CacheKeys = []string{"user:*"}
+	p := &Proxy{config: cfg, remoteAddr: ln.Addr().String(), cache: newReadCache(cfg), shutdown: make(chan struct{})}
+	defer close(p.shutdown)
+	go p.trackInvalidations()
+
+	if args := <-trackingArgs; args != "CLIENT TRACKING ON BCAST PREFIX user:" {
+		t.Errorf("Unexpected tracking request %q", args)
+	}
+	var fill *cacheFill
+	for deadline := time.Now().Add(5 * time.Second); fill == nil && time.Now().Before(deadline); {
+		if fill = p.cache.startFill(0, []string{"user:1"}, false); fill == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if fill == nil {
+		t.Fatal("Expected caching to start once tracking is enabled")
+	}
+	p.cache.finish(fill, &RESPValue{Type: BulkString, Str: "v"})
+
+	close(invalidate)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.cache.size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.cache.size() != 0 || p.cache.invalidations.Load() != 1 {
+		t.Errorf("Expected user:1 to be invalidated by the server, %d bytes cached", p.cache.size())
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+// errChaosDisconnect ends a client connection dropped by chaos injection
+var errChaosDisconnect = errors.New("connection dropped by chaos injection")
+
+// chaosKeyless lists commands whose first argument is not a key, so they are
+// never answered with an injected MOVED
+var chaosKeyless = map[string]bool{
+	"AUTH": true, "HELLO": true, "SELECT": true, "CLIENT": true, "CLUSTER": true,
+	"CONFIG": true, "COMMAND": true, "INFO": true, "ECHO": true, "PING": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true, "UNSUBSCRIBE": true,
+	"PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true, "PUBLISH": true, "SPUBLISH": true,
+	"SCRIPT": true, "FUNCTION": true, "EVAL": true, "EVALSHA": true, "FCALL": true,
+	"MEMORY": true, "SLOWLOG": true, "LATENCY": true, "ACL": true, "SCAN": true,
+}
+
+// chaosInjector injects Memorystore failure modes into proxied connections so
+// applications can test their retry logic: added latency, replies stalled
+// midway as if a packet was lost, dropped connections and MOVED redirects
+type chaosInjector struct {
+	latency        time.Duration // Added before each request is forwarded
+	stall          time.Duration // Pause in the middle of a stalled reply
+	stallRate      float64       // Fraction of replies that are stalled
+	disconnectRate float64       // Fraction of requests that drop the connection instead
+	movedRate      float64       // Fraction of keyed requests answered with MOVED instead
+
+	delayed     atomic.Uint64
+	stalls      atomic.Uint64
+	disconnects atomic.Uint64
+	moved       atomic.Uint64
+}
+
+// newChaosInjector returns the injector configured by cfg, or nil when chaos
+// injection is disabled
+func newChaosInjector(cfg *config.Config) *chaosInjector {
+	if cfg == nil || !cfg.ChaosEnabled() {
+		return nil
+	}
+	return &chaosInjector{
+		latency:        time.Duration(cfg.ChaosLatency) * time.Millisecond,
+		stall:          time.Duration(cfg.ChaosStall) * time.Millisecond,
+		stallRate:      cfg.ChaosStallRate,
+		disconnectRate: cfg.ChaosDisconnectRate,
+		movedRate:      cfg.ChaosMovedRate,
+	}
+}
+
+// request applies chaos to a request about to be forwarded. It returns the
+// reply answering the request instead (a MOVED redirect to localAddr) or
+// errChaosDisconnect if the connection is to be dropped.
+func (c *chaosInjector) request(value *RESPValue, name, localAddr string) (*RESPValue, error) {
+	if c.latency > 0 {
+		c.delayed.Add(1)
+		time.Sleep(c.latency)
+	}
+	if c.disconnectRate > 0 && rand.Float64() < c.disconnectRate {
+		c.disconnects.Add(1)
+		return nil, errChaosDisconnect
+	}
+	if c.movedRate > 0 && len(value.Array) > 1 && !chaosKeyless[name] && rand.Float64() < c.movedRate {
+		c.moved.Add(1)
+		slot := keySlot(value.Array[1].Str)
+		return &RESPValue{Type: Error, Str: fmt.Sprintf("MOVED %d %s", slot, redisAddr(localAddr))}, nil
+	}
+	return nil, nil
+}
+
+// write sends a serialized reply, pausing midway through it if it was picked
+// to stall
+func (c *chaosInjector) write(out *bufio.Writer, data []byte) error {
+	if c.stallRate <= 0 || len(data) < 2 || rand.Float64() >= c.stallRate {
+		_, err := out.Write(data)
+		return err
+	}
+	c.stalls.Add(1)
+	half := len(data) / 2
+	if _, err := out.Write(data[:half]); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	time.Sleep(c.stall)
+	_, err := out.Write(data[half:])
+	return err
+}
+
+// keySlot returns the cluster hash slot of key, honouring {hash tags}
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % 16384)
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster uses for key slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
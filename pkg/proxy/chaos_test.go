@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestKeySlot(t *testing.T) {
+	tests := map[string]int{
+		"123456789":            12739, // CRC-16/XMODEM check value 0x31C3
+		"foo":                  12182,
+		"{user1000}.following": keySlot("user1000"),
+		"foo{}{bar}":           keySlot("foo{}{bar}"), // Empty hash tag: the whole key is hashed
+	}
+	for key, want := range tests {
+		if got := keySlot(key); got != want {
+			t.Errorf("keySlot(%q): expected %d, got %d", key, want, got)
+		}
+	}
+	if keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Error("Expected keys with the same hash tag to share a slot")
+	}
+}
+
+// chaosConnection relays a client through p to an echo upstream and returns
+// the client end
+func chaosConnection(t *testing.T, cfg *config.Config) (net.Conn, *Proxy) {
+	t.Helper()
+	addr, _ := echoUpstream(t)
+	p := &Proxy{config: cfg, localAddr: "127.0.0.1:6380", chaos: newChaosInjector(cfg)}
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	go func() {
+		defer proxyClient.Close()
+		defer upstream.Close()
+		p.handleClusterConnection(proxyClient, upstream, sess)
+	}()
+	t.Cleanup(func() { clientSide.Close() })
+	return clientSide, p
+}
+
+func TestChaosMoved(t *testing.T) {
+	conn, p := chaosConnection(t, &config.Config{ChaosMovedRate: 1})
+
+	got := roundTripAll(t, conn, testRequest("GET", "a"), testRequest("PING"), testRequest("SET", "{a}b", "v"))
+	want := []string{
+		fmt.Sprintf("-MOVED %d 127.0.0.1:6380\r\n", keySlot("a")),
+		bulk("PING"),
+		fmt.Sprintf("-MOVED %d 127.0.0.1:6380\r\n", keySlot("a")),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if n := p.chaos.moved.Load(); n != 2 {
+		t.Errorf("Expected 2 injected redirects, got %d", n)
+	}
+}
+
+func TestChaosDisconnect(t *testing.T) {
+	conn, p := chaosConnection(t, &config.Config{ChaosDisconnectRate: 1})
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write(testRequest("GET", "a").Serialize())
+	if _, err := NewRESPReader(conn).ReadValue(); err != io.EOF {
+		t.Errorf("Expected the connection to be dropped, got %v", err)
+	}
+	if n := p.chaos.disconnects.Load(); n != 1 {
+		t.Errorf("Expected 1 injected disconnect, got %d", n)
+	}
+}
+
+func TestChaosLatencyAndStall(t *testing.T) {
+	conn, p := chaosConnection(t, &config.Config{ChaosLatency: 50, ChaosStall: 100, ChaosStallRate: 1})
+
+	start := time.Now()
+	got := roundTripAll(t, conn, testRequest("GET", "a"))
+	if got[0] != bulk("GET a") {
+		t.Errorf("Expected the stalled reply to arrive intact, got %q", got[0])
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected at least 150ms of injected delay, took %s", elapsed)
+	}
+	if p.chaos.delayed.Load() != 1 || p.chaos.stalls.Load() != 1 {
+		t.Errorf("Expected 1 delayed request and 1 stalled reply, got %d and %d", p.chaos.delayed.Load(), p.chaos.stalls.Load())
+	}
+
+	if newChaosInjector(&config.Config{ChaosStall: 1000}) != nil {
+		t.Error("Expected chaos injection to be disabled without a rate or latency")
+	}
+}
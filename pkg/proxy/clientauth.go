@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+// interceptsClientAuth reports whether the AUTH commands of clients are
+// answered or rewritten by the proxy instead of forwarded as sent
+func (p *Proxy) interceptsClientAuth() bool {
+	return p.config.ClientAuth == config.ClientAuthIgnore || p.config.ClientAuth == config.ClientAuthReplace
+}
+
+// clientAuth handles the AUTH of a client on a dedicated upstream connection
+// according to -client-auth. It returns the reply for an AUTH the proxy
+// answers itself, and the request to forward, which has the proxy's
+// credential in place of the client's with -client-auth replace.
+func (p *Proxy) clientAuth(value *RESPValue, sess *session) (reply, request *RESPValue) {
+	switch p.config.ClientAuth {
+	case config.ClientAuthIgnore:
+		return &RESPValue{Type: SimpleString, Str: "OK"}, value
+	case config.ClientAuthReplace:
+		credential, err := p.upstreamCredential()
+		if err != nil {
+			sess.log.Error(fmt.Sprintf("Failed to replace the credentials of a client AUTH: %v", err))
+			return &RESPValue{Type: Error, Str: "ERR proxy failed to get an IAM token"}, value
+		}
+		if credential == "" {
+			// The upstream doesn't require authentication
+			return nil, value
+		}
+		args := []RESPValue{{Type: BulkString, Str: "AUTH"}}
+		if user := authUser(p.config); user != "" {
+			args = append(args, RESPValue{Type: BulkString, Str: user})
+		}
+		return nil, &RESPValue{Type: Array, Array: append(args, RESPValue{Type: BulkString, Str: credential})}
+	}
+	return nil, value
+}
+
+// upstreamCredential returns what the proxy authenticates upstream
+// connections with: the instance password, else an IAM token, else ""
+func (p *Proxy) upstreamCredential() (string, error) {
+	if password := p.authPassword.get(); password != "" {
+		return password, nil
+	}
+	if p.tokenSource == nil {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return p.tokenSource.GetToken(ctx)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestClientAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     config.ClientAuthMode
+		user     string
+		password string
+		reply    string
+		request  string
+	}{
+		{"forwarded", config.ClientAuthForward, "", "secret", "", "AUTH user bogus"},
+		{"ignored", config.ClientAuthIgnore, "", "secret", "+OK\r\n", "AUTH user bogus"},
+		{"replaced", config.ClientAuthReplace, "", "secret", "", "AUTH secret"},
+		{"replaced with ACL user", config.ClientAuthReplace, "app", "secret", "", "AUTH app secret"},
+		{"nothing to replace with", config.ClientAuthReplace, "", "", "", "AUTH user bogus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{config: &config.Config{ClientAuth: tt.mode, AuthUser: tt.user}, authPassword: newCredential(tt.password)}
+			reply, request := p.clientAuth(testRequest("AUTH", "user", "bogus"), newSession(1, false))
+
+			got := ""
+			if reply != nil {
+				got = string(reply.Serialize())
+			}
+			if got != tt.reply {
+				t.Errorf("Expected reply %q, got %q", tt.reply, got)
+			}
+			var args []string
+			for _, arg := range request.Array {
+				args = append(args, arg.Str)
+			}
+			if got := strings.Join(args, " "); got != tt.request {
+				t.Errorf("Expected request %q, got %q", tt.request, got)
+			}
+		})
+	}
+}
+
+func TestMuxAnswersClientAuth(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	p := newMuxProxy(addr, 1)
+	p.config.ClientAuth = config.ClientAuthIgnore
+	defer p.mux.close()
+
+	conn, done := muxClient(t, p, 1)
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	got := roundTripAll(t, conn, testRequest("AUTH", "bogus"), testRequest("GET", "k"))
+	want := []string{"+OK\r\n", bulk("GET k")}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestBuildAuthCommand(t *testing.T) {
+	if got := buildAuthCommand("", "token"); got != "*2\r\n$4\r\nAUTH\r\n$5\r\ntoken\r\n" {
+		t.Errorf("Unexpected AUTH for the default user: %q", got)
+	}
+	if got := buildAuthCommand("app", "token"); got != "*3\r\n$4\r\nAUTH\r\n$3\r\napp\r\n$5\r\ntoken\r\n" {
+		t.Errorf("Unexpected AUTH for an ACL user: %q", got)
+	}
+}
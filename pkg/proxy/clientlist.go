@@ -0,0 +1,56 @@
+package proxy
+
+import "strings"
+
+// rewriteClientList rewrites the addresses in a CLIENT LIST or CLIENT INFO
+// reply, one client per line as space-separated field=value pairs: laddr (the
+// node's address) becomes the local listener of the node, and addr becomes
+// the address of the proxy's client when the connection belongs to one of
+// clients (keyed by upstream connection local address). Reports whether
+// anything was rewritten.
+func rewriteClientList(list string, nodeMap, clients map[string]string) (string, bool) {
+	lines := strings.Split(list, "\n")
+	rewritten := false
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		changed := false
+		for j, field := range fields {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			var local string
+			switch key {
+			case "addr":
+				local, ok = clients[normalizeAddr(value)]
+			case "laddr":
+				local, ok = nodeMap[normalizeAddr(value)]
+			default:
+				ok = false
+			}
+			if ok {
+				fields[j] = key + "=" + redisAddr(local)
+				changed = true
+			}
+		}
+		if changed {
+			lines[i] = strings.Join(fields, " ")
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return list, false
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// rewriteClientListReply rewrites the addresses of a CLIENT LIST or CLIENT
+// INFO reply in place
+func (p *Proxy) rewriteClientListReply(reply *RESPValue) {
+	if reply == nil || reply.Null || (reply.Type != BulkString && reply.Type != Verbatim) {
+		return
+	}
+	if list, ok := rewriteClientList(reply.Str, p.nodeMap.load(), p.sessions.clients()); ok {
+		reply.Str = list
+	}
+}
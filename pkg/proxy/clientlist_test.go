@@ -0,0 +1,52 @@
+package proxy
+
+import "testing"
+
+func TestRewriteClientList(t *testing.T) {
+	nodeMap := map[string]string{"10.0.0.5:6379": "127.0.0.1:6380"}
+	clients := map[string]string{"10.8.0.2:41000": "127.0.0.1:52000"}
+	tests := []struct {
+		name, list, want string
+	}{
+		{
+			"proxied client",
+			"id=3 addr=10.8.0.2:41000 laddr=10.0.0.5:6379 fd=8 name= db=0 cmd=client|list\n",
+			"id=3 addr=127.0.0.1:52000 laddr=127.0.0.1:6380 fd=8 name= db=0 cmd=client|list\n",
+		},
+		{
+			"other client",
+			"id=4 addr=10.9.0.1:5000 laddr=10.0.0.5:6379 fd=9 name=replica\n",
+			"id=4 addr=10.9.0.1:5000 laddr=127.0.0.1:6380 fd=9 name=replica\n",
+		},
+		{
+			"unknown node",
+			"id=5 addr=10.9.0.1:5000 laddr=10.0.0.9:6379 fd=10\n",
+			"id=5 addr=10.9.0.1:5000 laddr=10.0.0.9:6379 fd=10\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewritten := rewriteClientList(tt.list, nodeMap, clients)
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if rewritten != (tt.list != tt.want) {
+				t.Errorf("Expected rewritten to be %v", tt.list != tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionRegistryClients(t *testing.T) {
+	var r sessionRegistry
+	sess := newSession(1, false)
+	sess.clientAddr = "127.0.0.1:52000"
+	r.add(sess)
+	r.add(newSession(2, false))
+	r.setUpstream(sess, "10.8.0.2:41000")
+
+	clients := r.clients()
+	if len(clients) != 1 || clients["10.8.0.2:41000"] != "127.0.0.1:52000" {
+		t.Errorf("Expected only the connected session, got %v", clients)
+	}
+}
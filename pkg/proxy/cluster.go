@@ -1,87 +1,120 @@
 package proxy
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
 )
 
 // ClusterNode represents a node in the Redis/Valkey cluster
 type ClusterNode struct {
-	ID      string
-	Address string // IP:port format
-	Port    int
-	Flags   string // master, replica, myself, etc.
-	Role    string // master or replica
+	ID       string
+	Address  string // IP:port format
+	Port     int
+	Flags    string // master, replica, myself, etc.
+	Role     string // master or replica
+	MasterID string // ID of the master of a replica; empty for masters
+	Hostname string // Announced with cluster-announce-hostname; empty if not set
 }
 
-// DiscoverClusterTopology connects to a cluster node and discovers all cluster members
-// Returns a list of all nodes in the cluster
-func DiscoverClusterTopology(conn net.Conn) ([]ClusterNode, error) {
-	// Send CLUSTER NODES command
-	cmd := "*2\r\n$7\r\nCLUSTER\r\n$5\r\nNODES\r\n"
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	if _, err := conn.Write([]byte(cmd)); err != nil {
-		return nil, fmt.Errorf("failed to send CLUSTER NODES command: %w", err)
+// dialAddr returns the address the node is dialed at: its announced hostname
+// if it has one, resolved on every dial so it survives IP changes, and its
+// IP otherwise
+func (n ClusterNode) dialAddr() string {
+	if n.Hostname == "" {
+		return n.Address
 	}
+	return net.JoinHostPort(n.Hostname, strconv.Itoa(n.Port))
+}
 
-	// Read response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	reader := bufio.NewReader(conn)
+// clusterReplicaType is the endpoint type of cluster replica nodes
+const clusterReplicaType = "cluster-replica"
+
+// ProbeClusterMode runs CLUSTER INFO through the proxy of endpoint and
+// reports whether the instance has cluster mode enabled
+func (m *Manager) ProbeClusterMode(ctx context.Context, endpoint discovery.Endpoint) (bool, error) {
+	m.mu.Lock()
+	p := m.proxyFor(endpoint.Address())
+	m.mu.Unlock()
+	if p == nil {
+		return false, fmt.Errorf("no proxy for %s", endpoint.Address())
+	}
 
-	// Read first byte to check response type
-	typeByte, err := reader.ReadByte()
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+	conn, err := p.dialAuthenticated(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response type: %w", err)
+		return false, err
 	}
-
-	// If it's an error, this is not a cluster instance
-	if typeByte == '-' {
-		line, _ := reader.ReadString('\n')
-		return nil, fmt.Errorf("not a cluster instance: %s", line)
+	defer conn.Close()
+	reply, err := queryCommand(conn, "CLUSTER", "INFO")
+	if err != nil {
+		return false, err
 	}
-
-	// Should be a bulk string ($<length>\r\n<data>\r\n)
-	if typeByte != '$' {
-		return nil, fmt.Errorf("unexpected response type: %c", typeByte)
+	// Instances without cluster mode reject CLUSTER INFO with
+	// "ERR This instance has cluster support disabled"
+	switch {
+	case reply.Type == BulkString:
+		return true, nil
+	case reply.Type == Error && strings.Contains(reply.Str, "cluster support disabled"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected CLUSTER INFO reply: %s", reply.Str)
 	}
+}
 
-	// Read the length line
-	lengthLine, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, fmt.Errorf("failed to read length: %w", err)
-	}
+// readOnlyCommand lets a cluster replica serve reads of its master's slots
+// on the connection instead of redirecting them with MOVED
+const readOnlyCommand = "*1\r\n$8\r\nREADONLY\r\n"
 
-	var length int
-	if _, err := fmt.Sscanf(lengthLine, "%d\r\n", &length); err != nil {
-		return nil, fmt.Errorf("invalid length format: %s", lengthLine)
-	}
+// readOnlyUpstream reports whether upstream connections are sent READONLY
+// after AUTH, for proxies of cluster replica nodes not lagging behind their master
+func (p *Proxy) readOnlyUpstream() bool {
+	return p.endpointType() == clusterReplicaType && p.config != nil && p.config.ClusterReplicaReads && !p.lagging()
+}
 
-	// Read the actual data
-	data := make([]byte, length)
-	if _, err := reader.Read(data); err != nil {
-		return nil, fmt.Errorf("failed to read data: %w", err)
+// sendReadOnly sends READONLY on a new upstream connection and checks the reply
+func sendReadOnly(conn net.Conn) error {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(readOnlyCommand)); err != nil {
+		return fmt.Errorf("failed to send READONLY command: %w", err)
 	}
 
-	// Read trailing \r\n
-	if _, err := reader.ReadByte(); err != nil {
-		return nil, fmt.Errorf("failed to read trailing \\r: %w", err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response := make([]byte, authResponseBufferSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return fmt.Errorf("failed to read READONLY response: %w", err)
 	}
-	if _, err := reader.ReadByte(); err != nil {
-		return nil, fmt.Errorf("failed to read trailing \\n: %w", err)
+	if respStr := string(response[:n]); respStr != "+OK\r\n" {
+		return fmt.Errorf("READONLY rejected: %s", strings.TrimSpace(respStr))
 	}
-
-	// Clear deadlines
 	conn.SetReadDeadline(time.Time{})
 	conn.SetWriteDeadline(time.Time{})
+	return nil
+}
 
-	// Parse the cluster nodes output
-	return parseClusterNodes(string(data))
+// DiscoverClusterTopology runs CLUSTER NODES on an authenticated connection
+// to a cluster node and returns all cluster members
+func DiscoverClusterTopology(conn net.Conn) ([]ClusterNode, error) {
+	reply, err := queryCommand(conn, "CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Type {
+	case BulkString, Verbatim:
+	case Error, BlobError:
+		return nil, fmt.Errorf("not a cluster instance: %s", reply.Str)
+	default:
+		return nil, fmt.Errorf("unexpected CLUSTER NODES reply type: %c", reply.Type)
+	}
+	return parseClusterNodes(reply.Str)
 }
 
 // parseClusterNodes parses the output of CLUSTER NODES command
@@ -107,25 +140,32 @@ func parseClusterNodes(output string) ([]ClusterNode, error) {
 		addressField := fields[1]
 		flags := fields[2]
 
-		// Parse address field: "ip:port@cport" or "ip:port@cport,hostname"
-		// We only care about the "ip:port" part
-		address := addressField
-		if idx := strings.Index(address, "@"); idx != -1 {
-			address = address[:idx]
-		}
-		if idx := strings.Index(address, ","); idx != -1 {
-			address = address[:idx]
+		// Parse address field: "ip:port@cport" or "ip:port@cport,hostname",
+		// possibly followed by ",name=value" auxiliary fields
+		address, bus, _ := strings.Cut(addressField, "@")
+		hostname := ""
+		if _, aux, ok := strings.Cut(bus, ","); ok {
+			hostname, _, _ = strings.Cut(aux, ",")
+			if strings.Contains(hostname, "=") {
+				hostname = ""
+			}
 		}
 
-		// Extract port from address
-		var port int
-		parts := strings.Split(address, ":")
-		if len(parts) == 2 {
-			if _, err := fmt.Sscanf(parts[1], "%d", &port); err != nil {
-				logger.Debug(fmt.Sprintf("Failed to parse port from %s: %v", address, err))
+		// Extract port from address; IPv6 hosts are not bracketed, so the port follows the last colon
+		host, port, ok := splitAddr(address)
+		if !ok {
+			logger.Debug(fmt.Sprintf("Failed to parse port from %s", address))
+			continue
+		}
+		if host == "" {
+			// Nodes announcing a hostname may not report an IP
+			if hostname == "" {
+				logger.Debug(fmt.Sprintf("Skipping cluster node without address: %s", line))
 				continue
 			}
+			host = hostname
 		}
+		address = net.JoinHostPort(host, strconv.Itoa(port))
 
 		// Determine role
 		role := "replica"
@@ -140,6 +180,12 @@ func parseClusterNodes(output string) ([]ClusterNode, error) {
 			Flags:   flags,
 			Role:    role,
 		}
+		if hostname != host {
+			node.Hostname = hostname
+		}
+		if fields[3] != "-" {
+			node.MasterID = fields[3]
+		}
 
 		nodes = append(nodes, node)
 	}
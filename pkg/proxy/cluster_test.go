@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+func TestAuthenticateUpstreamSendsReadOnlyToReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		reads    bool
+		password string
+		reply    string
+		want     []string
+		wantErr  bool
+	}{
+		{"replica", clusterReplicaType, true, "secret", "+OK\r\n", []string{"AUTH secret", "READONLY"}, false},
+		{"replica without auth", clusterReplicaType, true, "", "+OK\r\n", []string{"READONLY"}, false},
+		{"master", "cluster-master", true, "secret", "+OK\r\n", []string{"AUTH secret"}, false},
+		{"disabled", clusterReplicaType, false, "secret", "+OK\r\n", []string{"AUTH secret"}, false},
+		{"rejected", clusterReplicaType, true, "", "-ERR This instance has cluster support disabled\r\n", []string{"READONLY"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{
+				config:       &config.Config{ClusterReplicaReads: tt.reads},
+				endpoint:     discovery.Endpoint{Type: tt.endpoint},
+				authPassword: newCredential(tt.password),
+			}
+			proxySide, serverSide := net.Pipe()
+			defer proxySide.Close()
+
+			received := make(chan []string, 1)
+			go func() {
+				defer serverSide.Close()
+				serverSide.SetDeadline(time.Now().Add(5 * time.Second))
+				reader := NewRESPReader(serverSide)
+				var commands []string
+				for range tt.want {
+					value, err := reader.ReadValue()
+					if err != nil {
+						break
+					}
+					commands = append(commands, strings.Join(requestArgs(value), " "))
+					serverSide.Write([]byte(tt.reply))
+				}
+				received <- commands
+			}()
+
+			err := p.authenticateUpstream(context.Background(), proxySide, newSession(1, false))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if got := <-received; strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected %q, upstream got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProbeClusterMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		cluster bool
+		wantErr bool
+	}{
+		{"cluster", bulk("cluster_state:ok\r\ncluster_slots_assigned:16384\r\n"), true, false},
+		{"standalone", "-ERR This instance has cluster support disabled\r\n", false, false},
+		{"denied", "-NOPERM this user has no permissions to run the 'cluster|info' command\r\n", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := fakeClusterNode(t, func(args []string, asking bool) string { return tt.reply })
+			host, port, _ := splitAddr(addr)
+			endpoint := discovery.Endpoint{Host: host, Port: port, Type: "primary"}
+
+			cfg := config.NewConfig()
+			m := NewManager(cfg)
+			m.proxies = []*Proxy{{config: cfg, remoteAddr: addr, endpoint: endpoint, shutdown: make(chan struct{})}}
+
+			cluster, err := m.ProbeClusterMode(context.Background(), endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if cluster != tt.cluster {
+				t.Errorf("Expected cluster mode %v, got %v", tt.cluster, cluster)
+			}
+		})
+	}
+}
+
+func TestDiscoverClusterTopology(t *testing.T) {
+	// Well beyond the reader's 4 KiB buffer
+	var nodes strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&nodes, "%040d 10.0.%d.%d:6379@16379 master - 0 0 1 connected\n", i, i/250, i%250+1)
+	}
+	tests := []struct {
+		name  string
+		reply string
+		nodes int
+	}{
+		{"large topology", bulk(nodes.String()), 200},
+		{"cluster disabled", "-ERR This instance has cluster support disabled\r\n", -1},
+		{"unexpected reply", "+OK\r\n", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := fakeClusterNode(t, func(args []string, asking bool) string { return tt.reply })
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+
+			got, err := DiscoverClusterTopology(conn)
+			if tt.nodes < 0 {
+				if err == nil {
+					t.Errorf("Expected an error, got %d nodes", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DiscoverClusterTopology failed: %v", err)
+			}
+			if len(got) != tt.nodes || got[len(got)-1].Address != "10.0.0.200:6379" {
+				t.Errorf("Expected %d nodes ending with 10.0.0.200:6379, got %d", tt.nodes, len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rewriteClusterSlots rewrites the node entries of a CLUSTER SLOTS reply
+// ([start, end, [host, port, id, {ip, hostname}], ...]) to the local
+// addresses of their proxies. The host is the node's IP or, on clusters
+// preferring hostnames, its hostname, so nodes are also looked up by the
+// metadata. Reports whether anything was rewritten.
+func rewriteClusterSlots(reply *RESPValue, nodeMap map[string]string) bool {
+	if reply.Type != Array {
+		return false
+	}
+	rewritten := false
+	for i := range reply.Array {
+		slots := &reply.Array[i]
+		if slots.Type != Array || len(slots.Array) < 3 {
+			continue
+		}
+		for j := range slots.Array[2:] {
+			node := &slots.Array[2+j]
+			if node.Type != Array || len(node.Array) < 2 || node.Array[1].Type != Integer {
+				continue
+			}
+			host, port := &node.Array[0], &node.Array[1]
+			hosts := []*RESPValue{host}
+			if len(node.Array) > 3 {
+				for _, key := range []string{"ip", "hostname"} {
+					if field := mapField(&node.Array[3], key); field != nil {
+						hosts = append(hosts, field)
+					}
+				}
+			}
+			localHost, localPort, ok := localPeerHost(hosts, strconv.FormatInt(port.Int, 10), nodeMap)
+			if !ok {
+				continue
+			}
+			host.Str = localHost
+			port.Int, _ = strconv.ParseInt(localPort, 10, 64)
+			rewritten = true
+		}
+	}
+	return rewritten
+}
+
+// rewriteClusterShards rewrites the nodes of a CLUSTER SHARDS reply, maps
+// (flat key/value arrays in RESP2) with ip, endpoint, port and tls-port
+// fields. Local listeners are plaintext, so a rewritten node is left with
+// its local port as port and no tls-port. Reports whether anything was
+// rewritten.
+func rewriteClusterShards(reply *RESPValue, nodeMap map[string]string) bool {
+	if reply.Type != Array {
+		return false
+	}
+	rewritten := false
+	for i := range reply.Array {
+		nodes := mapField(&reply.Array[i], "nodes")
+		if nodes == nil || nodes.Type != Array {
+			continue
+		}
+		for j := range nodes.Array {
+			if rewriteShardNode(&nodes.Array[j], nodeMap) {
+				rewritten = true
+			}
+		}
+	}
+	return rewritten
+}
+
+// rewriteShardNode rewrites one node of a CLUSTER SHARDS reply
+func rewriteShardNode(node *RESPValue, nodeMap map[string]string) bool {
+	var hosts []*RESPValue
+	for _, key := range []string{"ip", "endpoint", "hostname"} {
+		if field := mapField(node, key); field != nil {
+			hosts = append(hosts, field)
+		}
+	}
+	if len(hosts) == 0 {
+		return false
+	}
+	var localHost, localPort string
+	ok := false
+	for _, key := range []string{"port", "tls-port"} {
+		if port := mapField(node, key); port != nil && port.Type == Integer && port.Int > 0 {
+			if localHost, localPort, ok = localPeerHost(hosts, strconv.FormatInt(port.Int, 10), nodeMap); ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for _, key := range []string{"ip", "endpoint"} {
+		if field := mapField(node, key); field != nil {
+			field.Str = localHost
+		}
+	}
+	port, _ := strconv.ParseInt(localPort, 10, 64)
+	if field := mapField(node, "port"); field != nil {
+		field.Int = port
+	} else {
+		node.Array = append(node.Array, RESPValue{Type: BulkString, Str: "port"}, RESPValue{Type: Integer, Int: port})
+	}
+	for k := 0; k+1 < len(node.Array); k += 2 {
+		if node.Array[k].Str == "tls-port" {
+			node.Array = append(node.Array[:k], node.Array[k+2:]...)
+			break
+		}
+	}
+	return true
+}
+
+// localPeerHost is localPeerAddr for the first of several fields naming the
+// same node (IP, endpoint, hostname) that has a proxy
+func localPeerHost(hosts []*RESPValue, port string, nodeMap map[string]string) (string, string, bool) {
+	for _, host := range hosts {
+		if host.Str == "" || host.Str == "?" {
+			continue
+		}
+		if localHost, localPort, ok := localPeerAddr(host.Str, port, nodeMap); ok {
+			return localHost, localPort, true
+		}
+	}
+	return "", "", false
+}
+
+// mapField returns the value of key in a map, or a flat key/value array as
+// RESP2 sends maps, or nil if it has none
+func mapField(m *RESPValue, key string) *RESPValue {
+	if m.Type != Map && m.Type != Array {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Array); i += 2 {
+		if m.Array[i].Str == key {
+			return &m.Array[i+1]
+		}
+	}
+	return nil
+}
+
+// rewriteClusterNodes rewrites the address field ("ip:port@cport[,hostname]")
+// of each line of a CLUSTER NODES reply, looking nodes up by IP or hostname.
+// Reports whether anything was rewritten.
+func rewriteClusterNodes(nodes string, nodeMap map[string]string) (string, bool) {
+	lines := strings.Split(nodes, "\n")
+	rewritten := false
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			continue
+		}
+		addr, bus, ok := strings.Cut(fields[1], "@")
+		if !ok {
+			continue
+		}
+		_, aux, _ := strings.Cut(bus, ",")
+		hostname, _, _ := strings.Cut(aux, ",")
+		if strings.Contains(hostname, "=") {
+			hostname = ""
+		}
+		localAddr, ok := nodeMap[normalizeAddr(addr)]
+		if !ok && hostname != "" {
+			if _, port, valid := splitAddr(addr); valid {
+				localAddr, ok = nodeMap[net.JoinHostPort(hostname, strconv.Itoa(port))]
+			}
+		}
+		if !ok {
+			continue
+		}
+		fields[1] = redisAddr(localAddr) + "@" + bus
+		lines[i] = strings.Join(fields, " ")
+		rewritten = true
+	}
+	if !rewritten {
+		return nodes, false
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// clusterTopologyRewriter returns the function rewriting the reply to a
+// CLUSTER SLOTS, SHARDS or NODES request in place, or nil for other
+// subcommands. Cluster clients discover nodes from these replies, so they
+// must only see the local listeners, like in redirects.
+func (p *Proxy) clusterTopologyRewriter(subcommand string) func(*RESPValue) {
+	switch strings.ToUpper(subcommand) {
+	case "SLOTS":
+		return func(reply *RESPValue) {
+			if reply != nil {
+				rewriteClusterSlots(reply, p.nodeMap.load())
+			}
+		}
+	case "SHARDS":
+		return func(reply *RESPValue) {
+			if reply != nil {
+				rewriteClusterShards(reply, p.nodeMap.load())
+			}
+		}
+	case "NODES":
+		return func(reply *RESPValue) {
+			if reply == nil || reply.Null || (reply.Type != BulkString && reply.Type != Verbatim) {
+				return
+			}
+			if nodes, ok := rewriteClusterNodes(reply.Str, p.nodeMap.load()); ok {
+				reply.Str = nodes
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+var clusterTestNodeMap = map[string]string{
+	"10.0.0.5:6379": "127.0.0.1:6379",
+	"10.0.0.6:6379": "127.0.0.1:6380",
+}
+
+func TestRewriteClusterSlots(t *testing.T) {
+	node := func(ip string, port int64, id string) RESPValue {
+		return RESPValue{Type: Array, Array: []RESPValue{
+			{Type: BulkString, Str: ip}, {Type: Integer, Int: port}, {Type: BulkString, Str: id},
+			{Type: Map, Array: []RESPValue{{Type: BulkString, Str: "hostname"}, {Type: BulkString, Str: "node-a"}}},
+		}}
+	}
+	reply := &RESPValue{Type: Array, Array: []RESPValue{
+		{Type: Array, Array: []RESPValue{{Type: Integer, Int: 0}, {Type: Integer, Int: 8191}, node("10.0.0.5", 6379, "a"), node("10.0.0.6", 6379, "b")}},
+		{Type: Array, Array: []RESPValue{{Type: Integer, Int: 8192}, {Type: Integer, Int: 16383}, node("10.0.0.9", 6379, "c")}},
+	}}
+	if !rewriteClusterSlots(reply, clusterTestNodeMap) {
+		t.Fatal("Expected the reply to be rewritten")
+	}
+	want := "*2\r\n" +
+		"*4\r\n:0\r\n:8191\r\n" +
+		"*4\r\n$9\r\n127.0.0.1\r\n:6379\r\n$1\r\na\r\n%1\r\n$8\r\nhostname\r\n$6\r\nnode-a\r\n" +
+		"*4\r\n$9\r\n127.0.0.1\r\n:6380\r\n$1\r\nb\r\n%1\r\n$8\r\nhostname\r\n$6\r\nnode-a\r\n" +
+		"*3\r\n:8192\r\n:16383\r\n" +
+		"*4\r\n$8\r\n10.0.0.9\r\n:6379\r\n$1\r\nc\r\n%1\r\n$8\r\nhostname\r\n$6\r\nnode-a\r\n"
+	if got := string(reply.Serialize()); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	if rewriteClusterSlots(&RESPValue{Type: Error, Str: "ERR This instance has cluster support disabled"}, clusterTestNodeMap) {
+		t.Error("Expected errors not to be rewritten")
+	}
+}
+
+func TestRewriteClusterShards(t *testing.T) {
+	field := func(key string, value RESPValue) []RESPValue {
+		return []RESPValue{{Type: BulkString, Str: key}, value}
+	}
+	str := func(s string) RESPValue { return RESPValue{Type: BulkString, Str: s} }
+	num := func(n int64) RESPValue { return RESPValue{Type: Integer, Int: n} }
+	node := func(typ RESPType, ip string, fields ...[]RESPValue) RESPValue {
+		n := RESPValue{Type: typ}
+		n.Array = append(n.Array, field("id", str("a"))...)
+		for _, f := range fields {
+			n.Array = append(n.Array, f...)
+		}
+		n.Array = append(n.Array, field("ip", str(ip))...)
+		n.Array = append(n.Array, field("endpoint", str(ip))...)
+		return n
+	}
+	shard := func(typ RESPType, nodes ...RESPValue) RESPValue {
+		s := RESPValue{Type: typ}
+		s.Array = append(s.Array, field("slots", RESPValue{Type: Array, Array: []RESPValue{num(0), num(16383)}})...)
+		s.Array = append(s.Array, field("nodes", RESPValue{Type: Array, Array: nodes})...)
+		return s
+	}
+
+	reply := &RESPValue{Type: Array, Array: []RESPValue{
+		shard(Map, node(Map, "10.0.0.5", field("port", num(6379)))),
+		// RESP2 flat arrays; a TLS node reports its port as tls-port
+		shard(Array, node(Array, "10.0.0.6", field("port", num(0)), field("tls-port", num(6379))), node(Array, "10.0.0.9", field("port", num(6379)))),
+	}}
+	if !rewriteClusterShards(reply, clusterTestNodeMap) {
+		t.Fatal("Expected the reply to be rewritten")
+	}
+
+	nodes := mapField(&reply.Array[0], "nodes").Array
+	if ip, port := mapField(&nodes[0], "ip").Str, mapField(&nodes[0], "port").Int; ip != "127.0.0.1" || port != 6379 {
+		t.Errorf("Expected the first node at 127.0.0.1:6379, got %s:%d", ip, port)
+	}
+	nodes = mapField(&reply.Array[1], "nodes").Array
+	if endpoint, port := mapField(&nodes[0], "endpoint").Str, mapField(&nodes[0], "port").Int; endpoint != "127.0.0.1" || port != 6380 {
+		t.Errorf("Expected the TLS node at 127.0.0.1:6380, got %s:%d", endpoint, port)
+	}
+	if mapField(&nodes[0], "tls-port") != nil {
+		t.Error("Expected tls-port to be removed, as local listeners are plaintext")
+	}
+	if ip := mapField(&nodes[1], "ip").Str; ip != "10.0.0.9" {
+		t.Errorf("Expected a node without a local proxy to keep its address, got %s", ip)
+	}
+}
+
+func TestRewriteClusterNodes(t *testing.T) {
+	nodes := "07c3 10.0.0.5:6379@16379 myself,master - 0 0 1 connected 0-8191\n" +
+		"e7d1 10.0.0.6:6379@16379,node-b slave 07c3 0 1426238317239 1 connected\n" +
+		"a1b2 10.0.0.9:6379@16379 master - 0 1426238316232 2 connected 8192-16383\n"
+	got, rewritten := rewriteClusterNodes(nodes, clusterTestNodeMap)
+	if !rewritten {
+		t.Fatal("Expected the reply to be rewritten")
+	}
+	want := "07c3 127.0.0.1:6379@16379 myself,master - 0 0 1 connected 0-8191\n" +
+		"e7d1 127.0.0.1:6380@16379,node-b slave 07c3 0 1426238317239 1 connected\n" +
+		"a1b2 10.0.0.9:6379@16379 master - 0 1426238316232 2 connected 8192-16383\n"
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// The rewritten reply still parses like the original
+	parsed, err := parseClusterNodes(got)
+	if err != nil || len(parsed) != 3 || parsed[1].Address != "127.0.0.1:6380" {
+		t.Errorf("Unexpected nodes parsed from the rewritten reply: %v %v", parsed, err)
+	}
+
+	p := &Proxy{nodeMap: newAddrMap(clusterTestNodeMap)}
+	if p.clusterTopologyRewriter("keyslot") != nil {
+		t.Error("Expected no rewriting for other CLUSTER subcommands")
+	}
+	reply := &RESPValue{Type: BulkString, Str: nodes}
+	p.clusterTopologyRewriter("nodes")(reply)
+	if !strings.Contains(reply.Str, "127.0.0.1:6380@16379") {
+		t.Errorf("Expected the reply to be rewritten in place, got %q", reply.Str)
+	}
+}
+
+func TestHostnameAnnouncedCluster(t *testing.T) {
+	nodes, err := parseClusterNodes("" +
+		"07c3 10.0.0.5:6379@16379,node-a.example.internal myself,master - 0 0 1 connected 0-8191\n" +
+		"e7d1 :6379@16379,node-b.example.internal,shard-id=9f slave 07c3 0 0 1 connected\n" +
+		"a1b2 10.0.0.9:6379@16379,,shard-id=1c master - 0 0 2 connected 8192-16383\n")
+	if err != nil || len(nodes) != 3 {
+		t.Fatalf("Failed to parse: %v %v", nodes, err)
+	}
+	if nodes[0].Address != "10.0.0.5:6379" || nodes[0].Hostname != "node-a.example.internal" || nodes[0].dialAddr() != "node-a.example.internal:6379" {
+		t.Errorf("Expected a node with IP and hostname to be dialed by hostname, got %+v", nodes[0])
+	}
+	if nodes[1].Address != "node-b.example.internal:6379" || nodes[1].Hostname != "" {
+		t.Errorf("Expected a node without IP to be addressed by hostname, got %+v", nodes[1])
+	}
+	if nodes[2].Hostname != "" || nodes[2].dialAddr() != "10.0.0.9:6379" {
+		t.Errorf("Expected auxiliary fields not to be taken for a hostname, got %+v", nodes[2])
+	}
+
+	// Nodes dialed by hostname are mapped under the hostname and the IP
+	nodeMap := map[string]string{
+		"node-a.example.internal:6379": "127.0.0.1:6380",
+		"10.0.0.5:6379":                "127.0.0.1:6380",
+		"node-b.example.internal:6379": "127.0.0.1:6381",
+	}
+	moved := &RESPValue{Type: Error, Str: "MOVED 3999 node-a.example.internal:6379"}
+	if !moved.RewriteRedirectError(nodeMap) || moved.Str != "MOVED 3999 127.0.0.1:6380" {
+		t.Errorf("Expected a redirect to a hostname to be rewritten, got %q", moved.Str)
+	}
+
+	got, _ := rewriteClusterNodes("e7d1 :6379@16379,node-b.example.internal slave 07c3 0 0 1 connected\n", nodeMap)
+	if got != "e7d1 127.0.0.1:6381@16379,node-b.example.internal slave 07c3 0 0 1 connected\n" {
+		t.Errorf("Expected a node without IP to be found by hostname, got %q", got)
+	}
+
+	// With cluster-preferred-endpoint-type unknown-endpoint the host is "?"
+	reply := &RESPValue{Type: Array, Array: []RESPValue{{Type: Array, Array: []RESPValue{
+		{Type: Integer, Int: 0}, {Type: Integer, Int: 16383},
+		{Type: Array, Array: []RESPValue{
+			{Type: BulkString, Str: "?"}, {Type: Integer, Int: 6379}, {Type: BulkString, Str: "07c3"},
+			{Type: Array, Array: []RESPValue{{Type: BulkString, Str: "hostname"}, {Type: BulkString, Str: "node-a.example.internal"}}},
+		}},
+	}}}}
+	if !rewriteClusterSlots(reply, nodeMap) || reply.Array[0].Array[2].Array[0].Str != "127.0.0.1" || reply.Array[0].Array[2].Array[1].Int != 6380 {
+		t.Errorf("Expected a node to be found by its hostname metadata, got %q", reply.Serialize())
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+// denyList holds the commands the proxy answers with an error instead of
+// forwarding, so an endpoint can be exposed without FLUSHALL, KEYS and the like
+type denyList struct {
+	commands map[string]bool // Command names ("FLUSHALL") and subcommands ("CONFIG SET")
+	rejected commandCounter  // Requests rejected, by deny-list entry
+}
+
+// newDenyList returns the deny-list configured by cfg, or nil when no command
+// is denied
+func newDenyList(cfg *config.Config) *denyList {
+	if cfg == nil || len(cfg.DeniedCommands) == 0 {
+		return nil
+	}
+	d := &denyList{commands: make(map[string]bool, len(cfg.DeniedCommands))}
+	for _, command := range cfg.DeniedCommands {
+		d.commands[command] = true
+	}
+	return d
+}
+
+// match returns the deny-list entry a request matches, or "" if it may be
+// forwarded. name is the request's command name.
+func (d *denyList) match(value *RESPValue, name string) string {
+	if d == nil || name == "" {
+		return ""
+	}
+	if d.commands[name] {
+		return name
+	}
+	if len(value.Array) > 1 {
+		if entry := name + " " + strings.ToUpper(value.Array[1].Str); d.commands[entry] {
+			return entry
+		}
+	}
+	return ""
+}
+
+// check returns the error reply for a denied request, counting it, or nil if
+// it may be forwarded
+func (d *denyList) check(value *RESPValue, name string) *RESPValue {
+	entry := d.match(value, name)
+	if entry == "" {
+		return nil
+	}
+	d.rejected.inc(entry)
+	return &RESPValue{Type: Error, Str: fmt.Sprintf("ERR %s is not allowed through this proxy", entry)}
+}
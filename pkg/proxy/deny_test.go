@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestDenyListMatch(t *testing.T) {
+	d := newDenyList(&config.Config{DeniedCommands: []string{"FLUSHALL", "CONFIG SET"}})
+	tests := []struct {
+		request *RESPValue
+		want    string
+	}{
+		{testRequest("flushall", "ASYNC"), "FLUSHALL"},
+		{testRequest("config", "set", "maxmemory", "1"), "CONFIG SET"},
+		{testRequest("CONFIG", "GET", "maxmemory"), ""},
+		{testRequest("CONFIG"), ""},
+		{testRequest("GET", "FLUSHALL"), ""},
+	}
+	for _, tt := range tests {
+		if got := d.match(tt.request, tt.request.CommandName()); got != tt.want {
+			t.Errorf("match(%v): expected %q, got %q", tt.request.Array, tt.want, got)
+		}
+	}
+
+	if newDenyList(&config.Config{}) != nil {
+		t.Error("Expected no deny-list without denied commands")
+	}
+}
+
+func TestDeniedCommandsKeepPipelineOrder(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	cfg := &config.Config{DeniedCommands: []string{"FLUSHALL", "CONFIG SET"}}
+	p := &Proxy{config: cfg, denied: newDenyList(cfg)}
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		defer upstream.Close()
+		p.handleClusterConnection(proxyClient, upstream, sess)
+	}()
+
+	got := roundTripAll(t, clientSide,
+		testRequest("GET", "a"),
+		testRequest("FLUSHALL"),
+		testRequest("CONFIG", "SET", "maxmemory", "1"),
+		testRequest("CONFIG", "GET", "maxmemory"),
+		testRequest("GET", "b"),
+	)
+	want := []string{
+		bulk("GET a"),
+		"-ERR FLUSHALL is not allowed through this proxy\r\n",
+		"-ERR CONFIG SET is not allowed through this proxy\r\n",
+		bulk("CONFIG GET maxmemory"),
+		bulk("GET b"),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if counts := p.denied.rejected.snapshot(); counts["FLUSHALL"] != 1 || counts["CONFIG SET"] != 1 {
+		t.Errorf("Expected 1 rejection of each command, got %v", counts)
+	}
+}
+
+func TestDeniedCommandAbortsTransaction(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	cfg := &config.Config{DeniedCommands: []string{"KEYS"}}
+	p := &Proxy{config: cfg, denied: newDenyList(cfg)}
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		defer upstream.Close()
+		p.handleClusterConnection(proxyClient, upstream, sess)
+	}()
+
+	got := roundTripAll(t, clientSide,
+		testRequest("MULTI"),
+		testRequest("SET", "k", "v"),
+		testRequest("KEYS", "*"),
+		testRequest("EXEC"),
+		testRequest("GET", "k"),
+		testRequest("MULTI"),
+		testRequest("SET", "k", "v"),
+		testRequest("EXEC"),
+	)
+	want := []string{
+		"+OK\r\n",
+		"+QUEUED\r\n",
+		"-ERR KEYS is not allowed through this proxy\r\n",
+		"-" + muxExecAbort + "\r\n",
+		bulk("GET k"),
+		"+OK\r\n",
+		"+QUEUED\r\n",
+		"*1\r\n" + bulk("SET k v"),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestMuxDeniedCommands(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	p := newMuxProxy(addr, 1)
+	p.denied = newDenyList(&config.Config{DeniedCommands: []string{"KEYS"}})
+	defer p.mux.close()
+
+	conn, _ := muxClient(t, p, 1)
+	defer conn.Close()
+
+	got := roundTripAll(t, conn,
+		testRequest("KEYS", "*"),
+		testRequest("GET", "k"),
+		testRequest("MULTI"),
+		testRequest("KEYS", "*"),
+		testRequest("EXEC"),
+	)
+	want := []string{
+		"-ERR KEYS is not allowed through this proxy\r\n",
+		bulk("GET k"),
+		"+OK\r\n",
+		"-ERR KEYS is not allowed through this proxy\r\n",
+		"-" + muxExecAbort + "\r\n",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
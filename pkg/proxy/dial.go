@@ -0,0 +1,416 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Used when the proxy has no config
+const (
+	defaultDialTimeout        = 5 * time.Second
+	defaultHandshakeTimeout   = 5 * time.Second
+	defaultKeepAlivePeriod    = 30 * time.Second
+	defaultHappyEyeballsDelay = 250 * time.Millisecond // RFC 8305 Connection Attempt Delay
+)
+
+// dialTimeout returns how long to wait for the TCP connection to an endpoint
+func dialTimeout(cfg *config.Config) time.Duration {
+	if cfg == nil || cfg.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return time.Duration(cfg.DialTimeout) * time.Second
+}
+
+// tlsHandshakeTimeout returns how long to wait for the TLS handshake with an
+// endpoint, counted from the established TCP connection
+func tlsHandshakeTimeout(cfg *config.Config) time.Duration {
+	if cfg == nil || cfg.TLSHandshakeTimeout <= 0 {
+		return defaultHandshakeTimeout
+	}
+	return time.Duration(cfg.TLSHandshakeTimeout) * time.Second
+}
+
+// tlsHandshake runs the client TLS handshake on conn within the configured
+// timeout, closing conn if it fails
+func tlsHandshake(ctx context.Context, conn net.Conn, tlsConfig *tls.Config, cfg *config.Config) (*tls.Conn, error) {
+	timeout := tlsHandshakeTimeout(cfg)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("TLS handshake timed out after %s", timeout)
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// newDialer returns the dialer for upstream endpoints. When a host name
+// resolves to both IPv4 and IPv6 addresses, the dialer races the two families
+// (Happy Eyeballs): the other family is tried once the first has not connected
+// within the configured delay, and the first connection to succeed wins.
+func newDialer(cfg *config.Config) *net.Dialer {
+	fallback := defaultHappyEyeballsDelay
+	if cfg != nil && cfg.HappyEyeballsDelay != 0 {
+		fallback = time.Duration(cfg.HappyEyeballsDelay) * time.Millisecond
+	}
+	return &net.Dialer{Timeout: dialTimeout(cfg), FallbackDelay: fallback}
+}
+
+// keepAlivePeriod returns the TCP keepalive interval for client and upstream
+// connections; zero means keepalive is disabled
+func keepAlivePeriod(cfg *config.Config) time.Duration {
+	if cfg == nil {
+		return defaultKeepAlivePeriod
+	}
+	return time.Duration(max(cfg.KeepAlivePeriod, 0)) * time.Second
+}
+
+// upstreamPingInterval returns how often idle pooled and shared upstream
+// connections are PINGed; zero disables the PINGs
+func upstreamPingInterval(cfg *config.Config) time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(max(cfg.UpstreamPingInterval, 0)) * time.Second
+}
+
+// userTimeout returns how long transmitted data may stay unacknowledged
+// before the kernel drops a connection (TCP_USER_TIMEOUT); zero keeps the OS default
+func userTimeout(cfg *config.Config) time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(max(cfg.TCPUserTimeout, 0)) * time.Second
+}
+
+// tuneTCP applies the configured keepalive interval and TCP_USER_TIMEOUT and
+// disables Nagle's algorithm on conn
+func tuneTCP(conn net.Conn, cfg *config.Config) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlive := keepAlivePeriod(cfg); keepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(keepAlive)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	if timeout := userTimeout(cfg); timeout > 0 {
+		setUserTimeout(tcpConn, timeout)
+	}
+	// Disable Nagle's algorithm for lower latency
+	tcpConn.SetNoDelay(true)
+}
+
+// dialUpstream connects to the remote endpoint and performs the TLS handshake if TLS is configured
+func (p *Proxy) dialUpstream(ctx context.Context, sess *session) (net.Conn, error) {
+	if p.authPassword.get() == "" && p.tokenSource != nil {
+		// Get the token for AUTH while the connection is set up
+		sess.token = p.prefetchToken(ctx)
+	}
+
+	dialCtx, dialSpan := tracing.Start(ctx, "upstream.dial",
+		attribute.Int64("conn.id", int64(sess.id)),
+		attribute.String("net.peer.addr", p.remoteAddr))
+	conn, err := newDialer(p.config).DialContext(dialCtx, "tcp", p.remoteAddr)
+	if err == nil {
+		// The address actually connected to, which differs from the endpoint for host names
+		dialSpan.SetAttributes(attribute.String("net.sock.peer.addr", conn.RemoteAddr().String()))
+	}
+	tracing.End(dialSpan, err)
+	if err != nil {
+		sess.token = nil
+		return nil, fmt.Errorf("failed to connect to remote: %w", err)
+	}
+	// Tune before the TLS handshake so a dead peer is detected during it too
+	tuneTCP(conn, p.config)
+
+	if p.tlsConfig == nil {
+		return conn, nil
+	}
+
+	sess.log.Debug(fmt.Sprintf("Establishing TLS connection to %s", p.remoteAddr))
+	hsCtx, hsSpan := tracing.Start(ctx, "upstream.tls_handshake",
+		attribute.Int64("conn.id", int64(sess.id)),
+		attribute.String("net.peer.addr", p.remoteAddr))
+	tlsConn, err := tlsHandshake(hsCtx, conn, p.clientTLSConfig(), p.config)
+	if err == nil {
+		resumed := tlsConn.ConnectionState().DidResume
+		hsSpan.SetAttributes(attribute.Bool("tls.resumed", resumed))
+		p.stats.tlsHandshakes.Add(1)
+		if resumed {
+			p.stats.tlsResumed.Add(1)
+		}
+	}
+	tracing.End(hsSpan, err)
+	if err != nil {
+		sess.token = nil
+		return nil, fmt.Errorf("failed to establish TLS connection to remote: %w", err)
+	}
+	sess.log.Debug(fmt.Sprintf("TLS handshake completed successfully (resumed: %v)", tlsConn.ConnectionState().DidResume))
+
+	return tlsConn, nil
+}
+
+// prefetchedToken is the result of getting an IAM token in the background
+type prefetchedToken struct {
+	token string
+	err   error
+}
+
+// prefetchToken gets the IAM token for a new upstream connection in the
+// background. The token is usually cached, but when it has to be fetched
+// (at startup, or while the refresher fails) the round trip to the metadata
+// server or STS overlaps the TCP and TLS handshakes instead of following them.
+func (p *Proxy) prefetchToken(ctx context.Context) <-chan prefetchedToken {
+	result := make(chan prefetchedToken, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		token, err := p.tokenSource.GetToken(ctx)
+		result <- prefetchedToken{token: token, err: err}
+	}()
+	return result
+}
+
+// Backoff between upstream dial retries
+const (
+	dialRetryMinBackoff = 100 * time.Millisecond
+	dialRetryMaxBackoff = 2 * time.Second
+)
+
+// dialRetryWindow returns how long a client connection keeps retrying a failed
+// upstream dial; zero disables retries
+func dialRetryWindow(cfg *config.Config) time.Duration {
+	if cfg == nil {
+		return 0
+	}
+	return time.Duration(max(cfg.DialRetryWindow, 0)) * time.Second
+}
+
+// jitter returns a random duration in [d/2, d), so clients that failed
+// together don't retry in lockstep
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2)
+}
+
+// dialWithRetry dials the upstream like dialUpstream, retrying with jittered
+// exponential backoff while the configured retry window lasts, so a brief
+// network blip doesn't fail the client connection. Every failed attempt
+// counts as a dial error; the returned count includes the successful attempt.
+func (p *Proxy) dialWithRetry(ctx context.Context, sess *session) (net.Conn, int, error) {
+	deadline := time.Now().Add(dialRetryWindow(p.config))
+	backoff := dialRetryMinBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := p.dialUpstream(ctx, sess)
+		if err == nil {
+			return conn, attempt, nil
+		}
+		p.stats.dialErrors.Add(1)
+
+		wait := jitter(backoff)
+		if time.Now().Add(wait).After(deadline) {
+			return nil, attempt, err
+		}
+		sess.log.Debug(fmt.Sprintf("Upstream connection attempt %d failed, retrying in %s: %v", attempt, wait.Round(time.Millisecond), err))
+		select {
+		case <-time.After(wait):
+		case <-p.shutdown:
+			return nil, attempt, err
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		}
+		backoff = min(backoff*2, dialRetryMaxBackoff)
+	}
+}
+
+// dialAuthenticated dials, TLS-negotiates and authenticates an upstream
+// connection that isn't tied to a client, for the pool and shared connections
+func (p *Proxy) dialAuthenticated(ctx context.Context) (net.Conn, error) {
+	sess := newSession(nextConnID(), false)
+	sess.log = sess.log.With("remote_addr", p.remoteAddr)
+
+	conn, err := p.dialUpstream(ctx, sess)
+	if err != nil {
+		p.stats.dialErrors.Add(1)
+		p.upstreamFailed()
+		return nil, err
+	}
+	if err := p.authenticateUpstream(ctx, conn, sess); err != nil {
+		p.recordAuthFailure(err)
+		p.upstreamFailed()
+		conn.Close()
+		return nil, err
+	}
+	p.upstreamSucceeded()
+	return conn, nil
+}
+
+// endpointTLSConfig returns the TLS config for one endpoint's proxy, with its
+// own session cache so new upstream connections resume a previous session
+func endpointTLSConfig(base *tls.Config, cfg *config.Config) *tls.Config {
+	if base == nil || cfg == nil || cfg.TLSSessionCache <= 0 {
+		return base
+	}
+	tlsConfig := base.Clone()
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(cfg.TLSSessionCache)
+	return tlsConfig
+}
+
+// clientTLSConfig returns the TLS config for dialing this proxy's endpoint
+// Like tls.Dial, it defaults ServerName to the endpoint host. It verifies
+// against the current server CAs, which may have rotated since startup.
+func (p *Proxy) clientTLSConfig() *tls.Config {
+	var roots *x509.CertPool
+	if p.rootCAs != nil {
+		roots = p.rootCAs.Load()
+	}
+	if p.tlsConfig.ServerName != "" && (roots == nil || roots == p.tlsConfig.RootCAs) {
+		return p.tlsConfig
+	}
+	cfg := p.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = p.endpoint.Host
+	}
+	if roots != nil {
+		cfg.RootCAs = roots
+	}
+	return cfg
+}
+
+// authenticateUpstream sends AUTH on a freshly dialed upstream connection
+// Password auth takes precedence over IAM auth; does nothing if neither is configured.
+// Connections to cluster replicas are then sent READONLY.
+func (p *Proxy) authenticateUpstream(ctx context.Context, conn net.Conn, sess *session) error {
+	var method string
+	password := p.authPassword.get()
+	switch {
+	case password != "":
+		method = "password"
+	case p.tokenSource != nil:
+		method = "iam"
+	default:
+		return p.setupUpstream(conn, sess)
+	}
+
+	ctx, span := tracing.Start(ctx, "upstream.auth",
+		attribute.Int64("conn.id", int64(sess.id)),
+		attribute.String("net.peer.addr", p.remoteAddr),
+		attribute.String("auth.method", method))
+
+	var err error
+	if method == "password" {
+		// Password authentication (for Redis instances)
+		if err = p.authenticatePassword(conn, password); err != nil {
+			err = fmt.Errorf("password authentication failed: %w", err)
+		}
+	} else {
+		// IAM authentication (for Valkey with IAM_AUTH authorization mode)
+		if err = p.authenticateIAM(ctx, conn, sess); err != nil {
+			err = fmt.Errorf("IAM authentication failed: %w", err)
+		}
+	}
+	tracing.End(span, err)
+
+	if err != nil {
+		return err
+	}
+	sess.log.Debug(fmt.Sprintf("%s authentication successful", method))
+	return p.setupUpstream(conn, sess)
+}
+
+// setupUpstream prepares an authenticated connection before it is used:
+// READONLY on cluster replicas, the default DB, and the connection name
+func (p *Proxy) setupUpstream(conn net.Conn, sess *session) error {
+	if err := p.enableReplicaReads(conn, sess); err != nil {
+		return err
+	}
+	if err := p.selectDefaultDB(conn); err != nil {
+		return err
+	}
+	p.nameUpstream(conn, sess)
+	return nil
+}
+
+// nameUpstream names a connection with CLIENT SETNAME after the proxy pod and,
+// if it serves one client, the client's address, so CLIENT LIST on the server
+// shows which workload owns it. A failure only leaves it unnamed.
+func (p *Proxy) nameUpstream(conn net.Conn, sess *session) {
+	if p.config == nil || !p.config.ClientName {
+		return
+	}
+	name := upstreamClientName(p.config.PodName, sess.clientAddr)
+	if err := execCommand(conn, "CLIENT", "SETNAME", name); err != nil {
+		sess.log.Debug(fmt.Sprintf("Failed to name upstream connection %q: %v", name, err))
+	}
+}
+
+// upstreamClientName returns "pod/client-address", or the pod name alone for
+// connections not dialed for a client. Characters not allowed in connection
+// names (spaces, non-printable) are replaced.
+func upstreamClientName(pod, clientAddr string) string {
+	name := pod
+	if clientAddr != "" {
+		name += "/" + clientAddr
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// defaultDB returns the logical database upstream connections start in
+func (p *Proxy) defaultDB() int {
+	if p.config == nil {
+		return 0
+	}
+	return p.config.DefaultDB
+}
+
+// selectDefaultDB sends SELECT on a new connection when -default-db is set,
+// for applications that expect a non-zero database but can't be changed
+func (p *Proxy) selectDefaultDB(conn net.Conn) error {
+	db := p.defaultDB()
+	if db == 0 {
+		return nil
+	}
+	if err := execCommand(conn, "SELECT", strconv.Itoa(db)); err != nil {
+		return fmt.Errorf("failed to select default DB %d: %w", db, err)
+	}
+	return nil
+}
+
+// enableReplicaReads sends READONLY on a connection to a cluster replica, so
+// it serves reads of its master's slots instead of answering MOVED
+func (p *Proxy) enableReplicaReads(conn net.Conn, sess *session) error {
+	if !p.readOnlyUpstream() {
+		return nil
+	}
+	if err := sendReadOnly(conn); err != nil {
+		return err
+	}
+	sess.log.Debug("Reads enabled on the cluster replica")
+	return nil
+}
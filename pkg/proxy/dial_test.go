@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/auth"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDialUpstreamTLSRecordsSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	p := &Proxy{
+		remoteAddr: server.Listener.Addr().String(),
+		endpoint:   discovery.Endpoint{Host: host, Port: port},
+		tlsConfig:  &tls.Config{InsecureSkipVerify: true},
+	}
+
+	conn, err := p.dialUpstream(context.Background(), newSession(7, false))
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("Expected *tls.Conn, got %T", conn)
+	}
+
+	names := make(map[string]bool)
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = true
+	}
+	for _, expected := range []string{"upstream.dial", "upstream.tls_handshake"} {
+		if !names[expected] {
+			t.Errorf("Expected span %s, got %v", expected, names)
+		}
+	}
+}
+
+func TestDialUpstreamResumesTLSSessions(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	base := &tls.Config{InsecureSkipVerify: true}
+	p := &Proxy{
+		remoteAddr: server.Listener.Addr().String(),
+		endpoint:   discovery.Endpoint{Host: host, Port: port},
+		tlsConfig:  endpointTLSConfig(base, &config.Config{TLSSessionCache: 8}),
+	}
+	if base.ClientSessionCache != nil {
+		t.Fatal("Expected the shared TLS config to be left untouched")
+	}
+
+	for i := range 2 {
+		conn, err := p.dialUpstream(context.Background(), newSession(uint64(i), false))
+		if err != nil {
+			t.Fatalf("Unexpected dial error: %v", err)
+		}
+		// TLS 1.3 session tickets arrive after the handshake, with the first reply
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		io.ReadAll(conn)
+		conn.Close()
+
+		if resumed := conn.(*tls.Conn).ConnectionState().DidResume; resumed != (i == 1) {
+			t.Errorf("Connection %d: expected resumed=%v", i, i == 1)
+		}
+	}
+	if handshakes, resumed := p.stats.tlsHandshakes.Load(), p.stats.tlsResumed.Load(); handshakes != 2 || resumed != 1 {
+		t.Errorf("Expected 2 handshakes and 1 resumed, got %d and %d", handshakes, resumed)
+	}
+
+	if endpointTLSConfig(base, &config.Config{}) != base {
+		t.Error("Expected no session cache when disabled")
+	}
+}
+
+func TestDialUpstreamConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	p := &Proxy{remoteAddr: addr}
+	if _, err := p.dialUpstream(context.Background(), newSession(1, false)); err == nil {
+		t.Error("Expected error dialing closed port")
+	}
+}
+
+func TestDialUpstreamTLSHandshakeTimeout(t *testing.T) {
+	// Accepts the TCP connection but never answers the ClientHello
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := &Proxy{
+		remoteAddr: ln.Addr().String(),
+		config:     &config.Config{DialTimeout: 5, TLSHandshakeTimeout: 1},
+		tlsConfig:  &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"},
+	}
+	start := time.Now()
+	_, err = p.dialUpstream(context.Background(), newSession(1, false))
+	if err == nil || !strings.Contains(err.Error(), "TLS handshake timed out after 1s") {
+		t.Fatalf("Expected a handshake timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the handshake timeout to apply, took %s", elapsed)
+	}
+}
+
+func TestDialSettings(t *testing.T) {
+	cfg := config.NewConfig()
+	if got := dialTimeout(cfg); got != 5*time.Second {
+		t.Errorf("Expected default dial timeout 5s, got %s", got)
+	}
+	if got := keepAlivePeriod(cfg); got != 30*time.Second {
+		t.Errorf("Expected default keepalive period 30s, got %s", got)
+	}
+
+	if got := tlsHandshakeTimeout(cfg); got != 5*time.Second {
+		t.Errorf("Expected default TLS handshake timeout 5s, got %s", got)
+	}
+
+	cfg.DialTimeout = 20
+	cfg.TLSHandshakeTimeout = 10
+	cfg.KeepAlivePeriod = 0
+	if got := dialTimeout(cfg); got != 20*time.Second {
+		t.Errorf("Expected dial timeout 20s, got %s", got)
+	}
+	if got := tlsHandshakeTimeout(cfg); got != 10*time.Second {
+		t.Errorf("Expected TLS handshake timeout 10s, got %s", got)
+	}
+	if got := keepAlivePeriod(cfg); got != 0 {
+		t.Errorf("Expected keepalive to be disabled, got %s", got)
+	}
+
+	cfg.HappyEyeballsDelay = 100
+	if got := newDialer(cfg).FallbackDelay; got != 100*time.Millisecond {
+		t.Errorf("Expected fallback delay 100ms, got %s", got)
+	}
+	cfg.HappyEyeballsDelay = -1
+	if got := newDialer(cfg).FallbackDelay; got >= 0 {
+		t.Errorf("Expected dual-stack racing to be disabled, got %s", got)
+	}
+
+	// Proxies built without a config use the defaults
+	if dialTimeout(nil) != defaultDialTimeout || tlsHandshakeTimeout(nil) != defaultHandshakeTimeout || keepAlivePeriod(nil) != defaultKeepAlivePeriod ||
+		newDialer(nil).FallbackDelay != defaultHappyEyeballsDelay {
+		t.Error("Expected defaults for a nil config")
+	}
+}
+
+func TestDialUpstreamHostName(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// localhost may also resolve to ::1, where nothing listens; the IPv4 address still wins
+	p := &Proxy{remoteAddr: net.JoinHostPort("localhost", port), config: config.NewConfig()}
+	conn, err := p.dialUpstream(context.Background(), newSession(1, false))
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Expected a connection to 127.0.0.1, got %s", conn.RemoteAddr())
+	}
+}
+
+func TestDialWithRetry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	cfg := config.NewConfig()
+	p := &Proxy{remoteAddr: addr, config: cfg}
+
+	// Without a retry window a failed dial is given up at once
+	if _, attempts, err := p.dialWithRetry(context.Background(), newSession(1, false)); err == nil || attempts != 1 {
+		t.Fatalf("Expected a single failed attempt, got %d: %v", attempts, err)
+	}
+
+	// The endpoint comes back while the client connection is retrying
+	cfg.DialRetryWindow = 5
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			t.Cleanup(func() { ln.Close() })
+		}
+	}()
+	conn, attempts, err := p.dialWithRetry(context.Background(), newSession(2, false))
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed: %v", err)
+	}
+	conn.Close()
+	if attempts < 2 {
+		t.Errorf("Expected several attempts, got %d", attempts)
+	}
+	if got := p.stats.dialErrors.Load(); got != uint64(attempts) {
+		t.Errorf("Expected %d dial errors, got %d", attempts, got)
+	}
+}
+
+func TestDialWithRetryStopsWhenCancelled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	cfg := config.NewConfig()
+	cfg.DialRetryWindow = 60
+	p := &Proxy{remoteAddr: addr, config: cfg, shutdown: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := p.dialWithRetry(ctx, newSession(1, false)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the retries to stop with the context, took %s", elapsed)
+	}
+}
+
+func TestAuthenticateUpstreamNamesConnection(t *testing.T) {
+	for _, reply := range []string{"+OK\r\n", "-NOPERM this user has no permissions to run the 'client|setname' command\r\n"} {
+		p := &Proxy{config: &config.Config{ClientName: true, PodName: "web 1"}, authPassword: newCredential("secret")}
+		proxySide, serverSide := net.Pipe()
+
+		received := make(chan []string, 1)
+		go func() {
+			defer serverSide.Close()
+			serverSide.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := NewRESPReader(serverSide)
+			var commands []string
+			for _, r := range []string{"+OK\r\n", reply} {
+				value, err := reader.ReadValue()
+				if err != nil {
+					break
+				}
+				commands = append(commands, strings.Join(requestArgs(value), " "))
+				serverSide.Write([]byte(r))
+			}
+			received <- commands
+		}()
+
+		sess := newSession(1, false)
+		sess.clientAddr = "10.0.0.1:5000"
+		if err := p.authenticateUpstream(context.Background(), proxySide, sess); err != nil {
+			t.Errorf("Expected a failed CLIENT SETNAME not to fail the connection, got %v", err)
+		}
+		if got := strings.Join(<-received, ","); got != "AUTH secret,CLIENT SETNAME web_1/10.0.0.1:5000" {
+			t.Errorf("Unexpected upstream commands %q", got)
+		}
+		proxySide.Close()
+	}
+
+	if name := upstreamClientName("proxy-0", ""); name != "proxy-0" {
+		t.Errorf("Expected the pod name alone without a client, got %q", name)
+	}
+}
+
+func TestDialUpstreamPresentsClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(nil)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	m := NewManager(&config.Config{})
+	// Any certificate does, the server doesn't verify it
+	m.SetClientCertificate(server.TLS.Certificates[0])
+	if err := m.SetTLSConfig("", true); err != nil {
+		t.Fatalf("SetTLSConfig failed: %v", err)
+	}
+	p := &Proxy{
+		remoteAddr: server.Listener.Addr().String(),
+		endpoint:   discovery.Endpoint{Host: host, Port: port},
+		tlsConfig:  m.tlsConfig,
+	}
+
+	conn, err := p.dialUpstream(context.Background(), newSession(1, false))
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 a rejected client certificate only shows on the first read
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if reply, err := io.ReadAll(conn); err != nil || !strings.HasPrefix(string(reply), "HTTP/1.0 ") {
+		t.Fatalf("Expected the server to accept the client certificate, got %q: %v", reply, err)
+	}
+}
+
+func TestDialUpstreamPrefetchesToken(t *testing.T) {
+	addr, auths := authUpstream(t)
+	source := &sequenceTokenSource{lifetime: time.Hour}
+	p := &Proxy{config: &config.Config{}, remoteAddr: addr,
+		tokenSource: auth.NewIAMTokenProviderFromSource(source)}
+
+	sess := newSession(1, false)
+	conn, err := p.dialUpstream(context.Background(), sess)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	defer conn.Close()
+
+	// The token is requested without waiting for authentication
+	deadline := time.Now().Add(5 * time.Second)
+	for source.issued.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := source.issued.Load(); n != 1 {
+		t.Fatalf("Expected the token to be fetched during the dial, got %d fetches", n)
+	}
+
+	if err := p.authenticateUpstream(context.Background(), conn, sess); err != nil {
+		t.Fatalf("Unexpected auth error: %v", err)
+	}
+	expectAuth(t, auths, "token-1")
+	if n := source.issued.Load(); n != 1 {
+		t.Errorf("Expected AUTH to use the prefetched token, got %d fetches", n)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// maskedValue replaces credentials in protocol dumps
+const maskedValue = "[REDACTED]"
+
+// Dump directions, as seen from the client
+const (
+	dumpRequest  = "client->server"
+	dumpResponse = "server->client"
+)
+
+// dumpOutput serializes dumps from concurrent connections so frames never interleave
+var dumpOutput = &lockedWriter{w: os.Stderr}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// protocolDumper writes a hex/ASCII dump of each RESP frame on one connection
+type protocolDumper struct {
+	connID   uint64
+	maxValue int
+	out      io.Writer
+}
+
+// newProtocolDumper returns a dumper for a sampled fraction of connections, or nil
+func newProtocolDumper(connID uint64, sample float64, maxValue int) *protocolDumper {
+	if !sampled(sample) {
+		return nil
+	}
+	return &protocolDumper{connID: connID, maxValue: maxValue, out: dumpOutput}
+}
+
+// sampled reports whether a new connection falls within the given fraction
+func sampled(fraction float64) bool {
+	return fraction > 0 && rand.Float64() < fraction
+}
+
+// dump writes one frame. Credentials and secrets registered with the logger
+// (the instance password, IAM tokens) are masked and long bulk strings
+// truncated before the frame is re-serialized, so the dump shows what was sent
+// apart from those edits.
+func (d *protocolDumper) dump(direction string, value *RESPValue) {
+	if d == nil {
+		return
+	}
+	var sanitized RESPValue
+	if direction == dumpRequest {
+		sanitized = maskCredentials(value)
+	} else {
+		sanitized = *value
+	}
+	sanitized = maskSecrets(sanitized)
+	sanitized = truncateValues(sanitized, d.maxValue)
+	data := sanitized.Serialize()
+
+	header := fmt.Sprintf("%s conn_id=%d %s %d bytes\n", time.Now().Format(time.RFC3339Nano), d.connID, direction, len(data))
+	io.WriteString(d.out, header+hex.Dump(data))
+}
+
+// maskCredentials returns a copy of a request with passwords and tokens
+// replaced: AUTH arguments, HELLO ... AUTH user pass, MIGRATE ... AUTH/AUTH2,
+// CONFIG SET of *pass* parameters and ACL SETUSER password rules
+func maskCredentials(value *RESPValue) RESPValue {
+	masked := *value
+	name := value.CommandName()
+	if name == "" {
+		return masked
+	}
+
+	args := make([]RESPValue, len(value.Array))
+	copy(args, value.Array)
+	masked.Array = args
+
+	mask := func(i int) {
+		if i < len(args) {
+			args[i] = RESPValue{Type: BulkString, Str: maskedValue}
+		}
+	}
+
+	switch name {
+	case "AUTH":
+		for i := 1; i < len(args); i++ {
+			mask(i)
+		}
+	case "HELLO", "MIGRATE":
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i].Str) {
+			case "AUTH":
+				// HELLO takes username and password; MIGRATE AUTH takes only a password
+				if name == "HELLO" {
+					mask(i + 2)
+				} else {
+					mask(i + 1)
+				}
+			case "AUTH2":
+				mask(i + 2)
+			}
+		}
+	case "CONFIG":
+		if len(args) > 1 && strings.EqualFold(args[1].Str, "SET") {
+			for i := 2; i+1 < len(args); i += 2 {
+				if strings.Contains(strings.ToLower(args[i].Str), "pass") {
+					mask(i + 1)
+				}
+			}
+		}
+	case "ACL":
+		if len(args) > 1 && strings.EqualFold(args[1].Str, "SETUSER") {
+			for i := 3; i < len(args); i++ {
+				if rule := args[i].Str; strings.HasPrefix(rule, ">") || strings.HasPrefix(rule, "<") ||
+					strings.HasPrefix(rule, "#") || strings.HasPrefix(rule, "!") {
+					mask(i)
+				}
+			}
+		}
+	}
+	return masked
+}
+
+// maskSecrets returns a copy of value with the secrets registered with the
+// logger replaced wherever they appear, e.g. in CONFIG GET replies or errors
+func maskSecrets(value RESPValue) RESPValue {
+	switch {
+	case value.Type.aggregate():
+		if len(value.Array) > 0 {
+			elems := make([]RESPValue, len(value.Array))
+			for i, elem := range value.Array {
+				elems[i] = maskSecrets(elem)
+			}
+			value.Array = elems
+		}
+	case value.Str != "":
+		value.Str = logger.MaskSecrets(value.Str)
+	}
+	return value
+}
+
+// truncateValues returns a copy of value with bulk strings longer than limit
+// shortened and annotated with their original length
+func truncateValues(value RESPValue, limit int) RESPValue {
+	switch {
+	case value.Type == BulkString || value.Type == Verbatim:
+		if limit > 0 && len(value.Str) > limit {
+			value.Str = fmt.Sprintf("%s...(%d bytes)", value.Str[:limit], len(value.Str))
+		}
+	case value.Type.aggregate():
+		if len(value.Array) > 0 {
+			elems := make([]RESPValue, len(value.Array))
+			for i, elem := range value.Array {
+				elems[i] = truncateValues(elem, limit)
+			}
+			value.Array = elems
+		}
+	}
+	return value
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+func testRequest(args ...string) *RESPValue {
+	value := &RESPValue{Type: Array}
+	for _, arg := range args {
+		value.Array = append(value.Array, RESPValue{Type: BulkString, Str: arg})
+	}
+	return value
+}
+
+func TestMaskCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *RESPValue
+		want []string
+	}{
+		{"AUTH password", testRequest("AUTH", "hunter2"), []string{"AUTH", maskedValue}},
+		{"AUTH user password", testRequest("auth", "default", "hunter2"), []string{"auth", maskedValue, maskedValue}},
+		{"HELLO AUTH", testRequest("HELLO", "3", "AUTH", "default", "hunter2"), []string{"HELLO", "3", "AUTH", "default", maskedValue}},
+		{"MIGRATE AUTH2", testRequest("MIGRATE", "h", "6379", "", "0", "5000", "AUTH2", "user", "hunter2", "KEYS", "k"),
+			[]string{"MIGRATE", "h", "6379", "", "0", "5000", "AUTH2", "user", maskedValue, "KEYS", "k"}},
+		{"CONFIG SET", testRequest("CONFIG", "SET", "requirepass", "hunter2", "maxmemory", "1gb"),
+			[]string{"CONFIG", "SET", "requirepass", maskedValue, "maxmemory", "1gb"}},
+		{"ACL SETUSER", testRequest("ACL", "SETUSER", "alice", "on", ">hunter2", "~*"),
+			[]string{"ACL", "SETUSER", "alice", "on", maskedValue, "~*"}},
+		{"GET untouched", testRequest("GET", "hunter2"), []string{"GET", "hunter2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := tt.req.Array[len(tt.req.Array)-1].Str
+			masked := maskCredentials(tt.req)
+
+			var got []string
+			for _, arg := range masked.Array {
+				got = append(got, arg.Str)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if tt.req.Array[len(tt.req.Array)-1].Str != original {
+				t.Error("maskCredentials modified the original request")
+			}
+		})
+	}
+}
+
+func TestTruncateValues(t *testing.T) {
+	value := truncateValues(*testRequest("SET", "key", strings.Repeat("x", 100)), 8)
+	if got := value.Array[2].Str; got != "xxxxxxxx...(100 bytes)" {
+		t.Errorf("Expected truncated value, got %q", got)
+	}
+	if value.Array[1].Str != "key" {
+		t.Errorf("Short values must not be truncated, got %q", value.Array[1].Str)
+	}
+}
+
+func TestProtocolDumperOutput(t *testing.T) {
+	var out bytes.Buffer
+	d := &protocolDumper{connID: 7, maxValue: 64, out: &out}
+
+	d.dump(dumpRequest, testRequest("AUTH", "hunter2"))
+	d.dump(dumpResponse, &RESPValue{Type: SimpleString, Str: "OK"})
+
+	dump := out.String()
+	if strings.Contains(dump, "hunter2") {
+		t.Errorf("Dump leaked the password:\n%s", dump)
+	}
+	if !strings.Contains(dump, "conn_id=7 client->server") || !strings.Contains(dump, "conn_id=7 server->client 5 bytes") {
+		t.Errorf("Missing frame headers:\n%s", dump)
+	}
+	if !strings.Contains(dump, "|+OK..|") {
+		t.Errorf("Expected ASCII column in dump:\n%s", dump)
+	}
+}
+
+func TestProtocolDumperMasksRegisteredSecrets(t *testing.T) {
+	var out bytes.Buffer
+	d := &protocolDumper{connID: 8, maxValue: 64, out: &out}
+	logger.PinSecret("dump-test-password")
+
+	d.dump(dumpRequest, testRequest("SET", "key", "dump-test-password"))
+	d.dump(dumpResponse, &RESPValue{Type: Array, Array: []RESPValue{
+		{Type: BulkString, Str: "requirepass"},
+		{Type: BulkString, Str: "dump-test-password"},
+	}})
+
+	if dump := out.String(); strings.Contains(dump, "dump-test-pas") {
+		t.Errorf("Dump leaked the registered password:\n%s", dump)
+	}
+}
+
+func TestNewProtocolDumperSampling(t *testing.T) {
+	if newProtocolDumper(1, 0, 64) != nil {
+		t.Error("Expected no dumper with a zero sample rate")
+	}
+	if newProtocolDumper(1, 1, 64) == nil {
+		t.Error("Expected a dumper with a sample rate of 1")
+	}
+}
+
+func TestNilProtocolDumper(t *testing.T) {
+	var d *protocolDumper
+	d.dump(dumpRequest, testRequest("PING"))
+}
+
+func TestRelayCapturesSampledConnection(t *testing.T) {
+	var buf bytes.Buffer
+	p := &Proxy{config: &config.Config{}}
+	sess := newSession(9, false)
+	sess.capture.Store(capture.NewWriter(&buf))
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.relayClientToServer(proxyClient, proxyServer, sess)
+		proxyServer.Close()
+	}()
+
+	requests := "*2\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n*1\r\n$4\r\nPING\r\n"
+	go func() {
+		clientSide.Write([]byte(requests))
+		clientSide.Close()
+	}()
+
+	received, _ := io.ReadAll(serverSide)
+	<-done
+
+	if string(received) != requests {
+		t.Errorf("Expected requests to be forwarded unchanged, got %q", received)
+	}
+
+	conns, _, err := capture.ReadAll(&buf)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	recs := conns[9]
+	if len(recs) != 2 || recs[1].Direction != capture.DirectionRequest || string(recs[1].Data) != "*1\r\n$4\r\nPING\r\n" {
+		t.Fatalf("Unexpected capture records: %+v", recs)
+	}
+	if strings.Contains(string(recs[0].Data), "hunter2") {
+		t.Errorf("Capture leaked the password: %q", recs[0].Data)
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestCaptureStopsOnWriteErrorFromBothDirections(t *testing.T) {
+	sess := newSession(1, false)
+	sess.capture.Store(capture.NewWriter(failingWriter{}))
+
+	// Both relay directions hit the error at once; run with -race
+	var wg sync.WaitGroup
+	for _, direction := range []string{capture.DirectionRequest, capture.DirectionResponse} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				sess.captureFrame(direction, testRequest("PING"))
+			}
+		}()
+	}
+	wg.Wait()
+	if sess.tapped() {
+		t.Error("Expected capture to stop after a write error")
+	}
+}
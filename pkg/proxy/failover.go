@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// endpointType returns the type of the proxied endpoint; for cluster nodes it
+// follows the node's role through failovers
+func (p *Proxy) endpointType() string {
+	if role := p.role.Load(); role != nil {
+		return *role
+	}
+	return p.endpoint.Type
+}
+
+// setEndpointType records a new role of the proxied cluster node
+func (p *Proxy) setEndpointType(endpointType string) {
+	p.role.Store(&endpointType)
+}
+
+// proxyFor returns the proxy of the endpoint at remoteAddr, or of the cluster
+// node announcing it, or nil. Called with m.mu held.
+func (m *Manager) proxyFor(remoteAddr string) *Proxy {
+	for _, p := range m.proxies {
+		if p.remoteAddr == remoteAddr || (p.announcedAddr != "" && p.announcedAddr == remoteAddr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// unservedNode reports whether CLUSTER NODES flags a node as unusable: failed,
+// without an address yet or still joining
+func unservedNode(flags string) bool {
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "fail", "noaddr", "handshake":
+			return true
+		}
+	}
+	return false
+}
+
+// checkClusterFailover runs CLUSTER NODES through the proxy of primaryEndpoint
+// and applies role changes: a promoted replica's proxy becomes a master
+// proxy (and the old master's a replica proxy), so READONLY is sent to the
+// right nodes and metrics and /status show the current roles. Nodes that
+// joined, such as replacements of failed masters, get proxies and nodeMap
+// entries so redirects to them are rewritten, and nodes that left the cluster
+// have their listeners drained and removed. The routing slot map is reloaded
+// after any change.
+func (m *Manager) checkClusterFailover(ctx context.Context, primaryEndpoint discovery.Endpoint) error {
+	m.mu.Lock()
+	primary := m.proxyFor(primaryEndpoint.Address())
+	m.mu.Unlock()
+	if primary == nil {
+		return fmt.Errorf("no proxy for %s", primaryEndpoint.Address())
+	}
+
+	conn, err := primary.dialAuthenticated(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	nodes, err := DiscoverClusterTopology(conn)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.clusterNodes = nodes
+	changed := false
+	var joined []ClusterNode
+	var switched []*Proxy
+	for _, node := range FilterUniqueNodes(nodes, primary.remoteAddr) {
+		if unservedNode(node.Flags) {
+			continue
+		}
+		p := m.proxyFor(node.dialAddr())
+		if p == nil {
+			joined = append(joined, node)
+			continue
+		}
+		role := fmt.Sprintf("cluster-%s", node.Role)
+		if previous := p.endpointType(); previous != role {
+			p.setEndpointType(role)
+			changed = true
+			switched = append(switched, p)
+			logger.Info(fmt.Sprintf("Cluster node %s on %s changed from %s to %s", p.remoteAddr, p.localAddr, previous, role))
+		}
+	}
+	if len(joined) > 0 && m.clusterPorts != nil {
+		if m.addClusterNodes(ctx, joined) > 0 {
+			changed = true
+		}
+	}
+	departed := m.removeDepartedNodes(nodes)
+	if len(departed) > 0 {
+		changed = true
+	}
+	proxies := make([]*Proxy, len(m.proxies))
+	copy(proxies, m.proxies)
+	m.mu.Unlock()
+
+	// Idle pooled connections were set up for the old role: READONLY is only
+	// sent to replicas when a connection is dialed
+	until := time.Now().Add(reconfigureWindow)
+	for _, p := range switched {
+		p.pool.flush()
+		p.reconfiguring(until)
+	}
+	if r := primary.router.Load(); r != nil && changed {
+		r.removeNodes(departed)
+		r.addNodes(proxies)
+		r.refreshAsync()
+	}
+	drain := time.Duration(m.config.DrainTimeout) * time.Second
+	for _, p := range departed {
+		p.reconfiguring(until)
+		logger.Info(fmt.Sprintf("Cluster node %s left the cluster, draining %s", p.remoteAddr, p.localAddr))
+		go p.Shutdown(drain)
+	}
+	return nil
+}
+
+// removeDepartedNodes forgets the proxies of cluster nodes missing from
+// nodes: they're dropped from the proxy list, nodeMap and metrics, and their
+// ports are freed. Failed nodes are still listed and keep their proxies.
+// Returns the removed proxies for the caller to drain. Called with m.mu held.
+func (m *Manager) removeDepartedNodes(nodes []ClusterNode) []*Proxy {
+	present := make(map[string]bool, 2*len(nodes))
+	for _, node := range nodes {
+		present[node.Address] = true
+		present[node.dialAddr()] = true
+	}
+
+	var departed []*Proxy
+	kept := m.proxies[:0]
+	for _, p := range m.proxies {
+		if !strings.HasPrefix(p.endpoint.Type, "cluster-") || present[p.remoteAddr] || (p.announcedAddr != "" && present[p.announcedAddr]) {
+			kept = append(kept, p)
+			continue
+		}
+		departed = append(departed, p)
+		m.nodeMap.delete(p.remoteAddr)
+		if p.announcedAddr != "" {
+			m.nodeMap.delete(p.announcedAddr)
+		}
+		if m.clusterPorts != nil {
+			m.clusterPorts.release(p.remoteAddr)
+		}
+		if collector, ok := m.collectors[[2]string{p.localAddr, p.remoteAddr}]; ok {
+			collector.set(nil)
+		}
+	}
+	clear(m.proxies[len(kept):])
+	m.proxies = kept
+
+	if len(departed) > 0 && m.clusterPorts != nil {
+		if err := m.clusterPorts.save(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to save port state: %v", err))
+		}
+	}
+	return departed
+}
+
+// RunClusterFailoverChecks polls the cluster topology through the proxy of
+// primaryEndpoint every interval until ctx is cancelled, following failovers
+// and nodes joining the cluster. If record is not nil, it is called after
+// every poll with the number of proxied endpoints or the error, e.g. to show
+// the poll on /status.
+func (m *Manager) RunClusterFailoverChecks(ctx context.Context, primaryEndpoint discovery.Endpoint, interval time.Duration, record func(endpointCount int, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+		err := m.checkClusterFailover(checkCtx, primaryEndpoint)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil && !failing:
+			logger.Error(fmt.Sprintf("Failed to check the cluster topology, failovers are not followed until it succeeds: %v", err))
+		case err != nil:
+			logger.Debug(fmt.Sprintf("Failed to check the cluster topology: %v", err))
+		case failing:
+			logger.Info("Cluster topology check succeeded again")
+		}
+		failing = err != nil
+		if record != nil {
+			record(m.ProxyCount(), err)
+		}
+	}
+}
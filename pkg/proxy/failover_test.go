@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+func TestClusterFailoverChangesRoles(t *testing.T) {
+	var mu sync.Mutex
+	nodes := "" +
+		"a1 10.0.0.2:6379@16379 master - 0 0 1 connected 0-16383\n" +
+		"b1 10.0.0.3:6379@16379 slave a1 0 0 1 connected\n"
+	addr, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return bulk(nodes)
+	})
+	host, port, _ := splitAddr(addr)
+
+	// A free port for the node that joins
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	_, startPort, _ := splitAddr(ln.Addr().String())
+	ln.Close()
+
+	cfg := config.NewConfig()
+	cfg.LocalAddr = "127.0.0.1"
+	m := NewManager(cfg)
+	m.isClusterMode = true
+	m.clusterPorts, _ = loadPortState("")
+	m.clusterStartPort = startPort
+	endpoint := discovery.Endpoint{Host: host, Port: port, Type: "primary"}
+	primary := &Proxy{config: cfg, remoteAddr: addr, endpoint: endpoint, shutdown: make(chan struct{})}
+	master := &Proxy{config: cfg, remoteAddr: "10.0.0.2:6379", endpoint: discovery.Endpoint{Type: "cluster-master"}, shutdown: make(chan struct{})}
+	replica := &Proxy{config: cfg, remoteAddr: "10.0.0.3:6379", endpoint: discovery.Endpoint{Type: clusterReplicaType}, shutdown: make(chan struct{})}
+	m.proxies = []*Proxy{primary, master, replica}
+	defer m.Shutdown(0)
+
+	if err := m.checkClusterFailover(context.Background(), endpoint); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if master.endpointType() != "cluster-master" || !replica.readOnlyUpstream() {
+		t.Fatal("Expected roles to be unchanged before the failover")
+	}
+	if master.reconfiguringAt(time.Now()) || primary.reconfiguringAt(time.Now()) {
+		t.Fatal("Expected no endpoint to be reconfigured before the failover")
+	}
+
+	// Idle pooled connections to the old master were dialed without READONLY
+	master.pool = newUpstreamPool(1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	if err := master.pool.fill(); err != nil || master.pool.idleCount() != 1 {
+		t.Fatalf("Expected a pooled connection: %v", err)
+	}
+
+	// b1 was promoted, a1 rejoined as its replica and d1 replaced a failed node
+	mu.Lock()
+	nodes = "" +
+		"a1 10.0.0.2:6379@16379 slave b1 0 0 2 connected\n" +
+		"b1 10.0.0.3:6379@16379 master - 0 0 2 connected 0-16383\n" +
+		"c1 10.0.0.4:6379@16379 master,fail - 0 0 1 disconnected\n" +
+		"d1 10.0.0.5:6379@16379 slave b1 0 0 2 connected\n"
+	mu.Unlock()
+	if err := m.checkClusterFailover(context.Background(), endpoint); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if replica.endpointType() != "cluster-master" || replica.readOnlyUpstream() {
+		t.Errorf("Expected the promoted replica to become a master, got %s", replica.endpointType())
+	}
+	if master.endpointType() != clusterReplicaType || !master.readOnlyUpstream() {
+		t.Errorf("Expected the old master to become a replica, got %s", master.endpointType())
+	}
+	if master.pool.idleCount() != 0 {
+		t.Error("Expected the pooled connections of the old master to be flushed")
+	}
+	if !master.reconfiguringAt(time.Now()) || !replica.reconfiguringAt(time.Now()) || primary.reconfiguringAt(time.Now()) {
+		t.Error("Expected only the switched nodes to be reconfigured")
+	}
+
+	if local := m.nodeMap.load()["10.0.0.5:6379"]; local != fmt.Sprintf("127.0.0.1:%d", startPort) {
+		t.Errorf("Expected the joined node to be mapped to port %d, got %q", startPort, local)
+	}
+	if _, ok := m.nodeMap.load()["10.0.0.4:6379"]; ok {
+		t.Error("Expected the failed node not to get a listener")
+	}
+	if len(m.Topology().Nodes) != 5 {
+		t.Errorf("Expected the topology to list 5 nodes, got %v", m.Topology().Nodes)
+	}
+}
+
+func TestDepartedClusterNodeIsRemoved(t *testing.T) {
+	var mu sync.Mutex
+	nodes := "" +
+		"a1 10.0.0.2:6379@16379 master - 0 0 1 connected 0-16383\n" +
+		"d1 10.0.0.5:6379@16379 slave a1 0 0 1 connected\n"
+	addr, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return bulk(nodes)
+	})
+	host, port, _ := splitAddr(addr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	_, startPort, _ := splitAddr(ln.Addr().String())
+	ln.Close()
+
+	cfg := config.NewConfig()
+	cfg.LocalAddr = "127.0.0.1"
+	cfg.DrainTimeout = 1
+	m := NewManager(cfg)
+	m.isClusterMode = true
+	m.clusterPorts, _ = loadPortState("")
+	m.clusterStartPort = startPort
+	endpoint := discovery.Endpoint{Host: host, Port: port, Type: "primary"}
+	primary := &Proxy{config: cfg, remoteAddr: addr, endpoint: endpoint, shutdown: make(chan struct{})}
+	master := &Proxy{config: cfg, remoteAddr: "10.0.0.2:6379", endpoint: discovery.Endpoint{Type: "cluster-master"}, shutdown: make(chan struct{})}
+	m.proxies = []*Proxy{primary, master}
+	defer m.Shutdown(0)
+
+	if err := m.checkClusterFailover(context.Background(), endpoint); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	m.mu.Lock()
+	joined := m.proxyFor("10.0.0.5:6379")
+	m.mu.Unlock()
+	if joined == nil {
+		t.Fatal("Expected a proxy for the joined node")
+	}
+
+	// d1 was removed from the cluster
+	mu.Lock()
+	nodes = "a1 10.0.0.2:6379@16379 master - 0 0 1 connected 0-16383\n"
+	mu.Unlock()
+	if err := m.checkClusterFailover(context.Background(), endpoint); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	m.mu.Lock()
+	proxies := len(m.proxies)
+	m.mu.Unlock()
+	if proxies != 2 {
+		t.Errorf("Expected the departed node's proxy to be removed, got %d proxies", proxies)
+	}
+	if _, ok := m.nodeMap.load()["10.0.0.5:6379"]; ok {
+		t.Error("Expected the departed node's nodeMap entry to be removed")
+	}
+	if _, ok := m.clusterPorts.ports["10.0.0.5:6379"]; ok {
+		t.Error("Expected the departed node's port to be freed")
+	}
+	select {
+	case <-joined.shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the departed node's listener to be closed")
+	}
+	if _, err := net.Dial("tcp", joined.localAddr); err == nil {
+		t.Error("Expected the departed node's port to refuse connections")
+	}
+	select {
+	case <-master.shutdown:
+		t.Error("Expected the remaining node's proxy to keep running")
+	default:
+	}
+}
+
+func TestClusterFailoverChecksRecordPolls(t *testing.T) {
+	addr, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		return bulk("a1 10.0.0.2:6379@16379 master - 0 0 1 connected 0-16383\n")
+	})
+	host, port, _ := splitAddr(addr)
+
+	cfg := config.NewConfig()
+	m := NewManager(cfg)
+	endpoint := discovery.Endpoint{Host: host, Port: port, Type: "primary"}
+	type poll struct {
+		count int
+		err   error
+	}
+	polls := make(chan poll, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.RunClusterFailoverChecks(ctx, endpoint, 10*time.Millisecond, func(count int, err error) {
+		select {
+		case polls <- poll{count, err}:
+		default:
+		}
+	})
+
+	// Without a proxy for the primary endpoint the poll fails
+	select {
+	case got := <-polls:
+		if got.err == nil {
+			t.Fatal("Expected the poll to fail without a proxy for the primary endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the poll to be recorded")
+	}
+
+	m.mu.Lock()
+	m.proxies = []*Proxy{
+		{config: cfg, remoteAddr: addr, endpoint: endpoint, shutdown: make(chan struct{})},
+		{config: cfg, remoteAddr: "10.0.0.2:6379", endpoint: discovery.Endpoint{Type: "cluster-master"}, shutdown: make(chan struct{})},
+	}
+	m.mu.Unlock()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-polls:
+			if got.err != nil {
+				continue
+			}
+			if got.count != 2 {
+				t.Errorf("Expected 2 proxied endpoints to be recorded, got %d", got.count)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Expected a successful poll to be recorded")
+		}
+	}
+}
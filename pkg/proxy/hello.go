@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// protocolState tracks the RESP version negotiated on a connection whose
+// requests and replies are parsed. HELLO switches it once its reply arrives,
+// so replies are paired with requests to find out whether it succeeded.
+type protocolState struct {
+	mu       sync.Mutex
+	version  int              // Negotiated protocol; 2 until a HELLO 3 succeeds
+	sent     uint64           // Requests forwarded
+	received uint64           // Replies read, not counting push frames
+	switches []protocolSwitch // Requests that change the protocol if they succeed, in request order
+}
+
+type protocolSwitch struct {
+	seq     uint64 // Index of the request
+	version int
+}
+
+// newProtocolState returns the state of a new connection, which speaks RESP2
+func newProtocolState() *protocolState {
+	return &protocolState{version: 2}
+}
+
+// current returns the negotiated protocol version, or 0 if it isn't tracked
+func (s *protocolState) current() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// request accounts for a request about to be forwarded; version is the
+// protocol it switches to on success, or 0 if it doesn't
+func (s *protocolState) request(version int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != 0 {
+		s.switches = append(s.switches, protocolSwitch{seq: s.sent, version: version})
+	}
+	s.sent++
+}
+
+// reply accounts for a reply of type typ and applies the protocol switch of
+// its request if it succeeded
+func (s *protocolState) reply(typ RESPType) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.received
+	s.received++
+
+	if len(s.switches) == 0 || s.switches[0].seq != seq {
+		return
+	}
+	if typ != Error && typ != BlobError {
+		s.version = s.switches[0].version
+	}
+	s.switches = s.switches[1:]
+}
+
+// switching reports whether a protocol switch awaits its reply
+func (s *protocolState) switching() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.switches) > 0
+}
+
+// resp3 reports whether replies may be RESP3: it was negotiated, or a HELLO 3
+// awaits its reply, which is already sent in RESP3
+func (s *protocolState) resp3() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version == 3 {
+		return true
+	}
+	for _, sw := range s.switches {
+		if sw.version == 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// interceptHello inspects a request for protocol changes before it is
+// forwarded: HELLO with a protocol version and RESET, which reverts to RESP2.
+// When the proxy authenticates the upstream connection itself, the AUTH
+// clause of HELLO is dropped, as the client's credentials would replace the
+// proxy's (an IAM token can't be known to the client).
+func (p *Proxy) interceptHello(value *RESPValue, sess *session) *RESPValue {
+	switch value.CommandName() {
+	case "HELLO":
+	case "RESET":
+		sess.protocol.request(2)
+		return value
+	default:
+		sess.protocol.request(0)
+		return value
+	}
+
+	// HELLO [protover [AUTH username password] [SETNAME clientname]]
+	version := 0
+	if len(value.Array) > 1 {
+		if v, err := strconv.Atoi(value.Array[1].Str); err == nil && (v == 2 || v == 3) {
+			version = v
+		}
+	}
+	if p.authPassword.get() != "" || p.tokenSource != nil {
+		for i := 2; i < len(value.Array); {
+			option := strings.ToUpper(value.Array[i].Str)
+			if option == "SETNAME" {
+				i += 2
+				continue
+			}
+			if option != "AUTH" || i+2 >= len(value.Array) {
+				// Malformed; the upstream replies with the error
+				break
+			}
+			args := make([]RESPValue, 0, len(value.Array)-3)
+			args = append(args, value.Array[:i]...)
+			args = append(args, value.Array[i+3:]...)
+			value = &RESPValue{Type: Array, Array: args}
+			sess.log.Debug("Dropped AUTH from HELLO: the upstream connection is authenticated by the proxy")
+			break
+		}
+	}
+	sess.protocol.request(version)
+	return value
+}
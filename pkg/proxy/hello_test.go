@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestInterceptHello(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		request  *RESPValue
+		want     string
+		switches bool
+	}{
+		{"auth dropped", "secret", testRequest("HELLO", "3", "AUTH", "user", "pass", "SETNAME", "app"), "HELLO 3 SETNAME app", true},
+		{"auth after setname", "secret", testRequest("hello", "3", "SETNAME", "AUTH", "auth", "user", "pass"), "hello 3 SETNAME AUTH", true},
+		{"auth kept without proxy auth", "", testRequest("HELLO", "3", "AUTH", "user", "pass"), "HELLO 3 AUTH user pass", true},
+		{"no version", "secret", testRequest("HELLO"), "HELLO", false},
+		{"unsupported version", "secret", testRequest("HELLO", "4"), "HELLO 4", false},
+		{"other command", "secret", testRequest("GET", "key"), "GET key", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{authPassword: newCredential(tt.password)}
+			sess := newSession(1, false)
+			sess.protocol = newProtocolState()
+
+			var args []string
+			for _, arg := range p.interceptHello(tt.request, sess).Array {
+				args = append(args, arg.Str)
+			}
+			if got := strings.Join(args, " "); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if sess.protocol.switching() != tt.switches {
+				t.Errorf("Expected switching=%v", tt.switches)
+			}
+		})
+	}
+}
+
+func TestProtocolStateFollowsReplies(t *testing.T) {
+	p := &Proxy{}
+	sess := newSession(1, false)
+	sess.protocol = newProtocolState()
+	state := sess.protocol
+
+	// Pipelined: GET, a rejected HELLO 3, an accepted HELLO 3
+	p.interceptHello(testRequest("GET", "key"), sess)
+	p.interceptHello(testRequest("HELLO", "3"), sess)
+	p.interceptHello(testRequest("HELLO", "3"), sess)
+	if !state.resp3() || state.current() != 2 {
+		t.Fatal("Expected RESP3 replies to be accepted while HELLO 3 is pending")
+	}
+
+	state.reply(BulkString)
+	state.reply(Error)
+	if state.current() != 2 {
+		t.Errorf("Expected a failed HELLO to keep RESP2, got %d", state.current())
+	}
+	state.reply(Map)
+	if state.current() != 3 || state.switching() {
+		t.Errorf("Expected RESP3 after the accepted HELLO, got %d", state.current())
+	}
+
+	p.interceptHello(testRequest("RESET"), sess)
+	state.reply(SimpleString)
+	if state.current() != 2 {
+		t.Errorf("Expected RESET to revert to RESP2, got %d", state.current())
+	}
+
+	var untracked *protocolState
+	untracked.request(3)
+	untracked.reply(Map)
+	if untracked.current() != 0 || untracked.resp3() {
+		t.Error("Expected an untracked connection to report no protocol")
+	}
+}
+
+func TestClusterConnectionNegotiatesRESP3(t *testing.T) {
+	p := &Proxy{
+		config:        &config.Config{},
+		isClusterMode: true,
+		nodeMap:       newAddrMap(map[string]string{"10.0.0.2:6379": "127.0.0.1:6380"}),
+		authPassword:  newCredential("secret"),
+	}
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.protocol = newProtocolState()
+	go p.handleClusterConnection(proxyClient, proxyServer, sess)
+
+	requests := make(chan string, 2)
+	go func() {
+		reader := NewRESPReader(serverSide)
+		for _, reply := range []string{
+			"%1\r\n$5\r\nproto\r\n:3\r\n",
+			"|1\r\n+ttl\r\n:10\r\n-MOVED 1 10.0.0.2:6379\r\n",
+		} {
+			request, err := reader.ReadValue()
+			if err != nil {
+				return
+			}
+			requests <- string(request.Serialize())
+			serverSide.Write([]byte(reply))
+		}
+	}()
+
+	clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := NewRESPReader(clientSide)
+	reader.SetRESP3(true)
+
+	clientSide.Write(testRequest("HELLO", "3", "AUTH", "default", "pass").Serialize())
+	if got := <-requests; got != string(testRequest("HELLO", "3").Serialize()) {
+		t.Errorf("Expected AUTH to be dropped from HELLO, upstream got %q", got)
+	}
+	if reply, err := reader.ReadValue(); err != nil || reply.Type != Map {
+		t.Fatalf("Expected the HELLO map, got %+v: %v", reply, err)
+	}
+
+	clientSide.Write(testRequest("GET", "key").Serialize())
+	<-requests
+	reply, err := reader.ReadValue()
+	if err != nil || reply.Str != "MOVED 1 127.0.0.1:6380" || len(reply.Attrs) != 2 {
+		t.Errorf("Expected the RESP3 redirect to be parsed and rewritten, got %+v: %v", reply, err)
+	}
+	if sess.protocol.current() != 3 || p.stats.parseFallbacks.Load() != 0 {
+		t.Errorf("Expected RESP3 without fallback, got protocol %d and %d fallbacks", sess.protocol.current(), p.stats.parseFallbacks.Load())
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rewriteInfoAddrs rewrites the addresses of replication peers in an INFO
+// reply to the local addresses of their proxies, like cluster redirects:
+// master_host/master_port on a replica and the ip/port of each slaveN entry
+// on a master. Peers without a proxy are left as they are. Reports whether
+// anything was rewritten.
+func rewriteInfoAddrs(info string, nodeMap map[string]string) (string, bool) {
+	lines := strings.Split(info, "\r\n")
+	rewritten := false
+	masterHost, masterPort := -1, -1
+	for i, line := range lines {
+		field, value, ok := strings.Cut(line, ":")
+		switch {
+		case !ok:
+		case field == "master_host":
+			masterHost = i
+		case field == "master_port":
+			masterPort = i
+		case strings.HasPrefix(field, "slave") && strings.Contains(value, "ip="):
+			if entry, ok := rewriteReplicaEntry(value, nodeMap); ok {
+				lines[i] = field + ":" + entry
+				rewritten = true
+			}
+		}
+	}
+
+	if masterHost >= 0 && masterPort >= 0 {
+		host := strings.TrimPrefix(lines[masterHost], "master_host:")
+		port := strings.TrimPrefix(lines[masterPort], "master_port:")
+		if localHost, localPort, ok := localPeerAddr(host, port, nodeMap); ok {
+			lines[masterHost] = "master_host:" + localHost
+			lines[masterPort] = "master_port:" + localPort
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return info, false
+	}
+	return strings.Join(lines, "\r\n"), true
+}
+
+// rewriteReplicaEntry rewrites the ip and port of a slaveN entry
+// ("ip=10.0.0.6,port=6379,state=online,offset=1234,lag=0")
+func rewriteReplicaEntry(entry string, nodeMap map[string]string) (string, bool) {
+	fields := strings.Split(entry, ",")
+	ip, port := -1, -1
+	for i, f := range fields {
+		switch {
+		case strings.HasPrefix(f, "ip="):
+			ip = i
+		case strings.HasPrefix(f, "port="):
+			port = i
+		}
+	}
+	if ip < 0 || port < 0 {
+		return entry, false
+	}
+	localHost, localPort, ok := localPeerAddr(fields[ip][len("ip="):], fields[port][len("port="):], nodeMap)
+	if !ok {
+		return entry, false
+	}
+	fields[ip] = "ip=" + localHost
+	fields[port] = "port=" + localPort
+	return strings.Join(fields, ","), true
+}
+
+// localPeerAddr returns the local host and port proxying a peer, if any
+func localPeerAddr(host, port string, nodeMap map[string]string) (string, string, bool) {
+	localAddr, ok := nodeMap[normalizeAddr(net.JoinHostPort(host, port))]
+	if !ok {
+		return "", "", false
+	}
+	localHost, localPort, ok := splitAddr(localAddr)
+	if !ok {
+		return "", "", false
+	}
+	return localHost, strconv.Itoa(localPort), true
+}
+
+// rewriteInfoReply rewrites the replication peers of an INFO reply in place
+func (p *Proxy) rewriteInfoReply(reply *RESPValue) {
+	if reply == nil || reply.Null || (reply.Type != BulkString && reply.Type != Verbatim) {
+		return
+	}
+	if info, ok := rewriteInfoAddrs(reply.Str, p.nodeMap.load()); ok {
+		reply.Str = info
+	}
+}
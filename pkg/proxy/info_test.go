@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestRewriteInfoAddrs(t *testing.T) {
+	nodeMap := map[string]string{
+		"10.0.0.5:6379":      "127.0.0.1:6379",
+		"10.0.0.6:6379":      "127.0.0.1:6380",
+		"[2001:db8::7]:6379": "127.0.0.1:6381",
+	}
+	tests := []struct {
+		name, info, want string
+	}{
+		{
+			"replica",
+			"# Replication\r\nrole:slave\r\nmaster_host:10.0.0.5\r\nmaster_port:6379\r\nmaster_link_status:up\r\n",
+			"# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\nmaster_link_status:up\r\n",
+		},
+		{
+			"master",
+			"# Replication\r\nrole:master\r\nconnected_slaves:3\r\n" +
+				"slave0:ip=10.0.0.6,port=6379,state=online,offset=42,lag=0\r\n" +
+				"slave1:ip=2001:db8::7,port=6379,state=online,offset=42,lag=1\r\n" +
+				"slave2:ip=10.0.0.9,port=6379,state=online,offset=42,lag=0\r\n" +
+				"master_replid:abc\r\n",
+			"# Replication\r\nrole:master\r\nconnected_slaves:3\r\n" +
+				"slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0\r\n" +
+				"slave1:ip=127.0.0.1,port=6381,state=online,offset=42,lag=1\r\n" +
+				"slave2:ip=10.0.0.9,port=6379,state=online,offset=42,lag=0\r\n" +
+				"master_replid:abc\r\n",
+		},
+		{
+			"unknown master",
+			"master_host:10.0.0.9\r\nmaster_port:6379\r\n",
+			"master_host:10.0.0.9\r\nmaster_port:6379\r\n",
+		},
+		{
+			"other sections",
+			"# Server\r\nredis_version:7.2.4\r\ntcp_port:6379\r\n",
+			"# Server\r\nredis_version:7.2.4\r\ntcp_port:6379\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewritten := rewriteInfoAddrs(tt.info, nodeMap)
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			if rewritten != (tt.info != tt.want) {
+				t.Errorf("Expected rewritten to be %v", tt.info != tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterInfoRepliesRewritten(t *testing.T) {
+	p := &Proxy{config: &config.Config{}, isClusterMode: true, nodeMap: newAddrMap(map[string]string{"10.0.0.5:6379": "127.0.0.1:6380"})}
+	info := "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.5\r\nmaster_port:6379\r\n"
+
+	proxyUpstream, serverSide := net.Pipe()
+	go func() {
+		defer serverSide.Close()
+		reader := NewRESPReader(serverSide)
+		for {
+			if _, err := reader.ReadValue(); err != nil {
+				return
+			}
+			reply := RESPValue{Type: BulkString, Str: info}
+			serverSide.Write(reply.Serialize())
+		}
+	}()
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		defer proxyUpstream.Close()
+		p.handleClusterConnection(proxyClient, proxyUpstream, sess)
+	}()
+
+	got := roundTripAll(t, clientSide, testRequest("GET", "k"), testRequest("INFO", "replication"))
+	if got[0] != bulk(info) {
+		t.Errorf("Expected replies to other commands unchanged, got %q", got[0])
+	}
+	if !strings.Contains(got[1], "master_host:127.0.0.1\r\nmaster_port:6380\r\n") {
+		t.Errorf("Expected the master address to be rewritten, got %q", got[1])
+	}
+}
+
+func TestClusterInfoRepliesRewrittenMultiplexed(t *testing.T) {
+	info := "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.5\r\nmaster_port:6379\r\n"
+	addr, _ := fakeClusterNode(t, func(args []string, asking bool) string { return bulk(info) })
+
+	p := newMuxProxy(addr, 1)
+	p.isClusterMode = true
+	p.nodeMap = newAddrMap(map[string]string{"10.0.0.5:6379": "127.0.0.1:6380"})
+	client, _ := muxClient(t, p, 1)
+	defer client.Close()
+
+	got := roundTripAll(t, client, testRequest("INFO", "replication"), testRequest("MULTI"), testRequest("INFO"))
+	if !strings.Contains(got[0], "master_host:127.0.0.1\r\nmaster_port:6380\r\n") {
+		t.Errorf("Expected the master address to be rewritten, got %q", got[0])
+	}
+	if !strings.HasPrefix(got[2], "-ERR INFO is not supported") {
+		t.Errorf("Expected INFO inside MULTI to be rejected, got %q", got[2])
+	}
+}
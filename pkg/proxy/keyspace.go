@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyspaceNotification reports whether every channel or pattern of a
+// (P)SUBSCRIBE request is one of keyspace notifications
+func keyspaceNotification(args []RESPValue) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg.Str, "__keyspace@") && !strings.HasPrefix(arg.Str, "__keyevent@") {
+			return false
+		}
+	}
+	return true
+}
+
+// keyspaceFanIn subscribes a routed client to keyspace notifications on
+// every master node and relays the messages of all of them. A node only
+// notifies changes of its own keys, so subscribing on one node misses the
+// others' events.
+type keyspaceFanIn struct {
+	pending  chan<- muxPending
+	channels map[string]bool
+	patterns map[string]bool
+	conns    []net.Conn
+
+	closing atomic.Bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// masters returns the proxies of the nodes serving slots, or the listener's
+// proxy until the slot map is loaded
+func (r *clusterRouter) masters() []*Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[*Proxy]bool)
+	var masters []*Proxy
+	for _, node := range r.slots {
+		if node != nil && !seen[node] {
+			seen[node] = true
+			masters = append(masters, node)
+		}
+	}
+	if len(masters) == 0 {
+		return []*Proxy{r.primary}
+	}
+	return masters
+}
+
+// newKeyspaceFanIn opens a connection to every master node for the
+// subscriptions of c; messages are queued to pending
+func newKeyspaceFanIn(c *routedClient, pending chan<- muxPending) (*keyspaceFanIn, error) {
+	f := &keyspaceFanIn{pending: pending, channels: make(map[string]bool), patterns: make(map[string]bool), stop: make(chan struct{})}
+	masters := c.router.masters()
+	for _, node := range masters {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(node.config)+tlsHandshakeTimeout(node.config)+5*time.Second)
+		conn, err := node.dialAuthenticated(ctx)
+		cancel()
+		if err != nil {
+			f.close()
+			return nil, fmt.Errorf("cluster node %s: %w", node.remoteAddr, err)
+		}
+		node.nameUpstream(conn, c.sess)
+		f.conns = append(f.conns, conn)
+		f.wg.Add(1)
+		go f.relay(node, conn)
+	}
+	f.wg.Add(1)
+	go f.watchMasters(c.router, masters)
+	return f, nil
+}
+
+// watchMasters disconnects the client when the master nodes change, e.g.
+// after a failover, as the new ones' events would be missed. The client
+// subscribes again on reconnecting, on the new masters.
+func (f *keyspaceFanIn) watchMasters(router *clusterRouter, masters []*Proxy) {
+	defer f.wg.Done()
+	for {
+		changed := router.slotsChanged()
+		if !sameNodes(masters, router.masters()) {
+			f.fail(fmt.Errorf("keyspace notifications: cluster master nodes changed"))
+			return
+		}
+		select {
+		case <-changed:
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// sameNodes reports whether a and b hold the same node proxies in any order
+func sameNodes(a, b []*Proxy) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, node := range b {
+		if !slices.Contains(a, node) {
+			return false
+		}
+	}
+	return true
+}
+
+// fail disconnects the client with err, unless the subscriptions are being closed
+func (f *keyspaceFanIn) fail(err error) {
+	if f.closing.Load() {
+		return
+	}
+	reply := make(chan muxReply, 1)
+	reply <- muxReply{err: err}
+	f.pending <- muxPending{reply: reply}
+}
+
+// relay queues the messages a node publishes on conn. Subscription
+// confirmations are dropped, as the client gets one per channel from the
+// proxy rather than one per node. A lost connection disconnects the client
+// so it subscribes again instead of silently missing events.
+func (f *keyspaceFanIn) relay(node *Proxy, conn net.Conn) {
+	defer f.wg.Done()
+	reader := NewRESPReader(conn)
+	for {
+		value, err := reader.ReadValue()
+		if err != nil {
+			f.fail(fmt.Errorf("keyspace notifications of cluster node %s: %w", node.remoteAddr, err))
+			return
+		}
+		if value.Type != Array || len(value.Array) == 0 {
+			continue
+		}
+		if kind := strings.ToLower(value.Array[0].Str); kind == "message" || kind == "pmessage" {
+			f.pending <- localReply(*value)
+		}
+	}
+}
+
+// count returns the number of channels and patterns subscribed to
+func (f *keyspaceFanIn) count() int64 {
+	return int64(len(f.channels) + len(f.patterns))
+}
+
+// request handles a request of the subscribed client, which like any
+// subscribed client may only (un)subscribe and PING
+func (f *keyspaceFanIn) request(value *RESPValue, name string) {
+	args := value.Array[1:]
+	switch name {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if !keyspaceNotification(args) {
+			f.pending <- localReply(RESPValue{Type: Error, Str: "ERR only keyspace notifications can be subscribed to when commands are routed to cluster nodes"})
+			return
+		}
+		kind, subscribed := "subscribe", f.channels
+		if name == "PSUBSCRIBE" {
+			kind, subscribed = "psubscribe", f.patterns
+		}
+		for _, arg := range args {
+			subscribed[arg.Str] = true
+			f.confirm(kind, arg)
+		}
+		f.send(value)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		kind, subscribed := "unsubscribe", f.channels
+		if name == "PUNSUBSCRIBE" {
+			kind, subscribed = "punsubscribe", f.patterns
+		}
+		if len(args) == 0 {
+			for _, channel := range slices.Sorted(maps.Keys(subscribed)) {
+				args = append(args, RESPValue{Type: BulkString, Str: channel})
+			}
+			if len(args) == 0 {
+				f.confirm(kind, RESPValue{Type: BulkString, Null: true})
+			}
+		}
+		for _, arg := range args {
+			delete(subscribed, arg.Str)
+			f.confirm(kind, arg)
+		}
+		f.send(value)
+	case "PING":
+		message := RESPValue{Type: BulkString}
+		if len(args) > 0 {
+			message = args[0]
+		}
+		f.pending <- localReply(RESPValue{Type: Array, Array: []RESPValue{{Type: BulkString, Str: "pong"}, message}})
+	default:
+		f.pending <- localReply(RESPValue{Type: Error, Str: fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name))})
+	}
+}
+
+// confirm queues the (un)subscribe confirmation of channel
+func (f *keyspaceFanIn) confirm(kind string, channel RESPValue) {
+	f.pending <- localReply(RESPValue{Type: Array, Array: []RESPValue{
+		{Type: BulkString, Str: kind}, channel, {Type: Integer, Int: f.count()},
+	}})
+}
+
+// send forwards a subscription change to every node. A failed write shows
+// up as a failed read in relay.
+func (f *keyspaceFanIn) send(value *RESPValue) {
+	data := value.Serialize()
+	for _, conn := range f.conns {
+		conn.Write(data)
+	}
+}
+
+// close closes the node connections and waits for their messages to be queued
+func (f *keyspaceFanIn) close() {
+	if !f.closing.Swap(true) {
+		close(f.stop)
+		for _, conn := range f.conns {
+			conn.Close()
+		}
+	}
+	f.wg.Wait()
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// replicaLag holds the last replication lag measurement of a replica's
+// endpoint. A replica lagging more than -replica-max-lag, or whose link to its
+// master is down, is excluded from reads until it catches up.
+type replicaLag struct {
+	excluded atomic.Bool
+
+	mu         sync.Mutex
+	checked    time.Time
+	bytes      int64  // Replication offset of the master minus the replica's
+	linkStatus string // master_link_status of the replica
+	err        error
+}
+
+// record stores a measurement and reports whether the replica is excluded
+// and whether that changed
+func (l *replicaLag) record(at time.Time, bytes int64, linkStatus string, err error, maxLag int64) (excluded, changed bool) {
+	l.mu.Lock()
+	l.checked, l.bytes, l.linkStatus, l.err = at, bytes, linkStatus, err
+	l.mu.Unlock()
+
+	// A failed measurement keeps the last decision: an unreachable replica is
+	// left to the upstream checks and -retry-reads
+	excluded = l.excluded.Load()
+	if err == nil {
+		excluded = linkStatus != "up" || bytes > maxLag
+	}
+	return excluded, l.excluded.Swap(excluded) != excluded
+}
+
+// lagging reports whether reads are kept away from this replica proxy
+func (p *Proxy) lagging() bool {
+	return p != nil && p.lag.excluded.Load()
+}
+
+// replicationLag returns the last lag measurement for /status, or nil if the
+// endpoint's lag isn't measured
+func (p *Proxy) replicationLag() *health.ReplicationLag {
+	p.lag.mu.Lock()
+	defer p.lag.mu.Unlock()
+
+	if p.lag.checked.IsZero() {
+		return nil
+	}
+	lag := &health.ReplicationLag{
+		CheckedAt:  p.lag.checked,
+		Bytes:      p.lag.bytes,
+		LinkStatus: p.lag.linkStatus,
+		Excluded:   p.lag.excluded.Load(),
+	}
+	if p.lag.err != nil {
+		lag.Error = p.lag.err.Error()
+	}
+	return lag
+}
+
+// infoFields parses the "field:value" lines of an INFO reply
+func infoFields(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if field, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(field, "#") {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// replicationInfo runs INFO replication on a new authenticated connection
+// to the endpoint of p
+func (p *Proxy) replicationInfo(ctx context.Context) (map[string]string, error) {
+	conn, err := p.dialAuthenticated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	reply, err := queryCommand(conn, "INFO", "replication")
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != BulkString {
+		return nil, fmt.Errorf("unexpected INFO reply: %s", reply.Str)
+	}
+	return infoFields(reply.Str), nil
+}
+
+// measureLag returns how many bytes of the master's replication stream the
+// replica hasn't processed yet, and the replica's master_link_status. The
+// master is asked first, so writes in between make the lag look smaller,
+// never larger.
+func measureLag(ctx context.Context, master, replica *Proxy) (int64, string, error) {
+	masterInfo, err := master.replicationInfo(ctx)
+	if err != nil {
+		return 0, "", fmt.Errorf("master %s: %w", master.remoteAddr, err)
+	}
+	replicaInfo, err := replica.replicationInfo(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	masterOffset, err := strconv.ParseInt(masterInfo["master_repl_offset"], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("master %s reports no master_repl_offset", master.remoteAddr)
+	}
+	linkStatus := replicaInfo["master_link_status"]
+	if linkStatus == "" {
+		return 0, "", fmt.Errorf("%s is not a replica", replica.remoteAddr)
+	}
+	replicaOffset, err := strconv.ParseInt(replicaInfo["slave_repl_offset"], 10, 64)
+	if err != nil {
+		return 0, linkStatus, nil
+	}
+	return max(masterOffset-replicaOffset, 0), linkStatus, nil
+}
+
+// checkLag measures the lag of replica behind master and logs exclusion changes
+func (m *Manager) checkLag(ctx context.Context, master, replica *Proxy, maxLag int64) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	bytes, linkStatus, err := measureLag(ctx, master, replica)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("Failed to measure the replication lag of %s: %v", replica.remoteAddr, err))
+	}
+	excluded, changed := replica.lag.record(start, bytes, linkStatus, err, maxLag)
+	if changed {
+		// Idle and shared connections to a cluster replica were sent READONLY
+		// (or not) for the previous decision
+		replica.pool.flush()
+		replica.mux.retire()
+	}
+	switch {
+	case !changed:
+	case excluded:
+		logger.Info(fmt.Sprintf("Replica %s for %s is %d bytes behind (link %s), not sending it reads", replica.remoteAddr, replica.localAddr, bytes, linkStatus))
+	default:
+		logger.Info(fmt.Sprintf("Replica %s for %s caught up, sending it reads again", replica.remoteAddr, replica.localAddr))
+	}
+}
+
+// replicaPairs returns the replicas serving reads with the proxy of their
+// master: the read replicas of -read-write-split and, with
+// -cluster-replica-reads, cluster replica nodes whose master has a proxy
+func (m *Manager) replicaPairs() [][2]*Proxy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pairs [][2]*Proxy
+	if m.splitPrimary != nil {
+		m.splitPrimary.readReplicas.mu.Lock()
+		for _, replica := range m.splitPrimary.readReplicas.proxies {
+			pairs = append(pairs, [2]*Proxy{m.splitPrimary, replica})
+		}
+		m.splitPrimary.readReplicas.mu.Unlock()
+	}
+	if !m.config.ClusterReplicaReads {
+		return pairs
+	}
+
+	addrByID := make(map[string]string, len(m.clusterNodes))
+	masterByAddr := make(map[string]string, len(m.clusterNodes))
+	for _, node := range m.clusterNodes {
+		addrByID[node.ID] = node.dialAddr()
+		masterByAddr[node.dialAddr()] = node.MasterID
+	}
+	for _, replica := range m.proxies {
+		if replica.endpointType() != clusterReplicaType {
+			continue
+		}
+		masterID, ok := masterByAddr[replica.remoteAddr]
+		if !ok {
+			continue
+		}
+		if master := m.proxyFor(addrByID[masterID]); master != nil && master != replica {
+			pairs = append(pairs, [2]*Proxy{master, replica})
+		}
+	}
+	return pairs
+}
+
+// RunReplicaLagChecks measures the replication lag of every replica serving
+// reads now and then every interval until ctx is cancelled, excluding
+// replicas more than maxLag bytes behind their master from reads
+func (m *Manager) RunReplicaLagChecks(ctx context.Context, interval time.Duration, maxLag int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, pair := range m.replicaPairs() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.checkLag(ctx, pair[0], pair[1], maxLag)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
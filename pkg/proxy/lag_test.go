@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestReplicaLagExclusion(t *testing.T) {
+	var replicaOffset atomic.Int64
+	replicaOffset.Store(400)
+	masterAddr, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		return bulk("# Replication\r\nrole:master\r\nconnected_slaves:1\r\nmaster_repl_offset:1000\r\n")
+	})
+	replicaAddr, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		return bulk(fmt.Sprintf("# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nslave_repl_offset:%d\r\n", replicaOffset.Load()))
+	})
+
+	cfg := config.NewConfig()
+	m := NewManager(cfg)
+	primary := &Proxy{config: cfg, remoteAddr: masterAddr, readReplicas: &replicaSet{}, shutdown: make(chan struct{})}
+	replica := &Proxy{config: cfg, remoteAddr: replicaAddr, shutdown: make(chan struct{})}
+	primary.readReplicas.add(replica)
+	m.proxies = []*Proxy{primary, replica}
+	m.splitPrimary = primary
+
+	pairs := m.replicaPairs()
+	if len(pairs) != 1 || pairs[0] != [2]*Proxy{primary, replica} {
+		t.Fatalf("Expected the read replica to be measured against the primary, got %v", pairs)
+	}
+
+	// Idle pooled connections were set up before the replica fell behind
+	replica.pool = newUpstreamPool(1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	if err := replica.pool.fill(); err != nil {
+		t.Fatalf("Fill failed: %v", err)
+	}
+
+	m.checkLag(context.Background(), primary, replica, 100)
+	if replica.pool.idleCount() != 0 {
+		t.Error("Expected the pooled connections to be flushed when the replica was excluded")
+	}
+	lag := replica.replicationLag()
+	if lag == nil || lag.Bytes != 600 || lag.LinkStatus != "up" || !lag.Excluded {
+		t.Fatalf("Expected the replica to be excluded 600 bytes behind, got %+v", lag)
+	}
+	if primary.readReplicas.pick() != nil {
+		t.Error("Expected no replica for new clients while it lags")
+	}
+
+	replicaOffset.Store(950)
+	m.checkLag(context.Background(), primary, replica, 100)
+	if replica.lagging() || primary.readReplicas.pick() != replica {
+		t.Errorf("Expected the replica to serve reads again once caught up, got %+v", replica.replicationLag())
+	}
+}
+
+func TestSplitSendsReadsToPrimaryWhileReplicaLags(t *testing.T) {
+	primaryAddr, _ := taggedUpstream(t, "primary")
+	replicaAddr, _ := taggedUpstream(t, "replica")
+	p := &Proxy{config: &config.Config{}, readReplicas: &replicaSet{}}
+	replica := &Proxy{remoteAddr: replicaAddr}
+
+	primaryConn, err := net.Dial("tcp", primaryAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	replicaConn, err := net.Dial("tcp", replicaAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	go func() {
+		defer proxyClient.Close()
+		p.relaySplit(proxyClient, primaryConn, replicaConn, replica, newSession(1, false))
+	}()
+
+	got := roundTripAll(t, clientSide, testRequest("GET", "k"))
+	replica.lag.excluded.Store(true)
+	got = append(got, roundTripAll(t, clientSide, testRequest("GET", "k"))...)
+	replica.lag.excluded.Store(false)
+	got = append(got, roundTripAll(t, clientSide, testRequest("GET", "k"))...)
+
+	want := []string{bulk("replica GET k"), bulk("primary GET k"), bulk("replica GET k")}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// limitResponse is sent to clients whose connection is rejected because a
+// connection limit is reached (same text as the server's maxclients error)
+const limitResponse = "-ERR max number of clients reached\r\n"
+
+// connLimiter bounds the number of simultaneous client connections. A nil
+// limiter allows any number.
+type connLimiter struct {
+	slots chan struct{}
+}
+
+// newConnLimiter returns a limiter for max connections, or nil if max is not positive
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, max)}
+}
+
+// tryAcquire takes a slot without waiting and reports whether one was free
+func (l *connLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by tryAcquire
+func (l *connLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// admit takes a slot from the global and the per-proxy limiter for a new
+// connection. When either is full the client gets limitResponse and is closed.
+func (p *Proxy) admit(clientConn net.Conn) bool {
+	if !p.globalLimit.tryAcquire() {
+		p.rejectOverLimit(clientConn, &p.stats.globalLimitRejections)
+		return false
+	}
+	if !p.connLimit.tryAcquire() {
+		p.globalLimit.release()
+		p.rejectOverLimit(clientConn, &p.stats.proxyLimitRejections)
+		return false
+	}
+	return true
+}
+
+// releaseSlots frees the slots taken by admit
+func (p *Proxy) releaseSlots() {
+	p.connLimit.release()
+	p.globalLimit.release()
+}
+
+// rejectOverLimit answers a connection that exceeds a limit and closes it
+func (p *Proxy) rejectOverLimit(clientConn net.Conn, counter *atomic.Uint64) {
+	counter.Add(1)
+	clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+	clientConn.Write([]byte(limitResponse))
+	clientConn.Close()
+}
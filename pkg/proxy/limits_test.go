@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestConnLimiter(t *testing.T) {
+	var unlimited *connLimiter
+	if !unlimited.tryAcquire() {
+		t.Error("Expected a nil limiter to allow connections")
+	}
+	unlimited.release()
+
+	l := newConnLimiter(1)
+	if !l.tryAcquire() {
+		t.Fatal("Expected the first slot to be free")
+	}
+	if l.tryAcquire() {
+		t.Error("Expected the limiter to be full")
+	}
+	l.release()
+	if !l.tryAcquire() {
+		t.Error("Expected the released slot to be reusable")
+	}
+}
+
+// readRejection returns what a rejected client receives before the connection closes
+func readRejection(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return string(data)
+}
+
+func TestAdmitGlobalLimit(t *testing.T) {
+	global := newConnLimiter(1)
+	p1 := &Proxy{globalLimit: global}
+	p2 := &Proxy{globalLimit: global, connLimit: newConnLimiter(5)}
+
+	first, _ := net.Pipe()
+	if !p1.admit(first) {
+		t.Fatal("Expected the first connection to be admitted")
+	}
+
+	// The global slot is taken by p1, so p2 refuses even with its own slots free
+	client, server := net.Pipe()
+	go p2.admit(server)
+	if got := readRejection(t, client); got != limitResponse {
+		t.Errorf("Expected %q, got %q", limitResponse, got)
+	}
+	if p2.stats.globalLimitRejections.Load() != 1 || p2.stats.proxyLimitRejections.Load() != 0 {
+		t.Errorf("Expected one global rejection, got %d global and %d proxy",
+			p2.stats.globalLimitRejections.Load(), p2.stats.proxyLimitRejections.Load())
+	}
+
+	p1.releaseSlots()
+	if !p2.admit(first) {
+		t.Error("Expected a connection to be admitted after the slot was released")
+	}
+}
+
+func TestProxyConnectionLimit(t *testing.T) {
+	p := &Proxy{
+		localAddr:  "127.0.0.1:0",
+		remoteAddr: fakeUpstream(t, "+PONG\r\n"),
+		config:     &config.Config{},
+		connLimit:  newConnLimiter(1),
+		shutdown:   make(chan struct{}),
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer p.Shutdown(time.Second)
+	addr := p.listener.Addr().String()
+
+	// The first client holds the only slot
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	first.Write(pingCommand)
+	if reply, err := NewRESPReader(first).ReadValue(); err != nil || reply.Str != "PONG" {
+		t.Fatalf("Expected PONG, got %+v (%v)", reply, err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer second.Close()
+	if got := readRejection(t, second); got != limitResponse {
+		t.Errorf("Expected %q, got %q", limitResponse, got)
+	}
+	if stats := p.Stats(); stats.LimitRejections != 1 {
+		t.Errorf("Expected 1 rejection in stats, got %d", stats.LimitRejections)
+	}
+
+	// Once the first client leaves, new clients are admitted again
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(pingCommand)
+		reply, err := NewRESPReader(conn).ReadValue()
+		conn.Close()
+		if err == nil && reply.Str == "PONG" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the slot to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
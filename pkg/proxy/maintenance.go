@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceResponse is the reply to commands other than PING, INFO and QUIT
+// while a client is served by the maintenance responder
+const maintenanceResponse = "PROXYERR backend unavailable"
+
+// maintenanceProbeInterval is how often an upstream that can't be reached is
+// tried again while clients are held by the maintenance responder
+const maintenanceProbeInterval = 2 * time.Second
+
+// maintenanceMode keeps clients connected while the upstream can't be
+// reached, answering PING and INFO locally so client pools don't keep
+// reconnecting. Clients are disconnected once the upstream works again.
+type maintenanceMode struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	probing bool
+	probed  time.Time
+
+	upAt   atomic.Int64 // UnixNano of the last working upstream connection
+	served atomic.Uint64
+}
+
+// newMaintenanceMode creates the maintenance responder, or returns nil if it is disabled
+func newMaintenanceMode(enabled bool) *maintenanceMode {
+	if !enabled {
+		return nil
+	}
+	return &maintenanceMode{interval: maintenanceProbeInterval}
+}
+
+// up records a working upstream connection
+func (m *maintenanceMode) up(now time.Time) {
+	if m != nil {
+		m.upAt.Store(now.UnixNano())
+	}
+}
+
+// upSince reports whether the upstream has worked since the given time
+func (m *maintenanceMode) upSince(t time.Time) bool {
+	return m.upAt.Load() >= t.UnixNano()
+}
+
+// probe tries the upstream in the background, at most once per interval for
+// all held clients. The circuit breaker's cooldown is respected.
+func (m *maintenanceMode) probe(p *Proxy) {
+	now := time.Now()
+	if now.Before(p.breaker.openedUntil()) {
+		return
+	}
+	m.mu.Lock()
+	if m.probing || now.Sub(m.probed) < m.interval {
+		m.mu.Unlock()
+		return
+	}
+	m.probing, m.probed = true, now
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			m.probing = false
+			m.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+		defer cancel()
+		// dialAuthenticated records the result, waking up the held clients
+		if conn, err := p.dialAuthenticated(ctx); err == nil {
+			conn.Close()
+		}
+	}()
+}
+
+// serveMaintenance answers a client locally while the upstream can't be
+// reached: PING and INFO get a reply, anything else -PROXYERR. The client is
+// disconnected once the upstream works again, so it reconnects through it.
+func (p *Proxy) serveMaintenance(clientConn net.Conn, sess *session) {
+	m := p.maintenance
+	m.served.Add(1)
+	start := time.Now()
+	sess.log.Info("Upstream unavailable, answering the client locally until it is back")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-p.shutdown:
+				clientConn.Close()
+				return
+			case <-ticker.C:
+			}
+			if m.upSince(start) {
+				sess.log.Debug("Upstream is back, closing the locally answered connection")
+				clientConn.Close()
+				return
+			}
+			m.probe(p)
+		}
+	}()
+
+	respReader := p.respReader(clientConn)
+	defer p.buffers().releaseReader(respReader)
+	respReader.SetInline(true)
+	for {
+		value, err := respReader.ReadValue()
+		if err != nil {
+			return
+		}
+		name := value.CommandName()
+		var reply RESPValue
+		switch name {
+		case "PING":
+			reply = RESPValue{Type: SimpleString, Str: "PONG"}
+			if len(value.Array) > 1 {
+				reply = RESPValue{Type: BulkString, Str: value.Array[1].Str}
+			}
+		case "INFO":
+			reply = RESPValue{Type: BulkString, Str: p.maintenanceInfo()}
+		case "QUIT":
+			reply = RESPValue{Type: SimpleString, Str: "OK"}
+		default:
+			reply = RESPValue{Type: Error, Str: maintenanceResponse}
+		}
+		if _, err := clientConn.Write(reply.Serialize()); err != nil || name == "QUIT" {
+			return
+		}
+		m.probe(p)
+	}
+}
+
+// maintenanceInfo returns the INFO reply sent while the upstream is unavailable
+func (p *Proxy) maintenanceInfo() string {
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	b.WriteString("proxy:cloud-memstore-proxy\r\n")
+	fmt.Fprintf(&b, "upstream_addr:%s\r\n", p.remoteAddr)
+	b.WriteString("upstream_status:unavailable\r\n")
+	return b.String()
+}
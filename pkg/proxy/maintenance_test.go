@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestMaintenanceResponderHoldsClients(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := &Proxy{
+		config:      config.NewConfig(),
+		remoteAddr:  addr,
+		maintenance: &maintenanceMode{interval: 10 * time.Millisecond},
+	}
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	p.connections.Add(1)
+	go p.handleConnection(proxyClient, nextConnID())
+
+	got := roundTripAll(t, client,
+		testRequest("PING"),
+		testRequest("PING", "hello"),
+		testRequest("GET", "k"),
+		testRequest("INFO"),
+	)
+	want := []string{"+PONG\r\n", bulk("hello"), "-" + maintenanceResponse + "\r\n"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if !strings.Contains(got[3], "upstream_status:unavailable") {
+		t.Errorf("Expected INFO to report the upstream unavailable, got %q", got[3])
+	}
+	if n := p.maintenance.served.Load(); n != 1 {
+		t.Errorf("Expected 1 locally answered connection, got %d", n)
+	}
+
+	// Once the upstream is back the client is disconnected so it reconnects through it
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Upstream address no longer available: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Errorf("Expected the client to be disconnected once the upstream is back, got %v", err)
+	}
+}
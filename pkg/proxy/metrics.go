@@ -0,0 +1,574 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// proxyStats holds live counters for a single proxy listener
+type proxyStats struct {
+	activeConnections atomic.Int64
+	totalConnections  atomic.Uint64
+	bytesToUpstream   atomic.Uint64 // Client -> Server
+	bytesToClient     atomic.Uint64 // Server -> Client
+	dialErrors        atomic.Uint64
+	authFailures      atomic.Uint64
+	authRejections    atomic.Uint64 // AUTH replies that were errors, a subset of authFailures
+	reconnects        atomic.Uint64 // Upstream connections transparently replaced while their client was idle
+	tlsHandshakes     atomic.Uint64 // Completed upstream TLS handshakes
+	tlsResumed        atomic.Uint64 // Handshakes that resumed a cached session, a subset of tlsHandshakes
+	parseFallbacks    atomic.Uint64 // Connections relayed as raw bytes after an unparseable reply
+	scriptLoads       atomic.Uint64 // Scripts loaded on other cluster nodes after a client's SCRIPT LOAD
+	scriptLoadErrors  atomic.Uint64 // Failed SCRIPT LOAD copies to other cluster nodes
+	reauths           atomic.Uint64 // AUTHs with a newer IAM token or a rotated password on long-lived connections
+	reauthErrors      atomic.Uint64 // Failed re-authentications, including failed token fetches
+
+	proxyLimitRejections  atomic.Uint64 // Connections refused by the per-proxy connection limit
+	globalLimitRejections atomic.Uint64 // Connections refused by the process-wide connection limit
+	commands              commandCounter
+	redirects             redirectCounter
+}
+
+// redirectCounter counts cluster MOVED/ASK redirects by type and by whether
+// they could be rewritten to a local proxy address
+type redirectCounter struct {
+	movedRewritten atomic.Uint64
+	movedUnknown   atomic.Uint64 // Target node has no local proxy, client is sent to the remote address
+	askRewritten   atomic.Uint64
+	askUnknown     atomic.Uint64
+}
+
+// record counts a single redirect
+func (r *redirectCounter) record(moved, rewritten bool) {
+	switch {
+	case moved && rewritten:
+		r.movedRewritten.Add(1)
+	case moved:
+		r.movedUnknown.Add(1)
+	case rewritten:
+		r.askRewritten.Add(1)
+	default:
+		r.askUnknown.Add(1)
+	}
+}
+
+// snapshot returns the redirect counts for /status
+func (r *redirectCounter) snapshot() *health.RedirectStats {
+	return &health.RedirectStats{
+		Moved:       r.movedRewritten.Load() + r.movedUnknown.Load(),
+		Ask:         r.askRewritten.Load() + r.askUnknown.Load(),
+		Rewritten:   r.movedRewritten.Load() + r.askRewritten.Load(),
+		UnknownNode: r.movedUnknown.Load() + r.askUnknown.Load(),
+	}
+}
+
+// maxCommandNames caps the number of distinct command names tracked per proxy so
+// that clients sending garbage cannot blow up metric cardinality
+const maxCommandNames = 256
+
+// otherCommand is the bucket for commands beyond maxCommandNames
+const otherCommand = "OTHER"
+
+// commandCounter counts client requests by command name
+type commandCounter struct {
+	mu     sync.RWMutex
+	counts map[string]*atomic.Uint64
+}
+
+// inc increments the counter for the given command name
+func (c *commandCounter) inc(name string) {
+	c.mu.RLock()
+	counter, ok := c.counts[name]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+		if c.counts == nil {
+			c.counts = make(map[string]*atomic.Uint64)
+		}
+		counter, ok = c.counts[name]
+		if !ok {
+			if len(c.counts) >= maxCommandNames {
+				name = otherCommand
+				counter = c.counts[name]
+			}
+			if counter == nil {
+				counter = &atomic.Uint64{}
+				c.counts[name] = counter
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	counter.Add(1)
+}
+
+// snapshot returns the current count for each command name
+func (c *commandCounter) snapshot() map[string]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.counts) == 0 {
+		return nil
+	}
+	result := make(map[string]uint64, len(c.counts))
+	for name, counter := range c.counts {
+		result[name] = counter.Load()
+	}
+	return result
+}
+
+// countingWriter wraps an io.Writer and adds every written byte to a counter
+type countingWriter struct {
+	w           io.Writer
+	counter     *atomic.Uint64
+	connCounter *atomic.Uint64 // Optional per-connection counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.counter.Add(uint64(n))
+	if c.connCounter != nil {
+		c.connCounter.Add(uint64(n))
+	}
+	return n, err
+}
+
+var (
+	activeConnectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_active_connections",
+		"Number of client connections currently being proxied.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	bytesProxiedDesc = prometheus.NewDesc(
+		"memstore_proxy_bytes_total",
+		"Total bytes proxied, by direction (upstream: client to server, downstream: server to client).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "direction"}, nil,
+	)
+	dialErrorsDesc = prometheus.NewDesc(
+		"memstore_proxy_dial_errors_total",
+		"Total failed attempts to connect to the upstream endpoint.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	connectionsTotalDesc = prometheus.NewDesc(
+		"memstore_proxy_connections_total",
+		"Total client connections accepted.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	commandsTotalDesc = prometheus.NewDesc(
+		"memstore_proxy_commands_total",
+		"Total client commands by name (requires -inspect-commands).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "command"}, nil,
+	)
+	sheddingDesc = prometheus.NewDesc(
+		"memstore_proxy_shedding",
+		"1 while new connections are being shed because the upstream is overloaded.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	shedConnectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_shed_connections_total",
+		"Total client connections rejected while shedding load.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	circuitOpenDesc = prometheus.NewDesc(
+		"memstore_proxy_circuit_open",
+		"1 while the circuit is open after repeated upstream dial/AUTH failures and new connections are rejected.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	circuitRejectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_circuit_rejected_connections_total",
+		"Total client connections rejected while the circuit was open.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	maintenanceDesc = prometheus.NewDesc(
+		"memstore_proxy_maintenance_connections_total",
+		"Total client connections answered locally while the upstream could not be reached.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	redirectsDesc = prometheus.NewDesc(
+		"memstore_proxy_redirects_total",
+		"Total cluster MOVED/ASK redirects seen, by type and result (rewritten or unknown_node).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "type", "result"}, nil,
+	)
+	authFailuresDesc = prometheus.NewDesc(
+		"memstore_proxy_auth_failures_total",
+		"Total failed AUTH exchanges with the upstream endpoint.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	authRejectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_auth_rejections_total",
+		"Total AUTH commands rejected by the upstream endpoint (e.g. WRONGPASS or an expired token).",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	poolIdleDesc = prometheus.NewDesc(
+		"memstore_proxy_pool_idle_connections",
+		"Pre-authenticated upstream connections waiting in the pool.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	poolRequestsDesc = prometheus.NewDesc(
+		"memstore_proxy_pool_requests_total",
+		"Total client connections that took an upstream connection from the pool (hit) or had to dial one (miss).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "result"}, nil,
+	)
+	limitRejectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_limit_rejected_connections_total",
+		"Total client connections refused because a connection limit was reached, by limit (proxy or global).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "limit"}, nil,
+	)
+	reconnectsDesc = prometheus.NewDesc(
+		"memstore_proxy_upstream_reconnects_total",
+		"Total upstream connections transparently re-established after dropping while their client was idle.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	tlsHandshakesDesc = prometheus.NewDesc(
+		"memstore_proxy_tls_handshakes_total",
+		"Total completed upstream TLS handshakes, by whether a cached session was resumed.",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "resumed"}, nil,
+	)
+	requestDurationDesc = prometheus.NewDesc(
+		"memstore_proxy_request_duration_seconds",
+		"Round-trip latency from forwarding a client request to receiving the upstream reply (requires -inspect-commands).",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	parseFallbacksDesc = prometheus.NewDesc(
+		"memstore_proxy_parse_fallbacks_total",
+		"Total client connections whose replies were relayed as raw bytes, without inspection, after an unparseable reply.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	splitRequestsDesc = prometheus.NewDesc(
+		"memstore_proxy_split_requests_total",
+		"Total client requests routed by -read-write-split, by target (primary or replica).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "target"}, nil,
+	)
+	readRetriesDesc = prometheus.NewDesc(
+		"memstore_proxy_read_retries_total",
+		"Total reads sent again to the primary after the replica lost its connection or replied LOADING (with -retry-reads).",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	replicationLagDesc = prometheus.NewDesc(
+		"memstore_proxy_replication_lag_bytes",
+		"Replication offset of the master minus the replica's, last measured by -replica-max-lag.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	replicaExcludedDesc = prometheus.NewDesc(
+		"memstore_proxy_replica_excluded",
+		"Whether reads are kept away from the replica because it lags behind (1) or not (0).",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	routedRedirectsDesc = prometheus.NewDesc(
+		"memstore_proxy_routed_redirects_total",
+		"Total MOVED/ASK redirects followed by the proxy for clients of a -cluster-routing listener, by type.",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "type"}, nil,
+	)
+	routedFanoutsDesc = prometheus.NewDesc(
+		"memstore_proxy_routed_fanouts_total",
+		"Total MGET/MSET/DEL/UNLINK requests of a -cluster-routing listener split by slot across cluster nodes.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	scriptLoadsDesc = prometheus.NewDesc(
+		"memstore_proxy_script_loads_total",
+		"Total scripts a client loaded with SCRIPT LOAD copied to the other cluster nodes, by result.",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "result"}, nil,
+	)
+	reauthsDesc = prometheus.NewDesc(
+		"memstore_proxy_upstream_reauths_total",
+		"Total re-authentications of long-lived upstream connections with a newer IAM token or a rotated password, by result.",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "result"}, nil,
+	)
+	slotMapRefreshesDesc = prometheus.NewDesc(
+		"memstore_proxy_slot_map_refreshes_total",
+		"Total cluster slot map loads of a -cluster-routing listener.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	deniedCommandsDesc = prometheus.NewDesc(
+		"memstore_proxy_denied_commands_total",
+		"Total client commands rejected by -deny-commands, by deny-list entry.",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "command"}, nil,
+	)
+	cacheRequestsDesc = prometheus.NewDesc(
+		"memstore_proxy_cache_requests_total",
+		"Total GET/MGET requests for keys matching -cache-keys, by result (hit or miss).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "result"}, nil,
+	)
+	cacheInvalidationsDesc = prometheus.NewDesc(
+		"memstore_proxy_cache_invalidations_total",
+		"Total keys reported modified by the server to the read cache.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	cacheEvictionsDesc = prometheus.NewDesc(
+		"memstore_proxy_cache_evictions_total",
+		"Total read cache entries evicted to stay within -cache-max-memory.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	cacheBytesDesc = prometheus.NewDesc(
+		"memstore_proxy_cache_bytes",
+		"Memory used by read cache entries, in bytes.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+	chaosInjectedDesc = prometheus.NewDesc(
+		"memstore_proxy_chaos_injected_total",
+		"Total faults injected by the -chaos-* testing options, by fault (latency, stall, disconnect or moved).",
+		[]string{"local_addr", "remote_addr", "endpoint_type", "fault"}, nil,
+	)
+	muxConnectionsDesc = prometheus.NewDesc(
+		"memstore_proxy_mux_upstream_connections",
+		"Open upstream connections shared by multiplexed clients.",
+		[]string{"local_addr", "remote_addr", "endpoint_type"}, nil,
+	)
+)
+
+// latencyBuckets span 100µs to ~1.6s, covering in-region Memorystore round trips up to slow commands
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 2, 15)
+
+// newLatencyHistogram creates the request round-trip latency histogram for
+// one proxy. It has no labels: the collector exports it with the proxy's
+// labels, so it follows the endpoint type of a cluster node through failovers.
+func newLatencyHistogram() prometheus.Histogram {
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "memstore_proxy_request_duration_seconds",
+		Buckets: latencyBuckets,
+	})
+}
+
+// proxyCollector exports the counters of a single proxy as Prometheus metrics.
+// The proxy is cleared when its cluster node departs and set again if the node
+// returns: collectors can't be unregistered, as that drops the descriptors
+// shared with the other proxies' collectors.
+type proxyCollector struct {
+	mu    sync.RWMutex
+	proxy *Proxy
+}
+
+// set makes the collector export the counters of p, or nothing if p is nil
+func (c *proxyCollector) set(p *Proxy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxy = p
+}
+
+// Describe implements prometheus.Collector
+func (c *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeConnectionsDesc
+	ch <- connectionsTotalDesc
+	ch <- bytesProxiedDesc
+	ch <- dialErrorsDesc
+	ch <- authFailuresDesc
+	ch <- authRejectionsDesc
+	ch <- commandsTotalDesc
+	ch <- sheddingDesc
+	ch <- shedConnectionsDesc
+	ch <- circuitOpenDesc
+	ch <- circuitRejectionsDesc
+	ch <- maintenanceDesc
+	ch <- redirectsDesc
+	ch <- limitRejectionsDesc
+	ch <- poolIdleDesc
+	ch <- poolRequestsDesc
+	ch <- muxConnectionsDesc
+	ch <- reconnectsDesc
+	ch <- tlsHandshakesDesc
+	ch <- splitRequestsDesc
+	ch <- readRetriesDesc
+	ch <- replicationLagDesc
+	ch <- replicaExcludedDesc
+	ch <- routedRedirectsDesc
+	ch <- slotMapRefreshesDesc
+	ch <- routedFanoutsDesc
+	ch <- scriptLoadsDesc
+	ch <- reauthsDesc
+	ch <- deniedCommandsDesc
+	ch <- cacheRequestsDesc
+	ch <- cacheInvalidationsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheBytesDesc
+	ch <- chaosInjectedDesc
+	ch <- parseFallbacksDesc
+	ch <- requestDurationDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	p := c.proxy
+	c.mu.RUnlock()
+	if p == nil {
+		return
+	}
+	labels := []string{p.localAddr, p.remoteAddr, p.endpointType()}
+
+	ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue,
+		float64(p.stats.activeConnections.Load()), labels...)
+	ch <- prometheus.MustNewConstMetric(connectionsTotalDesc, prometheus.CounterValue,
+		float64(p.stats.totalConnections.Load()), labels...)
+	ch <- prometheus.MustNewConstMetric(bytesProxiedDesc, prometheus.CounterValue,
+		float64(p.stats.bytesToUpstream.Load()), append(labels, "upstream")...)
+	ch <- prometheus.MustNewConstMetric(bytesProxiedDesc, prometheus.CounterValue,
+		float64(p.stats.bytesToClient.Load()), append(labels, "downstream")...)
+	ch <- prometheus.MustNewConstMetric(dialErrorsDesc, prometheus.CounterValue,
+		float64(p.stats.dialErrors.Load()), labels...)
+	ch <- prometheus.MustNewConstMetric(authFailuresDesc, prometheus.CounterValue,
+		float64(p.stats.authFailures.Load()), labels...)
+	ch <- prometheus.MustNewConstMetric(authRejectionsDesc, prometheus.CounterValue,
+		float64(p.stats.authRejections.Load()), labels...)
+	if p.connLimit != nil || p.globalLimit != nil {
+		ch <- prometheus.MustNewConstMetric(limitRejectionsDesc, prometheus.CounterValue,
+			float64(p.stats.proxyLimitRejections.Load()), append(labels, "proxy")...)
+		ch <- prometheus.MustNewConstMetric(limitRejectionsDesc, prometheus.CounterValue,
+			float64(p.stats.globalLimitRejections.Load()), append(labels, "global")...)
+	}
+	for name, count := range p.stats.commands.snapshot() {
+		ch <- prometheus.MustNewConstMetric(commandsTotalDesc, prometheus.CounterValue,
+			float64(count), append(labels, name)...)
+	}
+	if p.shedder != nil {
+		shedding := 0.0
+		if p.shedder.isShedding(time.Now()) {
+			shedding = 1
+		}
+		ch <- prometheus.MustNewConstMetric(sheddingDesc, prometheus.GaugeValue, shedding, labels...)
+		ch <- prometheus.MustNewConstMetric(shedConnectionsDesc, prometheus.CounterValue,
+			float64(p.shedder.shedConnections.Load()), labels...)
+	}
+	if p.breaker != nil {
+		open := 0.0
+		if !p.breaker.openedUntil().IsZero() {
+			open = 1
+		}
+		ch <- prometheus.MustNewConstMetric(circuitOpenDesc, prometheus.GaugeValue, open, labels...)
+		ch <- prometheus.MustNewConstMetric(circuitRejectionsDesc, prometheus.CounterValue,
+			float64(p.breaker.rejected.Load()), labels...)
+	}
+	if p.maintenance != nil {
+		ch <- prometheus.MustNewConstMetric(maintenanceDesc, prometheus.CounterValue,
+			float64(p.maintenance.served.Load()), labels...)
+	}
+	if p.isClusterMode {
+		r := &p.stats.redirects
+		for _, m := range []struct {
+			kind, result string
+			value        uint64
+		}{
+			{"MOVED", "rewritten", r.movedRewritten.Load()},
+			{"MOVED", "unknown_node", r.movedUnknown.Load()},
+			{"ASK", "rewritten", r.askRewritten.Load()},
+			{"ASK", "unknown_node", r.askUnknown.Load()},
+		} {
+			ch <- prometheus.MustNewConstMetric(redirectsDesc, prometheus.CounterValue,
+				float64(m.value), append(labels, m.kind, m.result)...)
+		}
+	}
+	if p.isClusterMode || p.router.Load() != nil {
+		ch <- prometheus.MustNewConstMetric(scriptLoadsDesc, prometheus.CounterValue,
+			float64(p.stats.scriptLoads.Load()), append(labels, "success")...)
+		ch <- prometheus.MustNewConstMetric(scriptLoadsDesc, prometheus.CounterValue,
+			float64(p.stats.scriptLoadErrors.Load()), append(labels, "error")...)
+	}
+	if p.authPassword.get() != "" || p.tokenSource != nil {
+		ch <- prometheus.MustNewConstMetric(reauthsDesc, prometheus.CounterValue,
+			float64(p.stats.reauths.Load()), append(labels, "success")...)
+		ch <- prometheus.MustNewConstMetric(reauthsDesc, prometheus.CounterValue,
+			float64(p.stats.reauthErrors.Load()), append(labels, "error")...)
+	}
+	if p.pool != nil {
+		ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue,
+			float64(p.pool.idleCount()), labels...)
+		ch <- prometheus.MustNewConstMetric(poolRequestsDesc, prometheus.CounterValue,
+			float64(p.pool.hits.Load()), append(labels, "hit")...)
+		ch <- prometheus.MustNewConstMetric(poolRequestsDesc, prometheus.CounterValue,
+			float64(p.pool.misses.Load()), append(labels, "miss")...)
+	}
+	if p.mux != nil {
+		ch <- prometheus.MustNewConstMetric(muxConnectionsDesc, prometheus.GaugeValue,
+			float64(p.mux.open()), labels...)
+	}
+	if p.config != nil && p.config.TransparentReconnect {
+		ch <- prometheus.MustNewConstMetric(reconnectsDesc, prometheus.CounterValue,
+			float64(p.stats.reconnects.Load()), labels...)
+	}
+	if p.tlsConfig != nil {
+		resumed := p.stats.tlsResumed.Load()
+		ch <- prometheus.MustNewConstMetric(tlsHandshakesDesc, prometheus.CounterValue,
+			float64(p.stats.tlsHandshakes.Load()-resumed), append(labels, "false")...)
+		ch <- prometheus.MustNewConstMetric(tlsHandshakesDesc, prometheus.CounterValue,
+			float64(resumed), append(labels, "true")...)
+	}
+	if p.config != nil && p.inspectResponses() {
+		ch <- prometheus.MustNewConstMetric(parseFallbacksDesc, prometheus.CounterValue,
+			float64(p.stats.parseFallbacks.Load()), labels...)
+	}
+	if r := p.readReplicas; r != nil {
+		ch <- prometheus.MustNewConstMetric(splitRequestsDesc, prometheus.CounterValue,
+			float64(r.primaryRequests.Load()), append(labels, "primary")...)
+		ch <- prometheus.MustNewConstMetric(splitRequestsDesc, prometheus.CounterValue,
+			float64(r.replicaRequests.Load()), append(labels, "replica")...)
+		if p.config != nil && p.config.RetryReads {
+			ch <- prometheus.MustNewConstMetric(readRetriesDesc, prometheus.CounterValue,
+				float64(r.retries.Load()), labels...)
+		}
+	}
+	if lag := p.replicationLag(); lag != nil {
+		excluded := 0.0
+		if lag.Excluded {
+			excluded = 1
+		}
+		ch <- prometheus.MustNewConstMetric(replicationLagDesc, prometheus.GaugeValue,
+			float64(lag.Bytes), labels...)
+		ch <- prometheus.MustNewConstMetric(replicaExcludedDesc, prometheus.GaugeValue,
+			excluded, labels...)
+	}
+	if r := p.router.Load(); r != nil {
+		ch <- prometheus.MustNewConstMetric(routedRedirectsDesc, prometheus.CounterValue,
+			float64(r.moved.Load()), append(labels, "MOVED")...)
+		ch <- prometheus.MustNewConstMetric(routedRedirectsDesc, prometheus.CounterValue,
+			float64(r.asked.Load()), append(labels, "ASK")...)
+		ch <- prometheus.MustNewConstMetric(slotMapRefreshesDesc, prometheus.CounterValue,
+			float64(r.refreshes.Load()), labels...)
+		ch <- prometheus.MustNewConstMetric(routedFanoutsDesc, prometheus.CounterValue,
+			float64(r.fanouts.Load()), labels...)
+	}
+	if p.denied != nil {
+		for command, count := range p.denied.rejected.snapshot() {
+			ch <- prometheus.MustNewConstMetric(deniedCommandsDesc, prometheus.CounterValue,
+				float64(count), append(labels, command)...)
+		}
+	}
+	if c := p.cache; c != nil {
+		ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue,
+			float64(c.hits.Load()), append(labels, "hit")...)
+		ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue,
+			float64(c.misses.Load()), append(labels, "miss")...)
+		ch <- prometheus.MustNewConstMetric(cacheInvalidationsDesc, prometheus.CounterValue,
+			float64(c.invalidations.Load()), labels...)
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue,
+			float64(c.evictions.Load()), labels...)
+		ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(c.size()), labels...)
+	}
+	if c := p.chaos; c != nil {
+		for fault, count := range map[string]uint64{
+			"latency":    c.delayed.Load(),
+			"stall":      c.stalls.Load(),
+			"disconnect": c.disconnects.Load(),
+			"moved":      c.moved.Load(),
+		} {
+			ch <- prometheus.MustNewConstMetric(chaosInjectedDesc, prometheus.CounterValue,
+				float64(count), append(labels, fault)...)
+		}
+	}
+	if p.latency != nil && p.config != nil && p.config.InspectCommands {
+		var metric dto.Metric
+		if err := p.latency.Write(&metric); err == nil {
+			h := metric.GetHistogram()
+			buckets := make(map[float64]uint64, len(h.GetBucket()))
+			for _, b := range h.GetBucket() {
+				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+			ch <- prometheus.MustNewConstHistogram(requestDurationDesc, h.GetSampleCount(), h.GetSampleSum(), buckets, labels...)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var counter atomic.Uint64
+	w := &countingWriter{w: &buf, counter: &counter}
+
+	w.Write([]byte("hello"))
+	w.Write([]byte(" world"))
+
+	if counter.Load() != 11 {
+		t.Errorf("Expected 11 bytes counted, got %d", counter.Load())
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("Expected data to be passed through, got %q", buf.String())
+	}
+}
+
+func TestProxyCollector(t *testing.T) {
+	p := &Proxy{
+		localAddr:  "127.0.0.1:6379",
+		remoteAddr: "10.0.0.1:6379",
+		endpoint:   discovery.Endpoint{Host: "10.0.0.1", Port: 6379, Type: "primary"},
+	}
+	p.stats.activeConnections.Add(2)
+	p.stats.bytesToUpstream.Add(100)
+	p.stats.bytesToClient.Add(200)
+	p.stats.dialErrors.Add(1)
+
+	collector := &proxyCollector{proxy: p}
+
+	// active + total connections + 2 byte directions + dial errors + auth failures + auth rejections
+	if count := testutil.CollectAndCount(collector); count != 7 {
+		t.Errorf("Expected 7 metrics, got %d", count)
+	}
+
+	expected := `
+# HELP memstore_proxy_bytes_total Total bytes proxied, by direction (upstream: client to server, downstream: server to client).
+# TYPE memstore_proxy_bytes_total counter
+memstore_proxy_bytes_total{direction="downstream",endpoint_type="primary",local_addr="127.0.0.1:6379",remote_addr="10.0.0.1:6379"} 200
+memstore_proxy_bytes_total{direction="upstream",endpoint_type="primary",local_addr="127.0.0.1:6379",remote_addr="10.0.0.1:6379"} 100
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "memstore_proxy_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyCollectorFollowsRole(t *testing.T) {
+	p := &Proxy{
+		config:     &config.Config{InspectCommands: true},
+		localAddr:  "127.0.0.1:6380",
+		remoteAddr: "10.0.0.3:6379",
+		endpoint:   discovery.Endpoint{Host: "10.0.0.3", Port: 6379, Type: clusterReplicaType},
+		latency:    newLatencyHistogram(),
+	}
+	p.latency.Observe(0.001)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(&proxyCollector{proxy: p})
+
+	// The replica was promoted
+	p.setEndpointType("cluster-master")
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "endpoint_type" && label.GetValue() != "cluster-master" {
+					t.Errorf("Expected %s to be labeled with the current role, got %s", family.GetName(), label.GetValue())
+				}
+			}
+			if family.GetName() == "memstore_proxy_request_duration_seconds" && metric.GetHistogram().GetSampleCount() != 1 {
+				t.Errorf("Expected 1 latency sample, got %d", metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+}
+
+func TestCommandCounter(t *testing.T) {
+	var c commandCounter
+
+	if c.snapshot() != nil {
+		t.Error("Expected nil snapshot for empty counter")
+	}
+
+	c.inc("GET")
+	c.inc("GET")
+	c.inc("SET")
+
+	counts := c.snapshot()
+	if counts["GET"] != 2 || counts["SET"] != 1 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+}
+
+func TestCommandCounterCardinalityCap(t *testing.T) {
+	var c commandCounter
+
+	for i := 0; i < maxCommandNames+10; i++ {
+		c.inc(fmt.Sprintf("CMD%d", i))
+	}
+
+	counts := c.snapshot()
+	if len(counts) > maxCommandNames+1 {
+		t.Errorf("Expected at most %d command names, got %d", maxCommandNames+1, len(counts))
+	}
+	if counts[otherCommand] == 0 {
+		t.Error("Expected overflow commands to be counted as OTHER")
+	}
+}
+
+func TestSendAuthCommandRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, 256)
+		server.Read(buf)
+		server.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+		server.Close()
+	}()
+
+	err := sendAuthCommand(client, buildAuthCommand("", "secret"))
+	if !errors.Is(err, errAuthRejected) {
+		t.Errorf("Expected errAuthRejected, got %v", err)
+	}
+}
@@ -0,0 +1,767 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// muxPipelineDepth bounds how many requests of one client can await replies
+// before the proxy stops reading further requests from it
+const muxPipelineDepth = 128
+
+// muxUnsupported lists commands that change or depend on per-connection state
+// (selected DB, watched keys, subscriptions, blocking, client identity), which
+// would leak between clients sharing an upstream connection. MULTI blocks are
+// queued by the proxy instead, see muxTransaction.
+var muxUnsupported = map[string]bool{
+	"SELECT": true, "WATCH": true, "UNWATCH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"MONITOR": true, "SYNC": true, "PSYNC": true, "REPLCONF": true,
+	"BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true, "BLMOVE": true, "BLMPOP": true,
+	"BZPOPMIN": true, "BZPOPMAX": true, "BZMPOP": true, "WAIT": true, "WAITAOF": true,
+	"CLIENT": true, "HELLO": true, "AUTH": true, "RESET": true, "READONLY": true, "READWRITE": true,
+}
+
+// errMuxClosed is returned for requests on a shared connection after it failed
+var errMuxClosed = errors.New("shared upstream connection closed")
+
+// muxUnsupportedCommand reports whether a request can't be sent over a shared connection
+func muxUnsupportedCommand(value *RESPValue, name string) bool {
+	if muxUnsupported[name] {
+		return true
+	}
+	// XREAD and XREADGROUP only block with the BLOCK option
+	if name == "XREAD" || name == "XREADGROUP" {
+		for _, arg := range value.Array[1:] {
+			if strings.EqualFold(arg.Str, "BLOCK") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// muxReply is the server reply to one request sent over a shared connection
+type muxReply struct {
+	value *RESPValue
+	err   error
+}
+
+// failure returns the connection error or error reply of r, or nil if it succeeded
+func (r muxReply) failure() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.value.Type == Error {
+		return errors.New(r.value.Str)
+	}
+	return nil
+}
+
+// transientFailure reports whether a read failed in a way another endpoint may
+// not: the connection was lost, or the server is still loading its dataset
+// after a restart or failover
+func transientFailure(r muxReply) bool {
+	return r.err != nil || (r.value.Type == Error && strings.HasPrefix(r.value.Str, "LOADING"))
+}
+
+// muxConn is an upstream connection shared by many clients. RESP replies
+// arrive in request order, so each reply is handed to the oldest waiting request.
+type muxConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex // Serializes writes so the waiting queue matches the order on the wire
+
+	mu      sync.Mutex // Guards waiting and err; never held while writing so replies keep flowing
+	waiting []chan muxReply
+	err     error
+	done    chan struct{} // Closed once the connection failed
+
+	// Signalled when a reply shows the connection is no longer authenticated,
+	// see keepAuthenticated
+	unauthenticated chan struct{}
+
+	clients  atomic.Int64
+	lastSend atomic.Int64 // UnixNano of the last write
+	retired  atomic.Bool  // Replaced in its group; closed once its last client leaves
+}
+
+// newMuxConn starts dispatching replies read from conn, and PINGs it while it
+// is idle if ping is positive
+func newMuxConn(conn net.Conn, ping time.Duration) *muxConn {
+	m := &muxConn{conn: conn, done: make(chan struct{}), unauthenticated: make(chan struct{}, 1)}
+	m.lastSend.Store(time.Now().UnixNano())
+	go m.readReplies()
+	if ping > 0 {
+		go m.keepAlive(ping)
+	}
+	return m
+}
+
+// keepAlive sends a PING whenever nothing was sent for interval and no reply is
+// outstanding, so middleboxes and the server's idle timeout don't drop the
+// connection. Stops once the connection fails.
+func (m *muxConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if m.failed() {
+			return
+		}
+		m.mu.Lock()
+		busy := len(m.waiting) > 0
+		m.mu.Unlock()
+		if busy || time.Since(time.Unix(0, m.lastSend.Load())) < interval {
+			continue
+		}
+		// The reply goes to the buffered channel and is dropped with it
+		m.send(pingCommand, 1)
+	}
+}
+
+// send writes one or more serialized requests as a unit, so no other client's
+// request is interleaved, and returns a channel per request for its reply
+func (m *muxConn) send(data []byte, requests int) ([]chan muxReply, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	replies := make([]chan muxReply, requests)
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	for i := range replies {
+		replies[i] = make(chan muxReply, 1)
+	}
+	m.waiting = append(m.waiting, replies...)
+	m.mu.Unlock()
+
+	m.lastSend.Store(time.Now().UnixNano())
+	if _, err := m.conn.Write(data); err != nil {
+		m.fail(fmt.Errorf("%w: %v", errMuxClosed, err))
+		return nil, err
+	}
+	return replies, nil
+}
+
+// readReplies dispatches replies until the connection fails
+func (m *muxConn) readReplies() {
+	reader := NewRESPReader(m.conn)
+	for {
+		value, err := reader.ReadValue()
+		if err != nil {
+			m.fail(fmt.Errorf("%w: %v", errMuxClosed, err))
+			return
+		}
+
+		m.mu.Lock()
+		if len(m.waiting) == 0 {
+			// Unsolicited frame (e.g. a push message); nobody is waiting for it
+			m.mu.Unlock()
+			continue
+		}
+		if value.Type == Error && authExpired(value.Str) {
+			select {
+			case m.unauthenticated <- struct{}{}:
+			default:
+			}
+		}
+		reply := m.waiting[0]
+		m.waiting = m.waiting[1:]
+		if len(m.waiting) == 0 {
+			m.waiting = nil
+		}
+		m.mu.Unlock()
+
+		reply <- muxReply{value: value}
+	}
+}
+
+// fail closes the connection and fails every waiting request
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+		close(m.done)
+	}
+	waiting := m.waiting
+	m.waiting = nil
+	m.mu.Unlock()
+
+	m.conn.Close()
+	for _, reply := range waiting {
+		reply <- muxReply{err: err}
+	}
+}
+
+// failed reports whether the connection can no longer be used
+func (m *muxConn) failed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+// muxGroup holds the shared upstream connections of one proxy. Each client is
+// pinned to one of them for its lifetime so its requests are executed in order.
+type muxGroup struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	share   func(conn net.Conn, ping time.Duration) *muxConn // Wraps dialed connections, newMuxConn by default
+	ping    time.Duration                                    // PING idle shared connections this often (0 disables)
+	mu      sync.Mutex
+	conns   []*muxConn
+	dialing []*muxDial    // Dials in flight per slot, made without holding mu
+	dialed  chan struct{} // Closed and replaced whenever a dial finishes
+	closed  bool
+	retires uint64 // Times the connections were retired; a dial that started before is repeated
+}
+
+// muxDial is a shared connection being dialed
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+// newMuxGroup creates a group of up to size shared connections, dialed on demand
+func newMuxGroup(size int, dial func(ctx context.Context) (net.Conn, error)) *muxGroup {
+	return &muxGroup{
+		dial:    dial,
+		share:   newMuxConn,
+		conns:   make([]*muxConn, size),
+		dialing: make([]*muxDial, size),
+		dialed:  make(chan struct{}),
+	}
+}
+
+// dialLocked starts (re)dialing slot i unless that is already in flight. The
+// dial isn't bound to a client, so a client going away doesn't cancel it for
+// the others. g.mu must be held.
+func (g *muxGroup) dialLocked(i int) *muxDial {
+	if d := g.dialing[i]; d != nil {
+		return d
+	}
+	d := &muxDial{done: make(chan struct{})}
+	g.dialing[i] = d
+	retires := g.retires
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+			conn, err := g.dial(ctx)
+			cancel()
+
+			g.mu.Lock()
+			if err == nil && !g.closed && retires != g.retires {
+				// Set up for what the group was retired for
+				retires = g.retires
+				g.mu.Unlock()
+				conn.Close()
+				continue
+			}
+			g.dialing[i] = nil
+			switch {
+			case err != nil:
+			case g.closed:
+				conn.Close()
+				err = errMuxClosed
+			default:
+				g.conns[i] = g.share(conn, g.ping)
+			}
+			d.err = err
+			close(d.done)
+			close(g.dialed)
+			g.dialed = make(chan struct{})
+			g.mu.Unlock()
+			return
+		}
+	}()
+	return d
+}
+
+// acquire returns the usable shared connection with the fewest clients, and
+// (re)dials missing or failed ones in the background. Only while none is
+// usable it waits for those dials, and fails once all of them failed.
+func (g *muxGroup) acquire(ctx context.Context) (*muxConn, error) {
+	g.mu.Lock()
+	var dials []*muxDial
+	if !g.closed {
+		for i, mc := range g.conns {
+			if mc == nil || mc.failed() {
+				dials = append(dials, g.dialLocked(i))
+			}
+		}
+	}
+	for {
+		if g.closed {
+			g.mu.Unlock()
+			return nil, errMuxClosed
+		}
+		var least *muxConn
+		for _, mc := range g.conns {
+			if mc != nil && !mc.failed() && (least == nil || mc.clients.Load() < least.clients.Load()) {
+				least = mc
+			}
+		}
+		if least != nil {
+			least.clients.Add(1)
+			g.mu.Unlock()
+			return least, nil
+		}
+		if err := failedAll(dials); err != nil {
+			g.mu.Unlock()
+			return nil, err
+		}
+		dialed := g.dialed
+		g.mu.Unlock()
+
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		g.mu.Lock()
+	}
+}
+
+// failedAll returns the first error of dials once all of them failed
+func failedAll(dials []*muxDial) error {
+	var first error
+	for _, d := range dials {
+		select {
+		case <-d.done:
+		default:
+			return nil
+		}
+		if d.err == nil {
+			return nil
+		}
+		if first == nil {
+			first = d.err
+		}
+	}
+	return first
+}
+
+// warm dials the first n shared connections that aren't open yet
+func (g *muxGroup) warm(ctx context.Context, n int) error {
+	g.mu.Lock()
+	var dials []*muxDial
+	for i := range min(n, len(g.conns)) {
+		if mc := g.conns[i]; mc == nil || mc.failed() {
+			dials = append(dials, g.dialLocked(i))
+		}
+	}
+	g.mu.Unlock()
+
+	var errs []error
+	for _, d := range dials {
+		select {
+		case <-d.done:
+			errs = append(errs, d.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// release unpins a client from its shared connection
+func (g *muxGroup) release(mc *muxConn) {
+	if mc.clients.Add(-1) == 0 && mc.retired.Load() {
+		mc.fail(errMuxClosed)
+	}
+}
+
+// retire replaces the shared connections, e.g. once the READONLY they were
+// sent no longer applies: new clients get newly dialed ones, and a retired
+// connection is closed once its last client leaves
+func (g *muxGroup) retire() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.retires++
+	var retired []*muxConn
+	for i, mc := range g.conns {
+		if mc != nil {
+			retired = append(retired, mc)
+			g.conns[i] = nil
+		}
+	}
+	g.mu.Unlock()
+
+	for _, mc := range retired {
+		mc.retired.Store(true)
+		if mc.clients.Load() == 0 {
+			mc.fail(errMuxClosed)
+		}
+	}
+}
+
+// open returns the number of usable shared connections
+func (g *muxGroup) open() int {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, mc := range g.conns {
+		if mc != nil && !mc.failed() {
+			n++
+		}
+	}
+	return n
+}
+
+// shared returns the usable shared connections
+func (g *muxGroup) shared() []*muxConn {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var conns []*muxConn
+	for _, mc := range g.conns {
+		if mc != nil && !mc.failed() {
+			conns = append(conns, mc)
+		}
+	}
+	return conns
+}
+
+// close closes all shared connections
+func (g *muxGroup) close() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	for _, mc := range g.conns {
+		if mc != nil {
+			mc.fail(errMuxClosed)
+		}
+	}
+}
+
+// muxTransaction is a MULTI block queued by the proxy. On EXEC it is sent
+// wrapped in MULTI and EXEC as one write, so requests of other clients can't
+// be interleaved with it on the shared connection.
+type muxTransaction struct {
+	data     []byte // Queued commands, serialized
+	commands int
+	aborted  bool // A command was rejected while queueing, so EXEC fails
+}
+
+// muxExecAbort answers EXEC after a command of the transaction was rejected
+const muxExecAbort = "EXECABORT Transaction discarded because of previous errors."
+
+// muxPending is a client request awaiting its reply, in client order
+type muxPending struct {
+	reply  chan muxReply
+	sent   time.Time
+	retry  func() (chan muxReply, error) // Sends the request again if its reply is a transient failure; nil if it can't be retried
+	follow func(muxReply) muxReply       // Follows MOVED/ASK redirects of the reply to other nodes; nil unless requests are routed
+}
+
+// localReply returns an already answered pending request, for replies the
+// proxy generates itself
+func localReply(value RESPValue) muxPending {
+	reply := make(chan muxReply, 1)
+	reply <- muxReply{value: &value}
+	return muxPending{reply: reply}
+}
+
+// handleMultiplexedConnection pins a client to a shared upstream connection
+// and relays its traffic; span is the connection setup span
+func (p *Proxy) handleMultiplexedConnection(ctx context.Context, span trace.Span, clientConn net.Conn, sess *session) {
+	mc, err := p.mux.acquire(ctx)
+	if err != nil {
+		sess.log.Error(fmt.Sprintf("Upstream connection failed: %v", err))
+		tracing.End(span, err)
+		if p.maintenance != nil {
+			p.serveMaintenance(clientConn, sess)
+		} else {
+			p.rejectReconfiguring(clientConn, sess)
+		}
+		return
+	}
+	defer p.mux.release(mc)
+	p.upstreamSucceeded()
+	tracing.End(span, nil)
+
+	if tlsConn, ok := mc.conn.(*tls.Conn); ok {
+		sess.tlsVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+	}
+	p.sessions.add(sess)
+	defer p.sessions.remove(sess.id)
+
+	p.relayMultiplexed(clientConn, mc, sess)
+}
+
+// relayMultiplexed serves a client over a shared upstream connection. Requests
+// are forwarded as they arrive (clients may pipeline) and replies are written
+// back in request order.
+func (p *Proxy) relayMultiplexed(clientConn net.Conn, mc *muxConn, sess *session) {
+	pending := make(chan muxPending, muxPipelineDepth)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.writeMuxReplies(clientConn, pending, sess)
+	}()
+
+	if err := p.forwardMuxRequests(clientConn, mc, pending, sess); err != nil && err != io.EOF {
+		sess.log.Debug(fmt.Sprintf("Client->Server multiplexed relay error: %v", err))
+	}
+	close(pending)
+	<-done
+}
+
+// forwardMuxRequests reads client requests and sends them over the shared
+// connection, queueing one pending entry per request
+func (p *Proxy) forwardMuxRequests(clientConn net.Conn, mc *muxConn, pending chan<- muxPending, sess *session) error {
+	respReader := p.respReader(clientConn)
+	defer p.buffers().releaseReader(respReader)
+	respReader.SetInline(true)
+	var asking *RESPValue // ASKING only applies to the next command, so the two are sent together
+	var tx *muxTransaction
+
+	for {
+		value, err := respReader.ReadValue()
+		if err != nil {
+			return err
+		}
+
+		name := value.CommandName()
+		if name != "" {
+			p.stats.commands.inc(name)
+			sess.auditCommand(value, name)
+		}
+		sess.dump.dump(dumpRequest, value)
+		sess.captureFrame(capture.DirectionRequest, value)
+
+		if name == "QUIT" {
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			return nil
+		}
+		if reply := p.denied.check(value, name); reply != nil {
+			// Like a command the server rejects while queueing, a denied one aborts the transaction
+			if tx != nil {
+				tx.aborted = true
+			}
+			if asking != nil {
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+				asking = nil
+			}
+			pending <- localReply(*reply)
+			continue
+		}
+		if tx != nil {
+			if name != "EXEC" {
+				tx = p.queueMuxTransaction(tx, value, name, pending)
+				continue
+			}
+			if tx.aborted {
+				pending <- localReply(RESPValue{Type: Error, Str: muxExecAbort})
+				tx = nil
+				continue
+			}
+			// Only the EXEC reply goes to the client; MULTI and the commands were answered when queued
+			data := append(append(append([]byte(nil), multiCommand...), tx.data...), value.Serialize()...)
+			err := p.sendMux(mc, data, tx.commands+2, 1, nil, pending, sess)
+			tx = nil
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case name == "MULTI":
+			if asking != nil {
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+				asking = nil
+			}
+			tx = &muxTransaction{}
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			continue
+		case name == "EXEC" || name == "DISCARD":
+			pending <- localReply(RESPValue{Type: Error, Str: fmt.Sprintf("ERR %s without MULTI", name)})
+			continue
+		case name == "ASKING" && asking == nil:
+			asking = value
+			continue
+		case name == "AUTH" && p.interceptsClientAuth():
+			// The shared connection is authenticated with the proxy's credentials already
+			if asking != nil {
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+				asking = nil
+			}
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			continue
+		case name == "" || muxUnsupportedCommand(value, name):
+			msg := fmt.Sprintf("ERR %s is not supported when connections are multiplexed", name)
+			if name == "" {
+				msg = "ERR invalid request"
+			}
+			if asking != nil {
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+				asking = nil
+			}
+			pending <- localReply(RESPValue{Type: Error, Str: msg})
+			continue
+		}
+
+		requests := []*RESPValue{value}
+		if asking != nil {
+			requests = []*RESPValue{asking, value}
+			asking = nil
+		}
+		var data []byte
+		for _, r := range requests {
+			data = append(data, r.Serialize()...)
+		}
+		if p.isClusterMode {
+			p.scripts.wait(value, name)
+		}
+		var follow func(muxReply) muxReply
+		if watch := p.clusterReplyWatcher(value, name); watch != nil {
+			follow = watchReply(watch)
+		}
+		if err := p.sendMux(mc, data, len(requests), len(requests), follow, pending, sess); err != nil {
+			return err
+		}
+	}
+}
+
+// multiCommand opens a transaction sent over a shared connection
+var multiCommand = []byte("*1\r\n$5\r\nMULTI\r\n")
+
+// queueMuxTransaction handles a request inside a MULTI block other than EXEC
+// and QUIT, answering it locally. It returns the transaction, or nil once it
+// was discarded.
+func (p *Proxy) queueMuxTransaction(tx *muxTransaction, value *RESPValue, name string, pending chan<- muxPending) *muxTransaction {
+	switch {
+	case name == "DISCARD":
+		pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+		return nil
+	case name == "MULTI":
+		// Like the server, a nested MULTI is rejected without aborting the transaction
+		pending <- localReply(RESPValue{Type: Error, Str: "ERR MULTI calls can not be nested"})
+	case name == "" || muxUnsupportedCommand(value, name) || p.clusterReplyWatcher(value, name) != nil:
+		// Replies inside EXEC aren't rewritten, so node addresses would leak
+		msg := fmt.Sprintf("ERR %s is not supported when connections are multiplexed", name)
+		if name == "" {
+			msg = "ERR invalid request"
+		}
+		tx.aborted = true
+		pending <- localReply(RESPValue{Type: Error, Str: msg})
+	default:
+		tx.data = append(tx.data, value.Serialize()...)
+		tx.commands++
+		pending <- localReply(RESPValue{Type: SimpleString, Str: "QUEUED"})
+	}
+	return tx
+}
+
+// sendMux sends requests serialized in data as one write and queues the
+// replies of the last keep of them for the client; the replies of the others
+// are dropped as the client was already answered. follow, if set, handles
+// the reply to the last request.
+func (p *Proxy) sendMux(mc *muxConn, data []byte, requests, keep int, follow func(muxReply) muxReply, pending chan<- muxPending, sess *session) error {
+	sent := time.Now()
+	replies, err := p.muxSend(mc, data, requests, sess)
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies[requests-keep:] {
+		entry := muxPending{reply: reply, sent: sent}
+		if i == keep-1 {
+			entry.follow = follow
+		}
+		pending <- entry
+	}
+	return nil
+}
+
+// watchReply adapts a reply watcher of a dedicated connection to a shared one
+func watchReply(watch func(*RESPValue)) func(muxReply) muxReply {
+	return func(reply muxReply) muxReply {
+		if reply.err == nil {
+			watch(reply.value)
+		}
+		return reply
+	}
+}
+
+// muxSend sends requests serialized in data as one write, counting the bytes
+func (p *Proxy) muxSend(mc *muxConn, data []byte, requests int, sess *session) ([]chan muxReply, error) {
+	replies, err := mc.send(data, requests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to server: %w", err)
+	}
+	p.stats.bytesToUpstream.Add(uint64(len(data)))
+	sess.bytesToUpstream.Add(uint64(len(data)))
+	return replies, nil
+}
+
+// writeMuxReplies writes replies to the client in request order. After a
+// failure it keeps draining so the request reader never blocks.
+func (p *Proxy) writeMuxReplies(clientConn net.Conn, pending <-chan muxPending, sess *session) {
+	failed := false
+	for req := range pending {
+		reply := <-req.reply
+		if failed {
+			continue
+		}
+		if req.follow != nil {
+			reply = req.follow(reply)
+		}
+		if req.retry != nil && transientFailure(reply) {
+			if retried, err := req.retry(); err == nil {
+				sess.log.Debug(fmt.Sprintf("Retrying read after a transient upstream failure: %v", reply.failure()))
+				reply = <-retried
+			}
+		}
+
+		value := reply.value
+		if reply.err != nil {
+			// The shared connection is gone; tell the client and disconnect it so it reconnects
+			sess.log.Error(fmt.Sprintf("Shared upstream connection failed: %v", reply.err))
+			value = &RESPValue{Type: Error, Str: "ERR upstream connection lost"}
+			failed = true
+		} else {
+			if !req.sent.IsZero() && p.config.InspectCommands {
+				p.latency.Observe(time.Since(req.sent).Seconds())
+			}
+			p.inspectReply(value, sess)
+		}
+		sess.dump.dump(dumpResponse, value)
+		sess.captureFrame(capture.DirectionResponse, value)
+
+		data := value.Serialize()
+		n, err := clientConn.Write(data)
+		p.stats.bytesToClient.Add(uint64(n))
+		sess.bytesToClient.Add(uint64(n))
+		if err != nil {
+			sess.log.Debug(fmt.Sprintf("Server->Client multiplexed relay error: %v", err))
+			failed = true
+		}
+		if failed {
+			// Unblocks the request reader
+			clientConn.Close()
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+// echoUpstream replies to every request with its arguments joined by spaces.
+// Requests between MULTI and EXEC are answered with QUEUED and their echoes
+// are returned as the EXEC reply; DISCARD drops them.
+func echoUpstream(t *testing.T) (addr string, dials *atomic.Int64) {
+	t.Helper()
+	dials = &atomic.Int64{}
+	ln := fakeServer(t, func(net.Conn, int) func([]string) string {
+		dials.Add(1)
+		var queued []RESPValue
+		inMulti := false
+		return func(args []string) string {
+			reply := RESPValue{Type: BulkString, Str: strings.Join(args, " ")}
+			switch command := strings.ToUpper(args[0]); {
+			case command == "MULTI":
+				inMulti, reply = true, RESPValue{Type: SimpleString, Str: "OK"}
+			case command == "EXEC":
+				inMulti, reply, queued = false, RESPValue{Type: Array, Array: queued}, nil
+			case command == "DISCARD":
+				inMulti, reply, queued = false, RESPValue{Type: SimpleString, Str: "OK"}, nil
+			case inMulti:
+				queued = append(queued, reply)
+				reply = RESPValue{Type: SimpleString, Str: "QUEUED"}
+			}
+			return string(reply.Serialize())
+		}
+	})
+	return ln.Addr().String(), dials
+}
+
+// newMuxProxy returns a proxy multiplexing clients over size connections to addr
+func newMuxProxy(addr string, size int) *Proxy {
+	p := &Proxy{config: &config.Config{}, remoteAddr: addr}
+	p.mux = newMuxGroup(size, func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+	return p
+}
+
+// muxClient connects a client to p through a pipe and returns the client end
+func muxClient(t *testing.T, p *Proxy, id uint64) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	clientSide, proxyClient := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer proxyClient.Close()
+		mc, err := p.mux.acquire(context.Background())
+		if err != nil {
+			t.Errorf("acquire failed: %v", err)
+			return
+		}
+		defer p.mux.release(mc)
+		p.relayMultiplexed(proxyClient, mc, newSession(id, false))
+	}()
+	return clientSide, done
+}
+
+// bulk returns s serialized as a RESP bulk string
+func bulk(s string) string {
+	value := RESPValue{Type: BulkString, Str: s}
+	return string(value.Serialize())
+}
+
+// roundTripAll writes requests and reads one reply per request
+func roundTripAll(t *testing.T, conn net.Conn, requests ...*RESPValue) []string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for _, r := range requests {
+			conn.Write(r.Serialize())
+		}
+	}()
+	reader := NewRESPReader(conn)
+	replies := make([]string, len(requests))
+	for i := range requests {
+		reply, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Reading reply %d failed: %v", i, err)
+		}
+		replies[i] = string(reply.Serialize())
+	}
+	return replies
+}
+
+func TestMuxSharesUpstreamConnection(t *testing.T) {
+	addr, dials := echoUpstream(t)
+	p := newMuxProxy(addr, 1)
+	defer p.mux.close()
+
+	var wg sync.WaitGroup
+	for id := range uint64(4) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, done := muxClient(t, p, id)
+			defer func() {
+				conn.Close()
+				<-done
+			}()
+
+			// Pipelined requests from each client come back in order and are never mixed up
+			key := string(rune('a' + id))
+			var requests []*RESPValue
+			var want []string
+			for i := range 20 {
+				n := string(rune('0' + i%10))
+				requests = append(requests, testRequest("GET", key+n))
+				want = append(want, bulk("GET "+key+n))
+			}
+			got := roundTripAll(t, conn, requests...)
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("client %d reply %d: expected %q, got %q", id, i, want[i], got[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("Expected 1 upstream connection, got %d", n)
+	}
+	if p.mux.open() != 1 {
+		t.Errorf("Expected 1 open shared connection, got %d", p.mux.open())
+	}
+}
+
+func TestMuxRejectsStatefulCommands(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	p := newMuxProxy(addr, 2)
+	defer p.mux.close()
+
+	conn, done := muxClient(t, p, 1)
+	defer conn.Close()
+
+	got := roundTripAll(t, conn,
+		testRequest("SELECT", "1"),
+		testRequest("XREAD", "BLOCK", "0", "STREAMS", "s", "$"),
+		testRequest("ASKING"),
+		testRequest("GET", "k"),
+		testRequest("XREAD", "STREAMS", "s", "0"),
+		testRequest("QUIT"),
+	)
+	want := []string{
+		"-ERR SELECT is not supported when connections are multiplexed\r\n",
+		"-ERR XREAD is not supported when connections are multiplexed\r\n",
+		bulk("ASKING"),
+		bulk("GET k"),
+		bulk("XREAD STREAMS s 0"),
+		"+OK\r\n",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	// QUIT ends the client connection
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected QUIT to close the client connection")
+	}
+}
+
+func TestMuxTransactions(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	p := newMuxProxy(addr, 1)
+	defer p.mux.close()
+
+	a, doneA := muxClient(t, p, 1)
+	b, doneB := muxClient(t, p, 2)
+	defer func() {
+		a.Close()
+		b.Close()
+		<-doneA
+		<-doneB
+	}()
+
+	// Another client's requests on the shared connection while the transaction is open
+	got := roundTripAll(t, a, testRequest("MULTI"), testRequest("SET", "a", "1"))
+	if got[0] != "+OK\r\n" || got[1] != "+QUEUED\r\n" {
+		t.Errorf("Expected MULTI and the command to be answered, got %q", got)
+	}
+	if got := roundTripAll(t, b, testRequest("GET", "b")); got[0] != bulk("GET b") {
+		t.Errorf("Expected the other client's request to run outside the transaction, got %q", got[0])
+	}
+	got = roundTripAll(t, a, testRequest("INCR", "a"), testRequest("EXEC"))
+	if want := "*2\r\n" + bulk("SET a 1") + bulk("INCR a"); got[1] != want {
+		t.Errorf("Expected EXEC to return %q, got %q", want, got[1])
+	}
+
+	got = roundTripAll(t, a,
+		testRequest("EXEC"),
+		testRequest("MULTI"),
+		testRequest("MULTI"),
+		testRequest("SELECT", "1"),
+		testRequest("EXEC"),
+		testRequest("MULTI"),
+		testRequest("SET", "a", "2"),
+		testRequest("DISCARD"),
+		testRequest("GET", "a"),
+	)
+	want := []string{
+		"-ERR EXEC without MULTI\r\n",
+		"+OK\r\n",
+		"-ERR MULTI calls can not be nested\r\n",
+		"-ERR SELECT is not supported when connections are multiplexed\r\n",
+		"-" + muxExecAbort + "\r\n",
+		"+OK\r\n",
+		"+QUEUED\r\n",
+		"+OK\r\n",
+		bulk("GET a"),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestMuxUpstreamFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// Read one request and drop the connection without replying
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		NewRESPReader(conn).ReadValue()
+		conn.Close()
+	}()
+
+	p := newMuxProxy(ln.Addr().String(), 1)
+	defer p.mux.close()
+
+	conn, done := muxClient(t, p, 1)
+	defer conn.Close()
+
+	got := roundTripAll(t, conn, testRequest("GET", "k"))
+	if got[0] != "-ERR upstream connection lost\r\n" {
+		t.Errorf("Expected an error reply, got %q", got[0])
+	}
+	if _, err := NewRESPReader(conn).ReadValue(); err != io.EOF {
+		t.Errorf("Expected the client to be disconnected, got %v", err)
+	}
+	<-done
+
+	if p.mux.open() != 0 {
+		t.Errorf("Expected the failed connection not to count as open")
+	}
+}
+
+func TestMuxDialsOutsideLock(t *testing.T) {
+	// The first slot dials, the second hangs until released and the third fails
+	release := make(chan struct{})
+	var calls atomic.Int64
+	g := newMuxGroup(3, func(ctx context.Context) (net.Conn, error) {
+		switch calls.Add(1) {
+		case 1:
+			conn, _ := net.Pipe()
+			return conn, nil
+		case 2:
+			<-release
+			return nil, errors.New("dial timed out")
+		default:
+			return nil, errors.New("connection refused")
+		}
+	})
+	defer g.close()
+	defer close(release)
+
+	for range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		mc, err := g.acquire(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Expected the usable connection despite the slow and failing dials, got %v", err)
+		}
+		g.release(mc)
+	}
+	if n := calls.Load(); n > 5 {
+		t.Errorf("Expected the hanging dial not to be repeated, got %d dials", n)
+	}
+}
+
+func TestMuxAcquireFailsOnceAllDialsFail(t *testing.T) {
+	g := newMuxGroup(2, func(ctx context.Context) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+	defer g.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := g.acquire(ctx); err == nil || err.Error() != "connection refused" {
+		t.Errorf("Expected the dial error, got %v", err)
+	}
+}
+
+func TestMuxRetireReplacesConnections(t *testing.T) {
+	addr, _ := echoUpstream(t)
+	p := newMuxProxy(addr, 1)
+	defer p.mux.close()
+
+	ctx := context.Background()
+	old, err := p.mux.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	p.mux.retire()
+
+	// New clients get a new connection, the retired one serves its client until it leaves
+	mc, err := p.mux.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer p.mux.release(mc)
+	if mc == old {
+		t.Fatal("Expected a newly dialed connection")
+	}
+	if old.failed() {
+		t.Fatal("Expected the retired connection to stay open while it has a client")
+	}
+	p.mux.release(old)
+	if !old.failed() {
+		t.Error("Expected the retired connection to be closed once its last client left")
+	}
+}
+
+func TestMuxPingsIdleConnections(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	p := newMuxProxy(upstream.addr, 1)
+	p.mux.ping = 50 * time.Millisecond
+	defer p.mux.close()
+
+	mc, err := p.mux.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer p.mux.release(mc)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(upstream.recorded()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected PINGs on the idle connection, got %v", upstream.recorded())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, request := range upstream.recorded() {
+		if request != "1:PING" {
+			t.Errorf("Unexpected request %q", request)
+		}
+	}
+}
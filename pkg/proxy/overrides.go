@@ -0,0 +1,124 @@
+package proxy
+
+import "sync"
+
+// pingRequest is forwarded in place of a request answered by the proxy, so
+// the connection still gets exactly one reply for it, in order
+var pingRequest = &RESPValue{Type: Array, Array: []RESPValue{{Type: BulkString, Str: "PING"}}}
+
+// discardRequest is forwarded in place of the EXEC of a transaction the proxy
+// rejected a command of
+var discardRequest = &RESPValue{Type: Array, Array: []RESPValue{{Type: BulkString, Str: "DISCARD"}}}
+
+// replyOverrides answers some requests of a dedicated connection with a reply
+// made up by the proxy (a chaos MOVED, a denied command error, a cached
+// value). Such a request is forwarded as a PING whose reply is replaced,
+// keeping pipelined replies in order. The reply to other requests can be
+// handed to a callback before it is sent, to cache or rewrite it.
+type replyOverrides struct {
+	mu       sync.Mutex
+	sent     uint64          // Requests forwarded
+	received uint64          // Replies read, not counting push frames
+	replies  []replyOverride // Replies to replace or watch, in request order
+	multi    bool            // MULTI was forwarded and the transaction not ended yet
+	aborted  bool            // A request inside the transaction was answered with an error
+}
+
+type replyOverride struct {
+	seq   uint64           // Index of the request whose reply is replaced or watched
+	value *RESPValue       // Reply sent instead of the server's, or nil
+	watch func(*RESPValue) // Called with the server's reply, which it may modify, or nil
+}
+
+// request accounts for a request about to be forwarded; name is its command
+// name. If reply isn't nil it answers the request, and the PING to send
+// instead is returned. Otherwise watch, if set, is called with the server's
+// reply. An error reply inside MULTI aborts the transaction like one the
+// server returns while queueing: its EXEC is sent as a DISCARD and answered
+// with EXECABORT, as the server would run the other commands.
+func (o *replyOverrides) request(value *RESPValue, name string, reply *RESPValue, watch func(*RESPValue)) *RESPValue {
+	if o == nil {
+		return value
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seq := o.sent
+	o.sent++
+	if reply != nil {
+		if o.multi && reply.Type == Error {
+			o.aborted = true
+		}
+		o.replies = append(o.replies, replyOverride{seq: seq, value: reply})
+		return pingRequest
+	}
+
+	switch name {
+	case "MULTI":
+		o.multi = true
+	case "EXEC":
+		if o.aborted {
+			o.replies = append(o.replies, replyOverride{seq: seq, value: &RESPValue{Type: Error, Str: muxExecAbort}})
+			value, watch = discardRequest, nil
+		}
+		o.multi, o.aborted = false, false
+	case "DISCARD", "RESET":
+		o.multi, o.aborted = false, false
+	}
+	if watch != nil {
+		o.replies = append(o.replies, replyOverride{seq: seq, watch: watch})
+	}
+	return value
+}
+
+// reply accounts for a reply read from the server and returns the reply to
+// send the client in place of it, or nil to send it unchanged. value may be
+// nil when nothing is pending.
+func (o *replyOverrides) reply(value *RESPValue) *RESPValue {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	seq := o.received
+	o.received++
+
+	if len(o.replies) == 0 || o.replies[0].seq != seq {
+		o.mu.Unlock()
+		return nil
+	}
+	override := o.replies[0]
+	o.replies = o.replies[1:]
+	o.mu.Unlock()
+
+	if override.watch != nil {
+		override.watch(value)
+	}
+	return override.value
+}
+
+// pending reports whether a replaced or watched reply has yet to arrive
+func (o *replyOverrides) pending() bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.replies) > 0
+}
+
+// close hands nil to the watchers of replies that will never arrive, as the
+// connection is closed
+func (o *replyOverrides) close() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	replies := o.replies
+	o.replies = nil
+	o.mu.Unlock()
+
+	for _, r := range replies {
+		if r.watch != nil {
+			r.watch(nil)
+		}
+	}
+}
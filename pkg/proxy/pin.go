@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+)
+
+// errPinMismatch fails TLS handshakes with servers whose key isn't pinned
+var errPinMismatch = errors.New("server certificate doesn't match any pinned public key")
+
+// verifyPins returns a tls.Config.VerifyConnection callback accepting a
+// server whose certificate's public key hashes to one of pins. Without CA
+// verification only the server's own certificate counts, as anyone can send
+// a copy of a CA certificate; with it, any certificate of a verified chain
+// does, so a CA key can be pinned too.
+func verifyPins(pins [][32]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		var certs []*x509.Certificate
+		if len(cs.PeerCertificates) > 0 {
+			certs = append(certs, cs.PeerCertificates[0])
+		}
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		for _, cert := range certs {
+			if slices.Contains(pins, sha256.Sum256(cert.RawSubjectPublicKeyInfo)) {
+				return nil
+			}
+		}
+		return errPinMismatch
+	}
+}
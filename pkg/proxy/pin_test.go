@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+func TestDialUpstreamChecksPinnedKey(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	for _, tt := range []struct {
+		name string
+		pin  [32]byte
+		ok   bool
+	}{
+		{"server's key", sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo), true},
+		{"another key", sha256.Sum256([]byte("another key")), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pinning stands in for CA verification
+			m := NewManager(&config.Config{TLSPins: [][32]byte{tt.pin}})
+			if err := m.SetTLSConfig("", true); err != nil {
+				t.Fatalf("SetTLSConfig failed: %v", err)
+			}
+			p := &Proxy{
+				remoteAddr: server.Listener.Addr().String(),
+				endpoint:   discovery.Endpoint{Host: host, Port: port},
+				tlsConfig:  endpointTLSConfig(m.tlsConfig, &config.Config{TLSSessionCache: 8}),
+			}
+			// The pin is checked on resumed sessions too
+			for i := range 2 {
+				conn, err := p.dialUpstream(context.Background(), newSession(uint64(i), false))
+				if err == nil {
+					conn.Close()
+				}
+				if (err == nil) != tt.ok {
+					t.Fatalf("Dial %d: expected success=%v, got %v", i, tt.ok, err)
+				}
+				if err != nil && !errors.Is(err, errPinMismatch) {
+					t.Errorf("Expected a pin mismatch, got %v", err)
+				}
+			}
+		})
+	}
+}
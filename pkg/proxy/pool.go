@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// Pool refill backoff after failed dials
+const (
+	poolMinBackoff = time.Second
+	poolMaxBackoff = 30 * time.Second
+)
+
+// poolAliveProbe is how long get waits for an idle connection to show it was closed
+const poolAliveProbe = time.Millisecond
+
+// upstreamPool keeps a number of dialed, TLS-negotiated and authenticated
+// upstream connections ready so a new client connection does not pay the
+// dial+handshake+AUTH latency. Connections are handed out once and never
+// returned: a client may leave per-connection state (SELECT, CLIENT SETNAME,
+// MULTI, subscriptions) behind, so a used connection is never shared.
+type upstreamPool struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	size    int
+	maxIdle time.Duration // Idle connections older than this are replaced (IAM tokens expire)
+	ping    time.Duration // PING idle connections this often so middleboxes don't drop them (0 disables)
+
+	// With IAM auth: the expiry of the token new connections authenticate
+	// with, and sending AUTH with a newer one, returning its expiry
+	tokenExpiry func() time.Time
+	renew       func(conn net.Conn) (time.Time, error)
+
+	idle       chan pooledConn
+	generation atomic.Uint64 // Bumped by flush; connections dialed before are discarded
+	refill     chan struct{}
+	done       chan struct{}
+	once       sync.Once
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type pooledConn struct {
+	conn       net.Conn
+	created    time.Time
+	pinged     time.Time // Creation or last successful PING
+	expiry     time.Time // Expiry of the IAM token it authenticated with; zero if none
+	generation uint64    // Pool generation when it was dialed
+}
+
+// expired reports whether the connection's IAM token expired
+func (pc pooledConn) expired(now time.Time) bool {
+	return !pc.expiry.IsZero() && !now.Before(pc.expiry)
+}
+
+// newUpstreamPool creates a pool; run must be started to fill it
+func newUpstreamPool(size int, maxIdle time.Duration, dial func(ctx context.Context) (net.Conn, error)) *upstreamPool {
+	return &upstreamPool{
+		dial:    dial,
+		size:    size,
+		maxIdle: maxIdle,
+		idle:    make(chan pooledConn, size),
+		refill:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// get returns a ready connection, or nil if none is available. Expired or
+// server-closed connections are discarded.
+func (p *upstreamPool) get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	defer p.signalRefill()
+
+	for {
+		select {
+		case pc := <-p.idle:
+			if time.Since(pc.created) > p.maxIdle || pc.expired(time.Now()) || pc.generation != p.generation.Load() || !alive(pc.conn) {
+				pc.conn.Close()
+				continue
+			}
+			p.hits.Add(1)
+			return pc.conn
+		default:
+			p.misses.Add(1)
+			return nil
+		}
+	}
+}
+
+// alive reports whether an idle connection is still open. An idle upstream
+// never sends anything, so any data or error other than a timeout means the
+// connection can't be used.
+func alive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(poolAliveProbe))
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	conn.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// idleCount returns the number of connections currently waiting in the pool
+func (p *upstreamPool) idleCount() int {
+	return len(p.idle)
+}
+
+func (p *upstreamPool) signalRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the pool filled and replaces expired connections until close
+func (p *upstreamPool) run(remoteAddr string) {
+	interval := p.maxIdle / 2
+	if p.ping > 0 {
+		interval = min(interval, p.ping)
+	}
+	if p.renew != nil {
+		// Every connection is checked at least once within reauthMargin of its token's expiry
+		interval = min(interval, reauthMargin/2)
+	}
+	ticker := time.NewTicker(max(interval, time.Second))
+	defer ticker.Stop()
+
+	backoff := poolMinBackoff
+	for {
+		if err := p.fill(); err != nil {
+			logger.Debug(fmt.Sprintf("Connection pool for %s: %v (retrying in %s)", remoteAddr, err, backoff))
+			select {
+			case <-p.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, poolMaxBackoff)
+			continue
+		}
+		backoff = poolMinBackoff
+
+		select {
+		case <-p.done:
+			return
+		case <-p.refill:
+		case <-ticker.C:
+			p.expire()
+		}
+	}
+}
+
+// fill dials until the pool holds size connections
+func (p *upstreamPool) fill() error {
+	return p.fillTo(p.size)
+}
+
+// fillTo dials until the pool holds n connections (at most size)
+func (p *upstreamPool) fillTo(n int) error {
+	if p == nil {
+		return nil
+	}
+	for len(p.idle) < min(n, p.size) {
+		generation := p.generation.Load()
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+		conn, err := p.dial(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		if generation != p.generation.Load() {
+			// Flushed while dialing
+			conn.Close()
+			continue
+		}
+
+		pc := pooledConn{conn: conn, created: time.Now(), pinged: time.Now(), generation: generation}
+		if p.tokenExpiry != nil {
+			// The token just used to authenticate is the provider's current one
+			pc.expiry = p.tokenExpiry()
+		}
+		select {
+		case <-p.done:
+			conn.Close()
+			return nil
+		case p.idle <- pc:
+		default:
+			conn.Close()
+			return nil
+		}
+	}
+	return nil
+}
+
+// reauth runs auth on every idle connection, e.g. to send AUTH with a rotated
+// password, closing those it fails on; fill replaces them
+func (p *upstreamPool) reauth(auth func(conn net.Conn) error) {
+	if p == nil {
+		return
+	}
+	defer p.signalRefill()
+	for range len(p.idle) {
+		select {
+		case pc := <-p.idle:
+			if err := auth(pc.conn); err != nil {
+				pc.conn.Close()
+				continue
+			}
+			select {
+			case p.idle <- pc:
+			default:
+				pc.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// expire closes idle connections that are too old, sends AUTH with a newer
+// IAM token on those whose token is about to expire, and PINGs the others
+// when due, closing those that don't answer; fill replaces them
+func (p *upstreamPool) expire() {
+	for range len(p.idle) {
+		select {
+		case pc := <-p.idle:
+			if time.Since(pc.created) > p.maxIdle {
+				pc.conn.Close()
+				continue
+			}
+			if p.renew != nil && !pc.expiry.IsZero() && reauthDelay(pc.expiry, time.Now()) == 0 {
+				expiry, err := p.renew(pc.conn)
+				if err != nil {
+					logger.Debug(fmt.Sprintf("Closing pooled connection to %s: %v", pc.conn.RemoteAddr(), err))
+					pc.conn.Close()
+					continue
+				}
+				pc.expiry = expiry
+			}
+			if p.ping > 0 && time.Since(pc.pinged) >= p.ping {
+				if err := execCommand(pc.conn, "PING"); err != nil {
+					logger.Debug(fmt.Sprintf("Closing pooled connection to %s: %v", pc.conn.RemoteAddr(), err))
+					pc.conn.Close()
+					continue
+				}
+				pc.pinged = time.Now()
+			}
+			select {
+			case p.idle <- pc:
+			default:
+				pc.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flush closes the idle connections, and those being dialed once they are,
+// e.g. because they were set up for a cluster node role that changed; fill
+// replaces them
+func (p *upstreamPool) flush() {
+	if p == nil {
+		return
+	}
+	p.generation.Add(1)
+	defer p.signalRefill()
+	for {
+		select {
+		case pc := <-p.idle:
+			pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// startPool starts keeping size pre-authenticated connections ready
+func (p *Proxy) startPool(size int, maxIdle time.Duration) {
+	p.pool = newUpstreamPool(size, maxIdle, p.dialAuthenticated)
+	p.pool.ping = upstreamPingInterval(p.config)
+	p.keepPoolAuthenticated(p.pool)
+	go p.pool.run(p.remoteAddr)
+	logger.Info(fmt.Sprintf("Keeping %d pre-authenticated upstream connections ready for %s", size, p.remoteAddr))
+}
+
+// close stops refilling and closes all idle connections
+func (p *upstreamPool) close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		close(p.done)
+		for {
+			select {
+			case pc := <-p.idle:
+				pc.conn.Close()
+			default:
+				return
+			}
+		}
+	})
+}
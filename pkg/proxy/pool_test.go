@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitIdle waits until the pool holds n idle connections
+func waitIdle(t *testing.T, pool *upstreamPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.idleCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d idle connections, have %d", n, pool.idleCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolHandsOutAuthenticatedConnections(t *testing.T) {
+	p := &Proxy{localAddr: "127.0.0.1:6379", remoteAddr: fakeUpstream(t, "+OK\r\n"), authPassword: newCredential("secret")}
+	p.startPool(2, time.Minute)
+	defer p.pool.close()
+	waitIdle(t, p.pool, 2)
+
+	conn := p.pool.get()
+	if conn == nil {
+		t.Fatal("Expected a pooled connection")
+	}
+	defer conn.Close()
+
+	// The connection is usable as is, without another AUTH
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(pingCommand); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if reply, err := NewRESPReader(conn).ReadValue(); err != nil || reply.Str != "OK" {
+		t.Fatalf("Unexpected reply %+v: %v", reply, err)
+	}
+
+	// The pool refills behind the handed out connection
+	waitIdle(t, p.pool, 2)
+	if hits, misses := p.pool.hits.Load(), p.pool.misses.Load(); hits != 1 || misses != 0 {
+		t.Errorf("Expected 1 hit and 0 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestPoolDiscardsUnusableConnections(t *testing.T) {
+	var peers []net.Conn
+	dial := func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		peers = append(peers, server)
+		return client, nil
+	}
+
+	tests := []struct {
+		name    string
+		maxIdle time.Duration
+		prepare func()
+	}{
+		{"closed by server", time.Minute, func() { peers[0].Close() }},
+		{"expired", time.Nanosecond, func() {}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peers = nil
+			pool := newUpstreamPool(1, tt.maxIdle, dial)
+			if err := pool.fill(); err != nil {
+				t.Fatalf("fill failed: %v", err)
+			}
+			tt.prepare()
+
+			if conn := pool.get(); conn != nil {
+				t.Error("Expected the unusable connection to be discarded")
+			}
+			if pool.hits.Load() != 0 || pool.misses.Load() != 1 {
+				t.Errorf("Expected a miss, got %d hits and %d misses", pool.hits.Load(), pool.misses.Load())
+			}
+		})
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	pool := newUpstreamPool(1, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		return client, nil
+	})
+	if err := pool.fill(); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+
+	pool.close()
+	pool.close()
+
+	if _, err := client.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Expected idle connections to be closed, got %v", err)
+	}
+	if pool.get() != nil {
+		t.Error("Expected no connections after close")
+	}
+
+	var nilPool *upstreamPool
+	if nilPool.get() != nil {
+		t.Error("Expected a nil pool to hand out nothing")
+	}
+}
+
+func TestPoolPingsIdleConnections(t *testing.T) {
+	var peers []net.Conn
+	pool := newUpstreamPool(2, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		peers = append(peers, server)
+		return client, nil
+	})
+	pool.ping = time.Nanosecond
+	if err := pool.fill(); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+
+	// The first server answers PING, the second has silently gone away
+	go func() {
+		reader := NewRESPReader(peers[0])
+		if _, err := reader.ReadValue(); err == nil {
+			peers[0].Write([]byte("+PONG\r\n"))
+		}
+	}()
+	peers[1].Close()
+
+	pool.expire()
+	if n := pool.idleCount(); n != 1 {
+		t.Errorf("Expected the unresponsive connection to be dropped, %d idle", n)
+	}
+}
+
+func TestManagerPrewarm(t *testing.T) {
+	pooled := &Proxy{remoteAddr: fakeUpstream(t, "+OK\r\n"), authPassword: newCredential("secret")}
+	pooled.pool = newUpstreamPool(2, time.Minute, pooled.dialAuthenticated)
+	defer pooled.pool.close()
+
+	muxAddr, dials := echoUpstream(t)
+	muxed := newMuxProxy(muxAddr, 4)
+	defer muxed.mux.close()
+
+	// A closed port fails to dial
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := &Proxy{remoteAddr: ln.Addr().String()}
+	ln.Close()
+	down.pool = newUpstreamPool(2, time.Minute, func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", down.remoteAddr)
+	})
+
+	m := &Manager{proxies: []*Proxy{pooled, muxed, down}}
+	err = m.Prewarm(context.Background(), 3)
+	if err == nil || !strings.Contains(err.Error(), down.remoteAddr) {
+		t.Errorf("Expected an error naming %s, got %v", down.remoteAddr, err)
+	}
+
+	// Capped at the pool size
+	if n := pooled.pool.idleCount(); n != 2 {
+		t.Errorf("Expected 2 pooled connections, got %d", n)
+	}
+	if n := muxed.mux.open(); n != 3 {
+		t.Errorf("Expected 3 open shared connections, got %d", n)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("Expected 3 upstream dials, got %d", n)
+	}
+
+	// Already open connections are not dialed again
+	if err := (&Manager{proxies: []*Proxy{muxed}}).Prewarm(context.Background(), 3); err != nil {
+		t.Errorf("Prewarm failed: %v", err)
+	}
+	if n := muxed.mux.open(); n != 3 {
+		t.Errorf("Expected 3 open shared connections, got %d", n)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// maxPort is the highest TCP port
+const maxPort = 65535
+
+// portState holds the local port assigned to each cluster node, keyed by the
+// node's remote "ip:port". With a path it is persisted across restarts, so a
+// node keeps its local port and the cluster caches of clients and dashboards
+// keyed by port stay valid.
+type portState struct {
+	path  string
+	ports map[string]int
+}
+
+// loadPortState reads the port assignments saved at path; a missing file, or
+// an empty path (nothing persisted), gives an empty state
+func loadPortState(path string) (*portState, error) {
+	s := &portState{path: path, ports: make(map[string]int)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(data, &s.ports); err != nil {
+		return s, fmt.Errorf("invalid port state file %s: %w", path, err)
+	}
+	if s.ports == nil {
+		s.ports = make(map[string]int)
+	}
+	return s, nil
+}
+
+// assign returns the local port of each node in addrs. Nodes keep the port
+// they had; new nodes get the lowest port from startPort up not held by
+// another node, including nodes no longer in the cluster, so they get their
+// port back when they return, and not reserved (the endpoints' ports). Saved
+// ports below startPort or reserved are reassigned. Nodes left without a port
+// once the range up to 65535 is used up are missing from the result.
+func (s *portState) assign(addrs []string, startPort int, reserved map[int]bool) map[string]int {
+	known := make([]string, 0, len(s.ports))
+	for addr := range s.ports {
+		known = append(known, addr)
+	}
+	sort.Strings(known)
+
+	taken := make(map[int]bool, len(s.ports)+len(reserved))
+	for port := range reserved {
+		taken[port] = true
+	}
+	for _, addr := range known {
+		port := s.ports[addr]
+		if port < startPort || port > maxPort || taken[port] {
+			delete(s.ports, addr)
+			continue
+		}
+		taken[port] = true
+	}
+
+	assigned := make(map[string]int, len(addrs))
+	next := startPort
+	for _, addr := range addrs {
+		port, ok := s.ports[addr]
+		if !ok {
+			for next <= maxPort && taken[next] {
+				next++
+			}
+			if next > maxPort {
+				continue
+			}
+			port = next
+			s.ports[addr] = port
+			taken[port] = true
+		}
+		assigned[addr] = port
+	}
+	return assigned
+}
+
+// release frees the port of a node that left the cluster for good
+func (s *portState) release(addr string) {
+	delete(s.ports, addr)
+}
+
+// save writes the assignments to the state file, replacing it atomically so
+// a crash never leaves it half written. Does nothing without a path.
+func (s *portState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.ports, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPortStateKeepsPortsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+
+	state, err := loadPortState(path)
+	if err != nil {
+		t.Fatalf("Expected a missing state file to give an empty state, got %v", err)
+	}
+	got := state.assign([]string{"10.0.0.5:6379", "10.0.0.6:6379", "10.0.0.7:6379"}, 6380, nil)
+	want := map[string]int{"10.0.0.5:6379": 6380, "10.0.0.6:6379": 6381, "10.0.0.7:6379": 6382}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	if err := state.save(); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	// After a restart 10.0.0.5 is gone and 10.0.0.4 joined: the others keep
+	// their ports and the new node doesn't take the absent node's
+	state, err = loadPortState(path)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	got = state.assign([]string{"10.0.0.4:6379", "10.0.0.6:6379", "10.0.0.7:6379"}, 6380, nil)
+	want = map[string]int{"10.0.0.4:6379": 6383, "10.0.0.6:6379": 6381, "10.0.0.7:6379": 6382}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Ports now used by the endpoints are reassigned
+	got = state.assign([]string{"10.0.0.6:6379"}, 6382, nil)
+	if port := got["10.0.0.6:6379"]; port != 6384 {
+		t.Errorf("Expected a port below the start port to be reassigned, got %d", port)
+	}
+}
+
+func TestPortStateWithoutFile(t *testing.T) {
+	state, err := loadPortState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := state.assign([]string{"10.0.0.5:6379", "10.0.0.6:6379"}, 6380, nil)
+	if got["10.0.0.5:6379"] != 6380 || got["10.0.0.6:6379"] != 6381 {
+		t.Errorf("Expected ports in address order, got %v", got)
+	}
+	if err := state.save(); err != nil {
+		t.Errorf("Expected saving without a file to do nothing, got %v", err)
+	}
+
+	// A dedicated range below the endpoint ports skips them
+	state, _ = loadPortState("")
+	got = state.assign([]string{"10.0.0.5:6379", "10.0.0.6:6379"}, 6378, map[int]bool{6379: true, 6380: true})
+	if got["10.0.0.5:6379"] != 6378 || got["10.0.0.6:6379"] != 6381 {
+		t.Errorf("Expected endpoint ports to be skipped, got %v", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "ports.json")
+	os.WriteFile(path, []byte("not json"), 0o644)
+	if state, err := loadPortState(path); err == nil || state == nil {
+		t.Error("Expected an invalid state file to be reported along with an empty state")
+	}
+}
+
+func TestPortStateRangeExhausted(t *testing.T) {
+	state, _ := loadPortState("")
+	got := state.assign([]string{"10.0.0.5:6379", "10.0.0.6:6379", "10.0.0.7:6379"}, 65534, map[int]bool{65535: true})
+	if got["10.0.0.5:6379"] != 65534 {
+		t.Errorf("Expected the last free port, got %v", got)
+	}
+	if _, ok := got["10.0.0.6:6379"]; ok || len(got) != 1 {
+		t.Errorf("Expected nodes beyond port 65535 to get no port, got %v", got)
+	}
+	if len(state.ports) != 1 {
+		t.Errorf("Expected only assigned ports to be saved, got %v", state.ports)
+	}
+}
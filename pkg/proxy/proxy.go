@@ -1,63 +1,130 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/auth"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	authResponseBufferSize = 1024 // Buffer size for reading AUTH command responses
 )
 
+// connIDCounter hands out process-unique connection IDs across all proxies
+var connIDCounter atomic.Uint64
+
+// nextConnID returns a new unique connection ID
+func nextConnID() uint64 {
+	return connIDCounter.Add(1)
+}
+
 // Manager manages multiple proxy instances
 type Manager struct {
 	config            *config.Config
 	proxies           []*Proxy
 	tokenSource       *auth.IAMTokenProvider
-	authPassword      string // For Redis password auth
-	authorizationMode string // From discovery: IAM_AUTH, PASSWORD_AUTH, AUTH_DISABLED
+	authPassword      *credential // For Redis password auth
+	authorizationMode string      // From discovery: IAM_AUTH, PASSWORD_AUTH, AUTH_DISABLED
 	tlsConfig         *tls.Config
-	nodeMap           map[string]string // Maps remote "ip:port" -> local "ip:port" for cluster redirects
-	isClusterMode     bool              // True if cluster mode is detected
+	rootCAs           *atomic.Pointer[x509.CertPool] // Current server CAs, swapped when they rotate; shared by all proxies
+	caCert            string                         // PEM of rootCAs; only used by WatchCACertificates
+	clientCert        *tls.Certificate               // Presented to upstreams requiring mutual TLS; nil if not configured
+	nodeMap           *addrMap                       // Maps remote "ip:port" -> local "ip:port" for cluster redirects
+	isClusterMode     bool                           // True if cluster mode is detected
+	clusterNodes      []ClusterNode                  // Last CLUSTER NODES result, reported on /topology
+	scripts           *scriptLoader                  // Copies SCRIPT LOAD to every cluster node
+	clusterPorts      *portState                     // Local ports of cluster nodes; nil until cluster nodes are discovered
+	clusterStartPort  int                            // First local port for cluster nodes
+	endpointPorts     map[int]bool                   // Local ports of the endpoint listeners, never given to cluster nodes
+	metricsRegistry   prometheus.Registerer
+	collectors        map[[2]string]*proxyCollector // Metrics collectors of proxies by local and remote address; the endpoint type is read at collection, as cluster node roles change
+	capture           *capture.Writer               // Records sampled connections; nil unless -capture-file is set
+	buffers           *bufferPool                   // Relay buffers shared by all proxies
+	inherited         map[string]net.Listener       // Sockets handed over by the previous process, by local address
+	splitPrimary      *Proxy                        // Proxy sending reads to the read replicas; nil unless -read-write-split is set
+	connLimit         *connLimiter                  // Process-wide client connection limit; nil if unlimited
 	mu                sync.Mutex
 }
 
 // Proxy represents a single proxy instance
 type Proxy struct {
-	localAddr     string
-	remoteAddr    string
-	endpoint      discovery.Endpoint
-	listener      net.Listener
-	config        *config.Config
-	tokenSource   *auth.IAMTokenProvider
-	authPassword  string // For Redis password auth
-	tlsConfig     *tls.Config
-	isClusterMode bool              // True if cluster mode redirect rewriting is enabled
-	nodeMap       map[string]string // Maps remote "ip:port" -> local "ip:port" for cluster redirects
-	connections   sync.WaitGroup
-	shutdown      chan struct{}
-	shutdownOnce  sync.Once
+	localAddr          string
+	remoteAddr         string
+	announcedAddr      string // IP "ip:port" of a cluster node dialed by its hostname; empty otherwise
+	endpoint           discovery.Endpoint
+	role               atomic.Pointer[string] // Endpoint type set by a cluster failover; nil while it is endpoint.Type
+	reconfiguringUntil atomic.Int64           // UnixNano until which the endpoint is being swapped, see reconfiguring
+	listener           net.Listener
+	config             *config.Config
+	tokenSource        *auth.IAMTokenProvider
+	authPassword       *credential // For Redis password auth; shared by all proxies
+	tlsConfig          *tls.Config
+	rootCAs            *atomic.Pointer[x509.CertPool] // Current server CAs, overriding tlsConfig's after a rotation; shared by all proxies
+	isClusterMode      bool                           // True if cluster mode redirect rewriting is enabled
+	nodeMap            *addrMap                       // Maps remote "ip:port" -> local "ip:port" for cluster redirects
+	scripts            *scriptLoader                  // Copies SCRIPT LOAD to every cluster node; shared by all proxies
+	stats              proxyStats
+	shedder            *overloadShedder     // nil when connection shedding is disabled
+	breaker            *circuitBreaker      // nil when the circuit breaker is disabled
+	maintenance        *maintenanceMode     // nil unless clients are answered locally while the upstream is down
+	latency            prometheus.Histogram // Request round-trip latency, observed when commands are inspected
+	sessions           sessionRegistry      // Established connections, listed on /connections
+	capture            *capture.Writer
+	upstream           upstreamCheck  // Last upstream PING check, for /readyz and /status
+	lag                replicaLag     // Replication lag of a replica endpoint; measured with -replica-max-lag
+	pool               *upstreamPool  // Pre-authenticated upstream connections; nil unless -pool-size is set
+	mux                *muxGroup      // Upstream connections shared by all clients; nil unless -mux-connections is set
+	readReplicas       *replicaSet    // Proxies whose endpoints serve reads; nil unless this is the primary and -read-write-split is set
+	chaos              *chaosInjector // Failure injection for testing clients; nil unless a -chaos-* option is set
+	denied             *denyList      // Commands rejected instead of forwarded; nil unless -deny-commands is set
+	cache              *readCache     // GET/MGET replies cached with server-side invalidation; nil unless -cache-keys is set
+	bufferPool         *bufferPool
+	connLimit          *connLimiter // Client connections of this proxy; nil if unlimited
+	globalLimit        *connLimiter // Shared by all proxies; nil if unlimited
+	connections        sync.WaitGroup
+	router             atomic.Pointer[clusterRouter] // Routes requests to cluster nodes by key; nil unless -cluster-routing is set and this is the primary
+	shutdown           chan struct{}
+	shutdownOnce       sync.Once
 }
 
 // NewManager creates a new proxy manager
 func NewManager(cfg *config.Config) *Manager {
-	return &Manager{
-		config:  cfg,
-		proxies: make([]*Proxy, 0),
-		nodeMap: make(map[string]string),
+	buffers := defaultBuffers
+	if cfg.BufferSize > 0 && cfg.BufferSize != defaultBufferSize {
+		buffers = newBufferPool(cfg.BufferSize)
 	}
+	m := &Manager{
+		config:       cfg,
+		proxies:      make([]*Proxy, 0),
+		nodeMap:      newAddrMap(make(map[string]string)),
+		authPassword: newCredential(""),
+		rootCAs:      &atomic.Pointer[x509.CertPool]{},
+		collectors:   make(map[[2]string]*proxyCollector),
+		buffers:      buffers,
+		connLimit:    newConnLimiter(cfg.MaxConnections),
+	}
+	m.scripts = &scriptLoader{nodes: m.clusterProxies}
+	return m
 }
 
 // SetTLSConfig sets the TLS configuration for all proxies
@@ -74,6 +141,8 @@ func (m *Manager) SetTLSConfig(caCert string, skipVerify bool) error {
 			MinVersion:         tls.VersionTLS12,
 			InsecureSkipVerify: skipVerify,
 		}
+		m.rootCAs.Store(caCertPool)
+		m.caCert = caCert
 
 		logger.Info("TLS configuration initialized with instance CA certificate")
 	} else {
@@ -89,13 +158,32 @@ func (m *Manager) SetTLSConfig(caCert string, skipVerify bool) error {
 			logger.Info("TLS configuration initialized with system CA certificates")
 		}
 	}
+	if m.config.TLSServerName != "" {
+		m.tlsConfig.ServerName = m.config.TLSServerName
+		logger.Info(fmt.Sprintf("TLS server name: %s", m.config.TLSServerName))
+	}
+	if len(m.config.TLSPins) > 0 {
+		m.tlsConfig.VerifyConnection = verifyPins(m.config.TLSPins)
+		logger.Info(fmt.Sprintf("TLS server public key pinned to %d hash(es)", len(m.config.TLSPins)))
+	}
+	if m.clientCert != nil {
+		m.tlsConfig.Certificates = []tls.Certificate{*m.clientCert}
+		logger.Info("TLS client certificate configured")
+	}
 
 	return nil
 }
 
+// SetClientCertificate sets the certificate presented to upstreams requiring
+// mutual TLS; call before SetTLSConfig
+func (m *Manager) SetClientCertificate(cert tls.Certificate) {
+	m.clientCert = &cert
+}
+
 // SetAuthPassword sets the password for Redis authentication
 func (m *Manager) SetAuthPassword(password string) {
-	m.authPassword = password
+	m.authPassword.set(password)
+	logger.PinSecret(password)
 	if password != "" {
 		logger.Info("Password authentication configured")
 	}
@@ -107,56 +195,275 @@ func (m *Manager) SetAuthorizationMode(mode string) {
 	logger.Info(fmt.Sprintf("Authorization mode: %s", mode))
 }
 
+// SetMetricsRegistry sets the Prometheus registry that per-proxy collectors are registered with
+func (m *Manager) SetMetricsRegistry(registry prometheus.Registerer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metricsRegistry = registry
+}
+
+// SetCaptureWriter records the decrypted traffic of a sampled fraction of
+// new connections (Config.CaptureSample) to w
+func (m *Manager) SetCaptureWriter(w *capture.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.capture = w
+}
+
 // AddProxy adds and starts a new proxy
 func (m *Manager) AddProxy(ctx context.Context, endpoint discovery.Endpoint, localPort int) error {
+	return m.addProxy(ctx, endpoint, localPort, "")
+}
+
+// addProxy adds and starts a new proxy. announcedAddr is the "ip:port" of a
+// cluster node dialed by hostname, so redirects to its IP are rewritten too.
+func (m *Manager) addProxy(ctx context.Context, endpoint discovery.Endpoint, localPort int, announcedAddr string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Initialize token source if IAM auth is discovered AND no password is set (shared across all proxies)
-	// Password auth takes precedence over IAM auth
-	if m.authorizationMode == "IAM_AUTH" && m.authPassword == "" && m.tokenSource == nil {
-		tokenSource, err := auth.NewIAMTokenProvider(ctx)
+	// Initialize token source if IAM auth is discovered or a token command is
+	// configured AND no password is set (shared across all proxies)
+	// Password auth takes precedence over tokens
+	if (m.authorizationMode == "IAM_AUTH" || m.config.TokenCommand != "") && m.authPassword.get() == "" && m.tokenSource == nil {
+		var tokenSource *auth.IAMTokenProvider
+		var err error
+		if m.config.TokenCommand != "" {
+			tokenSource = auth.NewIAMTokenProviderFromSource(auth.CommandTokenSource(m.config.TokenCommand))
+		} else {
+			tokenSource, err = auth.NewIAMTokenProvider(ctx, m.config.ImpersonateServiceAccount)
+		}
 		if err != nil {
 			return fmt.Errorf("failed to create IAM token provider: %w", err)
 		}
 		m.tokenSource = tokenSource
-		logger.Info("IAM authentication initialized")
+		// Keep a token cached so connections don't wait on the metadata server
+		tokenSource.Start(ctx)
+		if m.metricsRegistry != nil {
+			if err := m.metricsRegistry.Register(tokenSource); err != nil {
+				logger.Error(fmt.Sprintf("Failed to register token metrics: %v", err))
+			}
+		}
+		switch {
+		case m.config.TokenCommand != "":
+			logger.Info("Token authentication initialized, tokens are obtained from -token-command")
+		case m.config.ImpersonateServiceAccount != "":
+			logger.Info(fmt.Sprintf("IAM authentication initialized, impersonating %s", m.config.ImpersonateServiceAccount))
+		default:
+			logger.Info("IAM authentication initialized")
+		}
 	}
 
-	localAddr := fmt.Sprintf("%s:%d", m.config.LocalAddr, localPort)
-	remoteAddr := fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
+	localAddr := m.config.ListenAddr(localPort)
+	remoteAddr := endpoint.Address()
+
+	shedder := newOverloadShedder(m.config.ShedThreshold,
+		time.Duration(m.config.ShedWindow)*time.Second,
+		time.Duration(m.config.ShedCooldown)*time.Second)
 
 	proxy := &Proxy{
 		localAddr:     localAddr,
 		remoteAddr:    remoteAddr,
+		announcedAddr: announcedAddr,
 		endpoint:      endpoint,
 		config:        m.config,
 		tokenSource:   m.tokenSource,
 		authPassword:  m.authPassword,
-		tlsConfig:     m.tlsConfig,
+		tlsConfig:     endpointTLSConfig(m.tlsConfig, m.config),
+		rootCAs:       m.rootCAs,
 		isClusterMode: m.isClusterMode,
 		nodeMap:       m.nodeMap,
+		scripts:       m.scripts,
+		shedder:       shedder,
+		breaker:       newCircuitBreaker(m.config.BreakerThreshold, time.Duration(m.config.BreakerCooldown)*time.Second),
+		maintenance:   newMaintenanceMode(m.config.MaintenanceResponder),
+		chaos:         newChaosInjector(m.config),
+		denied:        newDenyList(m.config),
+		cache:         newReadCache(m.config),
+		latency:       newLatencyHistogram(),
+		capture:       m.capture,
+		bufferPool:    m.buffers,
+		connLimit:     newConnLimiter(m.config.ConnectionLimit(localPort, endpoint.Type)),
+		globalLimit:   m.connLimit,
 		shutdown:      make(chan struct{}),
 	}
+	if m.config.ReadWriteSplit && endpoint.Type == "primary" && m.splitPrimary == nil && !m.isClusterMode {
+		proxy.readReplicas = &replicaSet{}
+	}
+	if ln, ok := m.inherited[localAddr]; ok {
+		proxy.listener = ln
+		delete(m.inherited, localAddr)
+	}
+
+	// Set up upstream connection reuse before accepting clients
+	maxIdle := time.Duration(m.config.PoolMaxIdle) * time.Second
+	switch {
+	case m.config.MuxConnections > 0:
+		proxy.mux = newMuxGroup(m.config.MuxConnections, proxy.dialAuthenticated)
+		proxy.mux.ping = upstreamPingInterval(m.config)
+		proxy.mux.share = proxy.newSharedConn
+	case m.config.PoolSize > 0:
+		proxy.startPool(m.config.PoolSize, maxIdle)
+	case m.config.Prewarm > 0:
+		// Holds the connections opened by Prewarm for the first clients; never refilled
+		proxy.pool = newUpstreamPool(m.config.Prewarm, maxIdle, proxy.dialAuthenticated)
+		proxy.keepPoolAuthenticated(proxy.pool)
+	}
 
 	if err := proxy.Start(); err != nil {
+		proxy.pool.close()
+		proxy.mux.close()
 		return err
 	}
 
+	if m.metricsRegistry != nil {
+		key := [2]string{localAddr, remoteAddr}
+		if collector, ok := m.collectors[key]; ok {
+			// A departed cluster node returned
+			collector.set(proxy)
+		} else {
+			collector := &proxyCollector{proxy: proxy}
+			if err := m.metricsRegistry.Register(collector); err != nil {
+				logger.Error(fmt.Sprintf("Failed to register metrics for %s: %v", localAddr, err))
+			} else {
+				m.collectors[key] = collector
+			}
+		}
+	}
+
 	// Track this node in the map for cluster redirect rewriting
-	m.nodeMap[remoteAddr] = localAddr
+	m.nodeMap.set(remoteAddr, localAddr)
+	if announcedAddr != "" {
+		m.nodeMap.set(announcedAddr, localAddr)
+	}
+
+	if proxy.cache != nil {
+		go proxy.trackInvalidations()
+	}
+
+	switch {
+	case proxy.readReplicas != nil:
+		m.splitPrimary = proxy
+	case m.splitPrimary != nil && endpoint.Type == "read-replica":
+		m.splitPrimary.readReplicas.add(proxy)
+		logger.Info(fmt.Sprintf("Reads on %s are sent to %s", m.splitPrimary.localAddr, remoteAddr))
+	}
 
 	m.proxies = append(m.proxies, proxy)
 	return nil
 }
 
-// Shutdown shuts down all proxies
-func (m *Manager) Shutdown() {
+// SetInheritedListeners makes proxies accept on sockets handed over by the
+// previous process instead of binding their local address
+func (m *Manager) SetInheritedListeners(listeners map[string]net.Listener) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inherited = listeners
+}
+
+// CloseUnusedListeners closes inherited sockets no proxy took over, for local
+// addresses that are no longer served (e.g. fewer cluster nodes)
+func (m *Manager) CloseUnusedListeners() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for addr, ln := range m.inherited {
+		logger.Info(fmt.Sprintf("Closing inherited listener %s, no longer proxied", addr))
+		ln.Close()
+	}
+	m.inherited = nil
+}
+
+// Listeners returns the sockets of all proxies by local address, for handing
+// over to a new process
+func (m *Manager) Listeners() map[string]net.Listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	listeners := make(map[string]net.Listener, len(m.proxies))
+	for _, p := range m.proxies {
+		if p.listener != nil {
+			listeners[p.localAddr] = p.listener
+		}
+	}
+	return listeners
+}
+
+// Prewarm opens n authenticated upstream connections per proxy, in parallel,
+// so the first clients don't pay for the handshake: pooled connections (up to
+// the pool size) or shared connections (up to -mux-connections). Returns the
+// errors of proxies that could not open all of them.
+func (m *Manager) Prewarm(ctx context.Context, n int) error {
+	m.mu.Lock()
+	proxies := append([]*Proxy(nil), m.proxies...)
+	m.mu.Unlock()
+
+	errs := make([]error, len(proxies))
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if p.mux != nil {
+				err = p.mux.warm(ctx, n)
+			} else {
+				err = p.pool.fillTo(n)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", p.remoteAddr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// ProxyCount returns the number of running proxies
+func (m *Manager) ProxyCount() int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return len(m.proxies)
+}
+
+// Connections returns the established client connections across all proxies
+func (m *Manager) Connections() []health.ConnectionInfo {
+	m.mu.Lock()
+	proxies := append([]*Proxy(nil), m.proxies...)
+	m.mu.Unlock()
 
-	for _, proxy := range m.proxies {
-		proxy.Shutdown()
+	var result []health.ConnectionInfo
+	for _, p := range proxies {
+		result = append(result, p.Connections()...)
+	}
+	return result
+}
+
+// ProxyStats returns a snapshot of traffic counters for every proxy
+func (m *Manager) ProxyStats() []health.ProxyStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make([]health.ProxyStats, 0, len(m.proxies))
+	for _, p := range m.proxies {
+		stats = append(stats, p.Stats())
+	}
+	return stats
+}
+
+// Shutdown stops accepting new connections on every proxy, then waits up to
+// timeout for established connections to finish
+func (m *Manager) Shutdown(timeout time.Duration) {
+	m.mu.Lock()
+	proxies := make([]*Proxy, len(m.proxies))
+	copy(proxies, m.proxies)
+	m.mu.Unlock()
+
+	// Stop every listener first so the grace period is shared rather than per proxy
+	for _, proxy := range proxies {
+		proxy.stopAccepting()
+	}
+	deadline := time.Now().Add(timeout)
+	for _, proxy := range proxies {
+		proxy.waitConnections(time.Until(deadline))
+		proxy.mux.close()
 	}
 }
 
@@ -167,16 +474,20 @@ func (m *Manager) DiscoverAndAddClusterNodes(ctx context.Context, primaryEndpoin
 	defer m.mu.Unlock()
 
 	// Connect to the primary endpoint to discover cluster topology
-	remoteAddr := net.JoinHostPort(primaryEndpoint.Host, fmt.Sprintf("%d", primaryEndpoint.Port))
+	remoteAddr := primaryEndpoint.Address()
 
 	var conn net.Conn
 	var err error
 
-	if m.tlsConfig != nil {
-		dialer := &net.Dialer{Timeout: 5 * time.Second}
-		conn, err = tls.DialWithDialer(dialer, "tcp", remoteAddr, m.tlsConfig)
-	} else {
-		conn, err = net.DialTimeout("tcp", remoteAddr, 5*time.Second)
+	conn, err = newDialer(m.config).DialContext(ctx, "tcp", remoteAddr)
+	if err == nil && m.tlsConfig != nil {
+		// Like tls.Dial, default ServerName to the endpoint host
+		tlsConfig := m.tlsConfig
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = primaryEndpoint.Host
+		}
+		conn, err = tlsHandshake(ctx, conn, tlsConfig, m.config)
 	}
 
 	if err != nil {
@@ -185,8 +496,8 @@ func (m *Manager) DiscoverAndAddClusterNodes(ctx context.Context, primaryEndpoin
 	defer conn.Close()
 
 	// Authenticate before running CLUSTER NODES
-	if m.authPassword != "" {
-		if err := m.authenticatePasswordOnConn(conn, m.authPassword); err != nil {
+	if password := m.authPassword.get(); password != "" {
+		if err := m.authenticatePasswordOnConn(conn, password); err != nil {
 			return 0, fmt.Errorf("authentication failed: %w", err)
 		}
 	} else if m.tokenSource != nil {
@@ -206,6 +517,7 @@ func (m *Manager) DiscoverAndAddClusterNodes(ctx context.Context, primaryEndpoin
 	}
 
 	logger.Info(fmt.Sprintf("Discovered %d cluster nodes", len(nodes)))
+	m.clusterNodes = nodes
 
 	// Filter out the current node and duplicates
 	newNodes := FilterUniqueNodes(nodes, remoteAddr)
@@ -218,15 +530,45 @@ func (m *Manager) DiscoverAndAddClusterNodes(ctx context.Context, primaryEndpoin
 	// Enable cluster mode
 	m.isClusterMode = true
 
-	// Prepare endpoint list before creating proxies
-	endpoints := make([]discovery.Endpoint, 0, len(newNodes))
-	for _, node := range newNodes {
+	// Nodes keep the local ports they had before a restart
+	state, err := loadPortState(m.config.PortStateFile)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to load port state, assigning new ports: %v", err))
+	}
+	m.clusterPorts, m.clusterStartPort = state, startPort
+
+	// Node listeners never take the ports of the endpoint listeners
+	m.endpointPorts = make(map[int]bool, len(m.proxies))
+	for _, p := range m.proxies {
+		if _, port, ok := splitAddr(p.localAddr); ok {
+			m.endpointPorts[port] = true
+		}
+	}
+
+	return m.addClusterNodes(ctx, newNodes), nil
+}
+
+// addClusterNodes creates proxies for cluster nodes on the ports the port
+// state holds for them and returns the number added. Called with m.mu held.
+func (m *Manager) addClusterNodes(ctx context.Context, nodes []ClusterNode) int {
+	// Prepare endpoint list before creating proxies, in address order so the
+	// ports of new nodes don't depend on the order CLUSTER NODES lists them in
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].dialAddr() < nodes[j].dialAddr() })
+	endpoints := make([]discovery.Endpoint, 0, len(nodes))
+	addrs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
 		endpoint := discovery.Endpoint{
-			Host: extractHost(node.Address),
+			Host: extractHost(node.dialAddr()),
 			Port: node.Port,
 			Type: fmt.Sprintf("cluster-%s", node.Role),
 		}
 		endpoints = append(endpoints, endpoint)
+		addrs = append(addrs, node.dialAddr())
+	}
+
+	ports := m.clusterPorts.assign(addrs, m.clusterStartPort, m.endpointPorts)
+	if err := m.clusterPorts.save(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save port state: %v", err))
 	}
 
 	// Release the lock before creating proxies (AddProxy acquires it)
@@ -236,25 +578,37 @@ func (m *Manager) DiscoverAndAddClusterNodes(ctx context.Context, primaryEndpoin
 	// Create proxies for each new node
 	addedCount := 0
 	for i, endpoint := range endpoints {
-		localPort := startPort + i
-		err := m.AddProxy(ctx, endpoint, localPort)
+		localPort, ok := ports[addrs[i]]
+		if !ok {
+			logger.Error(fmt.Sprintf("No local port left for cluster node %s: ports %d-%d are taken", endpoint.Address(), m.clusterStartPort, maxPort))
+			continue
+		}
+		announcedAddr := ""
+		if nodes[i].Hostname != "" {
+			announcedAddr = nodes[i].Address
+		}
+		err := m.addProxy(ctx, endpoint, localPort, announcedAddr)
 
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to create proxy for cluster node %s:%d: %v", endpoint.Host, endpoint.Port, err))
+			logger.Error(fmt.Sprintf("Failed to create proxy for cluster node %s: %v", endpoint.Address(), err))
 			continue
 		}
 
-		logger.Info(fmt.Sprintf("Added cluster node proxy: %s:%d -> %s:%d (%s)",
-			m.config.LocalAddr, localPort, endpoint.Host, endpoint.Port, endpoint.Type))
+		logger.Info(fmt.Sprintf("Added cluster node proxy: %s -> %s (%s)",
+			m.config.ListenAddr(localPort), endpoint.Address(), endpoint.Type))
 		addedCount++
 	}
 
-	return addedCount, nil
+	return addedCount
 }
 
-// buildAuthCommand constructs a RESP AUTH command for the given credential
-func buildAuthCommand(credential string) string {
-	return fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(credential), credential)
+// buildAuthCommand constructs a RESP AUTH command for the given credential,
+// with the ACL user unless user is empty
+func buildAuthCommand(user, credential string) string {
+	if user == "" {
+		return fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(credential), credential)
+	}
+	return fmt.Sprintf("*3\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(user), user, len(credential), credential)
 }
 
 // sendAuthCommand sends an AUTH command and validates the response
@@ -278,12 +632,12 @@ func sendAuthCommand(conn net.Conn, authCmd string) error {
 		return nil
 	}
 
-	return fmt.Errorf("authentication failed: %s", respStr)
+	return fmt.Errorf("%w: %s", errAuthRejected, logger.Redact(strings.TrimSpace(respStr)))
 }
 
 // authenticatePasswordOnConn performs password authentication on a connection
 func (m *Manager) authenticatePasswordOnConn(conn net.Conn, password string) error {
-	authCmd := buildAuthCommand(password)
+	authCmd := buildAuthCommand(authUser(m.config), password)
 	return sendAuthCommand(conn, authCmd)
 }
 
@@ -294,181 +648,357 @@ func (m *Manager) authenticateIAMOnConn(ctx context.Context, conn net.Conn) erro
 		return fmt.Errorf("failed to get IAM token: %w", err)
 	}
 
-	authCmd := buildAuthCommand(token)
+	authCmd := buildAuthCommand(authUser(m.config), token)
 	return sendAuthCommand(conn, authCmd)
 }
 
-// extractHost extracts the host part from "host:port" address
+// extractHost extracts the host part from "host:port" address, without IPv6 brackets
 func extractHost(address string) string {
-	if idx := strings.LastIndex(address, ":"); idx != -1 {
-		return address[:idx]
+	if host, _, ok := splitAddr(address); ok {
+		return host
 	}
 	return address
 }
 
 // Start starts the proxy server
 func (p *Proxy) Start() error {
-	listener, err := net.Listen("tcp", p.localAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", p.localAddr, err)
+	if p.listener == nil {
+		listener, err := net.Listen("tcp", p.localAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", p.localAddr, err)
+		}
+		p.listener = listener
 	}
-	p.listener = listener
 
 	go p.acceptConnections()
 	return nil
 }
 
-// Shutdown gracefully shuts down the proxy
-func (p *Proxy) Shutdown() {
+// Stats returns a snapshot of this proxy's traffic counters
+func (p *Proxy) Stats() health.ProxyStats {
+	stats := health.ProxyStats{
+		LocalAddr:         p.localAddr,
+		RemoteAddr:        p.remoteAddr,
+		EndpointType:      p.endpointType(),
+		ActiveConnections: p.stats.activeConnections.Load(),
+		TotalConnections:  p.stats.totalConnections.Load(),
+		BytesToUpstream:   p.stats.bytesToUpstream.Load(),
+		BytesToClient:     p.stats.bytesToClient.Load(),
+		Commands:          p.stats.commands.snapshot(),
+		LimitRejections:   p.stats.proxyLimitRejections.Load() + p.stats.globalLimitRejections.Load(),
+		Reconnects:        p.stats.reconnects.Load(),
+	}
+
+	if p.isClusterMode {
+		stats.Redirects = p.stats.redirects.snapshot()
+	}
+
+	stats.Upstream = p.upstreamLatency()
+	stats.Replication = p.replicationLag()
+
+	if p.breaker != nil {
+		stats.CircuitRejections = p.breaker.rejected.Load()
+		if until := p.breaker.openedUntil(); !until.IsZero() {
+			stats.CircuitOpen = true
+			stats.CircuitOpenUntil = &until
+		}
+	}
+
+	if p.shedder != nil {
+		stats.ShedConnections = p.shedder.shedConnections.Load()
+		if until := p.shedder.sheddingUntil(time.Now()); !until.IsZero() {
+			stats.Shedding = true
+			stats.SheddingUntil = &until
+		}
+	}
+
+	return stats
+}
+
+// Connections returns the established client connections of this proxy
+func (p *Proxy) Connections() []health.ConnectionInfo {
+	now := time.Now()
+	sessions := p.sessions.list()
+	result := make([]health.ConnectionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, health.ConnectionInfo{
+			ID:              s.id,
+			ClientAddr:      s.clientAddr,
+			LocalAddr:       p.localAddr,
+			RemoteAddr:      p.remoteAddr,
+			EndpointType:    p.endpointType(),
+			StartedAt:       s.startedAt,
+			Age:             now.Sub(s.startedAt).Round(time.Second).String(),
+			BytesToUpstream: s.bytesToUpstream.Load(),
+			BytesToClient:   s.bytesToClient.Load(),
+			TLS:             s.tlsVersion != "",
+			TLSVersion:      s.tlsVersion,
+			Protocol:        s.protocol.current(),
+		})
+	}
+	return result
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for
+// established connections to finish
+func (p *Proxy) Shutdown(timeout time.Duration) {
+	p.stopAccepting()
+	p.waitConnections(timeout)
+	p.mux.close()
+}
+
+// stopAccepting closes the listener; established connections keep running
+func (p *Proxy) stopAccepting() {
 	p.shutdownOnce.Do(func() {
 		close(p.shutdown)
 		if p.listener != nil {
 			p.listener.Close()
 		}
-		// Wait for all connections to finish (with timeout)
-		done := make(chan struct{})
-		go func() {
-			p.connections.Wait()
-			close(done)
-		}()
-		select {
-		case <-done:
-			logger.Debug(fmt.Sprintf("All connections closed for %s", p.localAddr))
-		case <-time.After(5 * time.Second):
-			logger.Error(fmt.Sprintf("Timeout waiting for connections to close for %s", p.localAddr))
-		}
+		p.pool.close()
 	})
 }
 
-// acceptConnections accepts and handles incoming connections
+// waitConnections waits up to timeout for established connections to finish
+func (p *Proxy) waitConnections(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		p.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Debug(fmt.Sprintf("All connections closed for %s", p.localAddr))
+	case <-time.After(max(timeout, 0)):
+		logger.Error(fmt.Sprintf("Timeout waiting for connections to close for %s (%d still active)",
+			p.localAddr, p.stats.activeConnections.Load()))
+	}
+}
+
+// acceptConnections accepts and handles incoming connections until the
+// listener is closed by stopAccepting
 func (p *Proxy) acceptConnections() {
+	var backoff time.Duration
 	for {
-		select {
-		case <-p.shutdown:
-			return
-		default:
-		}
-
-		// Set a deadline for Accept to allow checking shutdown channel
-		p.listener.(*net.TCPListener).SetDeadline(time.Now().Add(1 * time.Second))
-
 		clientConn, err := p.listener.Accept()
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
 			select {
 			case <-p.shutdown:
 				return
 			default:
-				logger.Error(fmt.Sprintf("Failed to accept connection: %v", err))
-				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Back off on errors such as running out of file descriptors instead of spinning
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			logger.Error(fmt.Sprintf("Failed to accept connection: %v (retrying in %s)", err, backoff))
+			select {
+			case <-p.shutdown:
+				return
+			case <-time.After(backoff):
+			}
+			continue
 		}
+		backoff = 0
 
+		p.stats.totalConnections.Add(1)
+		// Handlers only start while a slot is free, bounding goroutines and file descriptors
+		if !p.admit(clientConn) {
+			continue
+		}
 		p.connections.Add(1)
-		go p.handleConnection(clientConn)
+		go func() {
+			defer p.releaseSlots()
+			p.handleConnection(clientConn, nextConnID())
+		}()
 	}
 }
 
+// errClientWrite wraps errors writing replies to the client, telling them
+// apart from upstream errors
+var errClientWrite = errors.New("failed to write to client")
+
 // handleConnection handles a single client connection
-func (p *Proxy) handleConnection(clientConn net.Conn) {
+func (p *Proxy) handleConnection(clientConn net.Conn, connID uint64) {
 	defer p.connections.Done()
 	defer clientConn.Close()
 
-	logger.Debug(fmt.Sprintf("New connection from %s to %s", clientConn.RemoteAddr(), p.remoteAddr))
+	p.stats.activeConnections.Add(1)
+	defer p.stats.activeConnections.Add(-1)
 
-	// Connect to remote Valkey instance
-	var remoteConn net.Conn
-	var err error
+	start := time.Now()
+	sess := newSession(connID, p.config.InspectCommands)
+	sess.clientAddr = clientConn.RemoteAddr().String()
+	sess.log = sess.log.With("local_addr", p.localAddr, "remote_addr", p.remoteAddr, "client_addr", clientConn.RemoteAddr().String())
+	if p.config.AuditLog {
+		audit := sess.log.With(auditAttrs(clientConn)...)
+		sess.audit = &audit
+	}
+	if p.config.DumpProtocol {
+		sess.dump = newProtocolDumper(connID, p.config.DumpProtocolSample, p.config.DumpProtocolMaxValue)
+	}
+	if p.capture != nil && sampled(p.config.CaptureSample) {
+		sess.capture.Store(p.capture)
+		sess.log.Debug("Capturing connection traffic")
+	}
+	if p.chaos != nil || p.denied != nil || p.cache != nil || p.isClusterMode || p.interceptsClientAuth() {
+		sess.overrides = &replyOverrides{}
+		defer sess.overrides.close()
+	}
+	if p.cache != nil {
+		sess.cache = &cacheSession{}
+		sess.cache.db.Store(int64(p.defaultDB()))
+	}
+	log := sess.log
+	log.Debug("New connection")
+
+	// Fail fast while the upstream is signalling overload instead of piling on more load
+	if p.shedder.isShedding(time.Now()) {
+		p.shedder.shedConnections.Add(1)
+		log.Debug("Rejecting connection: shedding load while upstream is overloaded")
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		clientConn.Write([]byte(shedResponse))
+		return
+	}
 
-	if p.tlsConfig != nil {
-		// Establish TLS connection
-		logger.Debug(fmt.Sprintf("Establishing TLS connection to %s", p.remoteAddr))
-		dialer := &net.Dialer{
-			Timeout: 5 * time.Second,
-		}
-		remoteConn, err = tls.DialWithDialer(dialer, "tcp", p.remoteAddr, p.tlsConfig)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to establish TLS connection to remote: %v", err))
+	// Fail fast while the upstream keeps failing instead of making every client wait for the dial timeout
+	if !p.breaker.allow(time.Now()) {
+		if p.maintenance != nil {
+			p.serveMaintenance(clientConn, sess)
 			return
 		}
-		logger.Debug("TLS handshake completed successfully")
-	} else {
-		// Plain TCP connection
-		remoteConn, err = net.DialTimeout("tcp", p.remoteAddr, 5*time.Second)
+		log.Debug("Rejecting connection: circuit open after repeated upstream failures")
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		clientConn.Write([]byte(breakerResponse))
+		return
+	}
+
+	// Connection setup (dial, TLS, AUTH) is traced as one span per client connection
+	ctx, span := tracing.Start(context.Background(), "proxy.connect",
+		attribute.Int64("conn.id", int64(connID)),
+		attribute.String("proxy.local_addr", p.localAddr),
+		attribute.String("net.peer.addr", p.remoteAddr))
+
+	// Enable TCP keepalive (and TCP_USER_TIMEOUT if set) for client connection
+	tuneTCP(clientConn, p.config)
+
+	if p.mux != nil {
+		p.handleMultiplexedConnection(ctx, span, clientConn, sess)
+		log.Debug("Connection closed", "duration", time.Since(start).Round(time.Millisecond).String())
+		return
+	}
+
+	// Take a pre-authenticated connection from the pool, or connect to the remote Valkey instance
+	remoteConn := p.pool.get()
+	pooled := remoteConn != nil
+	span.SetAttributes(attribute.Bool("pool.hit", pooled))
+	if !pooled {
+		var err error
+		var attempts int
+		remoteConn, attempts, err = p.dialWithRetry(ctx, sess)
+		span.SetAttributes(attribute.Int("dial.attempts", attempts))
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to connect to remote: %v", err))
+			p.upstreamFailed()
+			log.Error(fmt.Sprintf("Upstream connection failed: %v", err))
+			tracing.End(span, err)
+			if p.maintenance != nil {
+				p.serveMaintenance(clientConn, sess)
+			} else {
+				p.rejectReconfiguring(clientConn, sess)
+			}
 			return
 		}
 	}
 	defer remoteConn.Close()
-
-	// Enable TCP keepalive for client connection
-	if tcpConn, ok := clientConn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
-		// Disable Nagle's algorithm for lower latency
-		tcpConn.SetNoDelay(true)
+	if tlsConn, ok := remoteConn.(*tls.Conn); ok {
+		sess.tlsVersion = tls.VersionName(tlsConn.ConnectionState().Version)
+	}
+	p.sessions.add(sess)
+	defer p.sessions.remove(connID)
+	p.sessions.setUpstream(sess, remoteConn.LocalAddr().String())
+	log.Debug(fmt.Sprintf("Upstream connection established: %s -> %s", remoteConn.LocalAddr(), remoteConn.RemoteAddr()))
+
+	// Pooled connections were named before their client was known
+	if pooled {
+		p.nameUpstream(remoteConn, sess)
 	}
 
-	// Enable TCP keepalive for remote connection (if it's a TCP connection under TLS)
-	if tlsConn, ok := remoteConn.(*tls.Conn); ok {
-		if tcpConn, ok := tlsConn.NetConn().(*net.TCPConn); ok {
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(30 * time.Second)
-			tcpConn.SetNoDelay(true)
-		}
-	} else if tcpConn, ok := remoteConn.(*net.TCPConn); ok {
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
-		tcpConn.SetNoDelay(true)
-	}
-
-	// Perform authentication based on configuration
-	// Password auth takes precedence over IAM auth
-	if p.authPassword != "" {
-		// Password authentication (for Redis instances)
-		if err := p.authenticatePassword(remoteConn, p.authPassword); err != nil {
-			logger.Error(fmt.Sprintf("Password authentication failed: %v", err))
+	// Perform authentication based on configuration (pooled connections are already authenticated)
+	if !pooled {
+		if err := p.authenticateUpstream(ctx, remoteConn, sess); err != nil {
+			p.recordAuthFailure(err)
+			p.upstreamFailed()
+			log.Error(fmt.Sprintf("Upstream authentication failed: %v", err))
+			tracing.End(span, err)
+			p.rejectReconfiguring(clientConn, sess)
 			return
 		}
-		logger.Debug("Password authentication successful")
-	} else if p.tokenSource != nil {
-		// IAM authentication (for Valkey with IAM_AUTH authorization mode)
-		if err := p.authenticateIAM(remoteConn); err != nil {
-			logger.Error(fmt.Sprintf("IAM authentication failed: %v", err))
-			return
-		}
-		logger.Debug("IAM authentication successful")
 	}
-
-	// Choose connection handling strategy based on cluster mode
-	if p.isClusterMode {
-		// Cluster mode: intercept server responses and rewrite MOVED/ASK redirects
-		p.handleClusterConnection(clientConn, remoteConn)
+	p.upstreamSucceeded()
+	tracing.End(span, nil)
+
+	// Choose connection handling strategy based on whether server responses need inspection
+	var replicaConn net.Conn
+	replica := p.readReplicas.pick()
+	if replica != nil {
+		replicaConn = p.connectReplica(ctx, replica, sess)
+	}
+	if r := p.router.Load(); r != nil {
+		// Each request goes to the cluster node serving its key
+		p.relayRouted(clientConn, remoteConn, r, sess)
+	} else if replicaConn != nil {
+		// Reads go to the read replica and everything else to the primary
+		defer replicaConn.Close()
+		p.relaySplit(clientConn, remoteConn, replicaConn, replica, sess)
+	} else if p.config.TransparentReconnect {
+		// Parse both directions to know when the client is idle and its upstream replaceable
+		sess.protocol = newProtocolState()
+		p.handleReconnectingConnection(clientConn, remoteConn, sess)
+	} else if p.inspectResponses() || sess.tapped() {
+		// Parse server responses to rewrite MOVED/ASK redirects, watch for overload
+		// errors, measure request latency and answer denied commands
+		sess.protocol = newProtocolState()
+		p.handleClusterConnection(clientConn, remoteConn, sess)
 	} else {
-		// Non-cluster mode: simple bidirectional copy (current behavior)
-		p.handleSimpleConnection(clientConn, remoteConn)
+		// Simple bidirectional copy
+		p.handleSimpleConnection(clientConn, remoteConn, sess)
 	}
 
-	logger.Debug(fmt.Sprintf("Connection closed: %s", clientConn.RemoteAddr()))
+	log.Debug("Connection closed", "duration", time.Since(start).Round(time.Millisecond).String())
 }
 
 // handleSimpleConnection handles bidirectional traffic without protocol inspection
 // This is used for non-cluster instances.
-func (p *Proxy) handleSimpleConnection(clientConn, remoteConn net.Conn) {
+func (p *Proxy) handleSimpleConnection(clientConn, remoteConn net.Conn, sess *session) {
+	log := sess.log
 	errChan := make(chan error, 2)
+	clientTCP, remoteTCP, splice := p.spliceConns(clientConn, remoteConn)
 
 	// Client -> Server
 	go func() {
-		_, err := io.Copy(remoteConn, clientConn)
+		var err error
+		if splice && !p.inspectRequests() {
+			_, err = spliceCopy(remoteTCP, clientTCP, &p.stats.bytesToUpstream, &sess.bytesToUpstream)
+		} else {
+			err = p.relayClientToServer(clientConn, remoteConn, sess)
+		}
+		if err != nil {
+			log.Debug(fmt.Sprintf("Client->Server copy error: %v", err))
+		}
 		errChan <- err
 	}()
 
 	// Server -> Client
 	go func() {
-		_, err := io.Copy(clientConn, remoteConn)
+		var err error
+		if splice {
+			_, err = spliceCopy(clientTCP, remoteTCP, &p.stats.bytesToClient, &sess.bytesToClient)
+		} else {
+			_, err = p.buffers().copy(&countingWriter{w: clientConn, counter: &p.stats.bytesToClient, connCounter: &sess.bytesToClient}, remoteConn)
+		}
+		if err != nil {
+			log.Debug(fmt.Sprintf("Server->Client copy error: %v", err))
+		}
 		errChan <- err
 	}()
 
@@ -476,25 +1006,38 @@ func (p *Proxy) handleSimpleConnection(clientConn, remoteConn net.Conn) {
 	<-errChan
 }
 
+// spliceConns returns both connections as TCP connections when raw bytes can
+// be relayed between them with splice(2): plaintext TCP on both sides (the
+// upstream isn't TLS) and -zero-copy enabled
+func (p *Proxy) spliceConns(clientConn, remoteConn net.Conn) (client, remote *net.TCPConn, ok bool) {
+	if !spliceSupported || !p.config.ZeroCopy {
+		return nil, nil, false
+	}
+	client, clientOK := clientConn.(*net.TCPConn)
+	remote, remoteOK := remoteConn.(*net.TCPConn)
+	return client, remote, clientOK && remoteOK
+}
+
 // handleClusterConnection handles bidirectional traffic with RESP protocol inspection
 // Intercepts and rewrites MOVED/ASK responses to use local proxy addresses
-func (p *Proxy) handleClusterConnection(clientConn, remoteConn net.Conn) {
+func (p *Proxy) handleClusterConnection(clientConn, remoteConn net.Conn, sess *session) {
+	log := sess.log
 	errChan := make(chan error, 2)
 
-	// Client -> Server: simple copy (no interception needed)
+	// Client -> Server: no rewriting needed
 	go func() {
-		_, err := io.Copy(remoteConn, clientConn)
+		err := p.relayClientToServer(clientConn, remoteConn, sess)
 		if err != nil {
-			logger.Debug(fmt.Sprintf("Client->Server copy error: %v", err))
+			log.Debug(fmt.Sprintf("Client->Server copy error: %v", err))
 		}
 		errChan <- err
 	}()
 
 	// Server -> Client: parse RESP and rewrite redirects
 	go func() {
-		err := p.proxyServerResponses(remoteConn, clientConn)
+		err := p.proxyServerResponses(remoteConn, clientConn, sess)
 		if err != nil && err != io.EOF {
-			logger.Debug(fmt.Sprintf("Server->Client proxy error: %v", err))
+			log.Debug(fmt.Sprintf("Server->Client proxy error: %v", err))
 		}
 		errChan <- err
 	}()
@@ -503,49 +1046,324 @@ func (p *Proxy) handleClusterConnection(clientConn, remoteConn net.Conn) {
 	<-errChan
 }
 
+// inspectResponses reports whether server responses must be parsed rather than copied as raw bytes
+func (p *Proxy) inspectResponses() bool {
+	return p.isClusterMode || p.shedder != nil || p.config.InspectCommands || p.chaos != nil || p.denied != nil || p.cache != nil || p.interceptsClientAuth()
+}
+
+// inspectRequests reports whether client requests must be parsed into commands
+func (p *Proxy) inspectRequests() bool {
+	return p.config.InspectCommands || p.config.AuditLog || p.chaos != nil || p.denied != nil || p.cache != nil || p.interceptsClientAuth()
+}
+
+// relayClientToServer copies client requests to the server, parsing them
+// into commands when command inspection, auditing, protocol dumps or capture
+// are enabled, or replies are parsed and must follow the negotiated protocol
+func (p *Proxy) relayClientToServer(clientConn, serverConn net.Conn, sess *session) error {
+	if !p.inspectRequests() && !sess.tapped() && sess.protocol == nil {
+		_, err := p.buffers().copy(&countingWriter{w: serverConn, counter: &p.stats.bytesToUpstream, connCounter: &sess.bytesToUpstream}, clientConn)
+		return err
+	}
+	return p.proxyClientRequests(clientConn, serverConn, sess)
+}
+
+// proxyClientRequests reads RESP requests from the client, counts them by command and forwards them
+func (p *Proxy) proxyClientRequests(clientConn, serverConn net.Conn, sess *session) error {
+	return p.readRequests(clientConn, sess, func(value *RESPValue) error {
+		return p.writeRequest(serverConn, value, sess)
+	})
+}
+
+// readRequests reads RESP requests from the client, counting, auditing,
+// dumping and capturing each one before handing it to forward
+func (p *Proxy) readRequests(clientConn net.Conn, sess *session, forward func(value *RESPValue) error) error {
+	respReader := p.respReader(clientConn)
+	defer p.buffers().releaseReader(respReader)
+	respReader.SetInline(true)
+
+	for {
+		value, err := respReader.ReadValue()
+		if err != nil {
+			if err == io.EOF {
+				return err
+			}
+			return fmt.Errorf("failed to read RESP request: %w", err)
+		}
+
+		if name := value.CommandName(); name != "" {
+			p.stats.commands.inc(name)
+			sess.auditCommand(value, name)
+		}
+		sess.dump.dump(dumpRequest, value)
+		sess.captureFrame(capture.DirectionRequest, value)
+
+		if err := forward(value); err != nil {
+			return err
+		}
+	}
+}
+
+// writeRequest sends one client request to the server. A request the proxy
+// answers itself (denied, picked for a chaos MOVED, cached, or an
+// intercepted AUTH) is sent as a PING whose reply is replaced.
+func (p *Proxy) writeRequest(serverConn net.Conn, value *RESPValue, sess *session) error {
+	name := value.CommandName()
+	reply := p.denied.check(value, name)
+	if name == "AUTH" && reply == nil {
+		reply, value = p.clientAuth(value, sess)
+	}
+	if p.chaos != nil && reply == nil {
+		var err error
+		if reply, err = p.chaos.request(value, name, p.localAddr); err != nil {
+			return err
+		}
+	}
+	var watch func(*RESPValue)
+	if p.cache != nil && reply == nil {
+		reply, watch = p.cache.request(value, name, sess)
+	}
+	if reply == nil && p.isClusterMode {
+		p.scripts.wait(value, name)
+		if clusterWatch := p.clusterReplyWatcher(value, name); clusterWatch != nil {
+			watch = clusterWatch
+		}
+	}
+	if !expectsReply(name) && reply == nil {
+		sess.pubsub.request(value, name)
+	} else {
+		value = sess.overrides.request(value, name, reply, watch)
+		if sess.protocol != nil {
+			value = p.interceptHello(value, sess)
+		}
+		// Record the send time before writing so a fast reply can't be paired before it's queued
+		if sess.pending != nil {
+			sess.pending.push(time.Now())
+		}
+	}
+
+	data := value.Serialize()
+	n, err := serverConn.Write(data)
+	p.stats.bytesToUpstream.Add(uint64(n))
+	sess.bytesToUpstream.Add(uint64(n))
+	if err != nil {
+		return fmt.Errorf("failed to write to server: %w", err)
+	}
+	return nil
+}
+
 // proxyServerResponses reads RESP responses from server and rewrites MOVED/ASK redirects
-func (p *Proxy) proxyServerResponses(serverConn, clientConn net.Conn) error {
-	respReader := NewRESPReader(serverConn)
+func (p *Proxy) proxyServerResponses(serverConn, clientConn net.Conn, sess *session) error {
+	respReader := p.respReader(serverConn)
+	defer p.buffers().releaseReader(respReader)
+	client := &countingWriter{w: clientConn, counter: &p.stats.bytesToClient, connCounter: &sess.bytesToClient}
+	out := p.buffers().writer(client)
+	defer p.buffers().releaseWriter(out)
 
 	for {
+		// Replies are written through a bounded buffer; flush it before blocking on
+		// the next read so the client never waits for a reply sitting in the buffer
+		if !respReader.buffered() {
+			if err := out.Flush(); err != nil {
+				return fmt.Errorf("%w: %w", errClientWrite, err)
+			}
+		}
+
+		// Only error replies are rewritten or inspected. Others are streamed
+		// through as they are read, so a huge reply or a slow client never makes
+		// the proxy hold a whole value in memory. A reply that may switch the
+		// protocol is parsed to see whether it succeeded, RESP3 attributes are
+		// parsed as they may precede an error, on subscribed connections
+		// frames are parsed to tell pub/sub messages from replies, and a reply
+		// the proxy replaces is parsed to be dropped.
+		if !sess.tapped() && p.chaos == nil {
+			typ, err := respReader.peekType()
+			if err != nil {
+				if err == io.EOF {
+					return err
+				}
+				return fmt.Errorf("failed to read RESP value: %w", err)
+			}
+			respReader.SetRESP3(sess.protocol.resp3())
+			// Checked once the reply arrived, as its request may have just been sent
+			if typ != Error && typ != Attribute && !sess.protocol.switching() && !sess.pubsub.subscribed() && !sess.overrides.pending() {
+				if err := respReader.copyValue(out); err != nil {
+					if isProtocolError(err) {
+						// Everything consumed has already been written to out
+						return p.passthroughResponses(respReader, out, client, nil, err, sess)
+					}
+					return fmt.Errorf("failed to relay RESP value: %w", err)
+				}
+				if typ != Push {
+					p.replied(sess)
+					sess.protocol.reply(typ)
+					sess.overrides.reply(nil) // None pending, so nothing to replace
+				}
+				continue
+			}
+		}
+
 		// Read a RESP value from the server
-		value, err := respReader.ReadValue()
+		respReader.SetRESP3(sess.protocol.resp3())
+		value, raw, err := respReader.readRaw()
 		if err != nil {
 			if err == io.EOF {
 				return err
 			}
+			if isProtocolError(err) {
+				return p.passthroughResponses(respReader, out, client, raw, err, sess)
+			}
 			// If not EOF, it might be a parse error or connection issue
 			return fmt.Errorf("failed to read RESP value: %w", err)
 		}
 
-		// Check if this is a redirect error and rewrite if needed
-		if value.IsRedirectError() {
-			if value.RewriteRedirectError(p.nodeMap) {
-				logger.Debug(fmt.Sprintf("Rewrote redirect: %s", value.Str))
-			} else {
-				logger.Debug(fmt.Sprintf("Redirect not rewritten (node not in map): %s", value.Str))
+		// Push frames aren't replies: they don't complete a request
+		push := isPush(value, sess)
+		sess.pubsub.reply(value)
+		if !push {
+			p.replied(sess)
+			sess.protocol.reply(value.Type)
+		}
+		p.inspectReply(value, sess)
+		if !push {
+			if override := sess.overrides.reply(value); override != nil {
+				value = override
 			}
 		}
 
+		sess.dump.dump(dumpResponse, value)
+		sess.captureFrame(capture.DirectionResponse, value)
+
 		// Serialize and send to client
-		data := value.Serialize()
-		if _, err := clientConn.Write(data); err != nil {
-			return fmt.Errorf("failed to write to client: %w", err)
+		if p.chaos != nil {
+			err = p.chaos.write(out, value.Serialize())
+		} else {
+			_, err = out.Write(value.Serialize())
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errClientWrite, err)
 		}
 	}
 }
 
-// authenticateIAM performs IAM authentication with Valkey
-func (p *Proxy) authenticateIAM(conn net.Conn) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// passthroughResponses relays the rest of the connection's replies as raw
+// bytes after a frame the parser doesn't understand (a protocol feature it
+// doesn't know, a push frame), rather than disconnecting the client. pending
+// holds the bytes of the frame consumed but not yet written to out. A
+// connection whose replies the proxy may replace or rewrite is closed
+// instead: relayed raw, a request answered by the proxy would get the
+// server's reply to the PING sent in its place.
+func (p *Proxy) passthroughResponses(respReader *RESPReader, out *bufio.Writer, client io.Writer, pending []byte, cause error, sess *session) error {
+	if sess.overrides != nil {
+		return fmt.Errorf("unparseable reply from upstream on a connection with replies answered by the proxy: %w", cause)
+	}
+	p.stats.parseFallbacks.Add(1)
+	sess.log.Info(fmt.Sprintf("Unparseable reply from upstream (%v), relaying the rest of the connection without inspection", cause))
+
+	if _, err := out.Write(pending); err != nil {
+		return fmt.Errorf("%w: %w", errClientWrite, err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("%w: %w", errClientWrite, err)
+	}
+	// respReader's buffer holds input already read from the server
+	if _, err := p.buffers().copy(client, respReader.reader); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// replied accounts for one reply: it is paired with the oldest in-flight
+// request to measure round-trip latency
+func (p *Proxy) replied(sess *session) {
+	if sess.inflight != nil {
+		sess.inflight.Add(-1)
+	}
+	if sess.pending != nil {
+		if sent, ok := sess.pending.pop(); ok {
+			p.latency.Observe(time.Since(sent).Seconds())
+		}
+	}
+}
+
+// inspectReply records overload errors for connection shedding and rewrites
+// cluster redirects in a server reply before it is sent to the client
+func (p *Proxy) inspectReply(value *RESPValue, sess *session) {
+	log := sess.log
+
+	// Track overload errors for connection shedding
+	if p.shedder != nil && isOverloadError(value) {
+		if p.shedder.recordOverload(time.Now()) {
+			log.Error(fmt.Sprintf("Upstream %s overloaded (%s), shedding new connections on %s for %s",
+				p.remoteAddr, value.Str, p.localAddr, p.shedder.cooldown))
+		}
+	}
+
+	// Check if this is a redirect error and rewrite if needed
+	if p.isClusterMode && value.IsRedirectError() {
+		moved := strings.HasPrefix(value.Str, "MOVED ")
+		original := value.Str
+		rewritten := value.RewriteRedirectError(p.nodeMap.load())
+		p.stats.redirects.record(moved, rewritten)
+		if rewritten {
+			log.Debug(fmt.Sprintf("Rewrote redirect: %s -> %s", original, value.Str))
+		} else {
+			log.Debug(fmt.Sprintf("Redirect not rewritten (node not in map): %s", value.Str))
+		}
+	}
+}
+
+// clusterReplyWatcher returns the function handling the reply to a cluster
+// request before it is sent to the client: node addresses are rewritten, and
+// loaded scripts are propagated to the other nodes. It is nil if there is none.
+func (p *Proxy) clusterReplyWatcher(value *RESPValue, name string) func(*RESPValue) {
+	if !p.isClusterMode {
+		return nil
+	}
+	if rewrite := p.addrRewriter(value, name); rewrite != nil {
+		return rewrite
+	}
+	return p.scripts.watcher(p, value, name)
+}
+
+// addrRewriter returns the function rewriting node addresses in the reply to
+// a cluster request, like redirects are rewritten, or nil if it has none
+func (p *Proxy) addrRewriter(value *RESPValue, name string) func(*RESPValue) {
+	switch {
+	case name == "INFO":
+		return p.rewriteInfoReply
+	case name == "CLIENT" && len(value.Array) > 1 &&
+		(strings.EqualFold(value.Array[1].Str, "LIST") || strings.EqualFold(value.Array[1].Str, "INFO")):
+		return p.rewriteClientListReply
+	case name == "CLUSTER" && len(value.Array) > 1:
+		return p.clusterTopologyRewriter(value.Array[1].Str)
+	}
+	return nil
+}
+
+// authenticateIAM performs IAM authentication with Valkey, with the token
+// prefetched while the connection was dialed if there is one
+func (p *Proxy) authenticateIAM(ctx context.Context, conn net.Conn, sess *session) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	// Get IAM token
-	token, err := p.tokenSource.GetToken(ctx)
+	var token string
+	var err error
+	if prefetch := sess.token; prefetch != nil {
+		sess.token = nil
+		select {
+		case result := <-prefetch:
+			token, err = result.token, result.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	} else {
+		token, err = p.tokenSource.GetToken(ctx)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get IAM token: %w", err)
 	}
 
-	authCmd := buildAuthCommand(token)
+	authCmd := buildAuthCommand(authUser(p.config), token)
 	return sendAuthCommand(conn, authCmd)
 }
@@ -1,10 +1,21 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
 	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestNewManager(t *testing.T) {
@@ -91,3 +102,354 @@ func TestEndpointTypes(t *testing.T) {
 		t.Errorf("Expected port 6379, got %d", endpoint.Port)
 	}
 }
+
+func TestNextConnIDUnique(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		id := nextConnID()
+		if seen[id] {
+			t.Fatalf("Duplicate connection ID %d", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestProxyClientRequestsCountsCommands(t *testing.T) {
+	p := &Proxy{config: &config.Config{InspectCommands: true}}
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.relayClientToServer(proxyClient, proxyServer, newSession(1, false))
+		proxyServer.Close()
+	}()
+
+	requests := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\nb\r\n"
+	go func() {
+		clientSide.Write([]byte(requests))
+		clientSide.Close()
+	}()
+
+	received, _ := io.ReadAll(serverSide)
+	<-done
+
+	if string(received) != requests {
+		t.Errorf("Expected requests to be forwarded unchanged, got %q", received)
+	}
+
+	counts := p.stats.commands.snapshot()
+	if counts["GET"] != 1 || counts["SET"] != 1 {
+		t.Errorf("Unexpected command counts: %v", counts)
+	}
+	if p.stats.bytesToUpstream.Load() != uint64(len(requests)) {
+		t.Errorf("Expected %d bytes upstream, got %d", len(requests), p.stats.bytesToUpstream.Load())
+	}
+}
+
+func TestProxyClientRequestsConvertsInlineCommands(t *testing.T) {
+	p := &Proxy{config: &config.Config{InspectCommands: true}}
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.relayClientToServer(proxyClient, proxyServer, newSession(1, false))
+		proxyServer.Close()
+	}()
+	go func() {
+		clientSide.Write([]byte("PING\r\nset a \"b c\"\r\n"))
+		clientSide.Close()
+	}()
+
+	received, _ := io.ReadAll(serverSide)
+	<-done
+
+	// The server gets the commands as arrays, as if the client had sent them so
+	want := "*1\r\n$4\r\nPING\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$3\r\nb c\r\n"
+	if string(received) != want {
+		t.Errorf("Expected %q, got %q", want, received)
+	}
+	if counts := p.stats.commands.snapshot(); counts["PING"] != 1 || counts["SET"] != 1 {
+		t.Errorf("Unexpected command counts: %v", counts)
+	}
+}
+
+func TestProxyServerResponsesObservesLatency(t *testing.T) {
+	p := &Proxy{
+		config:  &config.Config{InspectCommands: true},
+		latency: newLatencyHistogram(),
+	}
+	sess := newSession(1, true)
+	sess.pending.push(time.Now())
+
+	serverSide, proxyServer := net.Pipe()
+	proxyClient, clientSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.proxyServerResponses(proxyServer, proxyClient, sess)
+		proxyClient.Close()
+	}()
+
+	go func() {
+		// Second reply has no matching request and must not be observed
+		serverSide.Write([]byte("+OK\r\n+OK\r\n"))
+		serverSide.Close()
+	}()
+
+	received, _ := io.ReadAll(clientSide)
+	<-done
+
+	if string(received) != "+OK\r\n+OK\r\n" {
+		t.Errorf("Expected replies to be forwarded unchanged, got %q", received)
+	}
+
+	if count := testutil.CollectAndCount(p.latency); count != 1 {
+		t.Fatalf("Expected 1 histogram, got %d", count)
+	}
+	var metric dto.Metric
+	p.latency.Write(&metric)
+	if metric.GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("Expected 1 latency sample, got %d", metric.GetHistogram().GetSampleCount())
+	}
+}
+
+func TestProxyServerResponsesCountsRedirects(t *testing.T) {
+	p := &Proxy{
+		config:        &config.Config{},
+		isClusterMode: true,
+		nodeMap:       newAddrMap(map[string]string{"10.0.0.2:6379": "127.0.0.1:6380"}),
+	}
+
+	serverSide, proxyServer := net.Pipe()
+	proxyClient, clientSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.proxyServerResponses(proxyServer, proxyClient, newSession(1, false))
+		proxyClient.Close()
+	}()
+
+	go func() {
+		serverSide.Write([]byte("-MOVED 1 10.0.0.2:6379\r\n-ASK 2 10.0.0.9:6379\r\n-MOVED 3 10.0.0.9:6379\r\n"))
+		serverSide.Close()
+	}()
+
+	received, _ := io.ReadAll(clientSide)
+	<-done
+
+	if !strings.HasPrefix(string(received), "-MOVED 1 127.0.0.1:6380\r\n") {
+		t.Errorf("Expected first redirect to be rewritten, got %q", received)
+	}
+
+	got := p.stats.redirects.snapshot()
+	want := health.RedirectStats{Moved: 2, Ask: 1, Rewritten: 1, UnknownNode: 2}
+	if *got != want {
+		t.Errorf("Expected %+v, got %+v", want, *got)
+	}
+}
+
+func TestProxyServerResponsesFallsBackToPassthrough(t *testing.T) {
+	p := &Proxy{
+		config:        &config.Config{},
+		isClusterMode: true,
+		nodeMap:       newAddrMap(map[string]string{"10.0.0.2:6379": "127.0.0.1:6380"}),
+	}
+
+	serverSide, proxyServer := net.Pipe()
+	proxyClient, clientSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.proxyServerResponses(proxyServer, proxyClient, newSession(1, false))
+		proxyClient.Close()
+	}()
+
+	// A push frame the parser doesn't know, then replies that must still arrive
+	unparseable := ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n+OK\r\n-MOVED 1 10.0.0.2:6379\r\n"
+	go func() {
+		serverSide.Write([]byte("-MOVED 1 10.0.0.2:6379\r\n" + unparseable))
+		serverSide.Close()
+	}()
+
+	received, _ := io.ReadAll(clientSide)
+	if err := <-done; err != io.EOF {
+		t.Errorf("Expected the connection to end cleanly, got %v", err)
+	}
+
+	// The redirect before the fallback is rewritten, everything after is relayed untouched
+	if want := "-MOVED 1 127.0.0.1:6380\r\n" + unparseable; string(received) != want {
+		t.Errorf("Expected %q, got %q", want, received)
+	}
+	if n := p.stats.parseFallbacks.Load(); n != 1 {
+		t.Errorf("Expected 1 fallback, got %d", n)
+	}
+}
+
+func TestProxyServerResponsesClosesWithOverridesOnParseFailure(t *testing.T) {
+	p := &Proxy{config: &config.Config{}}
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	// A denied request was forwarded as a PING whose reply must be replaced
+	sess.overrides.request(testRequest("FLUSHALL"), "FLUSHALL", &RESPValue{Type: Error, Str: "ERR denied"}, nil)
+
+	serverSide, proxyServer := net.Pipe()
+	proxyClient, clientSide := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.proxyServerResponses(proxyServer, proxyClient, sess)
+		proxyClient.Close()
+	}()
+	go func() {
+		serverSide.Write([]byte(">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n+PONG\r\n"))
+		serverSide.Close()
+	}()
+
+	received, _ := io.ReadAll(clientSide)
+	if err := <-done; err == nil || err == io.EOF {
+		t.Errorf("Expected the connection to be closed with an error, got %v", err)
+	}
+	if strings.Contains(string(received), "PONG") {
+		t.Errorf("Expected the PING reply not to reach the client, got %q", received)
+	}
+	if n := p.stats.parseFallbacks.Load(); n != 0 {
+		t.Errorf("Expected no fallback, got %d", n)
+	}
+}
+
+func TestProxyShutdownWaitsForConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p := &Proxy{localAddr: ln.Addr().String(), listener: ln, shutdown: make(chan struct{})}
+
+	// Simulate an established connection that finishes shortly after shutdown begins
+	p.connections.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.connections.Done()
+	}()
+
+	start := time.Now()
+	p.Shutdown(5 * time.Second)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected Shutdown to return once the connection finished, took %v", elapsed)
+	}
+	if _, err := net.Dial("tcp", p.localAddr); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+
+	// A connection outliving the grace period must not block shutdown
+	p2 := &Proxy{localAddr: "127.0.0.1:0", shutdown: make(chan struct{})}
+	p2.connections.Add(1)
+	start = time.Now()
+	p2.Shutdown(20 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Shutdown to give up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestProxyServerResponsesStreamsLargeReplies(t *testing.T) {
+	p := &Proxy{config: &config.Config{}, bufferPool: newBufferPool(MinBufferSize)}
+
+	serverSide, proxyServer := net.Pipe()
+	proxyClient, clientSide := net.Pipe()
+
+	large := RESPValue{Type: Array, Array: []RESPValue{
+		{Type: BulkString, Str: strings.Repeat("x", 8<<20)},
+		{Type: Integer, Int: 42},
+		{Type: BulkString, Null: true},
+	}}
+	replies := append(large.Serialize(), "+OK\r\n"...)
+	want := sha256.Sum256(replies)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.proxyServerResponses(proxyServer, proxyClient, newSession(1, false))
+		proxyClient.Close()
+	}()
+	go func() {
+		serverSide.Write(replies)
+		serverSide.Close()
+	}()
+
+	hash := sha256.New()
+	io.Copy(hash, clientSide)
+	<-done
+	runtime.ReadMemStats(&after)
+
+	if !bytes.Equal(hash.Sum(nil), want[:]) {
+		t.Fatal("Expected replies to be forwarded unchanged")
+	}
+	// The reply is streamed rather than parsed, so the proxy never holds the 8MB value in memory
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2<<20 {
+		t.Errorf("Expected bounded allocations, got %d bytes", allocated)
+	}
+}
+
+func TestAcceptLoopStopsImmediately(t *testing.T) {
+	p := &Proxy{localAddr: "127.0.0.1:0", config: &config.Config{}, shutdown: make(chan struct{})}
+	ln, err := net.Listen("tcp", p.localAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	p.listener = ln
+
+	done := make(chan struct{})
+	go func() {
+		p.acceptConnections()
+		close(done)
+	}()
+
+	// Accept blocks without polling, so closing the listener must end the loop at once
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	p.stopAccepting()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Accept loop did not stop after the listener was closed")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected the accept loop to stop immediately, took %v", elapsed)
+	}
+}
+
+func TestManagerInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	m := NewManager(&config.Config{LocalAddr: "127.0.0.1"})
+	m.SetInheritedListeners(map[string]net.Listener{
+		ln.Addr().String():     ln,
+		unused.Addr().String(): unused,
+	})
+	// Binding the address again would fail: the proxy must accept on the inherited socket
+	if err := m.AddProxy(context.Background(), discovery.Endpoint{Host: "127.0.0.1", Port: 1}, port); err != nil {
+		t.Fatalf("AddProxy failed: %v", err)
+	}
+	defer m.Shutdown(time.Second)
+
+	if got := m.Listeners(); len(got) != 1 || got[ln.Addr().String()] != ln {
+		t.Errorf("Expected the inherited listener to be handed over again, got %v", got)
+	}
+	m.CloseUnusedListeners()
+	if _, err := unused.Accept(); err == nil {
+		t.Error("Expected the unused listener to be closed")
+	}
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// pubsubCommands are answered by push frames (one per channel, on RESP2 too)
+// rather than a single reply, so they are never paired with a reply
+var pubsubCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+}
+
+// pushKinds are the first elements of the RESP2 arrays a subscribed
+// connection receives outside of request/reply order
+var pushKinds = map[string]bool{
+	"message": true, "pmessage": true, "smessage": true,
+	"subscribe": true, "psubscribe": true, "ssubscribe": true,
+	"unsubscribe": true, "punsubscribe": true, "sunsubscribe": true,
+}
+
+// expectsReply reports whether a request is answered by exactly one reply
+func expectsReply(name string) bool {
+	return !pubsubCommands[name]
+}
+
+// isPush reports whether a frame from the server is out of band rather than
+// the reply to the oldest request: a RESP3 push frame, or on RESP2 a pub/sub
+// message or (un)subscribe confirmation on a connection that subscribed
+func isPush(value *RESPValue, sess *session) bool {
+	if value.Type == Push {
+		return true
+	}
+	if value.Type != Array || len(value.Array) < 3 || !sess.pubsub.subscribed() {
+		return false
+	}
+	kind := value.Array[0]
+	return kind.Type == BulkString && pushKinds[strings.ToLower(kind.Str)]
+}
+
+// pubsubState tracks whether a connection may have subscriptions, while
+// which RESP2 pub/sub arrays are push frames rather than replies
+type pubsubState struct {
+	active atomic.Bool
+
+	mu       sync.Mutex
+	pending  int   // Subscribe confirmations yet to arrive
+	channels int64 // Channels and patterns subscribed to, as last confirmed
+	shard    int64 // Shard channels subscribed to, as last confirmed
+}
+
+// subscribed reports whether the connection may have subscriptions
+func (s *pubsubState) subscribed() bool {
+	return s.active.Load()
+}
+
+// request accounts for a SUBSCRIBE-family request about to be forwarded
+func (s *pubsubState) request(value *RESPValue, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasSuffix(name, "SUBSCRIBE") && !strings.HasSuffix(name, "UNSUBSCRIBE") {
+		// One confirmation per channel
+		s.pending += len(value.Array) - 1
+	}
+	s.active.Store(true)
+}
+
+// reply accounts for a frame from the server: (un)subscribe confirmations
+// report how many subscriptions are left, and RESET drops them all. Once
+// none are left or awaited, arrays are replies again.
+func (s *pubsubState) reply(value *RESPValue) {
+	if !s.active.Load() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case value.Type == SimpleString && value.Str == "RESET":
+		s.channels, s.shard = 0, 0
+	case (value.Type == Array || value.Type == Push) && len(value.Array) == 3 && value.Array[2].Type == Integer:
+		count := value.Array[2].Int
+		switch strings.ToLower(value.Array[0].Str) {
+		case "subscribe", "psubscribe":
+			s.pending--
+			s.channels = count
+		case "ssubscribe":
+			s.pending--
+			s.shard = count
+		case "unsubscribe", "punsubscribe":
+			s.channels = count
+		case "sunsubscribe":
+			s.shard = count
+		default:
+			return
+		}
+	default:
+		return
+	}
+	if s.pending <= 0 && s.channels == 0 && s.shard == 0 {
+		s.pending = 0
+		s.active.Store(false)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestIsPush(t *testing.T) {
+	message := &RESPValue{Type: Array, Array: []RESPValue{
+		{Type: BulkString, Str: "message"}, {Type: BulkString, Str: "ch"}, {Type: BulkString, Str: "hi"},
+	}}
+	sess := newSession(1, false)
+	if isPush(message, sess) {
+		t.Error("Expected an array on a connection that never subscribed to be a reply")
+	}
+	sess.pubsub.request(testRequest("SUBSCRIBE", "ch"), "SUBSCRIBE")
+	if !isPush(message, sess) {
+		t.Error("Expected a RESP2 message on a subscribed connection to be a push frame")
+	}
+	pong := testRequest("pong", "")
+	if isPush(pong, sess) {
+		t.Error("Expected the reply to PING to be a reply")
+	}
+	if !isPush(&RESPValue{Type: Push, Array: message.Array}, newSession(2, false)) {
+		t.Error("Expected a RESP3 push frame to be a push frame")
+	}
+}
+
+func TestClusterConnectionRelaysPubSub(t *testing.T) {
+	p := &Proxy{
+		config:        &config.Config{InspectCommands: true},
+		isClusterMode: true,
+		nodeMap:       newAddrMap(map[string]string{"10.0.0.2:6379": "127.0.0.1:6380"}),
+		latency:       newLatencyHistogram(),
+	}
+
+	clientSide, proxyClient := net.Pipe()
+	proxyServer, serverSide := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, true)
+	sess.protocol = newProtocolState()
+	go p.handleClusterConnection(proxyClient, proxyServer, sess)
+
+	// Replies per request, with messages arriving in between
+	message := string(testRequest("message", "news", "hello").Serialize())
+	replies := []string{
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n" + message,
+		string(testRequest("pong", "").Serialize()) + message,
+		"-MOVED 1 10.0.0.2:6379\r\n",
+	}
+	go func() {
+		reader := NewRESPReader(serverSide)
+		for _, reply := range replies {
+			if _, err := reader.ReadValue(); err != nil {
+				return
+			}
+			serverSide.Write([]byte(reply))
+		}
+	}()
+
+	clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := NewRESPReader(clientSide)
+	var frames []*RESPValue
+	for i, request := range []*RESPValue{testRequest("SUBSCRIBE", "news", "sports"), testRequest("PING"), testRequest("GET", "key")} {
+		clientSide.Write(request.Serialize())
+		for range []int{3, 2, 1}[i] {
+			frame, err := reader.ReadValue()
+			if err != nil {
+				t.Fatalf("Failed to read frame: %v", err)
+			}
+			frames = append(frames, frame)
+		}
+	}
+
+	if last := frames[len(frames)-1]; last.Str != "MOVED 1 127.0.0.1:6380" {
+		t.Errorf("Expected the redirect to be rewritten, got %+v", last)
+	}
+	// Only PING and GET have replies to pair with
+	var metric dto.Metric
+	p.latency.Write(&metric)
+	if n := metric.GetHistogram().GetSampleCount(); n != 2 {
+		t.Errorf("Expected 2 latency samples, got %d", n)
+	}
+	if _, ok := sess.pending.pop(); ok {
+		t.Error("Expected no request left awaiting a reply")
+	}
+	if state := sess.protocol; state.sent != 2 || state.received != 2 {
+		t.Errorf("Expected 2 requests paired with 2 replies, got %d and %d", state.sent, state.received)
+	}
+}
+
+func TestSubscriptionEndsOnUnsubscribeAndReset(t *testing.T) {
+	subscribed := "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n*3\r\n$10\r\npsubscribe\r\n$2\r\np*\r\n:2\r\n"
+	// A reply shaped like a pub/sub message, paired with its request once unsubscribed
+	lookalike := string(testRequest("message", "ch", "hi").Serialize())
+	for _, tt := range []struct {
+		name     string
+		requests []*RESPValue
+		replies  []string // Written after each request, both confirmations after the second
+		paired   uint64
+	}{
+		{
+			"unsubscribe",
+			[]*RESPValue{testRequest("SUBSCRIBE", "ch"), testRequest("PSUBSCRIBE", "p*"), testRequest("UNSUBSCRIBE"), testRequest("PUNSUBSCRIBE"), testRequest("LRANGE", "l", "0", "-1")},
+			[]string{"", subscribed, "*3\r\n$11\r\nunsubscribe\r\n$2\r\nch\r\n:1\r\n", "*3\r\n$12\r\npunsubscribe\r\n$2\r\np*\r\n:0\r\n", lookalike},
+			1,
+		},
+		{
+			"reset",
+			[]*RESPValue{testRequest("SUBSCRIBE", "ch"), testRequest("PSUBSCRIBE", "p*"), testRequest("RESET"), testRequest("LRANGE", "l", "0", "-1")},
+			[]string{"", subscribed, "+RESET\r\n", lookalike},
+			2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{config: &config.Config{InspectCommands: true}}
+			clientSide, proxyClient := net.Pipe()
+			proxyServer, serverSide := net.Pipe()
+			defer clientSide.Close()
+			sess := newSession(1, false)
+			sess.protocol = newProtocolState()
+			go p.handleClusterConnection(proxyClient, proxyServer, sess)
+
+			go func() {
+				reader := NewRESPReader(serverSide)
+				for _, reply := range tt.replies {
+					if _, err := reader.ReadValue(); err != nil {
+						return
+					}
+					serverSide.Write([]byte(reply))
+				}
+			}()
+			clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				for _, r := range tt.requests {
+					clientSide.Write(r.Serialize())
+				}
+			}()
+
+			reader := NewRESPReader(clientSide)
+			for {
+				frame, err := reader.ReadValue()
+				if err != nil {
+					t.Fatalf("Failed to read frame: %v", err)
+				}
+				if string(frame.Serialize()) == lookalike {
+					break
+				}
+			}
+			if sess.pubsub.subscribed() {
+				t.Error("Expected the connection to be unsubscribed")
+			}
+			if state := sess.protocol; state.sent != tt.paired || state.received != tt.paired {
+				t.Errorf("Expected %d requests paired with %d replies, got %d and %d", tt.paired, tt.paired, state.sent, state.received)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// Re-authentication timing of long-lived upstream connections
+const (
+	reauthMargin = 2 * time.Minute  // AUTH is sent again this long before the connection's token expires
+	reauthRetry  = 10 * time.Second // Wait before asking again when no newer token is available yet
+)
+
+// authExpired reports whether an error reply means the connection's
+// credentials are no longer valid
+func authExpired(reply string) bool {
+	return strings.HasPrefix(reply, "NOAUTH") || strings.HasPrefix(reply, "WRONGPASS")
+}
+
+// newSharedConn wraps an authenticated connection for sharing between
+// requests. With IAM auth it is kept authenticated past the expiry of the
+// token it was dialed with.
+func (p *Proxy) newSharedConn(conn net.Conn, ping time.Duration) *muxConn {
+	m := newMuxConn(conn, ping)
+	if p.authPassword.get() == "" && p.tokenSource != nil {
+		// The token just used to authenticate is the provider's current one
+		go p.keepAuthenticated(m, p.tokenSource.Expiry())
+	}
+	return m
+}
+
+// keepAuthenticated sends AUTH with a newer token on m reauthMargin before
+// the token it authenticated with expires, and right away when a reply shows
+// the connection is no longer authenticated. AUTH is queued like any
+// request, so no client request fails because of it. A rejected AUTH fails
+// the connection, which is redialed by its next client.
+func (p *Proxy) keepAuthenticated(m *muxConn, expiry time.Time) {
+	timer := time.NewTimer(reauthDelay(expiry, time.Now()))
+	defer timer.Stop()
+	for {
+		force := false
+		select {
+		case <-m.done:
+			return
+		case <-m.unauthenticated:
+			force = true
+		case <-timer.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		token, next, err := p.tokenSource.GetTokenWithExpiry(ctx)
+		cancel()
+		if err != nil {
+			p.stats.reauthErrors.Add(1)
+			logger.Error(fmt.Sprintf("Failed to get IAM token to re-authenticate upstream connection to %s: %v", p.remoteAddr, err))
+			timer.Reset(reauthRetry)
+			continue
+		}
+		if !force && !next.After(expiry) && time.Now().Before(expiry) {
+			// The source hands out the current token until shortly before it expires
+			timer.Reset(reauthRetry)
+			continue
+		}
+
+		if err := reauthenticate(m, authUser(p.config), token); err != nil {
+			if m.failed() {
+				// Lost meanwhile; its clients see that on their own requests
+				return
+			}
+			p.stats.reauthErrors.Add(1)
+			logger.Error(fmt.Sprintf("Failed to re-authenticate upstream connection to %s: %v", p.remoteAddr, err))
+			m.fail(fmt.Errorf("%w: re-authentication failed: %v", errMuxClosed, err))
+			return
+		}
+		p.stats.reauths.Add(1)
+		expiry = next
+		timer.Reset(reauthDelay(expiry, time.Now()))
+	}
+}
+
+// keepPoolAuthenticated makes pool send AUTH with a newer IAM token on idle
+// connections reauthMargin before the token they authenticated with expires.
+// Connections relaying a single client are not covered: the client would see
+// the reply to an AUTH the proxy inserted.
+func (p *Proxy) keepPoolAuthenticated(pool *upstreamPool) {
+	if p.authPassword.get() != "" || p.tokenSource == nil {
+		return
+	}
+	pool.tokenExpiry = p.tokenSource.Expiry
+	pool.renew = func(conn net.Conn) (time.Time, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		token, expiry, err := p.tokenSource.GetTokenWithExpiry(ctx)
+		cancel()
+		if err == nil {
+			err = p.authenticatePassword(conn, token)
+		}
+		p.countReauth(err)
+		return expiry, err
+	}
+}
+
+// reauthPooled sends AUTH with a rotated password on the idle pooled and the
+// shared upstream connections, which authenticated with the previous one,
+// so they keep working should the old password be revoked. A connection
+// rejecting it is closed and dialed again.
+func (p *Proxy) reauthPooled(password string) {
+	p.pool.reauth(func(conn net.Conn) error {
+		err := p.authenticatePassword(conn, password)
+		p.countReauth(err)
+		return err
+	})
+	for _, mc := range p.mux.shared() {
+		err := reauthenticate(mc, authUser(p.config), password)
+		p.countReauth(err)
+		if err != nil && !mc.failed() {
+			logger.Error(fmt.Sprintf("Failed to re-authenticate upstream connection to %s: %v", p.remoteAddr, err))
+			mc.fail(fmt.Errorf("%w: re-authentication failed: %v", errMuxClosed, err))
+		}
+	}
+}
+
+// countReauth counts a re-authentication by its result
+func (p *Proxy) countReauth(err error) {
+	if err != nil {
+		p.stats.reauthErrors.Add(1)
+		return
+	}
+	p.stats.reauths.Add(1)
+}
+
+// reauthDelay returns how long to wait before re-authenticating a connection
+// whose token expires at expiry; forever if the token doesn't expire
+func reauthDelay(expiry, now time.Time) time.Duration {
+	if expiry.IsZero() {
+		return math.MaxInt64
+	}
+	return max(expiry.Sub(now)-reauthMargin, 0)
+}
+
+// reauthenticate sends AUTH with token on m and waits for the reply
+func reauthenticate(m *muxConn, user, token string) error {
+	replies, err := m.send([]byte(buildAuthCommand(user, token)), 1)
+	if err != nil {
+		return err
+	}
+	return (<-replies[0]).failure()
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/auth"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"golang.org/x/oauth2"
+)
+
+// sequenceTokenSource returns token-1, token-2, ... each expiring lifetime
+// after it was issued
+type sequenceTokenSource struct {
+	lifetime time.Duration
+	issued   atomic.Int64
+}
+
+func (s *sequenceTokenSource) Token() (*oauth2.Token, error) {
+	n := s.issued.Add(1)
+	return &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", n), Expiry: time.Now().Add(s.lifetime)}, nil
+}
+
+// authUpstream answers AUTH with OK and sends its token to auths, GET
+// expired with NOAUTH, and anything else with PONG
+func authUpstream(t *testing.T) (addr string, auths <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	tokens := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := NewRESPReader(conn)
+				for {
+					value, err := reader.ReadValue()
+					if err != nil {
+						return
+					}
+					reply := RESPValue{Type: SimpleString, Str: "PONG"}
+					switch {
+					case value.CommandName() == "AUTH":
+						tokens <- value.Array[1].Str
+						reply = RESPValue{Type: SimpleString, Str: "OK"}
+					case value.CommandName() == "GET" && value.Array[1].Str == "expired":
+						reply = RESPValue{Type: Error, Str: "NOAUTH Authentication required."}
+					}
+					conn.Write(reply.Serialize())
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), tokens
+}
+
+// newReauthProxy returns a proxy using IAM tokens of lifetime and a shared
+// connection to addr authenticated with the first of them
+func newReauthProxy(t *testing.T, addr string, lifetime time.Duration) (*Proxy, *muxConn) {
+	t.Helper()
+	p := &Proxy{config: &config.Config{}, remoteAddr: addr,
+		tokenSource: auth.NewIAMTokenProviderFromSource(&sequenceTokenSource{lifetime: lifetime})}
+	if _, err := p.tokenSource.GetToken(t.Context()); err != nil {
+		t.Fatalf("GetToken failed: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	mc := p.newSharedConn(conn, 0)
+	t.Cleanup(func() { mc.fail(errMuxClosed) })
+	return p, mc
+}
+
+// expectAuth waits for the upstream to receive AUTH with token
+func expectAuth(t *testing.T, auths <-chan string, token string) {
+	t.Helper()
+	select {
+	case got := <-auths:
+		if got != token {
+			t.Fatalf("Expected AUTH with %s, got %s", token, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for AUTH with %s", token)
+	}
+}
+
+func TestSharedConnReauthenticatesBeforeTokenExpiry(t *testing.T) {
+	addr, auths := authUpstream(t)
+	p, mc := newReauthProxy(t, addr, reauthMargin+200*time.Millisecond)
+
+	expectAuth(t, auths, "token-2")
+	deadline := time.Now().Add(5 * time.Second)
+	for p.stats.reauths.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if mc.failed() {
+		t.Fatal("Connection failed after re-authentication")
+	}
+	if n := p.stats.reauths.Load(); n == 0 {
+		t.Error("Expected the re-authentication to be counted")
+	}
+}
+
+func TestSharedConnReauthenticatesOnNoauth(t *testing.T) {
+	addr, auths := authUpstream(t)
+	p, mc := newReauthProxy(t, addr, time.Hour)
+
+	replies, err := mc.send((&RESPValue{Type: Array, Array: []RESPValue{
+		{Type: BulkString, Str: "GET"}, {Type: BulkString, Str: "expired"},
+	}}).Serialize(), 1)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if reply := <-replies[0]; reply.err != nil || reply.value.Type != Error {
+		t.Fatalf("Expected the NOAUTH reply to reach the client, got %+v", reply)
+	}
+
+	expectAuth(t, auths, "token-2")
+	deadline := time.Now().Add(5 * time.Second)
+	for p.stats.reauths.Load() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := p.stats.reauths.Load(); n != 1 {
+		t.Errorf("Expected 1 re-authentication, got %d", n)
+	}
+}
+
+func TestPooledConnsReauthenticateBeforeTokenExpiry(t *testing.T) {
+	addr, auths := authUpstream(t)
+	p := &Proxy{config: &config.Config{}, remoteAddr: addr,
+		tokenSource: auth.NewIAMTokenProviderFromSource(&sequenceTokenSource{lifetime: reauthMargin + 200*time.Millisecond})}
+	pool := newUpstreamPool(1, time.Hour, func(ctx context.Context) (net.Conn, error) {
+		token, err := p.tokenSource.GetToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, p.authenticatePassword(conn, token)
+	})
+	defer pool.close()
+	p.keepPoolAuthenticated(pool)
+
+	if err := pool.fill(); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+	expectAuth(t, auths, "token-1")
+
+	// Still outside reauthMargin of the token's expiry
+	pool.expire()
+	select {
+	case token := <-auths:
+		t.Fatalf("Expected no AUTH yet, got one with %s", token)
+	default:
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	pool.expire()
+	expectAuth(t, auths, "token-2")
+	if n := p.stats.reauths.Load(); n != 1 {
+		t.Errorf("Expected 1 re-authentication, got %d", n)
+	}
+	if pool.get() == nil {
+		t.Error("Expected the re-authenticated connection to stay pooled")
+	}
+}
+
+func TestReauthDelay(t *testing.T) {
+	now := time.Now()
+	if d := reauthDelay(now.Add(time.Hour), now); d != time.Hour-reauthMargin {
+		t.Errorf("Expected %s, got %s", time.Hour-reauthMargin, d)
+	}
+	if d := reauthDelay(now.Add(time.Minute), now); d != 0 {
+		t.Errorf("Expected a token expiring within the margin to be renewed right away, got %s", d)
+	}
+	if d := reauthDelay(time.Time{}, now); d < 24*time.Hour {
+		t.Errorf("Expected a token without expiry never to be renewed, got %s", d)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// reconfigureResponse is sent to clients whose upstream connection fails
+// while the endpoint is being reconfigured
+const reconfigureResponse = "-MAINT endpoint is being reconfigured, retry shortly\r\n"
+
+// reconfigureWindow is how long after a topology change or CA rotation a
+// failed upstream connection is put down to it
+const reconfigureWindow = 30 * time.Second
+
+// reconfiguring marks the endpoint of p as being swapped (a failover changed
+// its role, its node is leaving the cluster, or the server CA rotated) until
+// the given time
+func (p *Proxy) reconfiguring(until time.Time) {
+	p.reconfiguringUntil.Store(until.UnixNano())
+}
+
+// reconfiguringAt reports whether the endpoint is being swapped at the given time
+func (p *Proxy) reconfiguringAt(now time.Time) bool {
+	return now.UnixNano() < p.reconfiguringUntil.Load()
+}
+
+// rejectReconfiguring tells a client whose upstream connection failed while
+// the endpoint is being swapped to retry, rather than closing its connection
+// without a reply
+func (p *Proxy) rejectReconfiguring(clientConn net.Conn, sess *session) {
+	if !p.reconfiguringAt(time.Now()) {
+		return
+	}
+	sess.log.Debug("Upstream connection failed while the endpoint is reconfigured, asking the client to retry")
+	clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+	clientConn.Write([]byte(reconfigureResponse))
+}
+
+// reconfiguringAll marks the endpoints of all proxies as being swapped until
+// the given time, e.g. after the server CA rotated
+func (m *Manager) reconfiguringAll(until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.proxies {
+		p.reconfiguring(until)
+	}
+}
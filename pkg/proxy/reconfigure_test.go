@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestReconfiguringRejectsClients(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := &Proxy{config: config.NewConfig(), remoteAddr: addr}
+	connect := func() string {
+		client, proxyClient := net.Pipe()
+		defer client.Close()
+		p.connections.Add(1)
+		go p.handleConnection(proxyClient, nextConnID())
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := io.ReadAll(client)
+		return string(reply)
+	}
+
+	if reply := connect(); reply != "" {
+		t.Errorf("Expected the connection to be closed without a reply, got %q", reply)
+	}
+	p.reconfiguring(time.Now().Add(time.Minute))
+	if reply := connect(); reply != reconfigureResponse {
+		t.Errorf("Expected %q, got %q", reconfigureResponse, reply)
+	}
+	p.reconfiguring(time.Now().Add(-time.Second))
+	if reply := connect(); reply != "" {
+		t.Errorf("Expected no reply once the window passed, got %q", reply)
+	}
+}
+
+func TestCARotationMarksReconfiguring(t *testing.T) {
+	m := NewManager(config.NewConfig())
+	p := &Proxy{}
+	m.proxies = []*Proxy{p}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ca := otherCA(t)
+	go m.WatchCACertificates(ctx, 10*time.Millisecond, func(context.Context) (string, error) {
+		return ca, nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.reconfiguringAt(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the CA rotation to mark the endpoint as reconfigured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// reconnectPinned lists commands that leave state on the upstream connection
+// which can't be restored on a new one, so the client is never moved off it
+var reconnectPinned = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true, "MONITOR": true,
+	"SYNC": true, "PSYNC": true, "HELLO": true, "AUTH": true,
+}
+
+// clientReadOnlySubcommands are CLIENT subcommands that don't change connection state
+var clientReadOnlySubcommands = map[string]bool{"ID": true, "INFO": true, "LIST": true, "GETNAME": true}
+
+// upstreamLostResponse is sent to a client whose upstream could not be re-established
+const upstreamLostResponse = "-ERR upstream connection lost\r\n"
+
+// reconnectingUpstream is the upstream side of a client connection that
+// survives upstream failures (maintenance, failover) while the client is
+// idle: no request awaiting a reply and no state on the connection other than
+// the selected DB and READONLY, which are replayed. The lost connection is
+// replaced by a freshly dialed and authenticated one on the next request.
+type reconnectingUpstream struct {
+	p          *Proxy
+	sess       *session
+	clientConn net.Conn
+
+	mu       sync.Mutex
+	conn     net.Conn
+	lost     bool // conn failed while the client was idle; re-dial before the next request
+	closed   bool
+	db       string // Last SELECT argument, replayed on a new connection
+	readOnly bool   // READONLY was sent, replayed on a new connection
+	multi    bool   // Inside MULTI ... EXEC
+	watching bool   // WATCH is active
+	pinned   bool   // A command left state that can't be replayed
+}
+
+// handleReconnectingConnection relays a client connection whose upstream is
+// transparently replaced when it drops while the client is idle
+func (p *Proxy) handleReconnectingConnection(clientConn, remoteConn net.Conn, sess *session) {
+	sess.inflight = &atomic.Int64{}
+	u := &reconnectingUpstream{p: p, sess: sess, clientConn: clientConn, conn: remoteConn}
+	go u.relayReplies(remoteConn)
+
+	err := p.readRequests(clientConn, sess, u.forward)
+	if err != nil && err != io.EOF {
+		sess.log.Debug(fmt.Sprintf("Client->Server proxy error: %v", err))
+	}
+	u.close()
+}
+
+// relayReplies relays the replies of one upstream connection until it fails
+func (u *reconnectingUpstream) relayReplies(conn net.Conn) {
+	err := u.p.proxyServerResponses(conn, u.clientConn, u.sess)
+	if !errors.Is(err, errClientWrite) && u.detach(conn) {
+		u.sess.log.Info(fmt.Sprintf("Upstream connection lost while the client was idle (%v), reconnecting on its next request", err))
+		return
+	}
+	if err != nil && err != io.EOF {
+		u.sess.log.Debug(fmt.Sprintf("Server->Client proxy error: %v", err))
+	}
+	// Unblocks the request reader
+	u.clientConn.Close()
+}
+
+// detach marks a failed upstream connection as lost if it can be replaced:
+// the client is idle and left no state that can't be replayed
+func (u *reconnectingUpstream) detach(conn net.Conn) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed || u.sess.inflight.Load() > 0 || u.pinned || u.multi || u.watching {
+		return false
+	}
+	conn.Close()
+	u.lost = true
+	return true
+}
+
+// forward sends a client request, re-establishing a lost upstream connection first
+func (u *reconnectingUpstream) forward(value *RESPValue) error {
+	u.mu.Lock()
+	if u.lost {
+		conn, err := u.reconnect()
+		if err != nil {
+			u.mu.Unlock()
+			u.clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+			u.clientConn.Write([]byte(upstreamLostResponse))
+			return fmt.Errorf("failed to reconnect upstream: %w", err)
+		}
+		u.conn, u.lost = conn, false
+		u.p.sessions.setUpstream(u.sess, conn.LocalAddr().String())
+		go u.relayReplies(conn)
+	}
+	u.track(value)
+	// A denied request is sent as a PING, which has a reply
+	if name := value.CommandName(); expectsReply(name) || u.p.denied.match(value, name) != "" {
+		u.sess.inflight.Add(1)
+	}
+	conn := u.conn
+	u.mu.Unlock()
+
+	return u.p.writeRequest(conn, value, u.sess)
+}
+
+// track records the connection state a request changes
+func (u *reconnectingUpstream) track(value *RESPValue) {
+	name := value.CommandName()
+	switch name {
+	case "SELECT":
+		if len(value.Array) == 2 {
+			u.db = value.Array[1].Str
+		}
+	case "READONLY":
+		u.readOnly = true
+	case "READWRITE":
+		u.readOnly = false
+	case "MULTI":
+		u.multi = true
+	case "WATCH":
+		u.watching = true
+	case "UNWATCH":
+		u.watching = false
+	case "EXEC", "DISCARD":
+		u.multi, u.watching = false, false
+	case "RESET":
+		// RESET selects DB 0, which a new connection doesn't start in with -default-db
+		u.db, u.readOnly, u.multi, u.watching, u.pinned = "0", false, false, false, false
+	case "CLIENT":
+		if len(value.Array) < 2 || !clientReadOnlySubcommands[strings.ToUpper(value.Array[1].Str)] {
+			u.pinned = true
+		}
+	default:
+		if reconnectPinned[name] {
+			u.pinned = true
+		}
+	}
+}
+
+// reconnect dials, authenticates and restores the selected DB and READONLY on
+// a new upstream connection
+func (u *reconnectingUpstream) reconnect() (net.Conn, error) {
+	p := u.p
+	ctx, span := tracing.Start(context.Background(), "proxy.reconnect",
+		attribute.Int64("conn.id", int64(u.sess.id)),
+		attribute.String("net.peer.addr", p.remoteAddr))
+
+	conn, err := p.connectUpstream(ctx, u.sess)
+	if err == nil {
+		err = u.restore(conn)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	p.stats.reconnects.Add(1)
+	u.sess.log.Info("Upstream connection re-established")
+	return conn, nil
+}
+
+// restore replays the connection state recorded by track
+func (u *reconnectingUpstream) restore(conn net.Conn) error {
+	if u.readOnly {
+		if err := execCommand(conn, "READONLY"); err != nil {
+			return err
+		}
+	}
+	if u.db != "" && u.db != strconv.Itoa(u.p.defaultDB()) {
+		if err := execCommand(conn, "SELECT", u.db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the current upstream connection once the client is gone
+func (u *reconnectingUpstream) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	u.conn.Close()
+}
+
+// connectUpstream dials (with retries), TLS-negotiates and authenticates an
+// upstream connection for a client session, recording failures
+func (p *Proxy) connectUpstream(ctx context.Context, sess *session) (net.Conn, error) {
+	if conn := p.pool.get(); conn != nil {
+		return conn, nil
+	}
+	conn, _, err := p.dialWithRetry(ctx, sess)
+	if err != nil {
+		p.upstreamFailed()
+		return nil, err
+	}
+	if err := p.authenticateUpstream(ctx, conn, sess); err != nil {
+		p.recordAuthFailure(err)
+		p.upstreamFailed()
+		conn.Close()
+		return nil, err
+	}
+	p.upstreamSucceeded()
+	return conn, nil
+}
+
+// execCommand sends a command on an idle connection and checks its reply
+func execCommand(conn net.Conn, args ...string) error {
+	reply, err := queryCommand(conn, args...)
+	if err != nil {
+		return err
+	}
+	if reply.Type == Error {
+		return fmt.Errorf("%s failed: %s", args[0], reply.Str)
+	}
+	return nil
+}
+
+// queryCommand sends a command on an idle connection and returns its reply
+func queryCommand(conn net.Conn, args ...string) (*RESPValue, error) {
+	request := RESPValue{Type: Array}
+	for _, arg := range args {
+		request.Array = append(request.Array, RESPValue{Type: BulkString, Str: arg})
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(request.Serialize()); err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", args[0], err)
+	}
+	reply, err := NewRESPReader(conn).ReadValue()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s reply: %w", args[0], err)
+	}
+	return reply, nil
+}
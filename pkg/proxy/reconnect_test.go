@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+// recordingUpstream answers SELECT, READONLY and MULTI with +OK and anything
+// else with "<connection number>:<request>", recording every request
+type recordingUpstream struct {
+	ln    net.Listener
+	addr  string
+	conns chan net.Conn
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newRecordingUpstream(t *testing.T) *recordingUpstream {
+	t.Helper()
+	u := &recordingUpstream{conns: make(chan net.Conn, 10)}
+	u.ln = fakeServer(t, func(conn net.Conn, n int) func([]string) string {
+		u.conns <- conn
+		return func(args []string) string {
+			request := fmt.Sprintf("%d:%s", n, strings.Join(args, " "))
+			u.mu.Lock()
+			u.requests = append(u.requests, request)
+			u.mu.Unlock()
+
+			reply := RESPValue{Type: BulkString, Str: request}
+			switch strings.ToUpper(args[0]) {
+			case "SELECT", "READONLY", "MULTI":
+				reply = RESPValue{Type: SimpleString, Str: "OK"}
+			}
+			return string(reply.Serialize())
+		}
+	})
+	u.addr = u.ln.Addr().String()
+	return u
+}
+
+func (u *recordingUpstream) recorded() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.requests...)
+}
+
+// reconnectingClient connects a client through a proxy with transparent reconnect enabled
+func reconnectingClient(t *testing.T, upstream string) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	return reconnectingClientWith(t, upstream, config.NewConfig())
+}
+
+// reconnectingClientWith is reconnectingClient with other settings in cfg
+func reconnectingClientWith(t *testing.T, upstream string, cfg *config.Config) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	cfg.TransparentReconnect = true
+	p := &Proxy{config: cfg, remoteAddr: upstream}
+
+	client, proxyClient := net.Pipe()
+	done := make(chan struct{})
+	p.connections.Add(1)
+	go func() {
+		defer close(done)
+		p.handleConnection(proxyClient, nextConnID())
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client, done
+}
+
+func TestReconnectWhileIdle(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client, _ := reconnectingClient(t, upstream.addr)
+
+	got := roundTripAll(t, client, testRequest("SELECT", "2"), testRequest("READONLY"), testRequest("GET", "k"))
+	if got[2] != bulk("1:GET k") {
+		t.Fatalf("Unexpected reply %q", got[2])
+	}
+
+	// Maintenance closes the upstream connection while the client is idle
+	(<-upstream.conns).Close()
+	time.Sleep(200 * time.Millisecond)
+
+	got = roundTripAll(t, client, testRequest("GET", "k"))
+	if got[0] != bulk("2:GET k") {
+		t.Fatalf("Expected the request on a new upstream connection, got %q", got[0])
+	}
+	want := []string{"1:SELECT 2", "1:READONLY", "1:GET k", "2:READONLY", "2:SELECT 2", "2:GET k"}
+	if requests := upstream.recorded(); strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected upstream requests %v, got %v", want, requests)
+	}
+}
+
+func TestReconnectWithDefaultDB(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	cfg := config.NewConfig()
+	cfg.DefaultDB = 3
+	client, _ := reconnectingClientWith(t, upstream.addr, cfg)
+
+	roundTripAll(t, client, testRequest("GET", "k"))
+	(<-upstream.conns).Close()
+	time.Sleep(200 * time.Millisecond)
+	roundTripAll(t, client, testRequest("SELECT", "0"))
+
+	// The client moved to DB 0, which the new connection doesn't start in
+	(<-upstream.conns).Close()
+	time.Sleep(200 * time.Millisecond)
+	roundTripAll(t, client, testRequest("GET", "k"))
+
+	want := []string{"1:SELECT 3", "1:GET k", "2:SELECT 3", "2:SELECT 0", "3:SELECT 3", "3:SELECT 0", "3:GET k"}
+	if requests := upstream.recorded(); strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected upstream requests %v, got %v", want, requests)
+	}
+}
+
+func TestReconnectSkipsStatefulClients(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client, done := reconnectingClient(t, upstream.addr)
+
+	// A transaction can't be moved to another connection
+	roundTripAll(t, client, testRequest("MULTI"))
+	(<-upstream.conns).Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client inside MULTI to be disconnected")
+	}
+}
+
+func TestReconnectFailure(t *testing.T) {
+	upstream := newRecordingUpstream(t)
+	client, done := reconnectingClient(t, upstream.addr)
+
+	roundTripAll(t, client, testRequest("GET", "k"))
+	upstream.ln.Close()
+	(<-upstream.conns).Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// The instance is gone for good: the client is told and disconnected
+	got := roundTripAll(t, client, testRequest("GET", "k"))
+	if got[0] != upstreamLostResponse {
+		t.Errorf("Expected %q, got %q", upstreamLostResponse, got[0])
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to be disconnected")
+	}
+}
@@ -3,6 +3,7 @@
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -20,48 +21,330 @@
 	Array        RESPType = '*'
 )
 
-// RESPValue represents a parsed RESP value
+// RESP3 types, only accepted by readers that enabled RESP3
+const (
+	Null      RESPType = '_'
+	Boolean   RESPType = '#'
+	Double    RESPType = ','
+	BigNumber RESPType = '('
+	BlobError RESPType = '!'
+	Verbatim  RESPType = '='
+	Map       RESPType = '%'
+	Set       RESPType = '~'
+	Push      RESPType = '>'
+	Attribute RESPType = '|'
+)
+
+// resp3 reports whether t exists only in RESP3
+func (t RESPType) resp3() bool {
+	switch t {
+	case Null, Boolean, Double, BigNumber, BlobError, Verbatim, Map, Set, Push, Attribute:
+		return true
+	}
+	return false
+}
+
+// aggregate reports whether t holds nested values
+func (t RESPType) aggregate() bool {
+	return t == Array || t == Map || t == Set || t == Push || t == Attribute
+}
+
+// Parser limits protecting the proxy from malicious or corrupted input
+const (
+	maxBulkStringSize = 512 * 1024 * 1024 // Matches the server's default proto-max-bulk-len
+	maxArrayLength    = 1<<31 - 1         // Largest element count a server can announce
+	maxNestingDepth   = 128               // Nested arrays deeper than this are rejected
+	maxLineLength     = 64 * 1024         // Longest simple string, error or length line accepted
+	maxPrealloc       = 1024              // Elements/bytes allocated up front before data actually arrives
+)
+
+// RESPLimits bounds the bulk string sizes and array lengths a RESPReader
+// accepts; values announcing more are rejected before anything is read
+type RESPLimits struct {
+	MaxBulkSize    int // Longest bulk string in bytes
+	MaxArrayLength int // Largest array element count
+}
+
+// DefaultRESPLimits are the largest values the server itself accepts
+var DefaultRESPLimits = RESPLimits{MaxBulkSize: maxBulkStringSize, MaxArrayLength: maxArrayLength}
+
+// RESPValue represents a parsed RESP value. Simple RESP3 types keep their
+// line in Str; maps keep keys and values alternately in Array.
 type RESPValue struct {
 	Type  RESPType
 	Str   string
 	Int   int64
 	Array []RESPValue
 	Null  bool
+	Attrs []RESPValue // RESP3 attributes sent ahead of the value, as map entries
 }
 
 // RESPReader wraps a bufio.Reader for parsing RESP protocol
 type RESPReader struct {
 	reader *bufio.Reader
+	limits RESPLimits
+	tee    io.Writer // While set, receives every byte consumed from reader
+	resp3  bool      // Accept RESP3 types
+	inline bool      // Read inline commands, see SetInline
+}
+
+// protocolError is a malformed or unsupported RESP frame, as opposed to an
+// I/O error on the underlying connection
+type protocolError string
+
+func (e protocolError) Error() string { return string(e) }
+
+// protocolErrorf formats a protocolError
+func protocolErrorf(format string, args ...any) error {
+	return protocolError(fmt.Sprintf(format, args...))
+}
+
+// isProtocolError reports whether err was caused by the data rather than the connection
+func isProtocolError(err error) bool {
+	var pe protocolError
+	return errors.As(err, &pe)
 }
 
-// NewRESPReader creates a new RESP reader
+// NewRESPReader creates a new RESP reader with DefaultRESPLimits
 func NewRESPReader(r io.Reader) *RESPReader {
 	return &RESPReader{
 		reader: bufio.NewReader(r),
+		limits: DefaultRESPLimits,
+	}
+}
+
+// SetLimits sets the size limits; zero fields keep the defaults
+func (r *RESPReader) SetLimits(limits RESPLimits) {
+	r.limits = DefaultRESPLimits
+	if limits.MaxBulkSize > 0 {
+		r.limits.MaxBulkSize = min(limits.MaxBulkSize, maxBulkStringSize)
+	}
+	if limits.MaxArrayLength > 0 {
+		r.limits.MaxArrayLength = min(limits.MaxArrayLength, maxArrayLength)
 	}
 }
 
+// SetRESP3 enables or disables parsing of RESP3 types, which are otherwise
+// rejected like any unknown type
+func (r *RESPReader) SetRESP3(enabled bool) {
+	r.resp3 = enabled
+}
+
+// SetInline makes the reader parse client requests the way the server does:
+// anything but an array is an inline command (PING\r\n, as sent by
+// redis-cli and telnet), returned as an array of bulk strings
+func (r *RESPReader) SetInline(enabled bool) {
+	r.inline = enabled
+}
+
 // ReadValue reads and parses a single RESP value
 func (r *RESPReader) ReadValue() (*RESPValue, error) {
-	typeByte, err := r.reader.ReadByte()
+	if r.inline {
+		return r.readRequest()
+	}
+	return r.readValue(0)
+}
+
+// readRequest reads an array or an inline command, skipping empty lines
+func (r *RESPReader) readRequest() (*RESPValue, error) {
+	for {
+		typ, err := r.peekType()
+		if err != nil {
+			return nil, err
+		}
+		if typ == Array {
+			return r.readValue(0)
+		}
+
+		line, err := r.readInlineLine()
+		if err != nil {
+			return nil, err
+		}
+		args, err := splitInlineArgs(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) > r.limits.MaxArrayLength {
+			return nil, protocolErrorf("array count %d exceeds limit of %d elements", len(args), r.limits.MaxArrayLength)
+		}
+		value := &RESPValue{Type: Array, Array: make([]RESPValue, len(args))}
+		for i, arg := range args {
+			value.Array[i] = RESPValue{Type: BulkString, Str: arg}
+		}
+		return value, nil
+	}
+}
+
+// splitInlineArgs splits an inline command into arguments like the server:
+// separated by whitespace, with "double quoted" arguments supporting \n, \r,
+// \t, \b, \a, \\, \" and \xHH escapes and 'single quoted' ones only \'
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; ; {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		arg, next, err := inlineArg(line, i)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		i = next
+	}
+}
+
+// inlineArg parses the argument starting at line[i] and returns it with the
+// index following it
+func inlineArg(line string, i int) (string, int, error) {
+	var arg []byte
+	var quote byte
+	for ; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && isInlineSpace(c):
+			return string(arg), i, nil
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0:
+			arg = append(arg, c)
+		case c == quote:
+			// The closing quote must end the argument
+			if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+				return "", 0, protocolErrorf("unbalanced quotes in request")
+			}
+			return string(arg), i + 1, nil
+		case quote == '\'' && c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+			arg = append(arg, '\'')
+			i++
+		case quote == '"' && c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+			n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+			arg = append(arg, byte(n))
+			i += 3
+		case quote == '"' && c == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				arg = append(arg, '\n')
+			case 'r':
+				arg = append(arg, '\r')
+			case 't':
+				arg = append(arg, '\t')
+			case 'b':
+				arg = append(arg, '\b')
+			case 'a':
+				arg = append(arg, '\a')
+			default:
+				arg = append(arg, line[i])
+			}
+		default:
+			arg = append(arg, c)
+		}
+	}
+	if quote != 0 {
+		return "", 0, protocolErrorf("unbalanced quotes in request")
+	}
+	return string(arg), i, nil
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// readRaw reads a value like ReadValue and also returns the bytes it consumed,
+// which on a protocol error are the start of the unparseable frame
+func (r *RESPReader) readRaw() (*RESPValue, []byte, error) {
+	var raw bytes.Buffer
+	r.tee = &raw
+	defer func() { r.tee = nil }()
+	value, err := r.ReadValue()
+	return value, raw.Bytes(), err
+}
+
+// readValue reads a value nested depth arrays deep
+func (r *RESPReader) readValue(depth int) (*RESPValue, error) {
+	typeByte, err := r.readByte()
 	if err != nil {
 		return nil, err
 	}
+	typ := RESPType(typeByte)
+	if typ.resp3() && !r.resp3 {
+		return nil, protocolErrorf("unknown RESP type: %c", typeByte)
+	}
 
-	switch RESPType(typeByte) {
+	switch typ {
 	case SimpleString:
 		return r.readSimpleString()
 	case Error:
 		return r.readError()
 	case Integer:
 		return r.readInteger()
-	case BulkString:
-		return r.readBulkString()
-	case Array:
-		return r.readArray()
+	case BulkString, BlobError, Verbatim:
+		return r.readBulkString(typ)
+	case Array, Map, Set, Push:
+		return r.readArray(typ, depth)
+	case Null, Boolean, Double, BigNumber:
+		return r.readSimpleRESP3(typ)
+	case Attribute:
+		attrs, err := r.readArray(typ, depth)
+		if err != nil {
+			return nil, err
+		}
+		// Attributes annotate the value that follows them
+		value, err := r.readValue(depth)
+		if err != nil {
+			return nil, err
+		}
+		value.Attrs = append(attrs.Array, value.Attrs...)
+		return value, nil
 	default:
-		return nil, fmt.Errorf("unknown RESP type: %c", typeByte)
+		return nil, protocolErrorf("unknown RESP type: %c", typeByte)
+	}
+}
+
+// readSimpleRESP3 reads a one-line RESP3 value (_\r\n, #t\r\n, ,1.5\r\n, (123\r\n)
+func (r *RESPReader) readSimpleRESP3(typ RESPType) (*RESPValue, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSimpleRESP3(typ, line); err != nil {
+		return nil, err
+	}
+	return &RESPValue{Type: typ, Str: line, Null: typ == Null}, nil
+}
+
+// validateSimpleRESP3 checks the line of a one-line RESP3 value
+func validateSimpleRESP3(typ RESPType, line string) error {
+	switch typ {
+	case Null:
+		if line != "" {
+			return protocolErrorf("invalid null: %s", line)
+		}
+	case Boolean:
+		if line != "t" && line != "f" {
+			return protocolErrorf("invalid boolean: %s", line)
+		}
+	case Double:
+		if _, err := strconv.ParseFloat(line, 64); err != nil && line != "inf" && line != "-inf" && line != "nan" {
+			return protocolErrorf("invalid double: %s", line)
+		}
+	case BigNumber:
+		digits := strings.TrimPrefix(line, "-")
+		if digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return protocolErrorf("invalid big number: %s", line)
+		}
 	}
+	return nil
 }
 
 // readSimpleString reads a simple string (+OK\r\n)
@@ -90,13 +373,14 @@ func (r *RESPReader) readInteger() (*RESPValue, error) {
 	}
 	num, err := strconv.ParseInt(line, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("invalid integer: %s", line)
+		return nil, protocolErrorf("invalid integer: %s", line)
 	}
 	return &RESPValue{Type: Integer, Int: num}, nil
 }
 
-// readBulkString reads a bulk string ($6\r\nfoobar\r\n)
-func (r *RESPReader) readBulkString() (*RESPValue, error) {
+// readBulkString reads a bulk string ($6\r\nfoobar\r\n), or a RESP3 blob
+// error or verbatim string of the same layout
+func (r *RESPReader) readBulkString(typ RESPType) (*RESPValue, error) {
 	line, err := r.readLine()
 	if err != nil {
 		return nil, err
@@ -104,30 +388,77 @@ func (r *RESPReader) readBulkString() (*RESPValue, error) {
 
 	size, err := strconv.Atoi(line)
 	if err != nil {
-		return nil, fmt.Errorf("invalid bulk string size: %s", line)
+		return nil, protocolErrorf("invalid bulk string size: %s", line)
 	}
 
 	// Handle null bulk string ($-1\r\n)
-	if size < 0 {
+	if size == -1 && typ == BulkString {
 		return &RESPValue{Type: BulkString, Null: true}, nil
 	}
+	if size < 0 {
+		return nil, protocolErrorf("invalid bulk string size: %d", size)
+	}
+	if size > r.limits.MaxBulkSize {
+		return nil, protocolErrorf("bulk string size %d exceeds limit of %d bytes", size, r.limits.MaxBulkSize)
+	}
 
 	// Read the string data plus \r\n
-	buf := make([]byte, size+2)
-	if _, err := io.ReadFull(r.reader, buf); err != nil {
+	buf, err := r.readBytes(size + 2)
+	if err != nil {
 		return nil, err
 	}
 
 	// Verify \r\n terminator
 	if buf[size] != '\r' || buf[size+1] != '\n' {
-		return nil, fmt.Errorf("invalid bulk string terminator")
+		return nil, protocolErrorf("invalid bulk string terminator")
 	}
 
-	return &RESPValue{Type: BulkString, Str: string(buf[:size])}, nil
+	return &RESPValue{Type: typ, Str: string(buf[:size])}, nil
 }
 
-// readArray reads an array (*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n)
-func (r *RESPReader) readArray() (*RESPValue, error) {
+// readBytes reads exactly n bytes, growing the buffer as data arrives rather than
+// trusting the announced length for a single up-front allocation
+func (r *RESPReader) readBytes(n int) ([]byte, error) {
+	if n <= maxPrealloc {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf, r.consumed(buf)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(maxPrealloc)
+	if _, err := io.CopyN(&buf, r.reader, int64(n)); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), r.consumed(buf.Bytes())
+}
+
+// readByte reads one byte
+func (r *RESPReader) readByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return b, r.consumed([]byte{b})
+}
+
+// consumed passes bytes read from the input to tee, if set
+func (r *RESPReader) consumed(b []byte) error {
+	if r.tee == nil {
+		return nil
+	}
+	_, err := r.tee.Write(b)
+	return err
+}
+
+// readArray reads an array (*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n), or a RESP3
+// aggregate of the same layout; maps and attributes count key/value pairs
+func (r *RESPReader) readArray(typ RESPType, depth int) (*RESPValue, error) {
 	line, err := r.readLine()
 	if err != nil {
 		return nil, err
@@ -135,43 +466,206 @@ func (r *RESPReader) readArray() (*RESPValue, error) {
 
 	count, err := strconv.Atoi(line)
 	if err != nil {
-		return nil, fmt.Errorf("invalid array count: %s", line)
+		return nil, protocolErrorf("invalid array count: %s", line)
 	}
 
 	// Handle null array (*-1\r\n)
-	if count < 0 {
+	if count == -1 && typ == Array {
 		return &RESPValue{Type: Array, Null: true}, nil
 	}
+	if count < 0 {
+		return nil, protocolErrorf("invalid array count: %d", count)
+	}
+	if count > r.limits.MaxArrayLength {
+		return nil, protocolErrorf("array count %d exceeds limit of %d elements", count, r.limits.MaxArrayLength)
+	}
+	if depth >= maxNestingDepth {
+		return nil, protocolErrorf("array nesting exceeds %d levels", maxNestingDepth)
+	}
+
+	if typ == Map || typ == Attribute {
+		count *= 2
+	}
 
-	arr := make([]RESPValue, count)
+	arr := make([]RESPValue, 0, min(count, maxPrealloc))
 	for i := 0; i < count; i++ {
-		val, err := r.ReadValue()
+		val, err := r.readValue(depth + 1)
 		if err != nil {
 			return nil, err
 		}
-		arr[i] = *val
+		arr = append(arr, *val)
 	}
 
-	return &RESPValue{Type: Array, Array: arr}, nil
+	return &RESPValue{Type: typ, Array: arr}, nil
 }
 
-// readLine reads a line until \r\n
+// peekType returns the type byte of the next value without consuming it
+func (r *RESPReader) peekType() (RESPType, error) {
+	b, err := r.reader.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return RESPType(b[0]), nil
+}
+
+// buffered reports whether input is already buffered, i.e. the next read won't block
+func (r *RESPReader) buffered() bool {
+	return r.reader.Buffered() > 0
+}
+
+// copyValue copies one RESP value to w as raw bytes without building it in
+// memory: lines are copied as read and bulk string payloads are streamed, so
+// memory use is bounded by the buffers however large the value is. Every byte
+// consumed is written before it is validated, so after a protocol error w has
+// received exactly the input up to that point.
+func (r *RESPReader) copyValue(w io.Writer) error {
+	r.tee = w
+	defer func() { r.tee = nil }()
+	return r.copyValueDepth(0)
+}
+
+func (r *RESPReader) copyValueDepth(depth int) error {
+	typeByte, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	typ := RESPType(typeByte)
+	if typ.resp3() && !r.resp3 {
+		return protocolErrorf("unknown RESP type: %c", typeByte)
+	}
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case SimpleString, Error, Integer:
+		return nil
+	case Null, Boolean, Double, BigNumber:
+		return validateSimpleRESP3(typ, line)
+	case BulkString, BlobError, Verbatim:
+		size, err := strconv.Atoi(line)
+		if err != nil {
+			return protocolErrorf("invalid bulk string size: %s", line)
+		}
+		if size == -1 && typ == BulkString {
+			return nil
+		}
+		if size < 0 {
+			return protocolErrorf("invalid bulk string size: %d", size)
+		}
+		if size > r.limits.MaxBulkSize {
+			return protocolErrorf("bulk string size %d exceeds limit of %d bytes", size, r.limits.MaxBulkSize)
+		}
+		if _, err := io.CopyN(r.tee, r.reader, int64(size)); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		terminator, err := r.readBytes(2)
+		if err != nil {
+			return err
+		}
+		if terminator[0] != '\r' || terminator[1] != '\n' {
+			return protocolErrorf("invalid bulk string terminator")
+		}
+		return nil
+	case Array, Map, Set, Push, Attribute:
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return protocolErrorf("invalid array count: %s", line)
+		}
+		if count == -1 && typ == Array {
+			return nil
+		}
+		if count < 0 {
+			return protocolErrorf("invalid array count: %d", count)
+		}
+		if count > r.limits.MaxArrayLength {
+			return protocolErrorf("array count %d exceeds limit of %d elements", count, r.limits.MaxArrayLength)
+		}
+		if depth >= maxNestingDepth {
+			return protocolErrorf("array nesting exceeds %d levels", maxNestingDepth)
+		}
+		if typ == Map || typ == Attribute {
+			count *= 2
+		}
+		for i := 0; i < count; i++ {
+			if err := r.copyValueDepth(depth + 1); err != nil {
+				return err
+			}
+		}
+		if typ == Attribute {
+			// Attributes annotate the value that follows them
+			return r.copyValueDepth(depth)
+		}
+		return nil
+	default:
+		return protocolErrorf("unknown RESP type: %c", typeByte)
+	}
+}
+
+// readLine reads a line until \r\n, rejecting lines longer than maxLineLength
 func (r *RESPReader) readLine() (string, error) {
-	line, err := r.reader.ReadString('\n')
+	line, err := r.readRawLine()
 	if err != nil {
 		return "", err
 	}
 	// Remove \r\n
 	if len(line) < 2 || line[len(line)-2] != '\r' {
-		return "", fmt.Errorf("invalid line terminator")
+		return "", protocolErrorf("invalid line terminator")
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// readInlineLine reads an inline command line, which the server also accepts
+// terminated by a bare \n (echo PING | nc)
+func (r *RESPReader) readInlineLine() (string, error) {
+	line, err := r.readRawLine()
+	if err != nil {
+		return "", err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return string(line), nil
+}
+
+// readRawLine reads a line including its \n, rejecting lines longer than
+// maxLineLength
+func (r *RESPReader) readRawLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if cerr := r.consumed(chunk); cerr != nil {
+			return nil, cerr
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return nil, protocolErrorf("line exceeds %d bytes", maxLineLength)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return line, nil
 	}
-	return line[:len(line)-2], nil
 }
 
 // Serialize converts a RESPValue back to wire format
 func (v *RESPValue) Serialize() []byte {
 	var buf bytes.Buffer
 
+	if len(v.Attrs) > 0 {
+		buf.WriteByte(byte(Attribute))
+		buf.WriteString(strconv.Itoa(len(v.Attrs) / 2))
+		buf.WriteString("\r\n")
+		for _, elem := range v.Attrs {
+			buf.Write(elem.Serialize())
+		}
+	}
+
 	switch v.Type {
 	case SimpleString:
 		buf.WriteByte('+')
@@ -188,6 +682,30 @@ func (v *RESPValue) Serialize() []byte {
 		buf.WriteString(strconv.FormatInt(v.Int, 10))
 		buf.WriteString("\r\n")
 
+	case Null, Boolean, Double, BigNumber:
+		buf.WriteByte(byte(v.Type))
+		buf.WriteString(v.Str)
+		buf.WriteString("\r\n")
+
+	case BlobError, Verbatim:
+		buf.WriteByte(byte(v.Type))
+		buf.WriteString(strconv.Itoa(len(v.Str)))
+		buf.WriteString("\r\n")
+		buf.WriteString(v.Str)
+		buf.WriteString("\r\n")
+
+	case Map, Set, Push:
+		count := len(v.Array)
+		if v.Type == Map {
+			count /= 2
+		}
+		buf.WriteByte(byte(v.Type))
+		buf.WriteString(strconv.Itoa(count))
+		buf.WriteString("\r\n")
+		for _, elem := range v.Array {
+			buf.Write(elem.Serialize())
+		}
+
 	case BulkString:
 		buf.WriteByte('$')
 		if v.Null {
@@ -215,6 +733,20 @@ func (v *RESPValue) Serialize() []byte {
 	return buf.Bytes()
 }
 
+// CommandName returns the upper-cased command name of a client request
+// Requests are sent as arrays of bulk strings: *2\r\n$3\r\nget\r\n$3\r\nkey\r\n -> "GET"
+// Returns an empty string if the value is not a request array
+func (v *RESPValue) CommandName() string {
+	if v.Type != Array || v.Null || len(v.Array) == 0 {
+		return ""
+	}
+	first := v.Array[0]
+	if first.Type != BulkString && first.Type != SimpleString {
+		return ""
+	}
+	return strings.ToUpper(first.Str)
+}
+
 // IsRedirectError checks if this is a MOVED or ASK error
 func (v *RESPValue) IsRedirectError() bool {
 	if v.Type != Error {
@@ -241,13 +773,13 @@ func (v *RESPValue) RewriteRedirectError(nodeMap map[string]string) bool {
 	slot := parts[1]         // slot number
 	targetAddr := parts[2]   // "ip:port"
 
-	// Look up the local address for this remote address
-	localAddr, found := nodeMap[targetAddr]
+	// Look up the local address for this remote address (IPv6 targets are not bracketed)
+	localAddr, found := nodeMap[normalizeAddr(targetAddr)]
 	if !found {
 		return false
 	}
 
 	// Rewrite the error message
-	v.Str = fmt.Sprintf("%s %s %s", redirectType, slot, localAddr)
+	v.Str = fmt.Sprintf("%s %s %s", redirectType, slot, redisAddr(localAddr))
 	return true
 }
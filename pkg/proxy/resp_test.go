@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"GET request", "*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", "GET"},
+		{"PING request", "*1\r\n$4\r\nPING\r\n", "PING"},
+		{"Empty array", "*0\r\n", ""},
+		{"Null array", "*-1\r\n", ""},
+		{"Simple string", "+OK\r\n", ""},
+		{"Integer first element", "*1\r\n:1\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := NewRESPReader(strings.NewReader(tt.input)).ReadValue()
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", tt.input, err)
+			}
+			if got := value.CommandName(); got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	inputs := []string{
+		"+OK\r\n",
+		"-ERR unknown command\r\n",
+		":1000\r\n",
+		"$6\r\nfoobar\r\n",
+		"$-1\r\n",
+		"*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n",
+		"*-1\r\n",
+	}
+
+	for _, input := range inputs {
+		value, err := NewRESPReader(strings.NewReader(input)).ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", input, err)
+		}
+		if got := string(value.Serialize()); got != input {
+			t.Errorf("Expected %q, got %q", input, got)
+		}
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	inputs := []string{
+		"_\r\n",
+		"#t\r\n",
+		",3.14\r\n",
+		",-inf\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"!21\r\nSYNTAX invalid syntax\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%2\r\n+first\r\n:1\r\n+second\r\n#f\r\n",
+		"~2\r\n+a\r\n,1.5\r\n",
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+		"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n*1\r\n:2039\r\n",
+	}
+
+	for _, input := range inputs {
+		r := NewRESPReader(strings.NewReader(input))
+		r.SetRESP3(true)
+		value, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", input, err)
+		}
+		if got := string(value.Serialize()); got != input {
+			t.Errorf("Expected %q, got %q", input, got)
+		}
+
+		var out strings.Builder
+		r = NewRESPReader(strings.NewReader(input))
+		r.SetRESP3(true)
+		if err := r.copyValue(&out); err != nil || out.String() != input {
+			t.Errorf("copyValue(%q) = %q: %v", input, out.String(), err)
+		}
+
+		// RESP2 readers reject RESP3 types
+		if _, err := NewRESPReader(strings.NewReader(input)).ReadValue(); !isProtocolError(err) {
+			t.Errorf("Expected a RESP2 reader to reject %q, got %v", input, err)
+		}
+	}
+
+	invalid := []string{"_x\r\n", "#x\r\n", ",abc\r\n", "(12a\r\n", "!-1\r\n", "%-1\r\n", "%1\r\n+a\r\n"}
+	for _, input := range invalid {
+		r := NewRESPReader(strings.NewReader(input))
+		r.SetRESP3(true)
+		if _, err := r.ReadValue(); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestReadInlineRequests(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"PING\n", []string{"PING"}},
+		{"\nSET key value\n", []string{"SET", "key", "value"}},
+		{"  set  key   value \r\n", []string{"set", "key", "value"}},
+		{"\r\n\r\nGET k\r\n", []string{"GET", "k"}},
+		{"SET key \"hello world\"\r\n", []string{"SET", "key", "hello world"}},
+		{"SET key \"a\\tb\\x41\\\"\"\r\n", []string{"SET", "key", "a\tbA\""}},
+		{"SET key 'it\\'s \\n'\r\n", []string{"SET", "key", "it's \\n"}},
+		{"SET key \"\"\r\n", []string{"SET", "key", ""}},
+		{"*1\r\n$4\r\nPING\r\n", []string{"PING"}},
+	}
+
+	for _, tt := range tests {
+		r := NewRESPReader(strings.NewReader(tt.input))
+		r.SetInline(true)
+		value, err := r.ReadValue()
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tt.input, err)
+			continue
+		}
+		var got []string
+		for _, arg := range value.Array {
+			if arg.Type != BulkString {
+				t.Errorf("Expected bulk string arguments for %q, got %c", tt.input, arg.Type)
+			}
+			got = append(got, arg.Str)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("Parsing %q: expected %q, got %q", tt.input, tt.want, got)
+		}
+	}
+
+	for _, input := range []string{"GET \"key\r\n", "GET 'key\r\n", "GET \"a\"b\r\n", "PING"} {
+		r := NewRESPReader(strings.NewReader(input))
+		r.SetInline(true)
+		if _, err := r.ReadValue(); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+
+	// Without SetInline a bare command is not a RESP value
+	if _, err := NewRESPReader(strings.NewReader("PING\r\n")).ReadValue(); err == nil {
+		t.Error("Expected an inline command to be rejected by default")
+	}
+}
+
+func TestReadValueLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"Oversized bulk string", "$999999999999\r\n"},
+		{"Negative bulk string size", "$-2\r\n"},
+		{"Oversized array", "*999999999999\r\n"},
+		{"Negative array count", "*-5\r\n"},
+		{"Deep nesting", strings.Repeat("*1\r\n", maxNestingDepth+1) + ":1\r\n"},
+		{"Overlong line", "+" + strings.Repeat("a", maxLineLength+1) + "\r\n"},
+		{"Truncated bulk string", "$5000\r\nabc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRESPReader(strings.NewReader(tt.input)).ReadValue(); err == nil {
+				t.Errorf("Expected error for %s", tt.name)
+			}
+		})
+	}
+}
+
+func TestReadValueLargeBulkString(t *testing.T) {
+	payload := strings.Repeat("x", 100000)
+	input := "$100000\r\n" + payload + "\r\n"
+
+	value, err := NewRESPReader(strings.NewReader(input)).ReadValue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if value.Str != payload {
+		t.Errorf("Expected %d byte payload, got %d bytes", len(payload), len(value.Str))
+	}
+}
+
+func TestCopyValue(t *testing.T) {
+	valid := []string{
+		"+OK\r\n",
+		":-42\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"$5\r\nhello\r\n",
+		"*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n$0\r\n\r\n-ERR nested\r\n",
+	}
+	for _, input := range valid {
+		var out strings.Builder
+		r := NewRESPReader(strings.NewReader(input + "+NEXT\r\n"))
+		if err := r.copyValue(&out); err != nil {
+			t.Errorf("copyValue(%q) failed: %v", input, err)
+			continue
+		}
+		if out.String() != input {
+			t.Errorf("Expected %q copied unchanged, got %q", input, out.String())
+		}
+		// Exactly one value is consumed
+		if next, err := r.ReadValue(); err != nil || next.Str != "NEXT" {
+			t.Errorf("Expected the following value to be intact after %q, got %+v (%v)", input, next, err)
+		}
+	}
+
+	invalid := []string{
+		"$5\r\nhelloXX",
+		"$5000\r\nabc",
+		"*999999999999\r\n",
+		strings.Repeat("*1\r\n", maxNestingDepth+1) + ":1\r\n",
+		"?\r\n",
+	}
+	for _, input := range invalid {
+		var out strings.Builder
+		if err := NewRESPReader(strings.NewReader(input)).copyValue(&out); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+
+	// On a malformed frame the bytes consumed so far have been copied, so the
+	// rest of the stream can be relayed as is
+	var out strings.Builder
+	r := NewRESPReader(strings.NewReader("*2\r\n:1\r\n>1\r\n+OK\r\n"))
+	if err := r.copyValue(&out); !isProtocolError(err) {
+		t.Fatalf("Expected a protocol error, got %v", err)
+	}
+	rest, _ := io.ReadAll(r.reader)
+	if got := out.String() + string(rest); got != "*2\r\n:1\r\n>1\r\n+OK\r\n" {
+		t.Errorf("Expected the input to be preserved, got %q", got)
+	}
+}
+
+func TestRESPReaderLimits(t *testing.T) {
+	limits := RESPLimits{MaxBulkSize: 10, MaxArrayLength: 2}
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{"$10\r\n0123456789\r\n", true},
+		{"$11\r\n01234567890\r\n", false},
+		{"*2\r\n:1\r\n:2\r\n", true},
+		{"*3\r\n:1\r\n:2\r\n:3\r\n", false},
+		{"*1\r\n$11\r\n01234567890\r\n", false},
+	}
+
+	for _, tt := range tests {
+		r := NewRESPReader(strings.NewReader(tt.input))
+		r.SetLimits(limits)
+		if _, err := r.ReadValue(); (err == nil) != tt.ok {
+			t.Errorf("ReadValue(%q): expected ok=%v, got %v", tt.input, tt.ok, err)
+		}
+
+		r = NewRESPReader(strings.NewReader(tt.input))
+		r.SetLimits(limits)
+		var out strings.Builder
+		if err := r.copyValue(&out); (err == nil) != tt.ok {
+			t.Errorf("copyValue(%q): expected ok=%v, got %v", tt.input, tt.ok, err)
+		}
+	}
+
+	// Zero fields keep the defaults
+	r := NewRESPReader(strings.NewReader(""))
+	r.SetLimits(RESPLimits{MaxArrayLength: 5})
+	if r.limits.MaxBulkSize != maxBulkStringSize || r.limits.MaxArrayLength != 5 {
+		t.Errorf("Unexpected limits: %+v", r.limits)
+	}
+}
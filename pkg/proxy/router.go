@@ -0,0 +1,660 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// clusterSlots is the number of hash slots of a cluster
+const clusterSlots = 16384
+
+// Routing limits
+const (
+	routeMaxRedirects   = 5           // MOVED/ASK hops followed for one request before the client gets the redirect
+	routeRefreshBackoff = time.Second // Slot map refreshes triggered by redirects happen at most this often
+)
+
+// routeKeyless lists commands without keys, sent to the node of the listener's
+// endpoint. Commands not listed here or in routeKeyIndex have their first key
+// as first argument.
+var routeKeyless = map[string]bool{
+	"PING": true, "ECHO": true, "INFO": true, "TIME": true, "LASTSAVE": true, "DBSIZE": true,
+	"KEYS": true, "SCAN": true, "RANDOMKEY": true, "FLUSHALL": true, "FLUSHDB": true, "SWAPDB": true,
+	"SELECT": true, "CONFIG": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true,
+	"SCRIPT": true, "FUNCTION": true, "SLOWLOG": true, "LATENCY": true, "ACL": true,
+	"PUBLISH": true, "PUBSUB": true, "WAIT": true, "WAITAOF": true, "ASKING": true,
+}
+
+// routeKeyIndex gives the argument index of the first key of commands whose
+// first argument is something else
+var routeKeyIndex = map[string]int{
+	"OBJECT": 2, "MEMORY": 2, "XINFO": 2, "XGROUP": 2, "BITOP": 2,
+	"ZINTER": 2, "ZUNION": 2, "ZDIFF": 2, "ZINTERCARD": 2, "SINTERCARD": 2, "LMPOP": 2, "ZMPOP": 2,
+	"BLMPOP": 3, "BZMPOP": 3,
+}
+
+// routeUnsupported lists commands that need all requests on one upstream
+// connection or whose replies don't follow request order
+var routeUnsupported = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"MONITOR": true, "SYNC": true, "PSYNC": true, "HELLO": true, "RESET": true, "AUTH": true,
+	"WATCH": true, "UNWATCH": true, "READONLY": true, "READWRITE": true,
+}
+
+// routeMultiKey gives the arguments per key of multi-key commands that are
+// split by slot when their keys are served by several slots
+var routeMultiKey = map[string]int{"MGET": 1, "MSET": 2, "DEL": 1, "UNLINK": 1}
+
+// routingKey returns the key deciding which node serves a request, or false
+// for requests without keys
+func routingKey(value *RESPValue, name string) (string, bool) {
+	args := value.Array
+	i := 1
+	switch name {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		if len(args) < 3 {
+			return "", false
+		}
+		if n, err := strconv.Atoi(args[2].Str); err != nil || n <= 0 {
+			return "", false
+		}
+		i = 3
+	case "XREAD", "XREADGROUP":
+		i = -1
+		for j := 1; j < len(args); j++ {
+			if strings.EqualFold(args[j].Str, "STREAMS") {
+				i = j + 1
+				break
+			}
+		}
+		if i < 0 {
+			return "", false
+		}
+	default:
+		if routeKeyless[name] {
+			return "", false
+		}
+		if index, ok := routeKeyIndex[name]; ok {
+			i = index
+		}
+	}
+	if i >= len(args) {
+		return "", false
+	}
+	return args[i].Str, true
+}
+
+// clusterRouter routes the requests of one listener's clients to the cluster
+// node serving the slot of their key, so clients that don't speak the cluster
+// protocol can use a whole cluster through one port
+type clusterRouter struct {
+	primary *Proxy // The listener's proxy: serves keyless requests and slots of unknown nodes, and is asked for the slot map
+
+	mu      sync.RWMutex
+	nodes   map[string]*Proxy // Node proxies by remote address
+	slots   []*Proxy          // Node serving each slot; nil if unknown
+	changed chan struct{}     // Closed and replaced when slots change
+
+	refreshing  atomic.Bool
+	lastRefresh atomic.Int64 // UnixNano of the last refresh started
+
+	refreshes atomic.Uint64
+	moved     atomic.Uint64 // MOVED redirects followed
+	asked     atomic.Uint64 // ASK redirects followed
+	fanouts   atomic.Uint64 // Multi-key requests split by slot
+}
+
+// newClusterRouter creates a router for primary's clients over the nodes proxied by proxies
+func newClusterRouter(primary *Proxy, proxies []*Proxy) *clusterRouter {
+	r := &clusterRouter{primary: primary, nodes: make(map[string]*Proxy, len(proxies)), slots: make([]*Proxy, clusterSlots), changed: make(chan struct{})}
+	r.addNodes(proxies)
+	return r
+}
+
+// node returns the proxy of the node serving slot
+func (r *clusterRouter) node(slot int) *Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if node := r.slots[slot]; node != nil {
+		return node
+	}
+	return r.primary
+}
+
+// nodeAt returns the proxy of the node at remote address addr, or nil
+func (r *clusterRouter) nodeAt(addr string) *Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodes[normalizeAddr(addr)]
+}
+
+// addNodes adds the node proxies among proxies that are not known yet, under
+// their remote address and the IP a node dialed by hostname announces
+func (r *clusterRouter) addNodes(proxies []*Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range proxies {
+		r.nodes[normalizeAddr(p.remoteAddr)] = p
+		if p.announcedAddr != "" {
+			r.nodes[normalizeAddr(p.announcedAddr)] = p
+		}
+	}
+}
+
+// removeNodes forgets node proxies that were removed; their slots go to the
+// listener's endpoint until the slot map is refreshed
+func (r *clusterRouter) removeNodes(proxies []*Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range proxies {
+		for addr, node := range r.nodes {
+			if node == p {
+				delete(r.nodes, addr)
+			}
+		}
+		for slot, node := range r.slots {
+			if node == p {
+				r.slots[slot] = nil
+			}
+		}
+	}
+	r.notifyLocked()
+}
+
+// slotsChanged returns a channel closed the next time slots change
+func (r *clusterRouter) slotsChanged() <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.changed
+}
+
+// notifyLocked wakes up those waiting for slots to change. Must be called
+// with mu held.
+func (r *clusterRouter) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// setSlot records the node serving slot after a MOVED redirect
+func (r *clusterRouter) setSlot(slot int, node *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.slots[slot] != node {
+		r.slots[slot] = node
+		r.notifyLocked()
+	}
+}
+
+// refresh replaces the slot map with the CLUSTER SLOTS reply of the
+// listener's endpoint. Slots of nodes without a proxy go to the endpoint.
+func (r *clusterRouter) refresh(ctx context.Context) error {
+	r.lastRefresh.Store(time.Now().UnixNano())
+	conn, err := r.primary.dialAuthenticated(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reply, err := queryCommand(conn, "CLUSTER", "SLOTS")
+	if err != nil {
+		return err
+	}
+	if reply.Type != Array {
+		return fmt.Errorf("unexpected CLUSTER SLOTS reply: %s", reply.Str)
+	}
+
+	slots := make([]*Proxy, clusterSlots)
+	for _, rng := range reply.Array {
+		if rng.Type != Array || len(rng.Array) < 3 || rng.Array[2].Type != Array || len(rng.Array[2].Array) < 2 {
+			continue
+		}
+		// The first node of a range is its master
+		master := rng.Array[2].Array
+		node := r.nodeAt(net.JoinHostPort(master[0].Str, strconv.FormatInt(master[1].Int, 10)))
+		for slot := max(rng.Array[0].Int, 0); slot <= min(rng.Array[1].Int, clusterSlots-1); slot++ {
+			slots[slot] = node
+		}
+	}
+	r.mu.Lock()
+	r.slots = slots
+	r.notifyLocked()
+	r.mu.Unlock()
+	r.refreshes.Add(1)
+	return nil
+}
+
+// refreshAsync refreshes the slot map in the background after a redirect or
+// a lost node, unless a refresh is running or ran very recently
+func (r *clusterRouter) refreshAsync() {
+	if time.Since(time.Unix(0, r.lastRefresh.Load())) < routeRefreshBackoff || !r.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.refreshing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(r.primary.config)+tlsHandshakeTimeout(r.primary.config)+5*time.Second)
+		defer cancel()
+		if err := r.refresh(ctx); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to refresh the cluster slot map of %s: %v", r.primary.localAddr, err))
+		}
+	}()
+}
+
+// EnableClusterRouting makes the proxy of primaryEndpoint route every request
+// to the cluster node serving its key, through the node proxies. Called once
+// cluster nodes were added; a failed initial slot map load is only logged, as
+// redirects fill it in.
+func (m *Manager) EnableClusterRouting(ctx context.Context, primaryEndpoint discovery.Endpoint) error {
+	m.mu.Lock()
+	primary := m.proxyFor(primaryEndpoint.Address())
+	if primary == nil {
+		m.mu.Unlock()
+		return fmt.Errorf("no proxy for %s", primaryEndpoint.Address())
+	}
+	r := newClusterRouter(primary, m.proxies)
+	m.mu.Unlock()
+
+	if err := r.refresh(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Failed to load the cluster slot map, following redirects until it loads: %v", err))
+	}
+	primary.router.Store(r)
+	return nil
+}
+
+// routedClient holds the upstream connections of one routed client, one per
+// node, dialed on first use
+type routedClient struct {
+	p      *Proxy
+	router *clusterRouter
+	sess   *session
+
+	mu    sync.Mutex // Connections are opened by the request reader and by the reply writer following redirects
+	conns map[*Proxy]*muxConn
+
+	keyspace *keyspaceFanIn // Keyspace notification subscriptions; nil unless subscribed. Used by the request reader only.
+}
+
+// conn returns the client's connection to node, dialing it if needed
+func (c *routedClient) conn(node *Proxy) (*muxConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if mc, ok := c.conns[node]; ok {
+		return mc, nil
+	}
+	conn := node.pool.get()
+	if conn == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout(node.config)+tlsHandshakeTimeout(node.config)+5*time.Second)
+		defer cancel()
+		var err error
+		if conn, err = node.dialAuthenticated(ctx); err != nil {
+			// The node may have been replaced
+			c.router.refreshAsync()
+			return nil, err
+		}
+	}
+	node.nameUpstream(conn, c.sess)
+	mc := node.newSharedConn(conn, 0)
+	c.conns[node] = mc
+	return mc, nil
+}
+
+// close closes all upstream connections of the client
+func (c *routedClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, mc := range c.conns {
+		mc.fail(errMuxClosed)
+	}
+}
+
+// follow sends a request again to the node a MOVED or ASK reply points to,
+// up to routeMaxRedirects times. MOVED also updates the slot map. Redirects
+// to nodes without a proxy are returned to the client.
+func (c *routedClient) follow(data []byte, reply muxReply) muxReply {
+	for range routeMaxRedirects {
+		if reply.err != nil {
+			// The node may have failed over
+			c.router.refreshAsync()
+			return reply
+		}
+		if !reply.value.IsRedirectError() {
+			return reply
+		}
+		parts := strings.Fields(reply.value.Str)
+		if len(parts) != 3 {
+			return reply
+		}
+		slot, err := strconv.Atoi(parts[1])
+		node := c.router.nodeAt(parts[2])
+		if err != nil || slot < 0 || slot >= clusterSlots || node == nil {
+			return reply
+		}
+
+		request, requests := data, 1
+		if parts[0] == "MOVED" {
+			c.router.moved.Add(1)
+			c.router.setSlot(slot, node)
+			c.router.refreshAsync()
+		} else {
+			c.router.asked.Add(1)
+			request, requests = append(append([]byte(nil), askingCommand...), data...), 2
+		}
+		mc, err := c.conn(node)
+		if err != nil {
+			return muxReply{err: err}
+		}
+		replies, err := c.p.muxSend(mc, request, requests, c.sess)
+		if err != nil {
+			return muxReply{err: err}
+		}
+		reply = <-replies[requests-1]
+	}
+	return reply
+}
+
+// askingCommand precedes a request sent to the node an ASK redirect points to
+var askingCommand = []byte("*1\r\n$6\r\nASKING\r\n")
+
+// relayRouted serves a client by sending each request to the node serving
+// its key, over remoteConn for the listener's own node. Requests are
+// forwarded as they arrive (clients may pipeline) and replies are written
+// back in request order, whichever node they come from.
+func (p *Proxy) relayRouted(clientConn, remoteConn net.Conn, r *clusterRouter, sess *session) {
+	c := &routedClient{p: p, router: r, sess: sess, conns: map[*Proxy]*muxConn{p: p.newSharedConn(remoteConn, 0)}}
+	defer c.close()
+
+	pending := make(chan muxPending, muxPipelineDepth)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.writeMuxReplies(clientConn, pending, sess)
+	}()
+
+	if err := p.forwardRoutedRequests(clientConn, c, pending, sess); err != nil && err != io.EOF {
+		sess.log.Debug(fmt.Sprintf("Client->Server routed relay error: %v", err))
+	}
+	if c.keyspace != nil {
+		c.keyspace.close()
+	}
+	close(pending)
+	<-done
+}
+
+// forwardRoutedRequests reads client requests and sends each to the node of
+// its key, queueing one pending entry per request. MULTI blocks are queued by
+// the proxy and sent on EXEC to the node of their first key.
+func (p *Proxy) forwardRoutedRequests(clientConn net.Conn, c *routedClient, pending chan<- muxPending, sess *session) error {
+	respReader := p.respReader(clientConn)
+	defer p.buffers().releaseReader(respReader)
+	respReader.SetInline(true)
+	var tx *muxTransaction
+	txKey, txKeyed := "", false
+
+	for {
+		value, err := respReader.ReadValue()
+		if err != nil {
+			return err
+		}
+
+		name := value.CommandName()
+		if name != "" {
+			p.stats.commands.inc(name)
+			sess.auditCommand(value, name)
+		}
+		sess.dump.dump(dumpRequest, value)
+		sess.captureFrame(capture.DirectionRequest, value)
+
+		if name == "QUIT" {
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			return nil
+		}
+		if reply := p.denied.check(value, name); reply != nil {
+			// Like a command the server rejects while queueing, a denied one aborts the transaction
+			if tx != nil {
+				tx.aborted = true
+			}
+			pending <- localReply(*reply)
+			continue
+		}
+		if c.keyspace != nil {
+			c.keyspace.request(value, name)
+			if c.keyspace.count() == 0 {
+				c.keyspace.close()
+				c.keyspace = nil
+			}
+			continue
+		}
+		if (name == "SUBSCRIBE" || name == "PSUBSCRIBE") && tx == nil && keyspaceNotification(value.Array[1:]) {
+			f, err := newKeyspaceFanIn(c, pending)
+			if err != nil {
+				sess.log.Error(fmt.Sprintf("Failed to subscribe to keyspace notifications: %v", err))
+				pending <- localReply(RESPValue{Type: Error, Str: "ERR " + err.Error()})
+				continue
+			}
+			c.keyspace = f
+			f.request(value, name)
+			continue
+		}
+		if name == "AUTH" && tx == nil && p.interceptsClientAuth() {
+			// The node connections are authenticated with the proxy's credentials already
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			continue
+		}
+		unsupported := name == "" || routeUnsupported[name]
+		if unsupported {
+			msg := fmt.Sprintf("ERR %s is not supported when commands are routed to cluster nodes", name)
+			if name == "" {
+				msg = "ERR invalid request"
+			}
+			if tx != nil {
+				tx.aborted = true
+			}
+			pending <- localReply(RESPValue{Type: Error, Str: msg})
+			continue
+		}
+
+		if tx != nil {
+			switch name {
+			case "EXEC":
+				if tx.aborted {
+					pending <- localReply(RESPValue{Type: Error, Str: muxExecAbort})
+				} else {
+					// Only the EXEC reply goes to the client; MULTI and the commands were answered when queued
+					data := append(append(append([]byte(nil), multiCommand...), tx.data...), value.Serialize()...)
+					if err := p.sendRouted(c, txKey, txKeyed, data, tx.commands+2, nil, pending); err != nil {
+						return err
+					}
+				}
+				tx = nil
+			case "DISCARD":
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+				tx = nil
+			case "MULTI":
+				// Like the server, a nested MULTI is rejected without aborting the transaction
+				pending <- localReply(RESPValue{Type: Error, Str: "ERR MULTI calls can not be nested"})
+			default:
+				if key, ok := routingKey(value, name); ok && !txKeyed {
+					txKey, txKeyed = key, true
+				}
+				tx.data = append(tx.data, value.Serialize()...)
+				tx.commands++
+				pending <- localReply(RESPValue{Type: SimpleString, Str: "QUEUED"})
+			}
+			continue
+		}
+
+		switch name {
+		case "MULTI":
+			tx, txKey, txKeyed = &muxTransaction{}, "", false
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			continue
+		case "EXEC", "DISCARD":
+			pending <- localReply(RESPValue{Type: Error, Str: fmt.Sprintf("ERR %s without MULTI", name)})
+			continue
+		}
+
+		if _, ok := routeMultiKey[name]; ok {
+			split, err := p.sendMultiKey(c, value, name, pending)
+			if err != nil {
+				return err
+			}
+			if split {
+				continue
+			}
+		}
+
+		p.scripts.wait(value, name)
+		key, keyed := routingKey(value, name)
+		data := value.Serialize()
+		var follow func(muxReply) muxReply
+		if keyed {
+			follow = func(reply muxReply) muxReply { return c.follow(data, reply) }
+		} else if load := p.scripts.watcher(p, value, name); load != nil {
+			follow = watchReply(load)
+		}
+		if err := p.sendRouted(c, key, keyed, data, 1, follow, pending); err != nil {
+			return err
+		}
+	}
+}
+
+// sendRouted sends requests serialized in data to the node serving key (the
+// listener's node if not keyed) and queues the reply of the last one. A node
+// that can't be reached fails the request, not the client.
+func (p *Proxy) sendRouted(c *routedClient, key string, keyed bool, data []byte, requests int, follow func(muxReply) muxReply, pending chan<- muxPending) error {
+	node := p
+	if keyed {
+		node = c.router.node(keySlot(key))
+	}
+	mc, err := c.conn(node)
+	if err != nil {
+		c.sess.log.Error(fmt.Sprintf("Connection to cluster node %s failed: %v", node.remoteAddr, err))
+		pending <- localReply(RESPValue{Type: Error, Str: "ERR cluster node " + node.remoteAddr + " unavailable"})
+		return nil
+	}
+	sent := time.Now()
+	replies, err := p.muxSend(mc, data, requests, c.sess)
+	if err != nil {
+		return err
+	}
+	pending <- muxPending{reply: replies[requests-1], sent: sent, follow: follow}
+	return nil
+}
+
+// multiKeyPart is the request for the keys of a multi-key request in one slot
+type multiKeyPart struct {
+	data  []byte
+	keys  []int // Indexes of the keys in the original request
+	reply chan muxReply
+}
+
+// sendMultiKey splits a multi-key request whose keys are in several slots
+// into one request per slot, sends them to their nodes at once and queues
+// their merged reply, so clients don't get CROSSSLOT. It reports false,
+// sending nothing, when all keys are in one slot or the arguments are
+// malformed, for the request to be sent as it is.
+func (p *Proxy) sendMultiKey(c *routedClient, value *RESPValue, name string, pending chan<- muxPending) (bool, error) {
+	step := routeMultiKey[name]
+	args := value.Array[1:]
+	if len(args) == 0 || len(args)%step != 0 {
+		return false, nil
+	}
+
+	var slots []int
+	keysBySlot := make(map[int][]int)
+	for k := range len(args) / step {
+		slot := keySlot(args[k*step].Str)
+		if _, ok := keysBySlot[slot]; !ok {
+			slots = append(slots, slot)
+		}
+		keysBySlot[slot] = append(keysBySlot[slot], k)
+	}
+	if len(slots) == 1 {
+		return false, nil
+	}
+	c.router.fanouts.Add(1)
+
+	sent := time.Now()
+	parts := make([]multiKeyPart, len(slots))
+	for i, slot := range slots {
+		request := RESPValue{Type: Array, Array: []RESPValue{value.Array[0]}}
+		for _, k := range keysBySlot[slot] {
+			request.Array = append(request.Array, args[k*step:(k+1)*step]...)
+		}
+		parts[i] = multiKeyPart{data: request.Serialize(), keys: keysBySlot[slot]}
+
+		node := c.router.node(slot)
+		mc, err := c.conn(node)
+		if err != nil {
+			c.sess.log.Error(fmt.Sprintf("Connection to cluster node %s failed: %v", node.remoteAddr, err))
+			parts[i].reply = localReply(RESPValue{Type: Error, Str: "ERR cluster node " + node.remoteAddr + " unavailable"}).reply
+			continue
+		}
+		replies, err := p.muxSend(mc, parts[i].data, 1, c.sess)
+		if err != nil {
+			return true, err
+		}
+		parts[i].reply = replies[0]
+	}
+
+	// The requests are all on their way; the reply of the first is waited for
+	// as that of the request, the others by follow
+	pending <- muxPending{reply: parts[0].reply, sent: sent, follow: func(first muxReply) muxReply {
+		replies := make([]muxReply, len(parts))
+		for i, part := range parts {
+			reply := first
+			if i > 0 {
+				reply = <-part.reply
+			}
+			replies[i] = c.follow(part.data, reply)
+		}
+		return mergeMultiKey(name, len(args)/step, parts, replies)
+	}}
+	return true, nil
+}
+
+// mergeMultiKey builds the reply of a multi-key request from the replies of
+// its parts: MGET values in key order, the number of keys removed by DEL and
+// UNLINK, OK for MSET. The first failure of a part is the reply otherwise.
+func mergeMultiKey(name string, keys int, parts []multiKeyPart, replies []muxReply) muxReply {
+	for _, reply := range replies {
+		if reply.err != nil || reply.value.Type == Error {
+			return reply
+		}
+	}
+	unexpected := muxReply{value: &RESPValue{Type: Error, Str: "ERR unexpected " + name + " reply from a cluster node"}}
+	switch name {
+	case "MGET":
+		values := make([]RESPValue, keys)
+		for i, part := range parts {
+			if replies[i].value.Type != Array || len(replies[i].value.Array) != len(part.keys) {
+				return unexpected
+			}
+			for j, k := range part.keys {
+				values[k] = replies[i].value.Array[j]
+			}
+		}
+		return muxReply{value: &RESPValue{Type: Array, Array: values}}
+	case "MSET":
+		return muxReply{value: &RESPValue{Type: SimpleString, Str: "OK"}}
+	default:
+		var removed int64
+		for _, reply := range replies {
+			if reply.value.Type != Integer {
+				return unexpected
+			}
+			removed += reply.value.Int
+		}
+		return muxReply{value: &RESPValue{Type: Integer, Int: removed}}
+	}
+}
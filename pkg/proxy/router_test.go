@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestRoutingKey(t *testing.T) {
+	tests := []struct {
+		args  []string
+		key   string
+		keyed bool
+	}{
+		{[]string{"GET", "user:1"}, "user:1", true},
+		{[]string{"MSET", "a", "1", "b", "2"}, "a", true},
+		{[]string{"PING"}, "", false},
+		{[]string{"INFO", "server"}, "", false},
+		{[]string{"EVAL", "return 1", "1", "k"}, "k", true},
+		{[]string{"EVALSHA", "abc", "0"}, "", false},
+		{[]string{"XREAD", "COUNT", "2", "STREAMS", "s1", "0"}, "s1", true},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "streams", "s2", ">"}, "s2", true},
+		{[]string{"ZUNION", "2", "z1", "z2"}, "z1", true},
+		{[]string{"BLMPOP", "0", "1", "l", "LEFT"}, "l", true},
+		{[]string{"OBJECT", "ENCODING", "o"}, "o", true},
+		{[]string{"GET"}, "", false},
+	}
+	for _, tt := range tests {
+		value := testRequest(tt.args...)
+		key, keyed := routingKey(value, value.CommandName())
+		if key != tt.key || keyed != tt.keyed {
+			t.Errorf("routingKey(%v) = %q, %v, expected %q, %v", tt.args, key, keyed, tt.key, tt.keyed)
+		}
+	}
+}
+
+// requestArgs returns the arguments of a request received by a fake server
+func requestArgs(value *RESPValue) []string {
+	args := make([]string, len(value.Array))
+	for i, arg := range value.Array {
+		args[i] = arg.Str
+	}
+	return args
+}
+
+// fakeServer accepts connections until the test ends or its listener is
+// closed, and serves each with the handler newHandler returns for it, given
+// the connection and its number from 1. A handler gets the arguments of every
+// request and returns the raw reply to write.
+func fakeServer(t *testing.T, newHandler func(conn net.Conn, n int) func(args []string) string) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handle := newHandler(conn, n)
+			go func() {
+				defer conn.Close()
+				reader := NewRESPReader(conn)
+				for {
+					value, err := reader.ReadValue()
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(handle(requestArgs(value))))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// fakeClusterNode serves requests with reply, passing the arguments and
+// whether ASKING preceded them, and records the requests
+func fakeClusterNode(t *testing.T, reply func(args []string, asking bool) string) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []string
+	ln := fakeServer(t, func(net.Conn, int) func([]string) string {
+		asking := false
+		return func(args []string) string {
+			if len(args) > 0 && strings.EqualFold(args[0], "ASKING") {
+				asking = true
+				return "+OK\r\n"
+			}
+			mu.Lock()
+			requests = append(requests, strings.Join(args, " "))
+			mu.Unlock()
+			afterAsking := asking
+			asking = false
+			return reply(args, afterAsking)
+		}
+	})
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+// keyInSlots returns a key with the prefix whose slot is in [from, to]
+func keyInSlots(prefix string, from, to int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s{%s%d}", prefix, prefix, i)
+		if slot := keySlot(key); slot >= from && slot <= to {
+			return key
+		}
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	// Node A serves slots 0-8191 and node B 8192-16383; keys under "migrating"
+	// are being moved from B to A, so B answers ASK for them
+	var addrA, addrB string
+	owner := func(slot int) string {
+		if slot < 8192 {
+			return addrA
+		}
+		return addrB
+	}
+	serve := func(name string) func(args []string, asking bool) string {
+		return func(args []string, asking bool) string {
+			if strings.EqualFold(args[0], "CLUSTER") {
+				_, portA, _ := splitAddr(addrA)
+				_, portB, _ := splitAddr(addrB)
+				return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n*3\r\n:8192\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n", portA, portB)
+			}
+			if len(args) > 1 && args[0] == "GET" {
+				slot := keySlot(args[1])
+				self := map[string]string{"A": addrA, "B": addrB}[name]
+				switch {
+				case strings.HasPrefix(args[1], "migrating") && name == "B":
+					return fmt.Sprintf("-ASK %d %s\r\n", slot, addrA)
+				case strings.HasPrefix(args[1], "migrating") && name == "A" && asking:
+				case owner(slot) != self:
+					return fmt.Sprintf("-MOVED %d %s\r\n", slot, owner(slot))
+				}
+			}
+			return bulk(name + ":" + strings.Join(args, " "))
+		}
+	}
+	addrA, requestsA := fakeClusterNode(t, serve("A"))
+	addrB, requestsB := fakeClusterNode(t, serve("B"))
+
+	cfg := config.NewConfig()
+	cfg.ClusterRouting = true
+	primary := &Proxy{config: cfg, remoteAddr: addrA, shutdown: make(chan struct{})}
+	nodeB := &Proxy{config: cfg, remoteAddr: addrB, shutdown: make(chan struct{})}
+	r := newClusterRouter(primary, []*Proxy{primary, nodeB})
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to load the slot map: %v", err)
+	}
+	primary.router.Store(r)
+
+	keyA, keyB := keyInSlots("a", 0, 8191), keyInSlots("b", 8192, 16383)
+	migrating := keyInSlots("migrating", 8192, 16383)
+	// A stale slot map sends keyB to A, which redirects it
+	r.setSlot(keySlot(keyB), primary)
+
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	primary.connections.Add(1)
+	go primary.handleConnection(proxyClient, nextConnID())
+
+	// One at a time, so the MOVED updates the slot map before the transaction is sent
+	var got []string
+	for _, request := range []*RESPValue{
+		testRequest("GET", keyA),
+		testRequest("GET", keyB),
+		testRequest("PING"),
+		testRequest("GET", migrating),
+		testRequest("MULTI"),
+		testRequest("SET", keyB, "v"),
+		testRequest("EXEC"),
+		testRequest("SUBSCRIBE", "ch"),
+	} {
+		got = append(got, roundTripAll(t, client, request)...)
+	}
+	want := []string{
+		bulk("A:GET " + keyA),
+		bulk("B:GET " + keyB),
+		bulk("A:PING"),
+		bulk("A:GET " + migrating),
+		"+OK\r\n",
+		"+QUEUED\r\n",
+		bulk("B:EXEC"),
+		"-ERR SUBSCRIBE is not supported when commands are routed to cluster nodes\r\n",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	if r.node(keySlot(keyB)) != nodeB {
+		t.Error("Expected MOVED to update the slot map")
+	}
+	if r.moved.Load() != 1 || r.asked.Load() != 1 {
+		t.Errorf("Expected 1 MOVED and 1 ASK followed, got %d and %d", r.moved.Load(), r.asked.Load())
+	}
+	// The MOVED may also have started a slot map refresh
+	wantA := []string{"GET " + keyA, "GET " + keyB, "PING", "GET " + migrating}
+	if got := slices.DeleteFunc(requestsA(), func(r string) bool { return r == "CLUSTER SLOTS" }); strings.Join(got, ",") != strings.Join(wantA, ",") {
+		t.Errorf("Expected node A to get %v, got %v", wantA, got)
+	}
+	wantB := []string{"GET " + keyB, "GET " + migrating, "MULTI", "SET " + keyB + " v", "EXEC"}
+	if got := requestsB(); strings.Join(got, ",") != strings.Join(wantB, ",") {
+		t.Errorf("Expected node B to get %v, got %v", wantB, got)
+	}
+}
+
+func TestClusterRoutingSplitsMultiKeyRequests(t *testing.T) {
+	var addrA, addrB string
+	serve := func(name string) func(args []string, asking bool) string {
+		return func(args []string, asking bool) string {
+			switch args[0] {
+			case "CLUSTER":
+				_, portA, _ := splitAddr(addrA)
+				_, portB, _ := splitAddr(addrB)
+				return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n*3\r\n:8192\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n", portA, portB)
+			case "MGET":
+				reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+				for _, key := range args[1:] {
+					reply += bulk(name + ":" + key)
+				}
+				return reply
+			case "DEL":
+				return fmt.Sprintf(":%d\r\n", len(args)-1)
+			case "MSET":
+				if name == "B" {
+					return "-OOM command not allowed when used memory > 'maxmemory'\r\n"
+				}
+				return "+OK\r\n"
+			}
+			return bulk(name + ":" + strings.Join(args, " "))
+		}
+	}
+	addrA, requestsA := fakeClusterNode(t, serve("A"))
+	addrB, requestsB := fakeClusterNode(t, serve("B"))
+
+	cfg := config.NewConfig()
+	cfg.ClusterRouting = true
+	primary := &Proxy{config: cfg, remoteAddr: addrA, shutdown: make(chan struct{})}
+	nodeB := &Proxy{config: cfg, remoteAddr: addrB, shutdown: make(chan struct{})}
+	r := newClusterRouter(primary, []*Proxy{primary, nodeB})
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to load the slot map: %v", err)
+	}
+	primary.router.Store(r)
+
+	// a1 and a2 are in different slots of node A: even there keys of a request must share a slot
+	a1, a2 := keyInSlots("a1", 0, 8191), keyInSlots("a2", 0, 8191)
+	b1 := keyInSlots("b1", 8192, 16383)
+
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	primary.connections.Add(1)
+	go primary.handleConnection(proxyClient, nextConnID())
+
+	got := roundTripAll(t, client,
+		testRequest("MGET", a1, b1, a2),
+		testRequest("DEL", b1, a1),
+		testRequest("MGET", a1, a1),
+		testRequest("MSET", a1, "1", b1, "2"),
+	)
+	want := []string{
+		"*3\r\n" + bulk("A:"+a1) + bulk("B:"+b1) + bulk("A:"+a2),
+		":2\r\n",
+		"*2\r\n" + bulk("A:"+a1) + bulk("A:"+a1),
+		"-OOM command not allowed when used memory > 'maxmemory'\r\n",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	wantA := []string{"MGET " + a1, "MGET " + a2, "DEL " + a1, "MGET " + a1 + " " + a1, "MSET " + a1 + " 1"}
+	if got := slices.DeleteFunc(requestsA(), func(r string) bool { return r == "CLUSTER SLOTS" }); strings.Join(got, ",") != strings.Join(wantA, ",") {
+		t.Errorf("Expected node A to get %v, got %v", wantA, got)
+	}
+	wantB := []string{"MGET " + b1, "DEL " + b1, "MSET " + b1 + " 2"}
+	if got := requestsB(); strings.Join(got, ",") != strings.Join(wantB, ",") {
+		t.Errorf("Expected node B to get %v, got %v", wantB, got)
+	}
+	if n := r.fanouts.Load(); n != 3 {
+		t.Errorf("Expected 3 requests split, got %d", n)
+	}
+}
+
+func TestClusterRoutingFansInKeyspaceNotifications(t *testing.T) {
+	const channel = "__keyevent@0__:set"
+	var addrA, addrB string
+	serve := func(name string) func(args []string, asking bool) string {
+		return func(args []string, asking bool) string {
+			switch args[0] {
+			case "CLUSTER":
+				_, portA, _ := splitAddr(addrA)
+				_, portB, _ := splitAddr(addrB)
+				return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n*3\r\n:8192\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n", portA, portB)
+			case "SUBSCRIBE":
+				// The confirmation, then an event of a key of this node
+				return "*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n" +
+					"*3\r\n" + bulk("message") + bulk(args[1]) + bulk("key-on-"+name)
+			case "UNSUBSCRIBE":
+				return "*3\r\n" + bulk("unsubscribe") + bulk(channel) + ":0\r\n"
+			}
+			return bulk(name + ":" + strings.Join(args, " "))
+		}
+	}
+	addrA, requestsA := fakeClusterNode(t, serve("A"))
+	addrB, requestsB := fakeClusterNode(t, serve("B"))
+
+	cfg := config.NewConfig()
+	cfg.ClusterRouting = true
+	primary := &Proxy{config: cfg, remoteAddr: addrA, shutdown: make(chan struct{})}
+	nodeB := &Proxy{config: cfg, remoteAddr: addrB, shutdown: make(chan struct{})}
+	r := newClusterRouter(primary, []*Proxy{primary, nodeB})
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to load the slot map: %v", err)
+	}
+	primary.router.Store(r)
+
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	primary.connections.Add(1)
+	go primary.handleConnection(proxyClient, nextConnID())
+
+	if got := roundTripAll(t, client, testRequest("SUBSCRIBE", "news")); got[0] != "-ERR SUBSCRIBE is not supported when commands are routed to cluster nodes\r\n" {
+		t.Errorf("Expected other channels to stay unsupported, got %q", got[0])
+	}
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write(testRequest("SUBSCRIBE", channel).Serialize())
+	reader := NewRESPReader(client)
+	var frames []string
+	for range 3 {
+		frame, err := reader.ReadValue()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		frames = append(frames, string(frame.Serialize()))
+	}
+	if want := "*3\r\n" + bulk("subscribe") + bulk(channel) + ":1\r\n"; frames[0] != want {
+		t.Errorf("Expected one confirmation from the proxy, got %q", frames[0])
+	}
+	events := frames[1:]
+	slices.Sort(events)
+	for i, node := range []string{"A", "B"} {
+		if want := "*3\r\n" + bulk("message") + bulk(channel) + bulk("key-on-"+node); events[i] != want {
+			t.Errorf("Expected the event of node %s, got %q", node, events[i])
+		}
+	}
+
+	got := roundTripAll(t, client, testRequest("GET", "k"), testRequest("UNSUBSCRIBE"), testRequest("GET", "k"))
+	want := []string{
+		"-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n",
+		"*3\r\n" + bulk("unsubscribe") + bulk(channel) + ":0\r\n",
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if !strings.HasSuffix(got[2], ":GET k\r\n") {
+		t.Errorf("Expected requests to be routed again once unsubscribed, got %q", got[2])
+	}
+	for node, requests := range map[string][]string{"A": requestsA(), "B": requestsB()} {
+		if !slices.Contains(requests, "SUBSCRIBE "+channel) {
+			t.Errorf("Expected node %s to be subscribed, got %v", node, requests)
+		}
+	}
+}
+
+func TestKeyspaceFanInDisconnectsWhenMastersChange(t *testing.T) {
+	const channel = "__keyevent@0__:set"
+	var addrA, addrB string
+	serve := func(args []string, asking bool) string {
+		switch args[0] {
+		case "CLUSTER":
+			_, portA, _ := splitAddr(addrA)
+			_, portB, _ := splitAddr(addrB)
+			return fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n*3\r\n:8192\r\n:16383\r\n*2\r\n$9\r\n127.0.0.1\r\n:%d\r\n", portA, portB)
+		case "SUBSCRIBE":
+			return "*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"
+		}
+		return "+OK\r\n"
+	}
+	addrA, _ = fakeClusterNode(t, serve)
+	addrB, _ = fakeClusterNode(t, serve)
+
+	cfg := config.NewConfig()
+	cfg.ClusterRouting = true
+	primary := &Proxy{config: cfg, remoteAddr: addrA, shutdown: make(chan struct{})}
+	nodeB := &Proxy{config: cfg, remoteAddr: addrB, shutdown: make(chan struct{})}
+	r := newClusterRouter(primary, []*Proxy{primary, nodeB})
+	if err := r.refresh(context.Background()); err != nil {
+		t.Fatalf("Failed to load the slot map: %v", err)
+	}
+	primary.router.Store(r)
+
+	client, proxyClient := net.Pipe()
+	defer client.Close()
+	primary.connections.Add(1)
+	go primary.handleConnection(proxyClient, nextConnID())
+
+	if got := roundTripAll(t, client, testRequest("SUBSCRIBE", channel)); got[0] != "*3\r\n"+bulk("subscribe")+bulk(channel)+":1\r\n" {
+		t.Fatalf("Expected the subscription to be confirmed, got %q", got[0])
+	}
+
+	// A slot moving between subscribed masters changes nothing
+	r.setSlot(0, nodeB)
+	if got := roundTripAll(t, client, testRequest("PING")); got[0] != "*2\r\n"+bulk("pong")+bulk("") {
+		t.Fatalf("Expected the client to stay subscribed, got %q", got[0])
+	}
+
+	// Every slot moves to a master the client isn't subscribed on, as after a failover
+	nodeC := &Proxy{config: cfg, remoteAddr: "127.0.0.1:1", shutdown: make(chan struct{})}
+	for slot := range clusterSlots {
+		r.setSlot(slot, nodeC)
+	}
+	reader := NewRESPReader(client)
+	reply, err := reader.ReadValue()
+	if err != nil || reply.Type != Error {
+		t.Fatalf("Expected an error reply, got %+v, %v", reply, err)
+	}
+	if _, err := reader.ReadValue(); err == nil {
+		t.Error("Expected the client to be disconnected")
+	}
+}
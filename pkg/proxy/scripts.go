@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// scriptLoader copies the scripts clients load with SCRIPT LOAD to every
+// cluster node. Each node has its own script cache, so without it EVALSHA
+// fails with NOSCRIPT on every node but the one the script was loaded on.
+type scriptLoader struct {
+	nodes   func() []*Proxy // Proxies of the cluster nodes; nil outside cluster mode
+	mu      sync.Mutex
+	loading map[string]chan struct{} // Scripts being copied by SHA1, closed once done
+}
+
+// isScriptLoad reports whether value is a SCRIPT LOAD request
+func isScriptLoad(value *RESPValue, name string) bool {
+	return name == "SCRIPT" && len(value.Array) == 3 && strings.EqualFold(value.Array[1].Str, "LOAD")
+}
+
+// watcher returns the function loading the script of a SCRIPT LOAD request
+// sent to from on the other cluster nodes once the reply shows it loaded,
+// or nil for other requests
+func (l *scriptLoader) watcher(from *Proxy, value *RESPValue, name string) func(*RESPValue) {
+	if l == nil || !isScriptLoad(value, name) {
+		return nil
+	}
+	script := value.Array[2].Str
+	return func(reply *RESPValue) {
+		if reply != nil && reply.Type == BulkString {
+			l.propagate(from, script, reply.Str)
+		}
+	}
+}
+
+// propagate loads script on every cluster node but the one of from in the
+// background, so the client gets its reply without waiting for the nodes.
+// An EVALSHA of the script waits for them instead (see wait).
+func (l *scriptLoader) propagate(from *Proxy, script, sha string) {
+	done := make(chan struct{})
+	l.mu.Lock()
+	if _, ok := l.loading[sha]; ok {
+		l.mu.Unlock()
+		return
+	}
+	if l.loading == nil {
+		l.loading = make(map[string]chan struct{})
+	}
+	l.loading[sha] = done
+	l.mu.Unlock()
+
+	go func() {
+		defer func() {
+			l.mu.Lock()
+			delete(l.loading, sha)
+			l.mu.Unlock()
+			close(done)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, node := range l.nodes() {
+			if node.remoteAddr == from.remoteAddr {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := node.loadScript(ctx, script); err != nil {
+					from.stats.scriptLoadErrors.Add(1)
+					logger.Error(fmt.Sprintf("Failed to load script %s on cluster node %s: %v", sha, node.remoteAddr, err))
+					return
+				}
+				from.stats.scriptLoads.Add(1)
+			}()
+		}
+		wg.Wait()
+	}()
+}
+
+// wait holds an EVALSHA request until the script it runs is loaded on every
+// cluster node, if that is in progress, so it doesn't fail with NOSCRIPT
+func (l *scriptLoader) wait(value *RESPValue, name string) {
+	if l == nil || (name != "EVALSHA" && name != "EVALSHA_RO") || len(value.Array) < 2 {
+		return
+	}
+	l.mu.Lock()
+	done := l.loading[strings.ToLower(value.Array[1].Str)]
+	l.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// loadScript runs SCRIPT LOAD on a new authenticated connection to the
+// endpoint of p
+func (p *Proxy) loadScript(ctx context.Context, script string) error {
+	conn, err := p.dialAuthenticated(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reply, err := queryCommand(conn, "SCRIPT", "LOAD", script)
+	if err != nil {
+		return err
+	}
+	if reply.Type != BulkString {
+		return fmt.Errorf("unexpected SCRIPT LOAD reply: %s", reply.Str)
+	}
+	return nil
+}
+
+// clusterProxies returns the proxies of the cluster nodes, or nil outside
+// cluster mode
+func (m *Manager) clusterProxies() []*Proxy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClusterMode {
+		return nil
+	}
+	return slices.Clone(m.proxies)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+)
+
+func TestScriptLoadIsCopiedToClusterNodes(t *testing.T) {
+	const script = "return redis.call('GET', KEYS[1])"
+	const sha = "4e6d8fc8bb01276962cce5371fa795a7763657ae"
+	scriptNode := func(args []string, asking bool) string {
+		if len(args) == 3 && args[0] == "SCRIPT" && args[1] == "LOAD" {
+			return bulk(sha)
+		}
+		return "-ERR unexpected\r\n"
+	}
+	addrA, receivedA := fakeClusterNode(t, scriptNode)
+	addrB, receivedB := fakeClusterNode(t, scriptNode)
+	release := make(chan struct{})
+	addrC, _ := fakeClusterNode(t, func(args []string, asking bool) string {
+		<-release
+		return "-ERR loading\r\n"
+	})
+
+	cfg := config.NewConfig()
+	m := NewManager(cfg)
+	m.isClusterMode = true
+	node := func(addr string) *Proxy {
+		return &Proxy{config: cfg, remoteAddr: addr, isClusterMode: true, nodeMap: m.nodeMap, scripts: m.scripts, shutdown: make(chan struct{})}
+	}
+	a, b, c := node(addrA), node(addrB), node(addrC)
+	m.proxies = []*Proxy{a, b, c}
+
+	serverConn, err := net.Dial("tcp", addrA)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	sess := newSession(1, false)
+	sess.overrides = &replyOverrides{}
+	sess.protocol = newProtocolState()
+	go func() {
+		defer proxyClient.Close()
+		a.handleClusterConnection(proxyClient, serverConn, sess)
+	}()
+
+	// The reply isn't held while a node is slow to load the script
+	got := roundTripAll(t, clientSide, testRequest("SCRIPT", "LOAD", script))
+	if got[0] != bulk(sha) {
+		t.Fatalf("Expected the SHA1 of the script, got %q", got[0])
+	}
+	close(release)
+
+	// An EVALSHA is held until the other nodes loaded the script
+	roundTripAll(t, clientSide, testRequest("EVALSHA", sha, "0"))
+	load := "SCRIPT LOAD " + script
+	if requests := receivedB(); !slices.Contains(requests, load) {
+		t.Errorf("Expected the script to be loaded on the other node, got %q", requests)
+	}
+	if requests := receivedA(); len(requests) != 2 || requests[0] != load {
+		t.Errorf("Expected the script to be loaded once on the client's node, got %q", requests)
+	}
+	if n := a.stats.scriptLoads.Load(); n != 1 {
+		t.Errorf("Expected 1 copied script, got %d", n)
+	}
+	if n := a.stats.scriptLoadErrors.Load(); n != 1 {
+		t.Errorf("Expected 1 failed copy, got %d", n)
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// session holds per-connection state shared by the client->server and server->client relays
+type session struct {
+	id       uint64
+	log      logger.Logger   // Tags every line with the connection ID so a session can be correlated under load
+	pending  *requestQueue   // Send times of in-flight requests; nil unless commands are inspected
+	inflight *atomic.Int64   // Requests awaiting a reply; nil unless transparent reconnect is enabled
+	audit    *logger.Logger  // Per-command audit records; nil unless audit logging is enabled
+	dump     *protocolDumper // RESP frame dumps; nil unless this connection was sampled by -dump-protocol
+	protocol *protocolState  // Negotiated RESP version; nil unless requests and replies are parsed
+
+	overrides *replyOverrides // Replies made up or rewritten by the proxy; nil unless chaos injection, a deny-list, the read cache or cluster mode is enabled
+	cache     *cacheSession   // State deciding which reads are cached; nil unless the read cache is enabled
+
+	pubsub          pubsubState                    // Whether RESP2 pub/sub arrays are push frames
+	capture         atomic.Pointer[capture.Writer] // Traffic recording; nil unless this connection was sampled by -capture-file, or after a write error
+	clientAddr      string
+	upstreamAddr    string // Local address of the upstream connection; guarded by the registry
+	startedAt       time.Time
+	tlsVersion      string                 // Negotiated upstream TLS version; empty for plaintext
+	token           <-chan prefetchedToken // IAM token fetched while the upstream connection is dialed; nil unless a dial started one
+	bytesToUpstream atomic.Uint64
+	bytesToClient   atomic.Uint64
+}
+
+// newSession creates the state for a newly accepted client connection
+func newSession(id uint64, trackLatency bool) *session {
+	s := &session{
+		id:        id,
+		log:       logger.With("conn_id", id),
+		startedAt: time.Now(),
+	}
+	if trackLatency {
+		s.pending = &requestQueue{}
+	}
+	return s
+}
+
+// tapped reports whether frames must be parsed for dumping or capture
+func (s *session) tapped() bool {
+	return s.dump != nil || s.capture.Load() != nil
+}
+
+// captureFrame records a frame when the connection is being captured.
+// Requests are stored with credentials masked, like protocol dumps.
+func (s *session) captureFrame(direction string, value *RESPValue) {
+	w := s.capture.Load()
+	if w == nil {
+		return
+	}
+	if direction == capture.DirectionRequest {
+		masked := maskCredentials(value)
+		value = &masked
+	}
+	rec := capture.Record{ConnID: s.id, Time: time.Now(), Direction: direction, Data: value.Serialize()}
+	if err := w.Write(rec); err != nil && s.capture.CompareAndSwap(w, nil) {
+		s.log.Error(fmt.Sprintf("Failed to write capture record, capture stopped for this connection: %v", err))
+	}
+}
+
+// requestQueue is a FIFO of request send times used to pair responses with requests
+// RESP replies arrive in request order, so the oldest pending request matches the next reply
+type requestQueue struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// push records that a request was sent at t
+func (q *requestQueue) push(t time.Time) {
+	q.mu.Lock()
+	q.times = append(q.times, t)
+	q.mu.Unlock()
+}
+
+// pop removes and returns the oldest pending request time
+// Returns false if no request is pending (e.g. unsolicited push messages)
+func (q *requestQueue) pop() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.times) == 0 {
+		return time.Time{}, false
+	}
+	t := q.times[0]
+	q.times = q.times[1:]
+	if len(q.times) == 0 {
+		// Release the backing array once drained so it doesn't grow forever
+		q.times = nil
+	}
+	return t, true
+}
+
+// sessionRegistry tracks the established sessions of a proxy for /connections
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[uint64]*session
+}
+
+// add registers an established session
+func (r *sessionRegistry) add(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		r.sessions = make(map[uint64]*session)
+	}
+	r.sessions[s.id] = s
+}
+
+// setUpstream records the local address of a session's upstream connection
+func (r *sessionRegistry) setUpstream(s *session, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.upstreamAddr = addr
+}
+
+// clients maps the local address of each session's upstream connection to
+// the address of its client
+func (r *sessionRegistry) clients() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make(map[string]string, len(r.sessions))
+	for _, s := range r.sessions {
+		if s.upstreamAddr != "" {
+			clients[s.upstreamAddr] = s.clientAddr
+		}
+	}
+	return clients
+}
+
+// remove forgets a closed session
+func (r *sessionRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+// list returns the registered sessions ordered by connection ID
+func (r *sessionRegistry) list() []*session {
+	r.mu.Lock()
+	result := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		result = append(result, s)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+func TestRequestQueueFIFO(t *testing.T) {
+	q := &requestQueue{}
+	first := time.Unix(1, 0)
+	second := time.Unix(2, 0)
+
+	q.push(first)
+	q.push(second)
+
+	if got, ok := q.pop(); !ok || !got.Equal(first) {
+		t.Errorf("Expected first pushed time, got %v (ok=%v)", got, ok)
+	}
+	if got, ok := q.pop(); !ok || !got.Equal(second) {
+		t.Errorf("Expected second pushed time, got %v (ok=%v)", got, ok)
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("Expected empty queue")
+	}
+}
+
+func TestSessionRegistry(t *testing.T) {
+	var r sessionRegistry
+
+	for _, id := range []uint64{3, 1, 2} {
+		r.add(newSession(id, false))
+	}
+	r.remove(2)
+
+	sessions := r.list()
+	if len(sessions) != 2 || sessions[0].id != 1 || sessions[1].id != 3 {
+		t.Errorf("Expected sessions 1 and 3 in order, got %v", sessions)
+	}
+}
+
+func TestProxyConnections(t *testing.T) {
+	p := &Proxy{
+		localAddr:  "127.0.0.1:6379",
+		remoteAddr: "10.0.0.1:6379",
+		endpoint:   discovery.Endpoint{Type: "primary"},
+	}
+
+	sess := newSession(7, false)
+	sess.clientAddr = "127.0.0.1:50000"
+	sess.tlsVersion = "TLS 1.3"
+	sess.bytesToUpstream.Add(10)
+	p.sessions.add(sess)
+
+	conns := p.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	c := conns[0]
+	if c.ID != 7 || c.ClientAddr != "127.0.0.1:50000" || c.LocalAddr != "127.0.0.1:6379" || !c.TLS || c.BytesToUpstream != 10 {
+		t.Errorf("Unexpected connection info: %+v", c)
+	}
+}
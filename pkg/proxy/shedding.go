@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// overloadErrorPrefixes are upstream error replies that signal the server is struggling
+var overloadErrorPrefixes = []string{"BUSY", "LOADING", "OOM"}
+
+// shedResponse is sent to clients whose connection is rejected while shedding
+const shedResponse = "-ERR proxy is shedding connections: upstream overloaded (BUSY/LOADING/OOM), retry later\r\n"
+
+// isOverloadError reports whether v is a BUSY, LOADING or OOM error reply
+func isOverloadError(v *RESPValue) bool {
+	if v.Type != Error {
+		return false
+	}
+	for _, prefix := range overloadErrorPrefixes {
+		if v.Str == prefix || strings.HasPrefix(v.Str, prefix+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// overloadShedder tracks upstream overload errors and decides when new client
+// connections should be rejected to give a struggling instance room to recover
+type overloadShedder struct {
+	threshold int           // Overload errors within window that trigger shedding
+	window    time.Duration // Counting window for overload errors
+	cooldown  time.Duration // How long to shed once triggered
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+	shedUntil   time.Time
+
+	shedConnections atomic.Uint64
+}
+
+// newOverloadShedder creates a shedder, or returns nil if threshold is not positive (disabled)
+func newOverloadShedder(threshold int, window, cooldown time.Duration) *overloadShedder {
+	if threshold <= 0 {
+		return nil
+	}
+	return &overloadShedder{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// recordOverload records an overload error seen at the given time
+// Returns true if this error started a new shedding period
+func (s *overloadShedder) recordOverload(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.windowStart) > s.window {
+		s.windowStart = now
+		s.count = 0
+	}
+	s.count++
+
+	if s.count >= s.threshold && !now.Before(s.shedUntil) {
+		s.shedUntil = now.Add(s.cooldown)
+		s.count = 0
+		return true
+	}
+	return false
+}
+
+// isShedding reports whether new connections should be rejected at the given time
+func (s *overloadShedder) isShedding(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.shedUntil)
+}
+
+// sheddingUntil returns the end of the current shedding period, or zero time if not shedding
+func (s *overloadShedder) sheddingUntil(now time.Time) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Before(s.shedUntil) {
+		return s.shedUntil
+	}
+	return time.Time{}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsOverloadError(t *testing.T) {
+	tests := []struct {
+		value    RESPValue
+		expected bool
+	}{
+		{RESPValue{Type: Error, Str: "BUSY Redis is busy running a script"}, true},
+		{RESPValue{Type: Error, Str: "LOADING Redis is loading the dataset in memory"}, true},
+		{RESPValue{Type: Error, Str: "OOM command not allowed when used memory > 'maxmemory'"}, true},
+		{RESPValue{Type: Error, Str: "BUSYKEY Target key name already exists"}, false},
+		{RESPValue{Type: Error, Str: "ERR unknown command"}, false},
+		{RESPValue{Type: SimpleString, Str: "BUSY"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value.Str, func(t *testing.T) {
+			if got := isOverloadError(&tt.value); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestOverloadShedder(t *testing.T) {
+	s := newOverloadShedder(3, 10*time.Second, 30*time.Second)
+	now := time.Now()
+
+	if s.isShedding(now) {
+		t.Fatal("Expected no shedding initially")
+	}
+
+	s.recordOverload(now)
+	s.recordOverload(now.Add(time.Second))
+	if s.isShedding(now.Add(time.Second)) {
+		t.Fatal("Expected no shedding below threshold")
+	}
+
+	if !s.recordOverload(now.Add(2 * time.Second)) {
+		t.Fatal("Expected threshold to trigger shedding")
+	}
+	if !s.isShedding(now.Add(3 * time.Second)) {
+		t.Error("Expected shedding during cooldown")
+	}
+	if s.isShedding(now.Add(33 * time.Second)) {
+		t.Error("Expected shedding to end after cooldown")
+	}
+}
+
+func TestOverloadShedderWindowReset(t *testing.T) {
+	s := newOverloadShedder(2, time.Second, time.Minute)
+	now := time.Now()
+
+	s.recordOverload(now)
+	if s.recordOverload(now.Add(5 * time.Second)) {
+		t.Error("Expected errors in separate windows not to trigger shedding")
+	}
+}
+
+func TestOverloadShedderDisabled(t *testing.T) {
+	s := newOverloadShedder(0, time.Second, time.Second)
+	if s != nil {
+		t.Fatal("Expected nil shedder when threshold is 0")
+	}
+	if s.isShedding(time.Now()) {
+		t.Error("Expected disabled shedder never to shed")
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCPUserTimeoutSupported reports whether TCP_USER_TIMEOUT can be set
+const TCPUserTimeoutSupported = true
+
+// setUserTimeout sets TCP_USER_TIMEOUT, so a connection whose sent data stays
+// unacknowledged for d is dropped without waiting for keepalive retries
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(d.Milliseconds()))
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
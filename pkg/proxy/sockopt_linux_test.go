@@ -0,0 +1,47 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"golang.org/x/sys/unix"
+)
+
+// getUserTimeout reads TCP_USER_TIMEOUT of conn in milliseconds
+func getUserTimeout(t *testing.T, conn *net.TCPConn) int {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ms int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		ms, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return ms
+}
+
+func TestTuneTCPSetsUserTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cfg := config.NewConfig()
+	tuneTCP(client, cfg)
+	if ms := getUserTimeout(t, client); ms != 0 {
+		t.Errorf("Expected the OS default by default, got %dms", ms)
+	}
+
+	cfg.TCPUserTimeout = 7
+	tuneTCP(client, cfg)
+	if ms := getUserTimeout(t, client); ms != 7000 {
+		t.Errorf("Expected TCP_USER_TIMEOUT 7000ms, got %dms", ms)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// TCPUserTimeoutSupported reports whether TCP_USER_TIMEOUT can be set
+const TCPUserTimeoutSupported = false
+
+// setUserTimeout is only supported on Linux
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceSupported reports whether TCP-to-TCP relaying can use splice(2)
+const spliceSupported = true
+
+// spliceChunk is how many bytes are moved between byte counter updates
+const spliceChunk = 64 * 1024
+
+// spliceCopy relays src to dst until EOF with splice(2), so data moves between
+// the sockets inside the kernel without being copied through user space.
+// *net.TCPConn.ReadFrom splices when the source is a TCP connection, including
+// one wrapped in io.LimitedReader, which bounds how stale the counters get.
+func spliceCopy(dst, src *net.TCPConn, counters ...*atomic.Uint64) (int64, error) {
+	var total int64
+	for {
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunk})
+		total += n
+		for _, c := range counters {
+			c.Add(uint64(n))
+		}
+		if err != nil || n < spliceChunk {
+			// A short chunk without error means src reached EOF
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatalf("Failed to dial: %v", err)
+	}
+	server := <-accepted
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestSpliceCopy(t *testing.T) {
+	// writer -> src ... relay ... dst -> reader
+	writer, src := tcpPair(t)
+	dst, reader := tcpPair(t)
+
+	data := strings.Repeat("0123456789abcdef", 3*spliceChunk/16+7)
+	go func() {
+		writer.Write([]byte(data))
+		writer.Close()
+	}()
+
+	var total, conn atomic.Uint64
+	done := make(chan error, 1)
+	go func() {
+		n, err := spliceCopy(dst, src, &total, &conn)
+		if n != int64(len(data)) {
+			t.Errorf("Expected %d bytes spliced, got %d", len(data), n)
+		}
+		dst.CloseWrite()
+		done <- err
+	}()
+
+	received, _ := io.ReadAll(reader)
+	if err := <-done; err != nil {
+		t.Fatalf("spliceCopy failed: %v", err)
+	}
+	if !bytes.Equal(received, []byte(data)) {
+		t.Errorf("Data corrupted: got %d bytes, want %d", len(received), len(data))
+	}
+	if total.Load() != uint64(len(data)) || conn.Load() != uint64(len(data)) {
+		t.Errorf("Expected counters at %d, got %d and %d", len(data), total.Load(), conn.Load())
+	}
+}
+
+// benchmarkRelay measures relaying between two TCP connections, as in
+// handleSimpleConnection for a plaintext upstream
+func benchmarkRelay(b *testing.B, relay func(dst, src *net.TCPConn)) {
+	writer, src := tcpPair(b)
+	dst, reader := tcpPair(b)
+	go relay(dst, src)
+
+	chunk := make([]byte, 1<<20)
+	buf := make([]byte, len(chunk))
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for range b.N {
+		go writer.Write(chunk)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			b.Fatalf("Read failed: %v", err)
+		}
+	}
+}
+
+// Run with: go test ./pkg/proxy -run '^$' -bench Relay -benchtime 2s
+func BenchmarkRelaySplice(b *testing.B) {
+	var counter atomic.Uint64
+	benchmarkRelay(b, func(dst, src *net.TCPConn) {
+		spliceCopy(dst, src, &counter)
+	})
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	var counter atomic.Uint64
+	benchmarkRelay(b, func(dst, src *net.TCPConn) {
+		defaultBuffers.copy(&countingWriter{w: dst, counter: &counter}, src)
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// spliceSupported reports whether TCP-to-TCP relaying can use splice(2)
+const spliceSupported = false
+
+// spliceCopy is only supported on Linux
+func spliceCopy(dst, src *net.TCPConn, counters ...*atomic.Uint64) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/capture"
+)
+
+// splitReadOnly lists commands that only read data, sent to a read replica
+// when reads and writes are split. Anything else goes to the primary.
+var splitReadOnly = map[string]bool{
+	"GET": true, "MGET": true, "GETRANGE": true, "SUBSTR": true, "STRLEN": true, "LCS": true,
+	"EXISTS": true, "TYPE": true, "TTL": true, "PTTL": true, "EXPIRETIME": true, "PEXPIRETIME": true,
+	"DUMP": true, "OBJECT": true, "SCAN": true, "KEYS": true, "RANDOMKEY": true, "DBSIZE": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true, "HLEN": true,
+	"HEXISTS": true, "HSTRLEN": true, "HSCAN": true, "HRANDFIELD": true,
+	"LRANGE": true, "LLEN": true, "LINDEX": true, "LPOS": true,
+	"SMEMBERS": true, "SISMEMBER": true, "SMISMEMBER": true, "SCARD": true, "SRANDMEMBER": true,
+	"SINTER": true, "SINTERCARD": true, "SUNION": true, "SDIFF": true, "SSCAN": true,
+	"ZRANGE": true, "ZRANGEBYSCORE": true, "ZRANGEBYLEX": true, "ZREVRANGE": true,
+	"ZREVRANGEBYSCORE": true, "ZREVRANGEBYLEX": true, "ZSCORE": true, "ZMSCORE": true,
+	"ZRANK": true, "ZREVRANK": true, "ZCARD": true, "ZCOUNT": true, "ZLEXCOUNT": true,
+	"ZSCAN": true, "ZRANDMEMBER": true, "ZINTER": true, "ZINTERCARD": true, "ZUNION": true, "ZDIFF": true,
+	"XRANGE": true, "XREVRANGE": true, "XLEN": true, "XREAD": true, "XINFO": true, "XPENDING": true,
+	"GETBIT": true, "BITCOUNT": true, "BITPOS": true, "BITFIELD_RO": true, "PFCOUNT": true,
+	"GEOPOS": true, "GEODIST": true, "GEOHASH": true, "GEOSEARCH": true,
+	"GEORADIUS_RO": true, "GEORADIUSBYMEMBER_RO": true, "SORT_RO": true,
+	"EVAL_RO": true, "EVALSHA_RO": true, "FCALL_RO": true,
+}
+
+// splitBroadcast lists commands that set connection state, sent to both
+// upstream connections so reads and writes run with the same state
+var splitBroadcast = map[string]bool{"SELECT": true, "AUTH": true}
+
+// splitUnsupported lists commands whose replies don't follow request order
+// or that need one upstream connection for all requests
+var splitUnsupported = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"MONITOR": true, "SYNC": true, "PSYNC": true, "HELLO": true, "RESET": true,
+}
+
+// replicaSet holds the read-replica proxies that serve the reads of the
+// primary's clients. Each client is given one of them, in turn.
+type replicaSet struct {
+	mu      sync.Mutex
+	proxies []*Proxy
+	next    int
+
+	primaryRequests atomic.Uint64
+	replicaRequests atomic.Uint64
+	retries         atomic.Uint64 // Reads sent again to the primary, with -retry-reads
+}
+
+// add makes a read-replica proxy available to new clients
+func (r *replicaSet) add(p *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.proxies = append(r.proxies, p)
+}
+
+// pick returns the read-replica proxy for a new client, or nil if there is
+// none or all of them lag behind the primary
+func (r *replicaSet) pick() *Proxy {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range r.proxies {
+		p := r.proxies[r.next%len(r.proxies)]
+		r.next++
+		if !p.lagging() {
+			return p
+		}
+	}
+	return nil
+}
+
+// connectReplica returns an authenticated connection to the read replica of
+// replica, or nil if it can't be reached and the client is to be served by
+// the primary alone
+func (p *Proxy) connectReplica(ctx context.Context, replica *Proxy, sess *session) net.Conn {
+	if conn := replica.pool.get(); conn != nil {
+		replica.nameUpstream(conn, sess)
+		return conn
+	}
+	conn, err := replica.dialAuthenticated(ctx)
+	if err != nil {
+		sess.log.Info(fmt.Sprintf("Read replica %s unavailable, sending reads to the primary: %v", replica.remoteAddr, err))
+		return nil
+	}
+	// Dialed without the client, like pooled connections
+	replica.nameUpstream(conn, sess)
+	return conn
+}
+
+// relaySplit serves a client over a primary and a read-replica connection to
+// the endpoint of replicaProxy. Requests are forwarded as they arrive (clients
+// may pipeline) and replies are written back in request order, whichever
+// connection they come from.
+func (p *Proxy) relaySplit(clientConn, primaryConn, replicaConn net.Conn, replicaProxy *Proxy, sess *session) {
+	primary, replica := newMuxConn(primaryConn, 0), newMuxConn(replicaConn, 0)
+	defer primary.fail(errMuxClosed)
+	defer replica.fail(errMuxClosed)
+
+	pending := make(chan muxPending, muxPipelineDepth)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.writeMuxReplies(clientConn, pending, sess)
+	}()
+
+	if err := p.forwardSplitRequests(clientConn, primary, replica, replicaProxy, pending, sess); err != nil && err != io.EOF {
+		sess.log.Debug(fmt.Sprintf("Client->Server split relay error: %v", err))
+	}
+	close(pending)
+	<-done
+}
+
+// forwardSplitRequests reads client requests and sends reads to the replica
+// and everything else to the primary, queueing one pending entry per request.
+// Inside MULTI and after WATCH, reads go to the primary too, as the
+// transaction runs there, and so do reads while the replica lags behind.
+func (p *Proxy) forwardSplitRequests(clientConn net.Conn, primary, replica *muxConn, replicaProxy *Proxy, pending chan<- muxPending, sess *session) error {
+	respReader := p.respReader(clientConn)
+	defer p.buffers().releaseReader(respReader)
+	respReader.SetInline(true)
+	var multi, watching bool
+
+	for {
+		value, err := respReader.ReadValue()
+		if err != nil {
+			return err
+		}
+
+		name := value.CommandName()
+		if name != "" {
+			p.stats.commands.inc(name)
+			sess.auditCommand(value, name)
+		}
+		sess.dump.dump(dumpRequest, value)
+		sess.captureFrame(capture.DirectionRequest, value)
+
+		if name == "QUIT" {
+			pending <- localReply(RESPValue{Type: SimpleString, Str: "OK"})
+			return nil
+		}
+		if reply := p.denied.check(value, name); reply != nil {
+			pending <- localReply(*reply)
+			continue
+		}
+		if name == "AUTH" && !multi {
+			var reply *RESPValue
+			if reply, value = p.clientAuth(value, sess); reply != nil {
+				pending <- localReply(*reply)
+				continue
+			}
+		}
+		if name == "" || splitUnsupported[name] {
+			msg := fmt.Sprintf("ERR %s is not supported when reads and writes are split", name)
+			if name == "" {
+				msg = "ERR invalid request"
+			}
+			pending <- localReply(RESPValue{Type: Error, Str: msg})
+			continue
+		}
+
+		// With -retry-reads, a lost replica is left out and its reads go to the primary
+		replicaUp := !p.config.RetryReads || !replica.failed()
+		data := value.Serialize()
+		switch {
+		case splitBroadcast[name] || (name == "CLIENT" && len(value.Array) > 1 && strings.EqualFold(value.Array[1].Str, "SETNAME")):
+			// The client gets the primary's reply; the replica's is dropped
+			if replicaUp {
+				if err := p.sendMux(replica, data, 1, 0, nil, pending, sess); err != nil {
+					return err
+				}
+			}
+			err = p.sendMux(primary, data, 1, 1, nil, pending, sess)
+			p.readReplicas.primaryRequests.Add(1)
+		case splitReadOnly[name] && !multi && !watching && replicaUp && !replicaProxy.lagging():
+			err = p.sendRead(replica, primary, data, pending, sess)
+			p.readReplicas.replicaRequests.Add(1)
+		default:
+			err = p.sendMux(primary, data, 1, 1, nil, pending, sess)
+			p.readReplicas.primaryRequests.Add(1)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "MULTI":
+			multi = true
+		case "WATCH":
+			watching = true
+		case "UNWATCH":
+			// Inside MULTI it is only queued
+			watching = watching && multi
+		case "EXEC", "DISCARD":
+			multi, watching = false, false
+		}
+	}
+}
+
+// sendRead sends a read to the replica. With -retry-reads, a read the replica
+// fails to answer (connection lost, LOADING after a restart or failover) is
+// sent once to the primary before the client gets the error. Writes the
+// client pipelined after the read may then run before it.
+func (p *Proxy) sendRead(replica, primary *muxConn, data []byte, pending chan<- muxPending, sess *session) error {
+	if !p.config.RetryReads {
+		return p.sendMux(replica, data, 1, 1, nil, pending, sess)
+	}
+	sent := time.Now()
+	replies, err := p.muxSend(replica, data, 1, sess)
+	if err != nil {
+		// Lost since it was checked; the primary answers right away
+		return p.sendMux(primary, data, 1, 1, nil, pending, sess)
+	}
+	pending <- muxPending{reply: replies[0], sent: sent, retry: func() (chan muxReply, error) {
+		p.readReplicas.retries.Add(1)
+		replies, err := p.muxSend(primary, data, 1, sess)
+		if err != nil {
+			return nil, err
+		}
+		return replies[0], nil
+	}}
+	return nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+// taggedUpstream replies to every request with tag and its arguments, and
+// records the requests it received
+func taggedUpstream(t *testing.T, tag string) (addr string, received func() []string) {
+	t.Helper()
+	return fakeClusterNode(t, func(args []string, asking bool) string {
+		return bulk(tag + " " + strings.Join(args, " "))
+	})
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	var none *replicaSet
+	if none.pick() != nil || (&replicaSet{}).pick() != nil {
+		t.Error("Expected no replica without read-replica proxies")
+	}
+
+	a, b := &Proxy{remoteAddr: "a"}, &Proxy{remoteAddr: "b"}
+	r := &replicaSet{}
+	r.add(a)
+	r.add(b)
+	var got []string
+	for range 3 {
+		got = append(got, r.pick().remoteAddr)
+	}
+	if strings.Join(got, ",") != "a,b,a" {
+		t.Errorf("Expected clients to be given replicas in turn, got %v", got)
+	}
+}
+
+func TestSplitRoutesReadsToReplica(t *testing.T) {
+	primaryAddr, _ := taggedUpstream(t, "primary")
+	replicaAddr, replicaReceived := taggedUpstream(t, "replica")
+	p := &Proxy{config: &config.Config{}, readReplicas: &replicaSet{}}
+
+	primaryConn, err := net.Dial("tcp", primaryAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	replicaConn, err := net.Dial("tcp", replicaAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	go func() {
+		defer proxyClient.Close()
+		p.relaySplit(proxyClient, primaryConn, replicaConn, nil, newSession(1, false))
+	}()
+
+	got := roundTripAll(t, clientSide,
+		testRequest("SET", "k", "v"),
+		testRequest("GET", "k"),
+		testRequest("SELECT", "1"),
+		testRequest("MULTI"),
+		testRequest("GET", "k"),
+		testRequest("EXEC"),
+		testRequest("SUBSCRIBE", "ch"),
+		testRequest("HGETALL", "h"),
+	)
+	want := []string{
+		bulk("primary SET k v"),
+		bulk("replica GET k"),
+		bulk("primary SELECT 1"),
+		bulk("primary MULTI"),
+		bulk("primary GET k"),
+		bulk("primary EXEC"),
+		"-ERR SUBSCRIBE is not supported when reads and writes are split\r\n",
+		bulk("replica HGETALL h"),
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+
+	if received := strings.Join(replicaReceived(), ","); received != "GET k,SELECT 1,HGETALL h" {
+		t.Errorf("Expected the replica to get the reads and SELECT, got %q", received)
+	}
+	if p.readReplicas.primaryRequests.Load() != 5 || p.readReplicas.replicaRequests.Load() != 2 {
+		t.Errorf("Expected 5 requests to the primary and 2 to the replica, got %d and %d",
+			p.readReplicas.primaryRequests.Load(), p.readReplicas.replicaRequests.Load())
+	}
+}
+
+func TestSplitRetriesReadsOnPrimary(t *testing.T) {
+	primaryAddr, _ := taggedUpstream(t, "primary")
+	primaryConn, err := net.Dial("tcp", primaryAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	// The replica is still loading its dataset, then goes away
+	replicaConn, replicaSide := net.Pipe()
+	go func() {
+		defer replicaSide.Close()
+		reader := NewRESPReader(replicaSide)
+		if _, err := reader.ReadValue(); err != nil {
+			return
+		}
+		replicaSide.Write([]byte("-LOADING Redis is loading the dataset in memory\r\n"))
+		reader.ReadValue()
+	}()
+
+	p := &Proxy{config: &config.Config{RetryReads: true}, readReplicas: &replicaSet{}}
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+	go func() {
+		defer proxyClient.Close()
+		p.relaySplit(proxyClient, primaryConn, replicaConn, nil, newSession(1, false))
+	}()
+
+	got := roundTripAll(t, clientSide, testRequest("GET", "a"), testRequest("GET", "b"), testRequest("GET", "c"))
+	want := []string{bulk("primary GET a"), bulk("primary GET b"), bulk("primary GET c")}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Reply %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+	if n := p.readReplicas.retries.Load(); n < 2 {
+		t.Errorf("Expected the LOADING and the lost read to be retried, got %d retries", n)
+	}
+}
+
+func TestManagerSplitsPrimaryListener(t *testing.T) {
+	primaryAddr, _ := taggedUpstream(t, "primary")
+	replicaAddr, _ := taggedUpstream(t, "replica")
+
+	m := NewManager(&config.Config{LocalAddr: "127.0.0.1", ReadWriteSplit: true, DialTimeout: 5})
+	for _, addr := range []string{primaryAddr, replicaAddr} {
+		host, port, _ := splitAddr(addr)
+		typ := "primary"
+		if addr == replicaAddr {
+			typ = "read-replica"
+		}
+		if err := m.AddProxy(context.Background(), discovery.Endpoint{Host: host, Port: port, Type: typ}, 0); err != nil {
+			t.Fatalf("AddProxy failed: %v", err)
+		}
+	}
+	defer m.Shutdown(time.Second)
+
+	conn, err := net.Dial("tcp", m.proxies[0].listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	got := roundTripAll(t, conn, testRequest("GET", "k"), testRequest("DEL", "k"))
+	if got[0] != bulk("replica GET k") || got[1] != bulk("primary DEL k") {
+		t.Errorf("Expected the read on the replica and the write on the primary, got %q", got)
+	}
+	if m.proxies[1].readReplicas != nil {
+		t.Error("Expected only the primary listener to split traffic")
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
+)
+
+// Topology returns the remote->local mapping built by the manager. Every
+// proxied endpoint is listed; in cluster mode, discovered nodes without a
+// local proxy are included with an empty local address.
+func (m *Manager) Topology() health.Topology {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nodesByAddr := make(map[string]ClusterNode, len(m.clusterNodes))
+	for _, node := range m.clusterNodes {
+		nodesByAddr[node.Address] = node
+	}
+
+	topology := health.Topology{
+		ClusterMode: m.isClusterMode,
+		Nodes:       make([]health.TopologyNode, 0, len(m.proxies)),
+	}
+
+	proxied := make(map[string]bool, len(m.proxies))
+	for _, p := range m.proxies {
+		node := health.TopologyNode{
+			RemoteAddr:   p.remoteAddr,
+			LocalAddr:    p.localAddr,
+			EndpointType: p.endpointType(),
+		}
+		cn, ok := nodesByAddr[p.remoteAddr]
+		if !ok && p.announcedAddr != "" {
+			cn, ok = nodesByAddr[p.announcedAddr]
+		}
+		if ok {
+			node.ID, node.Role, node.Flags = cn.ID, cn.Role, cn.Flags
+		}
+		proxied[p.remoteAddr] = true
+		if p.announcedAddr != "" {
+			proxied[p.announcedAddr] = true
+		}
+		topology.Nodes = append(topology.Nodes, node)
+	}
+
+	for _, cn := range m.clusterNodes {
+		if proxied[cn.Address] {
+			continue
+		}
+		proxied[cn.Address] = true
+		topology.Nodes = append(topology.Nodes, health.TopologyNode{
+			ID:         cn.ID,
+			Role:       cn.Role,
+			Flags:      cn.Flags,
+			RemoteAddr: cn.Address,
+		})
+	}
+
+	return topology
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/config"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/discovery"
+)
+
+func TestManagerTopology(t *testing.T) {
+	m := NewManager(&config.Config{})
+	m.isClusterMode = true
+	m.proxies = []*Proxy{
+		{localAddr: "127.0.0.1:6379", remoteAddr: "10.0.0.1:6379", endpoint: discovery.Endpoint{Type: "primary"}},
+		{localAddr: "127.0.0.1:6380", remoteAddr: "10.0.0.2:6379", endpoint: discovery.Endpoint{Type: "cluster-replica"}},
+	}
+	m.clusterNodes = []ClusterNode{
+		{ID: "a", Address: "10.0.0.1:6379", Role: "master", Flags: "myself,master"},
+		{ID: "b", Address: "10.0.0.2:6379", Role: "replica", Flags: "slave"},
+		{ID: "c", Address: "10.0.0.3:6379", Role: "master", Flags: "master"},
+	}
+
+	topology := m.Topology()
+	if !topology.ClusterMode || len(topology.Nodes) != 3 {
+		t.Fatalf("Expected cluster topology with 3 nodes, got %+v", topology)
+	}
+
+	primary := topology.Nodes[0]
+	if primary.ID != "a" || primary.LocalAddr != "127.0.0.1:6379" || primary.EndpointType != "primary" {
+		t.Errorf("Unexpected primary node: %+v", primary)
+	}
+
+	unmapped := topology.Nodes[2]
+	if unmapped.ID != "c" || unmapped.LocalAddr != "" || unmapped.RemoteAddr != "10.0.0.3:6379" {
+		t.Errorf("Expected unmapped node c without local address, got %+v", unmapped)
+	}
+}
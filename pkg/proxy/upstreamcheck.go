@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/health"
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+)
+
+// upstreamCheckTimeout bounds a single upstream check (dial, TLS, AUTH and PING)
+const upstreamCheckTimeout = 10 * time.Second
+
+var pingCommand = []byte("*1\r\n$4\r\nPING\r\n")
+
+// errNotChecked is reported until the first upstream check of a proxy completes
+var errNotChecked = errors.New("not checked yet")
+
+// upstreamCheck holds the result of the last upstream check of one proxy
+type upstreamCheck struct {
+	mu        sync.Mutex
+	checked   time.Time
+	handshake time.Duration // Dial + TLS + AUTH
+	rtt       time.Duration // PING round trip on the established connection
+	err       error
+}
+
+// record stores a check result and reports whether health changed
+func (c *upstreamCheck) record(at time.Time, handshake, rtt time.Duration, err error) (changed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed = c.checked.IsZero() || (c.err == nil) != (err == nil)
+	c.checked, c.handshake, c.rtt, c.err = at, handshake, rtt, err
+	return changed
+}
+
+// pingUpstream opens a connection the same way a client connection would
+// (dial, TLS, AUTH) and sends PING, timing the handshake and the PING separately
+func (p *Proxy) pingUpstream(ctx context.Context) (handshake, rtt time.Duration, err error) {
+	sess := newSession(nextConnID(), false)
+	sess.log = sess.log.With("remote_addr", p.remoteAddr, "check", "upstream")
+
+	start := time.Now()
+	conn, err := p.dialUpstream(ctx, sess)
+	if err != nil {
+		return time.Since(start), 0, err
+	}
+	defer conn.Close()
+
+	if err := p.authenticateUpstream(ctx, conn, sess); err != nil {
+		return time.Since(start), 0, err
+	}
+	handshake = time.Since(start)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	start = time.Now()
+	if _, err := conn.Write(pingCommand); err != nil {
+		return handshake, 0, fmt.Errorf("failed to send PING: %w", err)
+	}
+	reply, err := NewRESPReader(conn).ReadValue()
+	rtt = time.Since(start)
+	if err != nil {
+		return handshake, rtt, fmt.Errorf("failed to read PING reply: %w", err)
+	}
+	if reply.Type == Error {
+		return handshake, rtt, fmt.Errorf("PING failed: %s", reply.Str)
+	}
+	return handshake, rtt, nil
+}
+
+// checkUpstream runs one upstream check and logs health transitions
+func (p *Proxy) checkUpstream(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	handshake, rtt, err := p.pingUpstream(ctx)
+	if !p.upstream.record(start, handshake, rtt, err) {
+		return
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Upstream %s for %s is unreachable: %v", p.remoteAddr, p.localAddr, err))
+	} else {
+		logger.Info(fmt.Sprintf("Upstream %s for %s is reachable", p.remoteAddr, p.localAddr))
+	}
+}
+
+// upstreamLatency returns the timings of the last check for /status, or nil before the first check
+func (p *Proxy) upstreamLatency() *health.UpstreamLatency {
+	p.upstream.mu.Lock()
+	defer p.upstream.mu.Unlock()
+
+	if p.upstream.checked.IsZero() {
+		return nil
+	}
+	latency := &health.UpstreamLatency{
+		CheckedAt: p.upstream.checked,
+		Handshake: p.upstream.handshake.Round(time.Microsecond).String(),
+	}
+	if p.upstream.err == nil {
+		latency.PingRTT = p.upstream.rtt.Round(time.Microsecond).String()
+	} else {
+		latency.Error = p.upstream.err.Error()
+	}
+	return latency
+}
+
+// UpstreamHealth returns the result of the last upstream check
+func (p *Proxy) UpstreamHealth() health.UpstreamHealth {
+	p.upstream.mu.Lock()
+	defer p.upstream.mu.Unlock()
+
+	result := health.UpstreamHealth{
+		LocalAddr:  p.localAddr,
+		RemoteAddr: p.remoteAddr,
+		Healthy:    !p.upstream.checked.IsZero() && p.upstream.err == nil,
+	}
+	if p.upstream.checked.IsZero() {
+		result.Error = errNotChecked.Error()
+		return result
+	}
+	checked := p.upstream.checked
+	result.LastCheck = &checked
+	result.Latency = (p.upstream.handshake + p.upstream.rtt).Round(time.Microsecond).String()
+	if p.upstream.err != nil {
+		result.Error = p.upstream.err.Error()
+	}
+	return result
+}
+
+// UpstreamHealth returns the last upstream check result of every proxy, for /readyz
+func (m *Manager) UpstreamHealth() []health.UpstreamHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]health.UpstreamHealth, 0, len(m.proxies))
+	for _, p := range m.proxies {
+		results = append(results, p.UpstreamHealth())
+	}
+	return results
+}
+
+// RunUpstreamChecks PINGs every upstream endpoint now and then every interval
+// until ctx is cancelled. Proxies are checked concurrently so a single
+// unreachable endpoint does not delay the others.
+func (m *Manager) RunUpstreamChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.mu.Lock()
+		proxies := make([]*Proxy, len(m.proxies))
+		copy(proxies, m.proxies)
+		m.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for _, p := range proxies {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.checkUpstream(ctx)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpstream accepts connections and answers every request line starting
+// with '*' with reply
+func fakeUpstream(t *testing.T, reply string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "*") {
+						conn.Write([]byte(reply))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCheckUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    func(t *testing.T) string
+		healthy bool
+		err     string
+	}{
+		{"PONG", func(t *testing.T) string { return fakeUpstream(t, "+PONG\r\n") }, true, ""},
+		{"error reply", func(t *testing.T) string { return fakeUpstream(t, "-LOADING server is loading\r\n") }, false, "PING failed: LOADING"},
+		{"unreachable", func(t *testing.T) string {
+			ln, _ := net.Listen("tcp", "127.0.0.1:0")
+			addr := ln.Addr().String()
+			ln.Close()
+			return addr
+		}, false, "failed to connect"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{localAddr: "127.0.0.1:6379", remoteAddr: tt.addr(t)}
+
+			if got := p.UpstreamHealth(); got.Healthy || got.Error != errNotChecked.Error() {
+				t.Errorf("Expected unchecked upstream to be unhealthy, got %+v", got)
+			}
+
+			if p.upstreamLatency() != nil {
+				t.Error("Expected no latency before the first check")
+			}
+
+			p.checkUpstream(context.Background())
+			got := p.UpstreamHealth()
+			if got.Healthy != tt.healthy || !strings.Contains(got.Error, tt.err) || got.LastCheck == nil {
+				t.Errorf("Unexpected result: %+v", got)
+			}
+
+			latency := p.upstreamLatency()
+			if latency == nil || latency.Handshake == "" || (latency.PingRTT != "") != tt.healthy {
+				t.Errorf("Unexpected latency: %+v", latency)
+			}
+		})
+	}
+}
+
+func TestRunUpstreamChecks(t *testing.T) {
+	m := &Manager{proxies: []*Proxy{{localAddr: "127.0.0.1:6379", remoteAddr: fakeUpstream(t, "+PONG\r\n")}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.RunUpstreamChecks(ctx, time.Hour)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.UpstreamHealth()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the first check")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
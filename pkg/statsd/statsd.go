@@ -0,0 +1,178 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awasilyev/cloud-memstore-proxy/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricPrefix limits the emitter to the proxy's own metrics; Go runtime and
+// process metrics are already collected by the Datadog agent
+const metricPrefix = "memstore_proxy_"
+
+// maxPacketSize keeps datagrams under a typical MTU
+const maxPacketSize = 1432
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// Emitter periodically pushes proxy metrics to a StatsD/DogStatsD endpoint.
+// Counters are sent as deltas since the previous flush, gauges as absolute
+// values and latency histograms as the mean request time in milliseconds.
+type Emitter struct {
+	conn     net.Conn
+	gatherer prometheus.Gatherer
+	interval time.Duration
+	tags     bool               // DogStatsD tags; plain StatsD folds label values into the name
+	last     map[string]float64 // Cumulative values at the previous flush, by series
+}
+
+// New creates an emitter sending UDP datagrams to addr
+func New(addr string, gatherer prometheus.Gatherer, interval time.Duration, tags bool) (*Emitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd at %s: %w", addr, err)
+	}
+	return &Emitter{
+		conn:     conn,
+		gatherer: gatherer,
+		interval: interval,
+		tags:     tags,
+		last:     make(map[string]float64),
+	}, nil
+}
+
+// Run flushes metrics every interval until ctx is cancelled
+func (e *Emitter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	defer e.conn.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Final flush so counters incremented during shutdown are not lost
+			if err := e.flush(); err != nil {
+				logger.Debug(fmt.Sprintf("Final statsd flush failed: %v", err))
+			}
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				logger.Debug(fmt.Sprintf("StatsD flush failed: %v", err))
+			}
+		}
+	}
+}
+
+// flush gathers the current metrics and writes them in MTU-sized packets
+func (e *Emitter) flush() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	var packet bytes.Buffer
+	for _, line := range e.lines(families) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxPacketSize {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := e.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lines converts metric families into StatsD lines, updating the counter baselines
+func (e *Emitter) lines(families []*dto.MetricFamily) []string {
+	var out []string
+	for _, mf := range families {
+		name := mf.GetName()
+		if !strings.HasPrefix(name, metricPrefix) {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				if delta := e.delta(name, m, m.GetCounter().GetValue()); delta > 0 {
+					out = append(out, e.line(name, m, delta, "c"))
+				}
+			case dto.MetricType_GAUGE:
+				out = append(out, e.line(name, m, m.GetGauge().GetValue(), "g"))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				base := strings.TrimSuffix(name, "_seconds")
+				count := e.delta(base+"_count", m, float64(h.GetSampleCount()))
+				sum := e.delta(base+"_sum", m, h.GetSampleSum())
+				if count > 0 {
+					out = append(out, e.line(base+"_count", m, count, "c"))
+					out = append(out, e.line(base, m, sum/count*1000, "ms"))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// delta returns how much a cumulative value grew since the previous flush
+func (e *Emitter) delta(name string, m *dto.Metric, value float64) float64 {
+	key := name + "{" + labelString(m) + "}"
+	prev := e.last[key]
+	e.last[key] = value
+	if value < prev {
+		// Series was reset (e.g. a proxy was re-created); report it from zero
+		return value
+	}
+	return value - prev
+}
+
+// line formats a single StatsD line
+func (e *Emitter) line(name string, m *dto.Metric, value float64, kind string) string {
+	v := strconv.FormatFloat(value, 'f', -1, 64)
+	if e.tags {
+		var tags []string
+		for _, lp := range m.GetLabel() {
+			tags = append(tags, lp.GetName()+":"+lp.GetValue())
+		}
+		if len(tags) > 0 {
+			return fmt.Sprintf("%s:%s|%s|#%s", name, v, kind, strings.Join(tags, ","))
+		}
+		return fmt.Sprintf("%s:%s|%s", name, v, kind)
+	}
+
+	// Plain StatsD has no tags, so label values become name segments
+	parts := []string{name}
+	for _, lp := range m.GetLabel() {
+		parts = append(parts, unsafeChars.ReplaceAllString(lp.GetValue(), "_"))
+	}
+	return fmt.Sprintf("%s:%s|%s", strings.Join(parts, "."), v, kind)
+}
+
+// labelString renders labels in a stable order for use as a map key
+func labelString(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
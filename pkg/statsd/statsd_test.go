@@ -0,0 +1,112 @@
+package statsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestRegistry() (*prometheus.Registry, *prometheus.CounterVec, prometheus.Gauge, prometheus.Histogram) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memstore_proxy_connections_total",
+	}, []string{"local_addr"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "memstore_proxy_active_connections"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "memstore_proxy_request_duration_seconds"})
+	ignored := prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_goroutines"})
+	reg.MustRegister(counter, gauge, histogram, ignored)
+	return reg, counter, gauge, histogram
+}
+
+func gatherLines(t *testing.T, e *Emitter) []string {
+	t.Helper()
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	lines := e.lines(families)
+	sort.Strings(lines)
+	return lines
+}
+
+func TestLinesDogStatsD(t *testing.T) {
+	reg, counter, gauge, histogram := newTestRegistry()
+	e := &Emitter{gatherer: reg, tags: true, last: make(map[string]float64)}
+
+	counter.WithLabelValues("127.0.0.1:6379").Add(5)
+	gauge.Set(2)
+	histogram.Observe(0.002)
+	histogram.Observe(0.004)
+
+	want := []string{
+		"memstore_proxy_active_connections:2|g",
+		"memstore_proxy_connections_total:5|c|#local_addr:127.0.0.1:6379",
+		"memstore_proxy_request_duration:3|ms",
+		"memstore_proxy_request_duration_count:2|c",
+	}
+	if got := gatherLines(t, e); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("First flush:\n got %v\nwant %v", got, want)
+	}
+
+	// Counters are reported as deltas; unchanged counters and idle histograms are skipped
+	counter.WithLabelValues("127.0.0.1:6379").Add(1)
+	want = []string{
+		"memstore_proxy_active_connections:2|g",
+		"memstore_proxy_connections_total:1|c|#local_addr:127.0.0.1:6379",
+	}
+	if got := gatherLines(t, e); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Second flush:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestLinesPlainStatsD(t *testing.T) {
+	reg, counter, _, _ := newTestRegistry()
+	e := &Emitter{gatherer: reg, tags: false, last: make(map[string]float64)}
+
+	counter.WithLabelValues("127.0.0.1:6379").Inc()
+
+	found := false
+	for _, line := range gatherLines(t, e) {
+		if line == "memstore_proxy_connections_total.127_0_0_1_6379:1|c" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected label value folded into metric name, got %v", gatherLines(t, e))
+	}
+}
+
+func TestFlushSendsDatagram(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+
+	reg, _, gauge, _ := newTestRegistry()
+	gauge.Set(7)
+
+	e, err := New(server.LocalAddr().String(), reg, time.Second, true)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer e.conn.Close()
+
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	if !strings.Contains(string(buf[:n]), "memstore_proxy_active_connections:7|g") {
+		t.Errorf("Unexpected datagram: %q", buf[:n])
+	}
+}